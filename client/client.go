@@ -0,0 +1,237 @@
+// Package client talks to the Rscs HTTP API. It has its own copies of the
+// request and response types so that programs using it do not link the
+// server or sqlite.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a single attempt at a request may take when
+	// Config.Timeout is not set.
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is how many times a failed request is retried when
+	// Config.Retries is not set.
+	DefaultRetries = 3
+	// DefaultBackoff is the wait before the first retry when Config.Backoff
+	// is not set. It doubles with each retry, up to MaxBackoff.
+	DefaultBackoff = 100 * time.Millisecond
+	// MaxBackoff is the longest wait between retries.
+	MaxBackoff = 5 * time.Second
+	// unixScheme begins an Address naming a unix domain socket.
+	unixScheme = "unix://"
+)
+
+// Config describes the daemon a Client talks to and how.
+type Config struct {
+	// Address is the daemon's base url, as in http://localhost:8081, or a
+	// unix socket, as in unix:///run/rscs.sock.
+	Address string
+	// Namespace is the namespace keys are read and written in. The default
+	// namespace is used if it is empty.
+	Namespace string
+	// Token is the bearer token presented to a daemon run with --auth.
+	Token string
+	// Timeout limits each attempt at a request, but not a Watch.
+	Timeout time.Duration
+	// Retries is how many times a request that failed in a way worth
+	// retrying is tried again. Set it negative to never retry.
+	Retries int
+	// Backoff is the wait before the first retry.
+	Backoff time.Duration
+	// HTTPClient sends the requests, e.g. one configured for TLS. Its
+	// Transport is replaced for a unix socket Address.
+	HTTPClient *http.Client
+}
+
+// Client makes requests of one daemon. It is safe for concurrent use.
+type Client struct {
+	config  Config
+	baseURL string
+	http    *http.Client
+}
+
+// New returns a Client for the daemon described by config.
+func New(config Config) (*Client, error) {
+	if config.Address == "" {
+		return nil, errors.New("empty Address")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Retries == 0 {
+		config.Retries = DefaultRetries
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.Backoff == 0 {
+		config.Backoff = DefaultBackoff
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	baseURL := strings.TrimSuffix(config.Address, "/")
+	if strings.HasPrefix(baseURL, unixScheme) {
+		path := strings.TrimPrefix(baseURL, unixScheme)
+		unixClient := *httpClient
+		unixClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+		httpClient = &unixClient
+		// The host is ignored by the dialer.
+		baseURL = "http://rscs"
+	}
+	_, parseErr := url.Parse(baseURL)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return &Client{config: config, baseURL: baseURL, http: httpClient}, nil
+}
+
+// scope returns the path prefix of the routes acting on the client's
+// namespace.
+func (c *Client) scope() string {
+	if c.config.Namespace == "" {
+		return "/v1"
+	}
+	return "/v1/ns/" + url.PathEscape(c.config.Namespace)
+}
+
+// response is a response read in full.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// newRequest builds a request for path, which is below the base url.
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Request, error) {
+	u := c.baseURL + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, reqErr := http.NewRequest(method, u, rd)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-type", "application/json")
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	return req, nil
+}
+
+// do sends a request, retrying it as the Config allows, and reads the
+// response in full. Responses of 400 and above are returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			sleepErr := sleep(ctx, c.backoff(attempt))
+			if sleepErr != nil {
+				return response{}, sleepErr
+			}
+		}
+		resp, doErr := c.attempt(ctx, method, path, query, header, body)
+		if doErr == nil && resp.status < 400 {
+			return resp, nil
+		}
+		if doErr == nil {
+			lastErr = newError(resp)
+		} else {
+			lastErr = doErr
+		}
+		if ctx.Err() != nil || !retryable(method, resp.status, doErr) {
+			break
+		}
+	}
+	return response{}, lastErr
+}
+
+// attempt sends a request once, within the Config's Timeout.
+func (c *Client) attempt(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	req, reqErr := c.newRequest(ctx, method, path, query, body)
+	if reqErr != nil {
+		return response{}, reqErr
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, doErr := c.http.Do(req)
+	if doErr != nil {
+		return response{}, doErr
+	}
+	defer resp.Body.Close()
+	respBody, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return response{}, readErr
+	}
+	return response{status: resp.StatusCode, header: resp.Header, body: respBody}, nil
+}
+
+// retryable reports whether a request that failed with err, or with the
+// status if err is nil, is worth trying again. Only requests that can be
+// repeated without writing twice are retried.
+func retryable(method string, status int, err error) bool {
+	if method == http.MethodPost {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff is the wait before retry attempt, with jitter so that clients
+// failing together do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.config.Backoff
+	for i := 1; i < attempt && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > MaxBackoff {
+		wait = MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// sleep waits for d, or returns early with the error of ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/bradclawsie/rscs/server"
+)
+
+// newTestServer serves a fresh memory store, passing each request through
+// wrap if it is set.
+func newTestServer(t *testing.T, wrap func(http.Handler) http.Handler) (*httptest.Server, *server.RscsServer, db.Store) {
+	store := db.NewMemoryStore()
+	rscsServer, srvErr := server.NewRscsServer(store)
+	if srvErr != nil {
+		t.Fatalf("new server:%s", srvErr.Error())
+	}
+	rtr, rtrErr := rscsServer.NewRouter()
+	if rtrErr != nil {
+		t.Fatalf("new router:%s", rtrErr.Error())
+	}
+	var handler http.Handler = rtr
+	if wrap != nil {
+		handler = wrap(rtr)
+	}
+	ts := httptest.NewServer(handler)
+	return ts, rscsServer, store
+}
+
+// newTestClient returns a Client of ts, failing the test if it cannot.
+func newTestClient(t *testing.T, ts *httptest.Server, config Config) *Client {
+	config.Address = ts.URL
+	if config.Backoff == 0 {
+		config.Backoff = time.Millisecond
+	}
+	c, newErr := New(config)
+	if newErr != nil {
+		t.Fatalf("new client:%s", newErr.Error())
+	}
+	return c
+}
+
+func TestKV(t *testing.T) {
+	ts, _, _ := newTestServer(t, nil)
+	defer ts.Close()
+	c := newTestClient(t, ts, Config{})
+	ctx := context.Background()
+
+	if _, getErr := c.Get(ctx, "key1"); !IsNotFound(getErr) {
+		t.Errorf("get missing key: %v", getErr)
+	}
+	if createErr := c.Create(ctx, "key1", "value1", WriteOptions{}); createErr != nil {
+		t.Fatalf("create:%s", createErr.Error())
+	}
+	if createErr := c.Create(ctx, "key1", "value1", WriteOptions{}); !IsConflict(createErr) {
+		t.Errorf("create existing key: %v", createErr)
+	} else if e := (*Error)(nil); !errors.As(createErr, &e) || e.Code != "precondition_failed" || e.Key != "key1" {
+		t.Errorf("create existing key error: %+v", e)
+	}
+	entry, getErr := c.Get(ctx, "key1")
+	if getErr != nil || entry.Value != "value1" || entry.Index == 0 || !entry.Expires.IsZero() {
+		t.Errorf("get: %+v %v", entry, getErr)
+	}
+
+	if putErr := c.Put(ctx, "key1", "value2", WriteOptions{Index: entry.Index}); putErr != nil {
+		t.Errorf("put:%s", putErr.Error())
+	}
+	if putErr := c.Put(ctx, "key1", "value3", WriteOptions{Index: entry.Index}); !IsConflict(putErr) {
+		t.Errorf("put with stale index: %v", putErr)
+	}
+	if putErr := c.Put(ctx, "missing", "value", WriteOptions{}); !IsNotFound(putErr) {
+		t.Errorf("put missing key: %v", putErr)
+	}
+	if putErr := c.Put(ctx, "key1", "value4", WriteOptions{TTL: time.Hour}); putErr != nil {
+		t.Errorf("put with ttl:%s", putErr.Error())
+	}
+	entry, _ = c.Get(ctx, "key1")
+	if entry.Value != "value4" || entry.Expires.IsZero() {
+		t.Errorf("get after put: %+v", entry)
+	}
+
+	c.Create(ctx, "key2", "value2", WriteOptions{})
+	c.Create(ctx, "other", "value", WriteOptions{})
+	entries, listErr := c.List(ctx, "key")
+	if listErr != nil || len(entries) != 2 || entries[1].Key != "key2" || entries[1].Value != "value2" {
+		t.Errorf("list: %+v %v", entries, listErr)
+	}
+
+	if deleteErr := c.Delete(ctx, "key1", WriteOptions{Index: 1}); !IsConflict(deleteErr) {
+		t.Errorf("delete with stale index: %v", deleteErr)
+	}
+	if deleteErr := c.Delete(ctx, "key1", WriteOptions{}); deleteErr != nil {
+		t.Errorf("delete:%s", deleteErr.Error())
+	}
+	if deleteErr := c.Delete(ctx, "key1", WriteOptions{}); !IsNotFound(deleteErr) {
+		t.Errorf("delete missing key: %v", deleteErr)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	ts, _, store := newTestServer(t, nil)
+	defer ts.Close()
+	db.CreateNamespace(store, "payments")
+	c := newTestClient(t, ts, Config{Namespace: "payments"})
+	ctx := context.Background()
+
+	if createErr := c.Create(ctx, "key1", "value1", WriteOptions{}); createErr != nil {
+		t.Fatalf("create:%s", createErr.Error())
+	}
+	if _, getErr := newTestClient(t, ts, Config{}).Get(ctx, "key1"); !IsNotFound(getErr) {
+		t.Errorf("key leaked out of namespace: %v", getErr)
+	}
+	if _, getErr := newTestClient(t, ts, Config{Namespace: "missing"}).Get(ctx, "key1"); !IsNotFound(getErr) {
+		t.Errorf("get in missing namespace: %v", getErr)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	ts, _, _ := newTestServer(t, nil)
+	defer ts.Close()
+	c := newTestClient(t, ts, Config{})
+	ctx := context.Background()
+
+	value := "value1"
+	results, txnErr := c.Txn(ctx, []TxnOp{
+		{Op: OpCheck, Key: "key1"},
+		{Op: OpInsert, Key: "key1", Value: &value},
+		{Op: OpGet, Key: "key1"},
+	})
+	if txnErr != nil || len(results) != 3 || !results[2].Found || *results[2].Value != value {
+		t.Fatalf("txn: %+v %v", results, txnErr)
+	}
+
+	_, txnErr = c.Txn(ctx, []TxnOp{
+		{Op: OpDelete, Key: "key1"},
+		{Op: OpCheck, Key: "key1", Index: results[1].Index},
+	})
+	var failed *TxnError
+	if !errors.As(txnErr, &failed) || failed.Op != 1 || !IsConflict(txnErr) {
+		t.Errorf("failed txn: %v", txnErr)
+	}
+	if _, getErr := c.Get(ctx, "key1"); getErr != nil {
+		t.Errorf("failed txn wrote: %v", getErr)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts, _, _ := newTestServer(t, nil)
+	defer ts.Close()
+	c := newTestClient(t, ts, Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c.Create(ctx, "other", "value", WriteOptions{})
+	c.Create(ctx, "key1", "value1", WriteOptions{})
+	go func() {
+		c.Put(ctx, "key1", "value2", WriteOptions{})
+		c.Delete(ctx, "key1", WriteOptions{})
+	}()
+
+	var events []WatchEvent
+	done := errors.New("done")
+	watchErr := c.Watch(ctx, "key", 0, func(event WatchEvent) error {
+		events = append(events, event)
+		if len(events) == 3 {
+			return done
+		}
+		return nil
+	})
+	if watchErr != done {
+		t.Fatalf("watch: %v", watchErr)
+	}
+	if events[0].Value != "value1" || events[1].Value != "value2" || events[2].Type != "delete" {
+		t.Errorf("events: %+v", events)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	ts, rscsServer, store := newTestServer(t, nil)
+	defer ts.Close()
+	authErr := rscsServer.RequireAuth()
+	if authErr != nil {
+		t.Fatalf("require auth:%s", authErr.Error())
+	}
+	ctx := context.Background()
+
+	if _, getErr := newTestClient(t, ts, Config{}).Get(ctx, "key1"); !IsUnauthorized(getErr) {
+		t.Errorf("get without token: %v", getErr)
+	}
+	token, bearer, _ := db.NewToken(false, []db.Policy{{Prefix: "app-", Permissions: []db.Permission{db.PermRead}}})
+	store.(db.TokenStore).PutToken(token)
+	c := newTestClient(t, ts, Config{Token: bearer})
+	if _, getErr := c.Get(ctx, "app-key"); !IsNotFound(getErr) {
+		t.Errorf("get with token: %v", getErr)
+	}
+	if createErr := c.Create(ctx, "app-key", "value", WriteOptions{}); !IsUnauthorized(createErr) {
+		t.Errorf("create without permission: %v", createErr)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests int32
+	failFirst := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	ts, _, _ := newTestServer(t, failFirst)
+	defer ts.Close()
+	ctx := context.Background()
+
+	c := newTestClient(t, ts, Config{})
+	if _, getErr := c.Get(ctx, "key1"); !IsNotFound(getErr) || requests != 3 {
+		t.Errorf("get after retries: %v after %d requests", getErr, requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	noRetries := newTestClient(t, ts, Config{Retries: -1})
+	var e *Error
+	if _, getErr := noRetries.Get(ctx, "key1"); !errors.As(getErr, &e) || e.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("get without retries: %v", getErr)
+	}
+
+	// A create is not retried, since it may have been applied.
+	atomic.StoreInt32(&requests, 0)
+	if createErr := c.Create(ctx, "key1", "value1", WriteOptions{}); createErr == nil || requests != 1 {
+		t.Errorf("create retried: %v after %d requests", createErr, requests)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	ts, _, _ := newTestServer(t, slow)
+	defer ts.Close()
+
+	c := newTestClient(t, ts, Config{Timeout: 10 * time.Millisecond, Retries: 1})
+	start := time.Now()
+	if _, getErr := c.Get(context.Background(), "key1"); getErr == nil || IsNotFound(getErr) {
+		t.Errorf("get did not time out: %v", getErr)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("timeout took %s", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, getErr := c.Get(ctx, "key1"); !errors.Is(getErr, context.Canceled) {
+		t.Errorf("get with canceled context: %v", getErr)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNotFound matches, with errors.Is, an error for a key or namespace
+	// that does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict matches an error for a write that lost to another, such as
+	// creating a key that exists or a failed index condition.
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized matches an error for a request the daemon refused
+	// because of its token, or the lack of one.
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Error is a response from the daemon with a status of 400 or above. Code
+// is the daemon's stable error code, such as "key_not_found", and Key the
+// key the error is about, if any. A body that is not an error result is
+// kept whole as Message.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Key        string
+}
+
+// newError converts a failed response to an *Error.
+func newError(resp response) *Error {
+	var result struct {
+		Code    string
+		Message string
+		Key     string
+	}
+	if json.Unmarshal(resp.body, &result) == nil && result.Code != "" && result.Message != "" {
+		return &Error{StatusCode: resp.status, Code: result.Code, Message: result.Message, Key: result.Key}
+	}
+	return &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+}
+
+// Error describes the response.
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("rscs: %d %s: %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Message)
+	}
+	return fmt.Sprintf("rscs: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches ErrNotFound, ErrConflict or ErrUnauthorized by status code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// IsNotFound reports whether err is for a key or namespace that does not
+// exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsConflict reports whether err is for a write that lost to another.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// IsUnauthorized reports whether err is for a request refused because of
+// its token.
+func IsUnauthorized(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Entry is a key and its value. Index is the key's modification index,
+// which is only known to Get. Expires is zero for a key that does not
+// expire.
+type Entry struct {
+	Key     string
+	Value   string
+	Index   int64
+	Expires time.Time
+}
+
+// WriteOptions changes how a key is written. A nonzero TTL makes the key
+// expire. A nonzero Index makes a Put or Delete fail with ErrConflict
+// unless the key still has that modification index.
+type WriteOptions struct {
+	TTL   time.Duration
+	Index int64
+}
+
+// value is the JSON envelope of a value on the wire.
+type value struct {
+	Value   string
+	TTL     string     `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// keyPath is the path of key in the client's namespace.
+func (c *Client) keyPath(key string) string {
+	return c.scope() + "/kv/" + url.PathEscape(key)
+}
+
+// writeBody encodes a value to write.
+func writeBody(val string, opts WriteOptions) ([]byte, error) {
+	v := value{Value: val}
+	if opts.TTL != 0 {
+		v.TTL = opts.TTL.String()
+	}
+	return json.Marshal(v)
+}
+
+// indexHeader makes a write conditional on opts.Index, if it is set.
+func indexHeader(opts WriteOptions) http.Header {
+	if opts.Index == 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {strconv.Quote(strconv.FormatInt(opts.Index, 10))}}
+}
+
+// Get returns the entry for key.
+func (c *Client) Get(ctx context.Context, key string) (Entry, error) {
+	resp, getErr := c.do(ctx, http.MethodGet, c.keyPath(key), nil, nil, nil)
+	if getErr != nil {
+		return Entry{}, getErr
+	}
+	var v value
+	umErr := json.Unmarshal(resp.body, &v)
+	if umErr != nil {
+		return Entry{}, umErr
+	}
+	entry := Entry{Key: key, Value: v.Value}
+	if v.Expires != nil {
+		entry.Expires = *v.Expires
+	}
+	if etag := resp.header.Get("ETag"); etag != "" {
+		unquoted, unquoteErr := strconv.Unquote(etag)
+		if unquoteErr == nil {
+			entry.Index, _ = strconv.ParseInt(unquoted, 10, 64)
+		}
+	}
+	return entry, nil
+}
+
+// Create adds key with value. It fails with ErrConflict if key exists.
+// opts.Index is ignored.
+func (c *Client) Create(ctx context.Context, key, val string, opts WriteOptions) error {
+	body, bodyErr := writeBody(val, opts)
+	if bodyErr != nil {
+		return bodyErr
+	}
+	header := http.Header{"If-None-Match": {"*"}}
+	_, postErr := c.do(ctx, http.MethodPost, c.keyPath(key), nil, header, body)
+	return postErr
+}
+
+// Put changes the value of key, which must exist. The key expires only if
+// opts.TTL is set.
+func (c *Client) Put(ctx context.Context, key, val string, opts WriteOptions) error {
+	body, bodyErr := writeBody(val, opts)
+	if bodyErr != nil {
+		return bodyErr
+	}
+	_, putErr := c.do(ctx, http.MethodPut, c.keyPath(key), nil, indexHeader(opts), body)
+	return putErr
+}
+
+// Delete removes key. opts.TTL is ignored.
+func (c *Client) Delete(ctx context.Context, key string, opts WriteOptions) error {
+	_, deleteErr := c.do(ctx, http.MethodDelete, c.keyPath(key), nil, indexHeader(opts), nil)
+	return deleteErr
+}
+
+// listResult is one page of keys on the wire.
+type listResult struct {
+	Entries []struct {
+		Key     string
+		Value   *string
+		Expires *time.Time
+	}
+	Next string
+}
+
+// List returns every key beginning with prefix, with its value, in sorted
+// order. It reads as many pages as it takes.
+func (c *Client) List(ctx context.Context, prefix string) ([]Entry, error) {
+	var entries []Entry
+	query := url.Values{"prefix": {prefix}, "values": {"true"}}
+	for {
+		resp, listErr := c.do(ctx, http.MethodGet, c.scope()+"/kv", query, nil, nil)
+		if listErr != nil {
+			return nil, listErr
+		}
+		var page listResult
+		umErr := json.Unmarshal(resp.body, &page)
+		if umErr != nil {
+			return nil, umErr
+		}
+		for _, e := range page.Entries {
+			entry := Entry{Key: e.Key}
+			if e.Value != nil {
+				entry.Value = *e.Value
+			}
+			if e.Expires != nil {
+				entry.Expires = *e.Expires
+			}
+			entries = append(entries, entry)
+		}
+		if page.Next == "" {
+			return entries, nil
+		}
+		query.Set("after", page.Next)
+	}
+}
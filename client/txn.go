@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The ops a TxnOp may be.
+const (
+	OpGet    = "get"
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+	OpCheck  = "check"
+)
+
+// TxnOp is one operation of a transaction. Value is required for insert and
+// update, and TTL may make the written key expire. A nonzero Index makes an
+// update or delete conditional on the key's modification index; for a check
+// it is the index the key must have, where zero means it must not exist.
+type TxnOp struct {
+	Op    string
+	Key   string
+	Value *string `json:",omitempty"`
+	TTL   string  `json:",omitempty"`
+	Index int64   `json:",omitempty"`
+}
+
+// TxnOpResult describes the key as one op left it. Value is set when the key
+// exists after the op.
+type TxnOpResult struct {
+	Op      string
+	Key     string
+	Found   bool
+	Value   *string    `json:",omitempty"`
+	Index   int64      `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// txnResult is the response to a transaction on the wire.
+type txnResult struct {
+	Results  []TxnOpResult
+	FailedOp *int
+	Error    string
+}
+
+// TxnError is returned by a transaction that could not be applied, so
+// wrote nothing. It matches ErrConflict.
+type TxnError struct {
+	Op     int
+	Reason string
+}
+
+// Error describes the failed op.
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("rscs: txn op %d: %s", e.Op, e.Reason)
+}
+
+// Is matches ErrConflict.
+func (e *TxnError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Txn applies ops atomically and returns one result per op. It is not
+// retried, since it may have been applied.
+func (c *Client) Txn(ctx context.Context, ops []TxnOp) ([]TxnOpResult, error) {
+	body, bodyErr := json.Marshal(struct{ Ops []TxnOp }{ops})
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+	resp, postErr := c.do(ctx, http.MethodPost, c.scope()+"/txn", nil, nil, body)
+	if e, ok := postErr.(*Error); ok && e.StatusCode == http.StatusConflict {
+		var result txnResult
+		if json.Unmarshal([]byte(e.Message), &result) == nil && result.FailedOp != nil {
+			return nil, &TxnError{Op: *result.FailedOp, Reason: result.Error}
+		}
+	}
+	if postErr != nil {
+		return nil, postErr
+	}
+	var result txnResult
+	umErr := json.Unmarshal(resp.body, &result)
+	if umErr != nil {
+		return nil, umErr
+	}
+	return result.Results, nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// FromNow passed as the index to Watch streams only changes made after the
+// watch starts.
+const FromNow int64 = -1
+
+// WatchEvent describes one change to a key. Type is "put" or "delete", and
+// Value is empty for a delete.
+type WatchEvent struct {
+	Type     string
+	Key      string
+	Value    string
+	Index    int64
+	Revision int
+}
+
+// Watch calls fn with each change to a key beginning with prefix made after
+// modification index since, in order, until ctx is done or fn returns an
+// error, which Watch then returns. A dropped stream is reopened from the
+// last change seen, giving up after Config.Retries failures in a row.
+func (c *Client) Watch(ctx context.Context, prefix string, since int64, fn func(WatchEvent) error) error {
+	failures := 0
+	for {
+		seen, streamErr := c.stream(ctx, prefix, since, fn)
+		if seen > since {
+			since = seen
+			failures = 0
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var fnErr callbackError
+		if errors.As(streamErr, &fnErr) {
+			return fnErr.err
+		}
+		if e, ok := streamErr.(*Error); ok && !retryable(http.MethodGet, e.StatusCode, nil) {
+			return e
+		}
+		failures++
+		if failures > c.config.Retries {
+			return streamErr
+		}
+		sleepErr := sleep(ctx, c.backoff(failures))
+		if sleepErr != nil {
+			return sleepErr
+		}
+	}
+}
+
+// callbackError carries an error returned by the function passed to Watch.
+type callbackError struct {
+	err error
+}
+
+func (e callbackError) Error() string {
+	return e.err.Error()
+}
+
+// stream opens one event stream and passes its events to fn until it ends.
+// It returns the index of the last event passed on, or since if there was
+// none, and why the stream ended.
+func (c *Client) stream(ctx context.Context, prefix string, since int64, fn func(WatchEvent) error) (int64, error) {
+	query := url.Values{"prefix": {prefix}}
+	if since != FromNow {
+		query.Set("index", strconv.FormatInt(since, 10))
+	}
+	req, reqErr := c.newRequest(ctx, http.MethodGet, c.scope()+"/watch", query, nil)
+	if reqErr != nil {
+		return since, reqErr
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, doErr := c.http.Do(req)
+	if doErr != nil {
+		return since, doErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return since, newError(response{status: resp.StatusCode, header: resp.Header, body: body})
+	}
+
+	var eventType, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if eventType == "error" {
+				return since, errors.New("rscs: watch: " + data)
+			}
+			if data != "" {
+				var event WatchEvent
+				umErr := json.Unmarshal([]byte(data), &event)
+				if umErr != nil {
+					return since, umErr
+				}
+				fnErr := fn(event)
+				if fnErr != nil {
+					return since, callbackError{fnErr}
+				}
+				since = event.Index
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	scanErr := scanner.Err()
+	if scanErr == nil {
+		scanErr = errors.New("rscs: watch stream closed")
+	}
+	return since, scanErr
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/bradclawsie/rscs/server"
+)
+
+// commands are the subcommands run in place of the daemon, as in
+// `rscs export --db=...`. Each is passed the arguments after its name.
+var commands = map[string]func(args []string) error{
+	"export":  exportCommand,
+	"import":  importCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"token":   tokenCommand,
+	"revoke":  revokeCommand,
+	"keygen":  keygenCommand,
+	"rekey":   rekeyCommand,
+	"get":     getCommand,
+	"put":     putCommand,
+	"create":  createCommand,
+	"delete":  deleteCommand,
+	"ls":      lsCommand,
+	"watch":   watchCommand,
+	"render":  renderCommand,
+}
+
+// storeFlags adds the flags naming a store, and the master keys of an
+// encrypted sqlite store, to fs.
+func storeFlags(fs *flag.FlagSet) (*string, *string, *string) {
+	dbFile := fs.String("db", "", "full path to sqlite db file, or to the file store")
+	storeType := fs.String("store", "sqlite", "storage backend: sqlite or file")
+	keyFile := fs.String("master-key-file", "", "file of master keys encrypting the sqlite db, instead of $"+db.MasterKeyEnv)
+	return dbFile, storeType, keyFile
+}
+
+// openStore opens an existing store for a subcommand. The returned function
+// closes it.
+func openStore(storeType, dbFile, keyFile string) (db.Store, func(), error) {
+	if dbFile == "" {
+		return nil, nil, errors.New("--db is required")
+	}
+	switch storeType {
+	case "sqlite":
+		rscsDB, rscsDBErr := db.NewRscsDB(dbFile)
+		if rscsDBErr != nil {
+			return nil, nil, rscsDBErr
+		}
+		keyring, keyringErr := db.LoadKeyring(keyFile)
+		if keyringErr != nil {
+			return nil, nil, keyringErr
+		}
+		rscsDB.SetKeyring(keyring)
+		return rscsDB, func() {}, nil
+	case "file":
+		if keyFile != "" || os.Getenv(db.MasterKeyEnv) != "" {
+			return nil, nil, fmt.Errorf("only the sqlite store encrypts values; use --store=sqlite or unset $%s", db.MasterKeyEnv)
+		}
+		fileStore, fileStoreErr := db.NewFileStore(dbFile)
+		if fileStoreErr != nil {
+			return nil, nil, fileStoreErr
+		}
+		return fileStore, func() { fileStore.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store '%s'", storeType)
+	}
+}
+
+// exportCommand writes every key in the store to stdout.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	format := fs.String("format", db.FormatJSON, "output format: json, yaml or env")
+	fs.Parse(args)
+
+	formatErr := db.CheckFormat(*format)
+	if formatErr != nil {
+		return formatErr
+	}
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+
+	values, exportErr := db.Export(store)
+	if exportErr != nil {
+		return exportErr
+	}
+	return db.EncodeValues(os.Stdout, *format, values)
+}
+
+// importCommand writes the keys read from a file, or stdin, into the store
+// and prints the changes.
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	format := fs.String("format", db.FormatJSON, "input format: json, yaml or env")
+	inFile := fs.String("file", "", "file to import, instead of stdin")
+	merge := fs.Bool("merge", false, "leave keys missing from the input alone (the default)")
+	replace := fs.Bool("replace", false, "delete keys missing from the input")
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	fs.Parse(args)
+
+	if *merge && *replace {
+		return errors.New("--merge and --replace are exclusive")
+	}
+	formatErr := db.CheckFormat(*format)
+	if formatErr != nil {
+		return formatErr
+	}
+
+	var in io.Reader = os.Stdin
+	if *inFile != "" {
+		file, openErr := os.Open(*inFile)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		in = file
+	}
+	values, decodeErr := db.DecodeValues(in, *format)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+
+	changes, importErr := db.Import(store, values, *replace, *dryRun)
+	if importErr != nil {
+		return importErr
+	}
+	for _, change := range changes {
+		switch change.Action {
+		case db.ImportAdd:
+			fmt.Printf("+ %s = %q\n", change.Key, change.New)
+		case db.ImportUpdate:
+			fmt.Printf("~ %s = %q (was %q)\n", change.Key, change.New, change.Old)
+		case db.ImportDelete:
+			fmt.Printf("- %s (was %q)\n", change.Key, change.Old)
+		}
+	}
+	return nil
+}
+
+// backupCommand writes a consistent snapshot of a store, or of a running
+// daemon, to a file or stdout.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	daemonURL := fs.String("url", "", "back up the daemon at this url instead, e.g. http://localhost:8081")
+	outFile := fs.String("out", "", "file to write the backup to, instead of stdout")
+	token := fs.String("token", "", "bearer token to present to a daemon run with --auth")
+	fs.Parse(args)
+
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		file, createErr := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if *daemonURL != "" {
+		resp, getErr := daemonRequest(http.MethodGet, *daemonURL, server.BackupRoute, *token, nil)
+		if getErr != nil {
+			return getErr
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		_, copyErr := io.Copy(out, resp.Body)
+		return copyErr
+	}
+
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+	return store.(db.Backuper).Backup(out)
+}
+
+// restoreCommand replaces the contents of a store, or of a running daemon,
+// with a snapshot written by backupCommand.
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	daemonURL := fs.String("url", "", "restore into the daemon at this url instead, e.g. http://localhost:8081")
+	inFile := fs.String("file", "", "backup file to restore")
+	token := fs.String("token", "", "bearer token to present to a daemon run with --auth")
+	fs.Parse(args)
+
+	if *inFile == "" {
+		return errors.New("--file is required")
+	}
+	file, openErr := os.Open(*inFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	if *daemonURL != "" {
+		resp, postErr := daemonRequest(http.MethodPost, *daemonURL, server.RestoreRoute, *token, file)
+		if postErr != nil {
+			return postErr
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+		return nil
+	}
+
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+	return store.(db.Backuper).Restore(file)
+}
+
+// policyFlags collects repeated --policy flags.
+type policyFlags []db.Policy
+
+func (p *policyFlags) String() string {
+	return fmt.Sprintf("%v", *p)
+}
+
+// Set parses a policy written as perms[@namespace]:prefix, where perms is a
+// comma separated list of read, write and delete, as in read,write@payments:app/.
+func (p *policyFlags) Set(value string) error {
+	i := strings.IndexByte(value, ':')
+	if i < 0 {
+		return errors.New("policy must be perms[@namespace]:prefix")
+	}
+	var policy db.Policy
+	perms := value[:i]
+	policy.Prefix = value[i+1:]
+	if at := strings.IndexByte(perms, '@'); at >= 0 {
+		perms, policy.Namespace = perms[:at], perms[at+1:]
+	}
+	for _, perm := range strings.Split(perms, ",") {
+		policy.Permissions = append(policy.Permissions, db.Permission(perm))
+	}
+	policyErr := db.CheckPolicy(policy)
+	if policyErr != nil {
+		return policyErr
+	}
+	*p = append(*p, policy)
+	return nil
+}
+
+// tokenCommand mints a token directly in a store, which is how the first
+// admin token is made, and prints its bearer string.
+func tokenCommand(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	admin := fs.Bool("admin", false, "allow the token to do anything")
+	var policies policyFlags
+	fs.Var(&policies, "policy", "grant perms[@namespace]:prefix, e.g. read,write@payments:app/ (repeatable)")
+	fs.Parse(args)
+
+	if !*admin && len(policies) == 0 {
+		return errors.New("--admin or --policy is required")
+	}
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+
+	token, bearer, newErr := db.NewToken(*admin, policies)
+	if newErr != nil {
+		return newErr
+	}
+	putErr := store.(db.TokenStore).PutToken(token)
+	if putErr != nil {
+		return putErr
+	}
+	fmt.Println(bearer)
+	return nil
+}
+
+// revokeCommand deletes a token directly from a store.
+func revokeCommand(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	id := fs.String("id", "", "id of the token to revoke, the part of it before the '.'")
+	fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("--id is required")
+	}
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+
+	deleted, deleteErr := store.(db.TokenStore).DeleteToken(*id)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if !deleted {
+		return fmt.Errorf("no token '%s' found", *id)
+	}
+	return nil
+}
+
+// daemonRequest sends a request for route to the daemon at daemonURL,
+// presenting token if it is set.
+func daemonRequest(method, daemonURL, route, token string, body io.Reader) (*http.Response, error) {
+	req, reqErr := http.NewRequest(method, strings.TrimSuffix(daemonURL, "/")+route, body)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if body != nil {
+		req.Header.Set("Content-type", "application/octet-stream")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// keygenCommand prints a new random master key.
+func keygenCommand(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, keyErr := db.NewMasterKey()
+	if keyErr != nil {
+		return keyErr
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// rekeyCommand seals every value in a sqlite store under the current, first,
+// master key. It can run while the daemon is serving the same store, once
+// the daemon has the new key.
+func rekeyCommand(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	dbFile, storeType, keyFile := storeFlags(fs)
+	fs.Parse(args)
+
+	if *storeType != "sqlite" {
+		return errors.New("only the sqlite store is encrypted")
+	}
+	if *keyFile == "" {
+		// Only a key file is reloaded by a running daemon.
+		log.Printf("a daemon given its keys in $%s must be restarted with the new key before a rekey, or it goes on sealing values under the old one", db.MasterKeyEnv)
+	}
+	store, closeStore, openErr := openStore(*storeType, *dbFile, *keyFile)
+	if openErr != nil {
+		return openErr
+	}
+	defer closeStore()
+
+	rewritten, rekeyErr := store.(*db.RscsDB).Rekey()
+	if rekeyErr != nil {
+		return rekeyErr
+	}
+	fmt.Printf("rekeyed %d rows\n", rewritten)
+	return nil
+}
+
+// responseError describes a failed response from the daemon.
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
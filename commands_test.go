@@ -0,0 +1,378 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/bradclawsie/rscs/server"
+)
+
+// testSQLiteDB creates an empty sqlite store and returns its path.
+func testSQLiteDB(t *testing.T) string {
+	dbFile := filepath.Join(t.TempDir(), "rscs.sqlite3")
+	rscsDB, newErr := db.NewRscsDB(dbFile)
+	if newErr != nil {
+		t.Fatalf("new db: %s", newErr.Error())
+	}
+	createErr := rscsDB.CreateTable()
+	if createErr != nil {
+		t.Fatalf("create table: %s", createErr.Error())
+	}
+	return dbFile
+}
+
+func TestExportImportCommands(t *testing.T) {
+	dbFile := testSQLiteDB(t)
+	run := func(command func([]string) error, in string, args ...string) (string, error) {
+		return withStdio(t, in, func() error {
+			return command(append([]string{"--db=" + dbFile}, args...))
+		})
+	}
+
+	out, importErr := run(importCommand, `{"b": "two words", "a": "1"}`)
+	if importErr != nil {
+		t.Fatalf("import: %s", importErr.Error())
+	}
+	if out != "+ a = \"1\"\n+ b = \"two words\"\n" {
+		t.Errorf("import printed '%s'", out)
+	}
+
+	envFile := writeTestFile(t, t.TempDir(), "values.env", "a=1\nb=2\nc=3\n")
+	out, importErr = run(importCommand, "", "--format=env", "--file="+envFile, "--dry-run")
+	if importErr != nil {
+		t.Fatalf("dry run: %s", importErr.Error())
+	}
+	if out != "~ b = \"2\" (was \"two words\")\n+ c = \"3\"\n" {
+		t.Errorf("dry run printed '%s'", out)
+	}
+	out, exportErr := run(exportCommand, "", "--format=env")
+	if exportErr != nil || out != "a=1\nb=\"two words\"\n" {
+		t.Errorf("export after a dry run printed '%s' %v", out, exportErr)
+	}
+
+	out, importErr = run(importCommand, "a: \"10\"\n", "--format=yaml", "--replace")
+	if importErr != nil {
+		t.Fatalf("replace: %s", importErr.Error())
+	}
+	if out != "~ a = \"10\" (was \"1\")\n- b (was \"two words\")\n" {
+		t.Errorf("replace printed '%s'", out)
+	}
+	for _, c := range []struct {
+		format, want string
+	}{
+		{format: db.FormatJSON, want: "{\n  \"a\": \"10\"\n}\n"},
+		{format: db.FormatYAML, want: "a: \"10\"\n"},
+		{format: db.FormatEnv, want: "a=10\n"},
+	} {
+		out, exportErr = run(exportCommand, "", "--format="+c.format)
+		if exportErr != nil {
+			t.Errorf("export %s: %s", c.format, exportErr.Error())
+			continue
+		}
+		if out != c.want {
+			t.Errorf("export %s printed '%s', want '%s'", c.format, out, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		command func([]string) error
+		args    []string
+	}{
+		{command: exportCommand, args: []string{"--format=xml"}},
+		{command: importCommand, args: []string{"--format=xml"}},
+		{command: importCommand, args: []string{"--merge", "--replace"}},
+		{command: importCommand, args: []string{"--file=" + envFile + ".missing"}},
+		{command: exportCommand, args: []string{"--store=other"}},
+	} {
+		_, runErr := run(c.command, "{}", c.args...)
+		if runErr == nil {
+			t.Errorf("%q returned no error", c.args)
+		}
+	}
+	_, importErr = run(importCommand, `{"a": 1}`)
+	if importErr == nil {
+		t.Errorf("import of a number returned no error")
+	}
+}
+
+func TestBackupRestoreCommands(t *testing.T) {
+	dir := t.TempDir()
+	for _, storeType := range []string{"sqlite", "file"} {
+		from := filepath.Join(dir, storeType+".from")
+		to := filepath.Join(dir, storeType+".to")
+		if storeType == "sqlite" {
+			from, to = testSQLiteDB(t), testSQLiteDB(t)
+		}
+		run := func(command func([]string) error, dbFile string, args ...string) (string, error) {
+			return withStdio(t, "", func() error {
+				return command(append([]string{"--store=" + storeType, "--db=" + dbFile}, args...))
+			})
+		}
+		_, importErr := withStdio(t, `{"a": "1", "b": "2"}`, func() error {
+			return importCommand([]string{"--store=" + storeType, "--db=" + from})
+		})
+		if importErr != nil {
+			t.Fatalf("%s import: %s", storeType, importErr.Error())
+		}
+
+		backup := filepath.Join(dir, storeType+".backup")
+		_, backupErr := run(backupCommand, from, "--out="+backup)
+		if backupErr != nil {
+			t.Fatalf("%s backup: %s", storeType, backupErr.Error())
+		}
+		_, backupErr = run(backupCommand, from, "--out="+backup)
+		if backupErr == nil {
+			t.Errorf("%s backup over an existing file returned no error", storeType)
+		}
+		_, restoreErr := run(restoreCommand, to, "--file="+backup)
+		if restoreErr != nil {
+			t.Fatalf("%s restore: %s", storeType, restoreErr.Error())
+		}
+		out, exportErr := run(exportCommand, to, "--format=env")
+		if exportErr != nil || out != "a=1\nb=2\n" {
+			t.Errorf("%s export after restore printed '%s' %v", storeType, out, exportErr)
+		}
+
+		_, restoreErr = run(restoreCommand, to)
+		if restoreErr == nil {
+			t.Errorf("%s restore without --file returned no error", storeType)
+		}
+	}
+
+	// With --url the snapshot goes to and from the daemon.
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer secret":
+			http.Error(w, "no token", http.StatusUnauthorized)
+		case r.Method == http.MethodGet && r.URL.Path == server.BackupRoute:
+			w.Write([]byte("snapshot"))
+		case r.Method == http.MethodPost && r.URL.Path == server.RestoreRoute:
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != "snapshot" {
+				http.Error(w, "bad snapshot", http.StatusBadRequest)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daemon.Close()
+
+	out, backupErr := withStdio(t, "", func() error {
+		return backupCommand([]string{"--url=" + daemon.URL + "/", "--token=secret"})
+	})
+	if backupErr != nil || out != "snapshot" {
+		t.Errorf("daemon backup printed '%s' %v", out, backupErr)
+	}
+	_, backupErr = withStdio(t, "", func() error {
+		return backupCommand([]string{"--url=" + daemon.URL})
+	})
+	if backupErr == nil {
+		t.Errorf("daemon backup without a token returned no error")
+	}
+	snapshot := writeTestFile(t, dir, "snapshot", "snapshot")
+	restoreErr := restoreCommand([]string{"--url=" + daemon.URL, "--token=secret", "--file=" + snapshot})
+	if restoreErr != nil {
+		t.Errorf("daemon restore: %s", restoreErr.Error())
+	}
+	bad := writeTestFile(t, dir, "bad", "not a snapshot")
+	restoreErr = restoreCommand([]string{"--url=" + daemon.URL, "--token=secret", "--file=" + bad})
+	if restoreErr == nil {
+		t.Errorf("daemon restore of a bad snapshot returned no error")
+	}
+}
+
+func TestPolicyFlags(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  db.Policy
+		fails bool
+	}{
+		{value: "read:app/", want: db.Policy{Prefix: "app/", Permissions: []db.Permission{db.PermRead}}},
+		{value: "read,write,delete:", want: db.Policy{
+			Permissions: []db.Permission{db.PermRead, db.PermWrite, db.PermDelete}}},
+		{value: "write@payments:a:b", want: db.Policy{Namespace: "payments", Prefix: "a:b",
+			Permissions: []db.Permission{db.PermWrite}}},
+		{value: "read", fails: true},
+		{value: ":app/", fails: true},
+		{value: "admin:app/", fails: true},
+		{value: "read@bad name:app/", fails: true},
+	} {
+		var policies policyFlags
+		setErr := policies.Set(c.value)
+		if c.fails {
+			if setErr == nil {
+				t.Errorf("%s: parsed %+v, want an error", c.value, policies)
+			}
+			continue
+		}
+		if setErr != nil {
+			t.Errorf("%s: %s", c.value, setErr.Error())
+			continue
+		}
+		if len(policies) != 1 || !reflect.DeepEqual(policies[0], c.want) {
+			t.Errorf("%s: parsed %+v, want %+v", c.value, policies, c.want)
+		}
+	}
+}
+
+func TestTokenCommands(t *testing.T) {
+	dbFile := testSQLiteDB(t)
+	authenticate := func(bearer string) (db.Token, bool) {
+		store, closeStore, openErr := openStore("sqlite", dbFile, "")
+		if openErr != nil {
+			t.Fatalf("open: %s", openErr.Error())
+		}
+		defer closeStore()
+		token, found, authErr := db.Authenticate(store.(db.TokenStore), bearer)
+		if authErr != nil {
+			t.Fatalf("authenticate: %s", authErr.Error())
+		}
+		return token, found
+	}
+
+	_, tokenErr := withStdio(t, "", func() error {
+		return tokenCommand([]string{"--db=" + dbFile})
+	})
+	if tokenErr == nil {
+		t.Errorf("token without --admin or --policy returned no error")
+	}
+
+	out, tokenErr := withStdio(t, "", func() error {
+		return tokenCommand([]string{"--db=" + dbFile, "--policy=read:app/", "--policy=write@payments:"})
+	})
+	if tokenErr != nil {
+		t.Fatalf("token: %s", tokenErr.Error())
+	}
+	bearer := strings.TrimSuffix(out, "\n")
+	token, found := authenticate(bearer)
+	if !found || token.Admin || len(token.Policies) != 2 {
+		t.Fatalf("minted %+v %v", token, found)
+	}
+	if !token.Allows(db.DefaultNamespace, "app/x", db.PermRead) || token.Allows(db.DefaultNamespace, "app/x", db.PermWrite) ||
+		!token.Allows("payments", "x", db.PermWrite) {
+		t.Errorf("minted token has the wrong policies: %+v", token.Policies)
+	}
+
+	out, tokenErr = withStdio(t, "", func() error {
+		return tokenCommand([]string{"--db=" + dbFile, "--admin"})
+	})
+	if tokenErr != nil {
+		t.Fatalf("admin token: %s", tokenErr.Error())
+	}
+	if admin, found := authenticate(strings.TrimSuffix(out, "\n")); !found || !admin.Admin {
+		t.Errorf("minted admin %+v %v", admin, found)
+	}
+
+	revokeErr := revokeCommand([]string{"--db=" + dbFile, "--id=" + token.ID})
+	if revokeErr != nil {
+		t.Fatalf("revoke: %s", revokeErr.Error())
+	}
+	if _, found := authenticate(bearer); found {
+		t.Errorf("revoked token still authenticates")
+	}
+	revokeErr = revokeCommand([]string{"--db=" + dbFile, "--id=" + token.ID})
+	if revokeErr == nil {
+		t.Errorf("second revoke returned no error")
+	}
+	revokeErr = revokeCommand([]string{"--db=" + dbFile})
+	if revokeErr == nil {
+		t.Errorf("revoke without --id returned no error")
+	}
+}
+
+func TestKeygenRekeyCommands(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := testSQLiteDB(t)
+	keygen := func() string {
+		out, keygenErr := withStdio(t, "", func() error {
+			return keygenCommand(nil)
+		})
+		if keygenErr != nil {
+			t.Fatalf("keygen: %s", keygenErr.Error())
+		}
+		return strings.TrimSuffix(out, "\n")
+	}
+	oldKey, newKey := keygen(), keygen()
+	if len(oldKey) != 2*db.MasterKeyLen || oldKey == newKey {
+		t.Fatalf("keygen printed '%s' and '%s'", oldKey, newKey)
+	}
+
+	_, importErr := withStdio(t, `{"a": "1"}`, func() error {
+		return importCommand([]string{"--db=" + dbFile})
+	})
+	if importErr != nil {
+		t.Fatalf("import: %s", importErr.Error())
+	}
+	keyFile := writeTestFile(t, dir, "keys", oldKey+"\n")
+	rekey := func() string {
+		out, rekeyErr := withStdio(t, "", func() error {
+			return rekeyCommand([]string{"--db=" + dbFile, "--master-key-file=" + keyFile})
+		})
+		if rekeyErr != nil {
+			t.Fatalf("rekey: %s", rekeyErr.Error())
+		}
+		return out
+	}
+	// The value and its one revision are sealed.
+	if out := rekey(); out != "rekeyed 2 rows\n" {
+		t.Errorf("rekey printed '%s'", out)
+	}
+	if out := rekey(); out != "rekeyed 0 rows\n" {
+		t.Errorf("second rekey printed '%s'", out)
+	}
+	writeTestFile(t, dir, "keys", newKey+"\n"+oldKey+"\n")
+	if out := rekey(); out != "rekeyed 2 rows\n" {
+		t.Errorf("rekey to a new key printed '%s'", out)
+	}
+
+	// Once rekeyed, the old key is not needed.
+	writeTestFile(t, dir, "keys", newKey+"\n")
+	out, exportErr := withStdio(t, "", func() error {
+		return exportCommand([]string{"--db=" + dbFile, "--master-key-file=" + keyFile, "--format=env"})
+	})
+	if exportErr != nil || out != "a=1\n" {
+		t.Errorf("export under the new key printed '%s' %v", out, exportErr)
+	}
+	_, exportErr = withStdio(t, "", func() error {
+		return exportCommand([]string{"--db=" + dbFile, "--format=env"})
+	})
+	if exportErr == nil {
+		t.Errorf("export without a key returned no error")
+	}
+
+	for _, args := range [][]string{
+		{"--db=" + dbFile},
+		{"--store=file", "--db=" + filepath.Join(dir, "store"), "--master-key-file=" + keyFile},
+	} {
+		_, rekeyErr := withStdio(t, "", func() error {
+			return rekeyCommand(args)
+		})
+		if rekeyErr == nil {
+			t.Errorf("rekey %q returned no error", args)
+		}
+	}
+	// A file store does not encrypt, so it refuses master keys rather than
+	// store values in plaintext.
+	fileArgs := []string{"--store=file", "--db=" + filepath.Join(dir, "store"), "--format=env"}
+	_, exportErr = withStdio(t, "", func() error {
+		return exportCommand(append(fileArgs, "--master-key-file="+keyFile))
+	})
+	if exportErr == nil {
+		t.Errorf("export of a file store with a key file returned no error")
+	}
+	os.Setenv(db.MasterKeyEnv, newKey)
+	defer os.Unsetenv(db.MasterKeyEnv)
+	_, exportErr = withStdio(t, "", func() error {
+		return exportCommand(fileArgs)
+	})
+	if exportErr == nil {
+		t.Errorf("export of a file store with $%s set returned no error", db.MasterKeyEnv)
+	}
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// AuditTableName is the append-only table of audit records.
+	AuditTableName = "audit"
+	// AuditIDColumn orders the audit records.
+	AuditIDColumn = "id"
+	// AuditTimeColumn is when the request was made, in unix nanoseconds.
+	AuditTimeColumn = "time"
+	// AuditKeyColumn is the key the request wrote, or empty.
+	AuditKeyColumn = "key"
+	// AuditRecordColumn holds the whole record as JSON.
+	AuditRecordColumn = "record"
+)
+
+// auditFileSuffix is added to the name of a FileStore file to name the file
+// its audit records are appended to.
+const auditFileSuffix = ".audit"
+
+// AuditRecord describes one request that tried to change the store. Caller
+// identifies who made it, such as "token:<id>", "cert:<subject>",
+// "uid:<uid>" or "addr:<host:port>". OldHash and NewHash are HashValue of
+// the key's value before and after the request, empty where the key did not
+// exist, or for requests that are not about a single key. Status is the HTTP
+// status the request was answered with.
+type AuditRecord struct {
+	Time      time.Time
+	Caller    string
+	Method    string
+	Path      string
+	Namespace string `json:",omitempty"`
+	Key       string `json:",omitempty"`
+	OldHash   string `json:",omitempty"`
+	NewHash   string `json:",omitempty"`
+	Status    int
+}
+
+// AuditLog is implemented by a Store that can keep an append-only log of
+// audit records, and by AuditFile. Every Store in this package is an
+// AuditLog.
+type AuditLog interface {
+	// AppendAudit adds a record to the end of the log.
+	AppendAudit(record AuditRecord) error
+	// Audit returns up to limit records made at or after since, oldest
+	// first. If key is not empty only the records for that key are returned.
+	Audit(key string, since time.Time, limit int) ([]AuditRecord, error)
+}
+
+var (
+	_ AuditLog = (*RscsDB)(nil)
+	_ AuditLog = (*MemoryStore)(nil)
+	_ AuditLog = (*FileStore)(nil)
+	_ AuditLog = (*AuditFile)(nil)
+)
+
+// HashValue is the hex SHA-256 hash of a value, as kept in an AuditRecord.
+func HashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditMatches reports whether record is one Audit should return.
+func auditMatches(record AuditRecord, key string, since time.Time) bool {
+	return (key == "" || record.Key == key) && !record.Time.Before(since)
+}
+
+// createAuditTable creates the audit table if it is missing, as it is in
+// dbs made before audit records were kept.
+func (r *RscsDB) createAuditTable() error {
+	queryStr := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s INTEGER PRIMARY KEY AUTOINCREMENT, %s INTEGER NOT NULL, %s VARCHAR(255) NOT NULL, %s TEXT NOT NULL)",
+		AuditTableName, AuditIDColumn, AuditTimeColumn, AuditKeyColumn, AuditRecordColumn)
+	_, createErr := r.db.Exec(queryStr)
+	return createErr
+}
+
+// AppendAudit adds a record to the audit table.
+func (r *RscsDB) AppendAudit(record AuditRecord) error {
+	createErr := r.createAuditTable()
+	if createErr != nil {
+		return createErr
+	}
+	recordBytes, jsonErr := json.Marshal(record)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3)",
+		AuditTableName, AuditTimeColumn, AuditKeyColumn, AuditRecordColumn)
+	_, execErr := r.db.Exec(queryStr, record.Time.UnixNano(), record.Key, string(recordBytes))
+	return execErr
+}
+
+// Audit returns up to limit records from the audit table made at or after
+// since, oldest first, only those for key if it is not empty.
+func (r *RscsDB) Audit(key string, since time.Time, limit int) ([]AuditRecord, error) {
+	createErr := r.createAuditTable()
+	if createErr != nil {
+		return nil, createErr
+	}
+	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE ($1 = '' OR %s = $1) AND %s >= $2 ORDER BY %s LIMIT $3",
+		AuditRecordColumn, AuditTableName, AuditKeyColumn, AuditTimeColumn, AuditIDColumn)
+	rows, queryErr := r.db.Query(queryStr, key, since.UnixNano(), limit)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	records := []AuditRecord{}
+	for rows.Next() {
+		var recordStr string
+		scanErr := rows.Scan(&recordStr)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		var record AuditRecord
+		umErr := json.Unmarshal([]byte(recordStr), &record)
+		if umErr != nil {
+			return nil, umErr
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// AppendAudit adds a record to the store's audit log, which, like the rest
+// of a MemoryStore, is lost when the process exits.
+func (m *MemoryStore) AppendAudit(record AuditRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit = append(m.audit, record)
+	return nil
+}
+
+// Audit returns up to limit records made at or after since, oldest first,
+// only those for key if it is not empty.
+func (m *MemoryStore) Audit(key string, since time.Time, limit int) ([]AuditRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := []AuditRecord{}
+	for _, record := range m.audit {
+		if len(records) == limit {
+			break
+		}
+		if auditMatches(record, key, since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// AppendAudit adds a record to the store's audit file.
+func (f *FileStore) AppendAudit(record AuditRecord) error {
+	return f.audit.AppendAudit(record)
+}
+
+// Audit returns up to limit records from the store's audit file.
+func (f *FileStore) Audit(key string, since time.Time, limit int) ([]AuditRecord, error) {
+	return f.audit.Audit(key, since, limit)
+}
+
+// AuditFile is an AuditLog kept in a file of JSON lines, one record per
+// line. The file is only ever appended to, and each record is synced to
+// disk before AppendAudit returns.
+type AuditFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenAuditFile opens the audit file at path for appending, creating it if
+// needed. A partially written last line, left by a crash during a write, is
+// discarded.
+func OpenAuditFile(path string) (*AuditFile, error) {
+	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if openErr != nil {
+		return nil, openErr
+	}
+	contents, readErr := ioutil.ReadAll(file)
+	if readErr == nil && len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		readErr = file.Truncate(int64(bytes.LastIndexByte(contents, '\n') + 1))
+	}
+	if readErr != nil {
+		file.Close()
+		return nil, readErr
+	}
+	return &AuditFile{path: path, file: file}, nil
+}
+
+// Close closes the file. The AuditFile must not be used afterwards.
+func (a *AuditFile) Close() error {
+	return a.file.Close()
+}
+
+// AppendAudit appends a record to the file and syncs it.
+func (a *AuditFile) AppendAudit(record AuditRecord) error {
+	recordBytes, jsonErr := json.Marshal(record)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, writeErr := a.file.Write(append(recordBytes, '\n'))
+	if writeErr != nil {
+		return writeErr
+	}
+	return a.file.Sync()
+}
+
+// Audit reads the file and returns up to limit records made at or after
+// since, oldest first, only those for key if it is not empty.
+func (a *AuditFile) Audit(key string, since time.Time, limit int) ([]AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	reader := bufio.NewReader(io.NewSectionReader(a.file, 0, 1<<62))
+	records := []AuditRecord{}
+	for len(records) < limit {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		var record AuditRecord
+		umErr := json.Unmarshal(bytes.TrimSpace(line), &record)
+		if umErr != nil {
+			return nil, fmt.Errorf("%s: %s", a.path, umErr.Error())
+		}
+		if auditMatches(record, key, since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
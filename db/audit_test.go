@@ -0,0 +1,89 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAudit checks an AuditLog by appending records and querying them. The
+// log must be empty.
+func testAudit(t *testing.T, log AuditLog) {
+	start := time.Now().UTC()
+	for i, key := range []string{"audit-a", "audit-b", "audit-a", ""} {
+		record := AuditRecord{Time: start.Add(time.Duration(i) * time.Second), Caller: "token:t1",
+			Method: "PUT", Path: "/v1/kv/" + key, Key: key, NewHash: HashValue(key), Status: 200}
+		appendErr := log.AppendAudit(record)
+		if appendErr != nil {
+			t.Fatalf("append audit: %s", appendErr.Error())
+		}
+	}
+
+	records, auditErr := log.Audit("", time.Time{}, 100)
+	if auditErr != nil || len(records) != 4 || records[1].Key != "audit-b" || !records[1].Time.Equal(start.Add(time.Second)) {
+		t.Errorf("audit: %+v %v", records, auditErr)
+	}
+	records, auditErr = log.Audit("audit-a", time.Time{}, 100)
+	if auditErr != nil || len(records) != 2 || records[1].NewHash != HashValue("audit-a") {
+		t.Errorf("audit of key: %+v %v", records, auditErr)
+	}
+	records, auditErr = log.Audit("audit-a", start.Add(time.Second), 100)
+	if auditErr != nil || len(records) != 1 || !records[0].Time.Equal(start.Add(2*time.Second)) {
+		t.Errorf("audit since: %+v %v", records, auditErr)
+	}
+	records, auditErr = log.Audit("", time.Time{}, 1)
+	if auditErr != nil || len(records) != 1 || records[0].Key != "audit-a" {
+		t.Errorf("audit limit: %+v %v", records, auditErr)
+	}
+}
+
+func TestAuditLogs(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("sqlite", func(t *testing.T) {
+		rscsDB, newErr := NewRscsDB(filepath.Join(dir, "audit.db"))
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		testAudit(t, rscsDB)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		testAudit(t, NewMemoryStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(dir, "audit.log")
+		fileStore, newErr := NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		testAudit(t, fileStore)
+		fileStore.Close()
+
+		// Simulate a crash part way through appending a record.
+		file, openErr := os.OpenFile(path+auditFileSuffix, os.O_WRONLY|os.O_APPEND, 0600)
+		if openErr != nil {
+			t.Fatalf("fail on open:%s", openErr.Error())
+		}
+		file.WriteString(`{"Time":"`)
+		file.Close()
+
+		fileStore, newErr = NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on reopen:%s", newErr.Error())
+		}
+		defer fileStore.Close()
+		fileStore.AppendAudit(AuditRecord{Time: time.Now(), Key: "audit-c", Status: 201})
+		records, auditErr := fileStore.Audit("", time.Time{}, 100)
+		if auditErr != nil || len(records) != 5 || records[4].Key != "audit-c" {
+			t.Errorf("audit after reopen: %+v %v", records, auditErr)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backuper is implemented by a Store that can take a consistent snapshot of
+// itself while in use and restore one. Every Store in this package is a
+// Backuper. A RscsDB snapshot is a SQLite database file; a MemoryStore or
+// FileStore snapshot is in the format of a FileStore file, so it can be
+// opened directly with NewFileStore.
+type Backuper interface {
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var (
+	_ Backuper = (*RscsDB)(nil)
+	_ Backuper = (*MemoryStore)(nil)
+	_ Backuper = (*FileStore)(nil)
+)
+
+// errTruncatedBackup is returned when restoring from an incomplete snapshot.
+var errTruncatedBackup = errors.New("backup is truncated")
+
+// Backup writes every revision in the store to w.
+func (m *MemoryStore) Backup(w io.Writer) error {
+	// Copy the log so that writes need not wait on a slow w.
+	m.mu.RLock()
+	writes := make([]memWrite, len(m.log))
+	for i, rev := range m.log {
+		writes[i].Revision = rev
+		if row, found := m.rows[rev.Key]; found && row.index == rev.Index {
+			writes[i].Expires = row.expires
+		}
+	}
+	m.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for len(writes) != 0 {
+		n := exportBatch
+		if n > len(writes) {
+			n = len(writes)
+		}
+		line, jsonErr := json.Marshal(writes[:n])
+		if jsonErr != nil {
+			return jsonErr
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+		writes = writes[n:]
+	}
+	return bw.Flush()
+}
+
+// Restore replaces the contents of the store with a snapshot written by
+// Backup. The store is unchanged if the snapshot cannot be read.
+func (m *MemoryStore) Restore(r io.Reader) error {
+	return m.restore(r, nil)
+}
+
+// restore loads a snapshot and, if commit succeeds with it, swaps it in.
+func (m *MemoryStore) restore(r io.Reader, commit func(restored *MemoryStore) error) error {
+	restored := NewMemoryStore()
+	_, partial, replayErr := restored.replay(r)
+	if replayErr != nil {
+		return replayErr
+	}
+	if partial {
+		return errTruncatedBackup
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if commit != nil {
+		commitErr := commit(restored)
+		if commitErr != nil {
+			return commitErr
+		}
+	}
+	m.rows, m.log, m.byKey = restored.rows, restored.log, restored.byKey
+	m.stats, m.expiring = restored.stats, restored.expiring
+	return nil
+}
+
+// Restore replaces the contents of the store, and its file, with a snapshot
+// written by Backup. The new file is written beside the old one and renamed
+// over it, so a failure leaves the store as it was.
+func (f *FileStore) Restore(r io.Reader) error {
+	return f.restore(r, func(restored *MemoryStore) error {
+		tmpFile, tmpErr := os.OpenFile(f.path+".restore", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if tmpErr != nil {
+			return tmpErr
+		}
+		backupErr := restored.Backup(tmpFile)
+		if backupErr == nil {
+			backupErr = tmpFile.Sync()
+		}
+		if backupErr == nil {
+			backupErr = os.Rename(tmpFile.Name(), f.path)
+		}
+		if backupErr != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return backupErr
+		}
+		size, seekErr := tmpFile.Seek(0, io.SeekEnd)
+		if seekErr != nil {
+			tmpFile.Close()
+			return seekErr
+		}
+		syncDir(f.path)
+		f.file.Close()
+		f.file, f.size = tmpFile, size
+		return nil
+	})
+}
+
+// syncDir syncs the directory holding path, so that a rename is durable.
+func syncDir(path string) {
+	dir, openErr := os.Open(filepath.Dir(path))
+	if openErr != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
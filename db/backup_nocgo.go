@@ -0,0 +1,22 @@
+//go:build !cgo
+// +build !cgo
+
+package db
+
+import (
+	"errors"
+	"io"
+)
+
+// errNoCgo is returned by RscsDB methods that need cgo.
+var errNoCgo = errors.New("sqlite backups need a cgo build")
+
+// Backup needs cgo for the SQLite online backup API.
+func (r *RscsDB) Backup(w io.Writer) error {
+	return errNoCgo
+}
+
+// Restore needs cgo for the SQLite online backup API.
+func (r *RscsDB) Restore(rd io.Reader) error {
+	return errNoCgo
+}
@@ -0,0 +1,162 @@
+//go:build cgo
+// +build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backup writes a consistent copy of the database to w as a SQLite file. It
+// is taken with the SQLite online backup API, so it is safe while the
+// database is in use, and writes wait until the copy is taken.
+func (r *RscsDB) Backup(w io.Writer) error {
+	defer r.observe("backup", time.Now())
+	tmpFile, tmpErr := ioutil.TempFile("", "rscs-backup")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	tmpDB, openErr := sql.Open("sqlite3", tmpFile.Name())
+	if openErr != nil {
+		return openErr
+	}
+	backupErr := copyDB(tmpDB, r.db)
+	tmpDB.Close()
+	if backupErr != nil {
+		return backupErr
+	}
+
+	backupFile, openErr := os.Open(tmpFile.Name())
+	if openErr != nil {
+		return openErr
+	}
+	defer backupFile.Close()
+	_, copyErr := io.Copy(w, backupFile)
+	return copyErr
+}
+
+// Restore replaces the contents of the database with a SQLite file written
+// by Backup. The file must pass SQLite's quick check and hold the kv and kv
+// history tables. The database is unchanged if the file cannot be read.
+func (r *RscsDB) Restore(rd io.Reader) error {
+	defer r.observe("restore", time.Now())
+	tmpFile, tmpErr := ioutil.TempFile("", "rscs-restore")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	defer os.Remove(tmpFile.Name())
+	_, copyErr := io.Copy(tmpFile, rd)
+	closeErr := tmpFile.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	sizeErr := checkSQLiteSize(tmpFile.Name())
+	if sizeErr != nil {
+		return sizeErr
+	}
+	tmpDB, openErr := sql.Open("sqlite3", tmpFile.Name())
+	if openErr != nil {
+		return openErr
+	}
+	defer tmpDB.Close()
+	var check string
+	checkErr := tmpDB.QueryRow("PRAGMA quick_check").Scan(&check)
+	if checkErr != nil {
+		return fmt.Errorf("not an rscs backup: %s", checkErr.Error())
+	}
+	if check != "ok" {
+		return fmt.Errorf("backup is corrupt: %s", check)
+	}
+	for _, table := range []string{KVTableName, HistoryTableName} {
+		var rowCount int
+		queryStr := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+		selectErr := tmpDB.QueryRow(queryStr).Scan(&rowCount)
+		if selectErr != nil {
+			return fmt.Errorf("not an rscs backup: %s", selectErr.Error())
+		}
+	}
+	copyErr = copyDB(r.db, tmpDB)
+	if copyErr != nil {
+		return copyErr
+	}
+	// A backup of a db from before tokens has no token table.
+	return r.createTokenTable()
+}
+
+// checkSQLiteSize compares the size of a SQLite file with the size recorded
+// in its header, which catches a truncated backup that would otherwise pass
+// a quick check.
+func checkSQLiteSize(path string) error {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	header := make([]byte, 100)
+	_, readErr := io.ReadFull(file, header)
+	if readErr != nil || string(header[:16]) != "SQLite format 3\x00" {
+		return errors.New("not an rscs backup: not a SQLite file")
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	pageSize := int64(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	pageCount := int64(binary.BigEndian.Uint32(header[28:32]))
+	if info.Size() != pageSize*pageCount {
+		return errTruncatedBackup
+	}
+	return nil
+}
+
+// copyDB copies the main database of src over that of dest with the SQLite
+// online backup API.
+func copyDB(dest, src *sql.DB) error {
+	ctx := context.Background()
+	destConn, destErr := dest.Conn(ctx)
+	if destErr != nil {
+		return destErr
+	}
+	defer destConn.Close()
+	srcConn, srcErr := src.Conn(ctx)
+	if srcErr != nil {
+		return srcErr
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, backupErr := destDriverConn.(*sqlite3.SQLiteConn).Backup("main",
+				srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if backupErr != nil {
+				return backupErr
+			}
+			_, stepErr := backup.Step(-1)
+			if stepErr != nil {
+				backup.Finish()
+				return stepErr
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	rscsDB, newErr := NewRscsDB(filepath.Join(dir, "backup.db"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	createErr := rscsDB.CreateTable()
+	if createErr != nil {
+		t.Fatalf("fail on create table:%s", createErr.Error())
+	}
+	fileStore, newErr := NewFileStore(filepath.Join(dir, "backup.log"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	defer fileStore.Close()
+
+	stores := map[string]Store{"sqlite": rscsDB, "memory": NewMemoryStore(), "file": fileStore}
+	for name, store := range stores {
+		backuper := store.(Backuper)
+		store.Insert("backup-a", "1")
+		store.InsertTTL("backup-b", "2", time.Hour)
+
+		var buf bytes.Buffer
+		backupErr := backuper.Backup(&buf)
+		if backupErr != nil {
+			t.Errorf("%s backup:%s", name, backupErr.Error())
+			continue
+		}
+		snapshot := buf.Bytes()
+
+		store.Update("backup-a", "changed")
+		store.Delete("backup-b")
+		restoreErr := backuper.Restore(bytes.NewReader(snapshot))
+		if restoreErr != nil {
+			t.Errorf("%s restore:%s", name, restoreErr.Error())
+			continue
+		}
+		value, found, _ := store.Get("backup-a")
+		if !found || value != "1" {
+			t.Errorf("%s restored value: %s %v", name, value, found)
+		}
+		entry, found, _ := store.GetEntry("backup-b")
+		if !found || entry.Expires.IsZero() {
+			t.Errorf("%s restored expiry: %+v %v", name, entry, found)
+		}
+		if index, _ := store.CurrentIndex(); index != 2 {
+			t.Errorf("%s restored index: %d", name, index)
+		}
+
+		restoreErr = backuper.Restore(bytes.NewReader(snapshot[:len(snapshot)-1]))
+		if restoreErr == nil {
+			t.Errorf("%s restore of truncated backup", name)
+		}
+		value, _, _ = store.Get("backup-a")
+		if value != "1" {
+			t.Errorf("%s failed restore changed the store", name)
+		}
+	}
+
+	// The file store's file must hold the restored contents.
+	fileStore.Update("backup-a", "after restore")
+	reopened, reopenErr := NewFileStore(filepath.Join(dir, "backup.log"))
+	if reopenErr != nil {
+		t.Fatalf("fail on reopen:%s", reopenErr.Error())
+	}
+	defer reopened.Close()
+	revisions, _ := reopened.History("backup-a")
+	if len(revisions) != 2 || revisions[1].Value != "after restore" {
+		t.Errorf("reopened history: %+v", revisions)
+	}
+}
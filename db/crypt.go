@@ -0,0 +1,517 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MasterKeyEnv names the environment variable master keys are read from
+	// when no key file is given. It holds one or more keys separated by
+	// commas, the current key first.
+	MasterKeyEnv = "RSCS_MASTER_KEY"
+	// MasterKeyLen is the length of a master key in bytes before encoding.
+	MasterKeyLen = 32
+	// sealedPrefix starts every encrypted value. It is followed by the ID of
+	// the master key, the data key wrapped by the master key, and the value
+	// sealed by the data key, separated by ':'.
+	sealedPrefix = "rscs:aesgcm:v1:"
+	// rekeyBatch is how many rows Rekey rewrites in each transaction.
+	rekeyBatch = 100
+)
+
+// errNoKeyring is returned when reading an encrypted value without keys.
+var errNoKeyring = errors.New("value is encrypted and no master key is loaded")
+
+// Keyring holds the master keys values are encrypted under. Each value is
+// sealed with AES-GCM under its own random data key, and the data key is
+// sealed under the current master key. Older master keys are kept so values
+// sealed under them can still be read until Rekey rewraps them.
+type Keyring struct {
+	source func() ([]byte, error)
+	file   string // empty if the keys came from MasterKeyEnv
+	mu     sync.RWMutex
+	keys   map[string]cipher.AEAD
+	// current is the ID of the key new values are sealed under.
+	current string
+	// loaded is the modification time and size of file when it was read.
+	loaded time.Time
+	size   int64
+}
+
+// NewMasterKey returns a random master key, hex encoded as it is written in
+// a key file.
+func NewMasterKey() (string, error) {
+	return randomHex(MasterKeyLen)
+}
+
+// LoadKeyring reads master keys from keyFile, one per line with the current
+// key first, or from MasterKeyEnv if keyFile is empty. Keys are hex or
+// base64 encoded. It returns nil if keyFile is empty and MasterKeyEnv is
+// unset, meaning values are not encrypted. A keyring read from a file is
+// read again before sealing a value if the file has changed, and whenever a
+// value sealed under an unknown key is met, so keys can be rotated without
+// a restart.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	source := func() ([]byte, error) {
+		return ioutil.ReadFile(keyFile)
+	}
+	if keyFile == "" {
+		env := os.Getenv(MasterKeyEnv)
+		if env == "" {
+			return nil, nil
+		}
+		source = func() ([]byte, error) {
+			return []byte(strings.Replace(env, ",", "\n", -1)), nil
+		}
+	}
+	k := &Keyring{source: source, file: keyFile}
+	loadErr := k.Reload()
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	return k, nil
+}
+
+// Reload reads the keys from the keyring's file or MasterKeyEnv again. If
+// they cannot be read the keys already loaded are kept.
+func (k *Keyring) Reload() error {
+	var info os.FileInfo
+	if k.file != "" {
+		var statErr error
+		info, statErr = os.Stat(k.file)
+		if statErr != nil {
+			return statErr
+		}
+	}
+	keyBytes, readErr := k.source()
+	if readErr != nil {
+		return readErr
+	}
+	keys := make(map[string]cipher.AEAD)
+	current := ""
+	for _, line := range strings.Split(string(keyBytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, decodeErr := decodeMasterKey(line)
+		if decodeErr != nil {
+			return decodeErr
+		}
+		aead, aeadErr := newAEAD(key)
+		if aeadErr != nil {
+			return aeadErr
+		}
+		id := keyID(key)
+		keys[id] = aead
+		if current == "" {
+			current = id
+		}
+	}
+	if current == "" {
+		return errors.New("no master key found")
+	}
+	k.mu.Lock()
+	k.keys, k.current = keys, current
+	if info != nil {
+		k.loaded, k.size = info.ModTime(), info.Size()
+	}
+	k.mu.Unlock()
+	return nil
+}
+
+// refresh reloads a keyring read from a file if the file has changed since
+// it was read, so values are sealed under a new current key as soon as it
+// is written there.
+func (k *Keyring) refresh() error {
+	if k.file == "" {
+		return nil
+	}
+	info, statErr := os.Stat(k.file)
+	if statErr != nil {
+		return statErr
+	}
+	k.mu.RLock()
+	changed := !info.ModTime().Equal(k.loaded) || info.Size() != k.size
+	k.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return k.Reload()
+}
+
+// decodeMasterKey decodes a hex or base64 master key.
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, hexErr := hex.DecodeString(encoded)
+	if hexErr != nil {
+		var b64Err error
+		key, b64Err = base64.StdEncoding.DecodeString(encoded)
+		if b64Err != nil {
+			return nil, errors.New("master key must be hex or base64 encoded")
+		}
+	}
+	if len(key) != MasterKeyLen {
+		return nil, fmt.Errorf("master key must be %d bytes", MasterKeyLen)
+	}
+	return key, nil
+}
+
+// keyID names a master key without revealing it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// newAEAD returns AES-GCM under key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWith encrypts plaintext under aead with a random nonce, which is
+// prepended to the result.
+func sealWith(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, readErr := io.ReadFull(rand.Reader, nonce)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// openWith decrypts what sealWith returned.
+func openWith(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is truncated")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// masterKey returns the AEAD of the master key with the given ID, reloading
+// the keyring once if it is unknown.
+func (k *Keyring) masterKey(id string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	aead, found := k.keys[id]
+	k.mu.RUnlock()
+	if found {
+		return aead, nil
+	}
+	reloadErr := k.Reload()
+	if reloadErr != nil {
+		return nil, reloadErr
+	}
+	k.mu.RLock()
+	aead, found = k.keys[id]
+	k.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("no master key '%s' loaded", id)
+	}
+	return aead, nil
+}
+
+// currentKey returns the ID and AEAD of the current master key.
+func (k *Keyring) currentKey() (string, cipher.AEAD) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// seal encrypts the value of key under a new data key wrapped by the
+// current master key. The key is bound to the result, so a sealed value
+// cannot be moved to another key.
+func (k *Keyring) seal(key, value string) (string, error) {
+	refreshErr := k.refresh()
+	if refreshErr != nil {
+		return "", refreshErr
+	}
+	dataKey := make([]byte, MasterKeyLen)
+	_, readErr := io.ReadFull(rand.Reader, dataKey)
+	if readErr != nil {
+		return "", readErr
+	}
+	dataAEAD, aeadErr := newAEAD(dataKey)
+	if aeadErr != nil {
+		return "", aeadErr
+	}
+	sealedValue, sealErr := sealWith(dataAEAD, []byte(value), []byte(key))
+	if sealErr != nil {
+		return "", sealErr
+	}
+	id, master := k.currentKey()
+	wrapped, wrapErr := sealWith(master, dataKey, []byte(key))
+	if wrapErr != nil {
+		return "", wrapErr
+	}
+	return sealedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), nil
+}
+
+// sealedLenSQL is an SQL expression for the length of the plaintext of the
+// sealed value in column, which follows from the length of the value: less
+// the prefix, key ID, wrapped data key and separators, it is the base64 of
+// the plaintext with a GCM nonce and tag.
+func sealedLenSQL(column string) string {
+	const nonceLen, tagLen = 12, 16
+	overhead := len(sealedPrefix) + hex.EncodedLen(4) + 1 +
+		base64.RawStdEncoding.EncodedLen(nonceLen+MasterKeyLen+tagLen) + 1
+	return fmt.Sprintf("((length(%s) - %d) * 3 / 4 - %d)", column, overhead, nonceLen+tagLen)
+}
+
+// sealedParts splits a sealed value into the master key ID, the wrapped
+// data key and the sealed value.
+func sealedParts(stored string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("sealed value is malformed")
+	}
+	wrapped, wrappedErr := base64.RawStdEncoding.DecodeString(parts[1])
+	if wrappedErr != nil {
+		return "", nil, nil, wrappedErr
+	}
+	sealedValue, sealedErr := base64.RawStdEncoding.DecodeString(parts[2])
+	if sealedErr != nil {
+		return "", nil, nil, sealedErr
+	}
+	return parts[0], wrapped, sealedValue, nil
+}
+
+// unwrap returns the data key of a sealed value.
+func (k *Keyring) unwrap(key, id string, wrapped []byte) ([]byte, error) {
+	master, masterErr := k.masterKey(id)
+	if masterErr != nil {
+		return nil, masterErr
+	}
+	dataKey, openErr := openWith(master, wrapped, []byte(key))
+	if openErr != nil {
+		return nil, fmt.Errorf("cannot unwrap data key of '%s': %s", key, openErr.Error())
+	}
+	return dataKey, nil
+}
+
+// open decrypts a value sealed by seal.
+func (k *Keyring) open(key, stored string) (string, error) {
+	id, wrapped, sealedValue, partsErr := sealedParts(stored)
+	if partsErr != nil {
+		return "", partsErr
+	}
+	dataKey, unwrapErr := k.unwrap(key, id, wrapped)
+	if unwrapErr != nil {
+		return "", unwrapErr
+	}
+	dataAEAD, aeadErr := newAEAD(dataKey)
+	if aeadErr != nil {
+		return "", aeadErr
+	}
+	value, openErr := openWith(dataAEAD, sealedValue, []byte(key))
+	if openErr != nil {
+		return "", fmt.Errorf("cannot decrypt '%s': %s", key, openErr.Error())
+	}
+	return string(value), nil
+}
+
+// rewrap returns stored sealed under the current master key, and whether
+// that changed it. Only the data key is rewrapped; a value that is not
+// sealed is sealed in full.
+func (k *Keyring) rewrap(key, stored string) (string, bool, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		sealed, sealErr := k.seal(key, stored)
+		return sealed, sealErr == nil, sealErr
+	}
+	refreshErr := k.refresh()
+	if refreshErr != nil {
+		return "", false, refreshErr
+	}
+	id, wrapped, sealedValue, partsErr := sealedParts(stored)
+	if partsErr != nil {
+		return "", false, partsErr
+	}
+	currentID, master := k.currentKey()
+	if id == currentID {
+		return stored, false, nil
+	}
+	dataKey, unwrapErr := k.unwrap(key, id, wrapped)
+	if unwrapErr != nil {
+		return "", false, unwrapErr
+	}
+	rewrapped, wrapErr := sealWith(master, dataKey, []byte(key))
+	if wrapErr != nil {
+		return "", false, wrapErr
+	}
+	return sealedPrefix + currentID + ":" + base64.RawStdEncoding.EncodeToString(rewrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), true, nil
+}
+
+// SetKeyring makes the RscsDB encrypt every value it writes under keyring,
+// and decrypt the values it reads. Values written before are read as they
+// are until Rekey encrypts them. A nil keyring turns encryption off, after
+// which encrypted values cannot be read. Call it before the RscsDB is used.
+func (r *RscsDB) SetKeyring(keyring *Keyring) {
+	r.keyring = keyring
+}
+
+// seal encrypts the value of key for storage, if there is a keyring.
+// Without one a value that looks encrypted is refused, as it would be read
+// back as one.
+func (r *RscsDB) seal(key, value string) (string, error) {
+	if r.keyring == nil {
+		if strings.HasPrefix(value, sealedPrefix) {
+			return "", &KeyError{Op: "write", Key: key, Err: ErrReservedValue}
+		}
+		return value, nil
+	}
+	return r.keyring.seal(key, value)
+}
+
+// open decrypts the stored value of key. Values that are not encrypted are
+// returned as they are.
+func (r *RscsDB) open(key, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	if r.keyring == nil {
+		return "", errNoKeyring
+	}
+	return r.keyring.open(key, stored)
+}
+
+// openRevisions decrypts the values of revisions in place.
+func (r *RscsDB) openRevisions(revisions []Revision) error {
+	for i := range revisions {
+		if revisions[i].Deleted {
+			continue
+		}
+		value, openErr := r.open(revisions[i].Key, revisions[i].Value)
+		if openErr != nil {
+			return openErr
+		}
+		revisions[i].Value = value
+	}
+	return nil
+}
+
+// Rekey seals every value in the kv and kv history tables under the current
+// master key, including values written before encryption was turned on. It
+// only rewraps the data key of a value that is already sealed. Rows are
+// rewritten a batch at a time, and only if unchanged since they were read,
+// so it is safe while the database is in use by a daemon reading the same
+// key file, which reloads it when it changes. A daemon whose keys come from
+// MasterKeyEnv must be restarted with the new current key first, or it
+// goes on sealing values under the old one. It returns the number of rows
+// rewritten.
+func (r *RscsDB) Rekey() (int, error) {
+	if r.keyring == nil {
+		return 0, errors.New("rekey needs a master key")
+	}
+	rewritten := 0
+	for _, table := range []struct{ name, idColumn string }{
+		{KVTableName, KVPrimaryKeyColumn},
+		{HistoryTableName, HistoryIDColumn},
+	} {
+		var after interface{} = ""
+		if table.name == HistoryTableName {
+			after = int64(0)
+		}
+		for {
+			count, last, batchErr := r.rekeyBatch(table.name, table.idColumn, after)
+			if batchErr != nil {
+				return rewritten, batchErr
+			}
+			rewritten += count
+			if last == nil {
+				break
+			}
+			after = last
+		}
+	}
+	return rewritten, nil
+}
+
+// rekeyBatch rewraps up to rekeyBatch rows of table whose idColumn sorts
+// after after. It returns how many rows it rewrote and the id of the last
+// row read, which is nil once there are no more rows.
+func (r *RscsDB) rekeyBatch(table, idColumn string, after interface{}) (int, interface{}, error) {
+	var count int
+	var last interface{}
+	batchErr := r.withTx(func(tx *sql.Tx) error {
+		queryStr := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s > $1 ORDER BY %s LIMIT $2",
+			idColumn, KVPrimaryKeyColumn, KVValueColumn, table, idColumn, idColumn)
+		if idColumn == KVPrimaryKeyColumn {
+			queryStr = fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s > $1 ORDER BY %s LIMIT $2",
+				KVPrimaryKeyColumn, KVValueColumn, table, idColumn, idColumn)
+		}
+		rows, selectErr := tx.Query(queryStr, after, rekeyBatch)
+		if selectErr != nil {
+			return selectErr
+		}
+		type row struct {
+			id         interface{}
+			key, value string
+		}
+		var batch []row
+		for rows.Next() {
+			var rw row
+			var scanErr error
+			if idColumn == KVPrimaryKeyColumn {
+				scanErr = rows.Scan(&rw.key, &rw.value)
+				rw.id = rw.key
+			} else {
+				var id int64
+				scanErr = rows.Scan(&id, &rw.key, &rw.value)
+				rw.id = id
+			}
+			if scanErr != nil {
+				rows.Close()
+				return scanErr
+			}
+			batch = append(batch, rw)
+		}
+		rows.Close()
+		rowsErr := rows.Err()
+		if rowsErr != nil {
+			return rowsErr
+		}
+		for _, rw := range batch {
+			last = rw.id
+			if table == HistoryTableName && rw.value == "" {
+				// Deletes record no value.
+				continue
+			}
+			rewrapped, changed, rewrapErr := r.keyring.rewrap(rw.key, rw.value)
+			if rewrapErr != nil {
+				return rewrapErr
+			}
+			if !changed {
+				continue
+			}
+			updateStr := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3",
+				table, KVValueColumn, idColumn, KVValueColumn)
+			rowCount, execErr := execRowCount(tx, updateStr, rewrapped, rw.id, rw.value)
+			if execErr != nil {
+				return execErr
+			}
+			count += rowCount
+		}
+		return nil
+	})
+	if batchErr != nil {
+		return 0, nil, batchErr
+	}
+	return count, last, nil
+}
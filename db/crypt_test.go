@@ -0,0 +1,204 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	rscsDB, newErr := NewRscsDB(filepath.Join(dir, "crypt.db"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	createErr := rscsDB.CreateTable()
+	if createErr != nil {
+		t.Fatalf("fail on create table:%s", createErr.Error())
+	}
+	rscsDB.Insert("plain", "before encryption")
+
+	oldKey, _ := NewMasterKey()
+	keyFile := filepath.Join(dir, "keys")
+	ioutil.WriteFile(keyFile, []byte(oldKey+"\n"), 0600)
+	keyring, keyringErr := LoadKeyring(keyFile)
+	if keyringErr != nil {
+		t.Fatalf("load keyring:%s", keyringErr.Error())
+	}
+	rscsDB.SetKeyring(keyring)
+
+	rscsDB.Insert("secret", "hunter2")
+	rscsDB.Update("secret", "hunter3")
+	rscsDB.Txn([]Op{{Type: OpInsert, Key: "txn", Value: "in a txn"}})
+	raw := func(key string) string {
+		var stored string
+		rscsDB.db.QueryRow("SELECT value FROM kv WHERE key = $1", key).Scan(&stored)
+		return stored
+	}
+	if !strings.HasPrefix(raw("secret"), sealedPrefix) || strings.Contains(raw("secret"), "hunter") {
+		t.Errorf("value stored in the clear: %s", raw("secret"))
+	}
+	if value, _, _ := rscsDB.Get("secret"); value != "hunter3" {
+		t.Errorf("get: %s", value)
+	}
+	if value, _, _ := rscsDB.Get("plain"); value != "before encryption" {
+		t.Errorf("get unencrypted: %s", value)
+	}
+	if value, _, _ := rscsDB.GetRevision("secret", 1); value != "hunter2" {
+		t.Errorf("get revision: %s", value)
+	}
+	results, _ := rscsDB.Txn([]Op{{Type: OpGet, Key: "txn"}})
+	if len(results) != 1 || results[0].Value != "in a txn" {
+		t.Errorf("txn get: %+v", results)
+	}
+	changes, _ := rscsDB.Changes("secret", 0, 10)
+	if len(changes) != 2 || changes[1].Value != "hunter3" {
+		t.Errorf("changes: %+v", changes)
+	}
+	rscsDB.db.Exec("UPDATE kv SET value = (SELECT value FROM kv WHERE key = 'secret') WHERE key = 'txn'")
+	if _, _, getErr := rscsDB.Get("txn"); getErr == nil {
+		t.Errorf("value moved between keys was decrypted")
+	}
+	rscsDB.Update("txn", "in a txn")
+
+	// A second handle stands in for a daemon that loaded only the old key.
+	daemon, _ := NewRscsDB(filepath.Join(dir, "crypt.db"))
+	daemonKeyring, _ := LoadKeyring(keyFile)
+	daemon.SetKeyring(daemonKeyring)
+
+	newKey, _ := NewMasterKey()
+	ioutil.WriteFile(keyFile, []byte(newKey+"\n"+oldKey+"\n"), 0600)
+	rekeyring, _ := LoadKeyring(keyFile)
+	rscsDB.SetKeyring(rekeyring)
+	rewritten, rekeyErr := rscsDB.Rekey()
+	if rekeyErr != nil {
+		t.Fatalf("rekey:%s", rekeyErr.Error())
+	}
+	if rewritten != 8 {
+		t.Errorf("rekey rewrote %d rows", rewritten)
+	}
+	newID, _ := decodeMasterKey(newKey)
+	for _, key := range []string{"plain", "secret", "txn"} {
+		if !strings.HasPrefix(raw(key), sealedPrefix+keyID(newID)+":") {
+			t.Errorf("%s not under the new key: %s", key, raw(key))
+		}
+	}
+	if rewritten, _ = rscsDB.Rekey(); rewritten != 0 {
+		t.Errorf("second rekey rewrote %d rows", rewritten)
+	}
+	if value, _, getErr := daemon.Get("secret"); value != "hunter3" {
+		t.Errorf("daemon get after rekey: %s %v", value, getErr)
+	}
+
+	ioutil.WriteFile(keyFile, []byte(newKey+"\n"), 0600)
+	rscsDB.SetKeyring(nil)
+	if _, _, getErr := rscsDB.Get("secret"); getErr == nil {
+		t.Errorf("encrypted value read without a key")
+	}
+
+	for _, bad := range []string{"", "abcd", strings.Repeat("zz", MasterKeyLen)} {
+		ioutil.WriteFile(keyFile, []byte(bad), 0600)
+		if _, badErr := LoadKeyring(keyFile); badErr == nil {
+			t.Errorf("loaded bad key '%s'", bad)
+		}
+	}
+	os.Setenv(MasterKeyEnv, newKey+","+oldKey)
+	defer os.Unsetenv(MasterKeyEnv)
+	envKeyring, envErr := LoadKeyring("")
+	if envErr != nil || envKeyring == nil || len(envKeyring.keys) != 2 {
+		t.Errorf("env keyring: %v", envErr)
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	dir := t.TempDir()
+	rscsDB, newErr := NewRscsDB(filepath.Join(dir, "crypt.db"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	createErr := rscsDB.CreateTable()
+	if createErr != nil {
+		t.Fatalf("fail on create table:%s", createErr.Error())
+	}
+	raw := func(key string) string {
+		var stored string
+		rscsDB.db.QueryRow("SELECT value FROM kv WHERE key = $1", key).Scan(&stored)
+		return stored
+	}
+	sealedUnder := func(key, masterKey string) bool {
+		decoded, _ := decodeMasterKey(masterKey)
+		return strings.HasPrefix(raw(key), sealedPrefix+keyID(decoded)+":")
+	}
+
+	// Without a keyring, a value that looks sealed would not read back.
+	_, insertErr := rscsDB.Insert("looks-sealed", sealedPrefix+"x:y:z")
+	if !errors.Is(insertErr, ErrReservedValue) {
+		t.Errorf("insert of a sealed-looking value returned %v", insertErr)
+	}
+	_, txnErr := rscsDB.Txn([]Op{{Type: OpInsert, Key: "looks-sealed", Value: sealedPrefix}})
+	if !errors.Is(txnErr, ErrReservedValue) {
+		t.Errorf("txn insert of a sealed-looking value returned %v", txnErr)
+	}
+
+	oldKey, _ := NewMasterKey()
+	keyFile := filepath.Join(dir, "keys")
+	ioutil.WriteFile(keyFile, []byte(oldKey+"\n"), 0600)
+	keyring, keyringErr := LoadKeyring(keyFile)
+	if keyringErr != nil {
+		t.Fatalf("load keyring:%s", keyringErr.Error())
+	}
+	rscsDB.SetKeyring(keyring)
+
+	// With one it is sealed like any other.
+	_, insertErr = rscsDB.Insert("looks-sealed", sealedPrefix+"x:y:z")
+	if insertErr != nil {
+		t.Fatalf("insert of a sealed-looking value with a key:%s", insertErr.Error())
+	}
+	if value, _, _ := rscsDB.Get("looks-sealed"); value != sealedPrefix+"x:y:z" {
+		t.Errorf("get of a sealed-looking value: %s", value)
+	}
+
+	rscsDB.Insert("a", "1")
+	if !sealedUnder("a", oldKey) {
+		t.Errorf("a not under the old key: %s", raw("a"))
+	}
+
+	// A new current key is used as soon as it is written to the file.
+	newKey, _ := NewMasterKey()
+	ioutil.WriteFile(keyFile, []byte(newKey+"\n"+oldKey+"\n"), 0600)
+	rscsDB.Insert("b", "2")
+	if !sealedUnder("b", newKey) {
+		t.Errorf("b not under the new key: %s", raw("b"))
+	}
+	if value, _, _ := rscsDB.Get("a"); value != "1" {
+		t.Errorf("get under the old key: %s", value)
+	}
+
+	// A file that cannot be read keeps the keys loaded, but writes fail
+	// until it is fixed rather than sealing under a stale key.
+	ioutil.WriteFile(keyFile, []byte("not a key\n"), 0600)
+	if reloadErr := keyring.Reload(); reloadErr == nil {
+		t.Errorf("reloaded a bad key file")
+	}
+	if _, insertErr = rscsDB.Insert("c", "3"); insertErr == nil {
+		t.Errorf("insert with a bad key file")
+	}
+	if value, _, _ := rscsDB.Get("b"); value != "2" {
+		t.Errorf("get with a bad key file: %s", value)
+	}
+	ioutil.WriteFile(keyFile, []byte(newKey+"\n"), 0600)
+	if reloadErr := keyring.Reload(); reloadErr != nil {
+		t.Errorf("reload:%s", reloadErr.Error())
+	}
+	if _, insertErr = rscsDB.Insert("c", "3"); insertErr != nil || !sealedUnder("c", newKey) {
+		t.Errorf("insert after the key file was fixed: %v %s", insertErr, raw("c"))
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3" //
 )
 
@@ -17,12 +19,37 @@ const (
 	KVPrimaryKeyColumn = "key"
 	// KVValueColumn is the KV value.
 	KVValueColumn = "value"
+	// KVIndexColumn is the modification index of the last write to the row.
+	KVIndexColumn = "modindex"
+	// KVExpiresColumn is when the row expires in unix nanoseconds, or zero.
+	KVExpiresColumn = "expires"
+	// KVExpiresIndex indexes the rows that expire, for PurgeExpired.
+	KVExpiresIndex = "kv_expires"
 )
 
+// kvAddedColumns are the columns added to the kv table since it was first
+// made, with their definitions, in the order they were added.
+var kvAddedColumns = []struct{ name, definition string }{
+	{KVIndexColumn, "INTEGER NOT NULL DEFAULT 0"},
+	{KVExpiresColumn, "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// Entry is a single key/value row. Index is the modification index of the
+// last write to the row; indexes increase monotonically across all keys.
+// Expires is the zero time for a row that never expires.
+type Entry struct {
+	Key     string
+	Value   string
+	Index   int64
+	Expires time.Time
+}
+
 // RscsDB contains the state values for communicating with the underlying sqlite file.
 type RscsDB struct {
 	sqliteDBFile string
 	db           *sql.DB
+	keyring      *Keyring   // nil unless values are encrypted; see SetKeyring
+	observer     OpObserver // nil unless set by SetOpObserver
 }
 
 // NewRscsDB initializes a new RscsDB instance.
@@ -31,9 +58,80 @@ func NewRscsDB(sqliteDBFile string) (*RscsDB, error) {
 	if connErr != nil {
 		return nil, connErr
 	}
-	return &RscsDB{
+	// SQLite allows one writer at a time anyway. Sharing a single connection
+	// keeps concurrent readers (such as watches) from failing with "database
+	// is locked" while a write transaction is open.
+	db.SetMaxOpenConns(1)
+	rscsDB := &RscsDB{
 		sqliteDBFile: sqliteDBFile,
-		db:           db}, nil
+		db:           db}
+	migrateErr := rscsDB.migrate()
+	if migrateErr != nil {
+		db.Close()
+		return nil, migrateErr
+	}
+	return rscsDB, nil
+}
+
+// migrate brings the tables of a db made by an older rscs up to date. The
+// token table is created for any db, but a db without a kv table is
+// otherwise left for CreateTable.
+func (r *RscsDB) migrate() error {
+	tokenErr := r.createTokenTable()
+	if tokenErr != nil {
+		return tokenErr
+	}
+	var tableCount int
+	queryStr := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1"
+	countErr := r.db.QueryRow(queryStr, KVTableName).Scan(&tableCount)
+	if countErr != nil || tableCount == 0 {
+		return countErr
+	}
+
+	rows, columnsErr := r.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", KVTableName))
+	if columnsErr != nil {
+		return columnsErr
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var dflt sql.NullString
+		scanErr := rows.Scan(&cid, &name, &columnType, &notNull, &dflt, &pk)
+		if scanErr != nil {
+			rows.Close()
+			return scanErr
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	rowsErr := rows.Err()
+	if rowsErr != nil {
+		return rowsErr
+	}
+	for _, column := range kvAddedColumns {
+		if columns[column.name] {
+			continue
+		}
+		_, alterErr := r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", KVTableName, column.name, column.definition))
+		if alterErr != nil {
+			return alterErr
+		}
+	}
+
+	indexErr := r.createExpiresIndex()
+	if indexErr != nil {
+		return indexErr
+	}
+	return r.createHistoryTable()
+}
+
+// createExpiresIndex indexes the rows that expire, if they are not already.
+func (r *RscsDB) createExpiresIndex() error {
+	queryStr := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s) WHERE %s != 0",
+		KVExpiresIndex, KVTableName, KVExpiresColumn, KVExpiresColumn)
+	_, createErr := r.db.Exec(queryStr)
+	return createErr
 }
 
 // DBFileName returns the db used.
@@ -41,34 +139,51 @@ func (r *RscsDB) DBFileName() string {
 	return r.sqliteDBFile
 }
 
-// CreateTable will create a new kv table. You will need to DROP independently if needed.
+// CreateTable will create new kv and kv history tables. You will need to DROP
+// independently if needed.
 func (r *RscsDB) CreateTable() error {
-	queryStr := fmt.Sprintf("CREATE TABLE %s (%s VARCHAR(255) PRIMARY KEY, %s TEXT NOT NULL)",
-		KVTableName, KVPrimaryKeyColumn, KVValueColumn)
+	queryStr := fmt.Sprintf("CREATE TABLE %s (%s VARCHAR(255) PRIMARY KEY, %s TEXT NOT NULL, %s INTEGER NOT NULL DEFAULT 0, %s INTEGER NOT NULL DEFAULT 0)",
+		KVTableName, KVPrimaryKeyColumn, KVValueColumn, KVIndexColumn, KVExpiresColumn)
 	_, createErr := r.db.Exec(queryStr)
-	return createErr
+	if createErr != nil {
+		return createErr
+	}
+	indexErr := r.createExpiresIndex()
+	if indexErr != nil {
+		return indexErr
+	}
+	return r.createHistoryTable()
 }
 
-// DropTable will drop the kv table.
+// DropTable will drop the kv and kv history tables.
 func (r *RscsDB) DropTable() error {
 	queryStr := fmt.Sprintf("DROP TABLE %s", KVTableName)
 	_, dropErr := r.db.Exec(queryStr)
-	return dropErr
+	if dropErr != nil {
+		return dropErr
+	}
+	return r.dropHistoryTable()
 }
 
-// Insert will insert a new key/value pair.
-func (r *RscsDB) Insert(key, value string) (int, error) {
-	if key == "" {
-		return 0, errors.New("insert empty key")
+// withTx runs f inside a transaction, committing only if f returns no error.
+func (r *RscsDB) withTx(f func(tx *sql.Tx) error) error {
+	tx, beginErr := r.db.Begin()
+	if beginErr != nil {
+		return beginErr
 	}
-	if len(key) > 255 {
-		return 0, errors.New("key exceeds len")
+	fErr := f(tx)
+	if fErr != nil {
+		tx.Rollback()
+		return fErr
 	}
-	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES ($1, $2)",
-		KVTableName, KVPrimaryKeyColumn, KVValueColumn)
-	result, insertErr := r.db.Exec(queryStr, key, value)
-	if insertErr != nil {
-		return 0, insertErr
+	return tx.Commit()
+}
+
+// execRowCount runs a statement in tx and returns the number of rows it affected.
+func execRowCount(tx *sql.Tx, queryStr string, args ...interface{}) (int, error) {
+	result, execErr := tx.Exec(queryStr, args...)
+	if execErr != nil {
+		return 0, execErr
 	}
 	rowCount, rowCountErr := result.RowsAffected()
 	if rowCountErr != nil {
@@ -77,59 +192,382 @@ func (r *RscsDB) Insert(key, value string) (int, error) {
 	return int(rowCount), nil
 }
 
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkKey validates a key passed to op.
+func checkKey(op, key string) error {
+	if key == "" {
+		return emptyKeyError(op)
+	}
+	if len(key) > MaxKeyLen {
+		return &KeyError{Op: op, Key: key, Err: ErrKeyTooLong}
+	}
+	return nil
+}
+
+// checkTTL validates a ttl passed to a write.
+func checkTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("negative ttl")
+	}
+	return nil
+}
+
+// rowCountOf converts the index returned by a write helper into the row count
+// reported by the public write methods: zero if nothing was written.
+func rowCountOf(index int64) int {
+	if index == 0 {
+		return 0
+	}
+	return 1
+}
+
+// Insert will insert a new key/value pair.
+func (r *RscsDB) Insert(key, value string) (int, error) {
+	return r.InsertTTL(key, value, 0)
+}
+
+// InsertTTL will insert a new key/value pair that expires after ttl. A zero
+// ttl never expires.
+func (r *RscsDB) InsertTTL(key, value string, ttl time.Duration) (int, error) {
+	defer r.observe("insert", time.Now())
+	keyErr := checkKey("insert", key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
+	}
+	stored, sealErr := r.seal(key, value)
+	if sealErr != nil {
+		return 0, sealErr
+	}
+	now := time.Now()
+	var index int64
+	insertErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		index, execErr = insertTx(tx, key, stored, expiresAt(now, ttl), now)
+		return execErr
+	})
+	if insertErr != nil {
+		return 0, insertErr
+	}
+	return rowCountOf(index), nil
+}
+
+// insertTx inserts a new key in tx, first purging it if it has expired, and
+// records the revision. It is an ErrExists error if the key exists. The new
+// modification index is returned.
+func insertTx(tx *sql.Tx, key, value string, expires int64, now time.Time) (int64, error) {
+	index, createErr := createTx(tx, key, value, expires, now)
+	if createErr == nil && index == 0 {
+		return 0, &KeyError{Op: "insert", Key: key, Err: ErrExists}
+	}
+	return index, createErr
+}
+
+// createTx is like insertTx but returns a zero index instead of an error if
+// the key exists.
+func createTx(tx *sql.Tx, key, value string, expires int64, now time.Time) (int64, error) {
+	purgeErr := purgeExpiredKeyTx(tx, key, now)
+	if purgeErr != nil {
+		return 0, purgeErr
+	}
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s) SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s = $1)",
+		KVTableName, KVPrimaryKeyColumn, KVValueColumn, KVExpiresColumn,
+		KVTableName, KVPrimaryKeyColumn)
+	rowCount, execErr := execRowCount(tx, queryStr, key, value, expires)
+	if execErr != nil || rowCount == 0 {
+		return 0, execErr
+	}
+	return recordRevision(tx, key, value, false)
+}
+
 // Delete will delete a row with ID key.
 func (r *RscsDB) Delete(key string) (int, error) {
+	defer r.observe("delete", time.Now())
 	if key == "" {
-		return 0, errors.New("delete empty key")
+		return 0, emptyKeyError("delete")
 	}
-	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = $1",
-		KVTableName, KVPrimaryKeyColumn)
-	result, deleteErr := r.db.Exec(queryStr, key)
+	now := time.Now()
+	var index int64
+	deleteErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		index, execErr = deleteTx(tx, key, 0, now)
+		return execErr
+	})
 	if deleteErr != nil {
 		return 0, deleteErr
 	}
-	rowCount, rowCountErr := result.RowsAffected()
-	if rowCountErr != nil {
-		return 0, rowCountErr
+	return rowCountOf(index), nil
+}
+
+// deleteTx deletes an unexpired key in tx and records the revision. If
+// expectedIndex is not zero the row must also have that modification index.
+// The index of the delete is returned, or zero if nothing was deleted.
+func deleteTx(tx *sql.Tx, key string, expectedIndex int64, now time.Time) (int64, error) {
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND %s AND ($3 = 0 OR %s = $3)",
+		KVTableName, KVPrimaryKeyColumn, unexpired("$2"), KVIndexColumn)
+	rowCount, execErr := execRowCount(tx, queryStr, key, now.UnixNano(), expectedIndex)
+	if execErr != nil || rowCount == 0 {
+		return 0, execErr
 	}
-	return int(rowCount), nil
+	return recordRevision(tx, key, "", true)
 }
 
-// Update will give a row a new value.
+// Update will give a row a new value. Any expiry the row had is cleared.
 func (r *RscsDB) Update(key, value string) (int, error) {
+	return r.UpdateTTL(key, value, 0)
+}
+
+// UpdateTTL will give a row a new value that expires after ttl, replacing
+// any previous expiry. A zero ttl never expires.
+func (r *RscsDB) UpdateTTL(key, value string, ttl time.Duration) (int, error) {
+	defer r.observe("update", time.Now())
 	if key == "" {
-		return 0, errors.New("update empty key")
+		return 0, emptyKeyError("update")
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
 	}
-	queryStr := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s is $2",
-		KVTableName, KVValueColumn, KVPrimaryKeyColumn)
-	result, updateErr := r.db.Exec(queryStr, value, key)
+	stored, sealErr := r.seal(key, value)
+	if sealErr != nil {
+		return 0, sealErr
+	}
+	now := time.Now()
+	var index int64
+	updateErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		index, execErr = updateTx(tx, key, stored, expiresAt(now, ttl), 0, now)
+		return execErr
+	})
 	if updateErr != nil {
 		return 0, updateErr
 	}
-	rowCount, rowCountErr := result.RowsAffected()
-	if rowCountErr != nil {
-		return 0, rowCountErr
+	return rowCountOf(index), nil
+}
+
+// updateTx sets a new value and expiry for an existing, unexpired key in tx
+// and records the revision. If expectedIndex is not zero the row must also
+// have that modification index. The new modification index is returned, or
+// zero if nothing was updated.
+func updateTx(tx *sql.Tx, key, value string, expires, expectedIndex int64, now time.Time) (int64, error) {
+	queryStr := fmt.Sprintf("UPDATE %s SET %s = $1, %s = $2 WHERE %s is $3 AND %s AND ($5 = 0 OR %s = $5)",
+		KVTableName, KVValueColumn, KVExpiresColumn, KVPrimaryKeyColumn,
+		unexpired("$4"), KVIndexColumn)
+	rowCount, execErr := execRowCount(tx, queryStr, value, expires, key, now.UnixNano(), expectedIndex)
+	if execErr != nil || rowCount == 0 {
+		return 0, execErr
 	}
-	return int(rowCount), nil
+	return recordRevision(tx, key, value, false)
 }
 
 // Get returns the value string for the key string. The second return
 // value is a 'found' flag that easily distinguishes a db error case
 // from that of no matching row.
 func (r *RscsDB) Get(key string) (string, bool, error) {
+	entry, found, getErr := r.GetEntry(key)
+	return entry.Value, found, getErr
+}
+
+// GetEntry is like Get but returns the whole row, including its
+// modification index and expiry.
+func (r *RscsDB) GetEntry(key string) (Entry, bool, error) {
+	defer r.observe("get", time.Now())
 	if key == "" {
-		return "", false, errors.New("key is an empty string")
+		return Entry{}, false, emptyKeyError("get")
+	}
+	entry, found, getErr := getTx(r.db, key, time.Now())
+	if getErr != nil || !found {
+		return entry, found, getErr
 	}
-	queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE %s=?",
-		KVValueColumn, KVTableName, KVPrimaryKeyColumn)
-	var value string
-	selectErr := r.db.QueryRow(queryStr, key).Scan(&value)
+	entry.Value, getErr = r.open(key, entry.Value)
+	if getErr != nil {
+		return Entry{}, false, getErr
+	}
+	return entry, true, nil
+}
+
+// getTx reads an unexpired row.
+func getTx(q queryRower, key string, now time.Time) (Entry, bool, error) {
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s=$1 AND %s",
+		KVValueColumn, KVIndexColumn, KVExpiresColumn, KVTableName,
+		KVPrimaryKeyColumn, unexpired("$2"))
+	entry := Entry{Key: key}
+	var expires int64
+	selectErr := q.QueryRow(queryStr, key, now.UnixNano()).Scan(&entry.Value, &entry.Index, &expires)
 	switch {
 	case selectErr == sql.ErrNoRows:
-		return "", false, nil
+		return Entry{}, false, nil
 	case selectErr != nil:
-		return "", false, selectErr
+		return Entry{}, false, selectErr
 	default:
-		return value, true, nil
+		entry.Expires = expiresTime(expires)
+		return entry, true, nil
+	}
+}
+
+// List returns up to limit entries whose keys begin with prefix, in key
+// order, starting with the first key that sorts after the key after. An empty
+// prefix matches every key and an empty after starts from the beginning. The
+// second return value reports whether more matching entries remain beyond
+// those returned, in which case the Key of the last entry can be passed as
+// after to fetch the next page.
+func (r *RscsDB) List(prefix, after string, limit int) ([]Entry, bool, error) {
+	defer r.observe("list", time.Now())
+	if limit < 1 {
+		return nil, false, errors.New("list limit must be positive")
+	}
+	// Bound the keys by range rather than by comparing their prefix, so the
+	// primary key index is searched instead of the whole table.
+	where, args := fmt.Sprintf("%s >= $1", KVPrimaryKeyColumn), []interface{}{prefix}
+	if after >= prefix {
+		where, args = fmt.Sprintf("%s > $1", KVPrimaryKeyColumn), []interface{}{after}
+	}
+	if end := prefixEnd(prefix); end != "" {
+		args = append(args, end)
+		where += fmt.Sprintf(" AND %s < $%d", KVPrimaryKeyColumn, len(args))
+	}
+	args = append(args, time.Now().UnixNano())
+	where += " AND " + unexpired(fmt.Sprintf("$%d", len(args)))
+	// Ask for one extra row so we know if there is another page.
+	args = append(args, limit+1)
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s WHERE %s ORDER BY %s LIMIT $%d",
+		KVPrimaryKeyColumn, KVValueColumn, KVIndexColumn, KVExpiresColumn, KVTableName,
+		where, KVPrimaryKeyColumn, len(args))
+	rows, selectErr := r.db.Query(queryStr, args...)
+	if selectErr != nil {
+		return nil, false, selectErr
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var expires int64
+		scanErr := rows.Scan(&e.Key, &e.Value, &e.Index, &expires)
+		if scanErr != nil {
+			return nil, false, scanErr
+		}
+		var openErr error
+		e.Value, openErr = r.open(e.Key, e.Value)
+		if openErr != nil {
+			return nil, false, openErr
+		}
+		e.Expires = expiresTime(expires)
+		entries = append(entries, e)
+	}
+	rowsErr := rows.Err()
+	if rowsErr != nil {
+		return nil, false, rowsErr
+	}
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// prefixEnd returns the least string greater than every string beginning
+// with prefix, or "" if there is none, as when prefix is empty or all 0xff.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// namespaceStats counts the keys and value bytes of a namespace in one
+// query. The length of an encrypted value's plaintext is worked out from
+// the length of the value, so nothing is decrypted.
+func (r *RscsDB) namespaceStats(prefix string) (NamespaceStats, error) {
+	defer r.observe("stats", time.Now())
+	// The default namespace is every key outside the reserved range.
+	inRange := fmt.Sprintf("(%s < $2 OR %s >= $3)", KVPrimaryKeyColumn, KVPrimaryKeyColumn)
+	from, to := nsRegistryPrefix, nsReservedEnd
+	if prefix != "" {
+		inRange = fmt.Sprintf("(%s >= $2 AND %s < $3)", KVPrimaryKeyColumn, KVPrimaryKeyColumn)
+		from, to = prefix, prefixEnd(prefix)
+	}
+	queryStr := fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(CASE WHEN substr(%s, 1, %d) = $1 THEN %s ELSE length(CAST(%s AS BLOB)) END), 0) FROM %s WHERE %s AND %s",
+		KVValueColumn, len(sealedPrefix), sealedLenSQL(KVValueColumn), KVValueColumn,
+		KVTableName, inRange, unexpired("$4"))
+	var stats NamespaceStats
+	scanErr := r.db.QueryRow(queryStr, sealedPrefix, from, to, time.Now().UnixNano()).Scan(&stats.Keys, &stats.Bytes)
+	if scanErr != nil {
+		return NamespaceStats{}, scanErr
+	}
+	return stats, nil
+}
+
+// CompareAndSwap sets a new value for key only if the row's modification
+// index is still expectedIndex. An expectedIndex of zero means the key must
+// not exist yet, in which case it is inserted. A zero row count means the
+// swap did not happen because the index did not match.
+func (r *RscsDB) CompareAndSwap(key string, expectedIndex int64, value string) (int, error) {
+	return r.CompareAndSwapTTL(key, expectedIndex, value, 0)
+}
+
+// CompareAndSwapTTL is like CompareAndSwap but the new value expires after
+// ttl. A zero ttl never expires.
+func (r *RscsDB) CompareAndSwapTTL(key string, expectedIndex int64, value string, ttl time.Duration) (int, error) {
+	defer r.observe("compare_and_swap", time.Now())
+	keyErr := checkKey("compare and swap", key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
+	}
+	stored, sealErr := r.seal(key, value)
+	if sealErr != nil {
+		return 0, sealErr
+	}
+	now := time.Now()
+	var index int64
+	casErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		if expectedIndex == 0 {
+			index, execErr = createTx(tx, key, stored, expiresAt(now, ttl), now)
+		} else {
+			index, execErr = updateTx(tx, key, stored, expiresAt(now, ttl), expectedIndex, now)
+		}
+		return execErr
+	})
+	if casErr != nil {
+		return 0, casErr
+	}
+	return rowCountOf(index), nil
+}
+
+// CompareAndDelete deletes key only if the row's modification index is still
+// expectedIndex. A zero row count means the key was not deleted.
+func (r *RscsDB) CompareAndDelete(key string, expectedIndex int64) (int, error) {
+	defer r.observe("compare_and_delete", time.Now())
+	if key == "" {
+		return 0, emptyKeyError("compare and delete")
+	}
+	if expectedIndex == 0 {
+		// No row has a zero index.
+		return 0, nil
+	}
+	now := time.Now()
+	var index int64
+	deleteErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		index, execErr = deleteTx(tx, key, expectedIndex, now)
+		return execErr
+	})
+	if deleteErr != nil {
+		return 0, deleteErr
 	}
+	return rowCountOf(index), nil
 }
@@ -5,10 +5,14 @@ package db
 
 import (
 	"bytes"
+	"database/sql"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -190,6 +194,492 @@ func TestWithTempDB(t *testing.T) {
 			t.Errorf("%s found?", badKey)
 		}
 	})
+
+	t.Run("list", func(t *testing.T) {
+		_, _, listErr := rscsDB.List("", "", 0)
+		if listErr == nil {
+			t.Errorf("list with zero limit")
+		}
+
+		listKeys := []string{"list/c", "list/a", "list/b", "lisu"}
+		for _, k := range listKeys {
+			_, insertErr := rscsDB.Insert(k, k+"-value")
+			if insertErr != nil {
+				t.Fatalf("insert fail:%s", insertErr.Error())
+			}
+		}
+
+		entries, more, listErr := rscsDB.List("list/", "", 2)
+		if listErr != nil {
+			t.Fatalf("list fail:%s", listErr.Error())
+		}
+		if !more {
+			t.Errorf("list should have more")
+		}
+		if len(entries) != 2 || entries[0].Key != "list/a" || entries[1].Key != "list/b" {
+			t.Errorf("list first page:%v", entries)
+		}
+		if entries[0].Value != "list/a-value" {
+			t.Errorf("list value:%s", entries[0].Value)
+		}
+
+		entries, more, listErr = rscsDB.List("list/", entries[1].Key, 2)
+		if listErr != nil {
+			t.Fatalf("list fail:%s", listErr.Error())
+		}
+		if more {
+			t.Errorf("list should not have more")
+		}
+		if len(entries) != 1 || entries[0].Key != "list/c" {
+			t.Errorf("list second page:%v", entries)
+		}
+
+		entries, _, listErr = rscsDB.List("nothing-here/", "", 10)
+		if listErr != nil {
+			t.Fatalf("list fail:%s", listErr.Error())
+		}
+		if len(entries) != 0 {
+			t.Errorf("list unmatched prefix:%v", entries)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		const histKey = "histkey"
+		_, historyErr := rscsDB.History("")
+		if historyErr == nil {
+			t.Errorf("history empty key")
+		}
+
+		_, insertErr := rscsDB.Insert(histKey, "v1")
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		_, updateErr := rscsDB.Update(histKey, "v2")
+		if updateErr != nil {
+			t.Fatalf("update fail:%s", updateErr.Error())
+		}
+		_, deleteErr := rscsDB.Delete(histKey)
+		if deleteErr != nil {
+			t.Fatalf("delete fail:%s", deleteErr.Error())
+		}
+
+		revisions, historyErr := rscsDB.History(histKey)
+		if historyErr != nil {
+			t.Fatalf("history fail:%s", historyErr.Error())
+		}
+		if len(revisions) != 3 {
+			t.Fatalf("history len:%d", len(revisions))
+		}
+		for i, rev := range revisions {
+			if rev.Revision != i+1 {
+				t.Errorf("history revision %d numbered %d", i, rev.Revision)
+			}
+			if rev.Modified.IsZero() {
+				t.Errorf("history revision %d has no time", i)
+			}
+		}
+		if revisions[1].Value != "v2" || revisions[1].Deleted {
+			t.Errorf("history revision 2:%v", revisions[1])
+		}
+		if !revisions[2].Deleted {
+			t.Errorf("history revision 3 not deleted")
+		}
+
+		value, found, getErr := rscsDB.GetRevision(histKey, 1)
+		if getErr != nil {
+			t.Errorf("get revision fail:%s", getErr.Error())
+		}
+		if !found || value != "v1" {
+			t.Errorf("get revision 1:%s %v", value, found)
+		}
+		_, found, getErr = rscsDB.GetRevision(histKey, 3)
+		if getErr != nil {
+			t.Errorf("get revision fail:%s", getErr.Error())
+		}
+		if found {
+			t.Errorf("get deleted revision found")
+		}
+
+		rowCount, rollbackErr := rscsDB.Rollback(histKey, 3)
+		if rollbackErr == nil {
+			t.Errorf("rollback to deleted revision")
+		}
+		rowCount, rollbackErr = rscsDB.Rollback(histKey, 99)
+		if rollbackErr != nil {
+			t.Errorf("rollback fail:%s", rollbackErr.Error())
+		}
+		if rowCount != 0 {
+			t.Errorf("rollback missing revision rowcount:%d", rowCount)
+		}
+		rowCount, rollbackErr = rscsDB.Rollback(histKey, 1)
+		if rollbackErr != nil {
+			t.Fatalf("rollback fail:%s", rollbackErr.Error())
+		}
+		if rowCount != 1 {
+			t.Errorf("rollback rowcount:%d", rowCount)
+		}
+		value, found, getErr = rscsDB.Get(histKey)
+		if getErr != nil || !found || value != "v1" {
+			t.Errorf("rollback not restored:%s", value)
+		}
+		rowCount, rollbackErr = rscsDB.Rollback(histKey, 2)
+		if rollbackErr != nil || rowCount != 1 {
+			t.Errorf("rollback existing key:%d", rowCount)
+		}
+
+		revisions, historyErr = rscsDB.History(histKey)
+		if historyErr != nil {
+			t.Fatalf("history fail:%s", historyErr.Error())
+		}
+		if len(revisions) != 5 || revisions[4].Value != "v2" {
+			t.Errorf("rollback revisions:%v", revisions)
+		}
+		for i := 1; i < len(revisions); i++ {
+			if revisions[i].Index <= revisions[i-1].Index {
+				t.Errorf("revision indexes not increasing:%v", revisions)
+			}
+		}
+	})
+
+	t.Run("compare-and-swap", func(t *testing.T) {
+		const casKey = "caskey"
+		rowCount, casErr := rscsDB.CompareAndSwap("", 0, "v")
+		if casErr == nil {
+			t.Errorf("compare and swap empty key")
+		}
+
+		rowCount, casErr = rscsDB.CompareAndSwap(casKey, 0, "v1")
+		if casErr != nil {
+			t.Fatalf("compare and swap fail:%s", casErr.Error())
+		}
+		if rowCount != 1 {
+			t.Errorf("compare and swap create rowcount:%d", rowCount)
+		}
+		rowCount, casErr = rscsDB.CompareAndSwap(casKey, 0, "v1")
+		if casErr != nil || rowCount != 0 {
+			t.Errorf("compare and swap created existing key")
+		}
+
+		entry, found, getErr := rscsDB.GetEntry(casKey)
+		if getErr != nil || !found {
+			t.Fatalf("get entry fail")
+		}
+		if entry.Value != "v1" || entry.Index == 0 {
+			t.Errorf("get entry:%v", entry)
+		}
+
+		rowCount, casErr = rscsDB.CompareAndSwap(casKey, entry.Index+1, "v2")
+		if casErr != nil || rowCount != 0 {
+			t.Errorf("compare and swap with stale index")
+		}
+		rowCount, casErr = rscsDB.CompareAndSwap(casKey, entry.Index, "v2")
+		if casErr != nil || rowCount != 1 {
+			t.Errorf("compare and swap with current index")
+		}
+
+		swapped, _, getErr := rscsDB.GetEntry(casKey)
+		if getErr != nil || swapped.Value != "v2" || swapped.Index <= entry.Index {
+			t.Errorf("compare and swap entry:%v", swapped)
+		}
+
+		rowCount, casErr = rscsDB.CompareAndDelete(casKey, entry.Index)
+		if casErr != nil || rowCount != 0 {
+			t.Errorf("compare and delete with stale index")
+		}
+		rowCount, casErr = rscsDB.CompareAndDelete(casKey, swapped.Index)
+		if casErr != nil || rowCount != 1 {
+			t.Errorf("compare and delete with current index")
+		}
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		const changesKey = "changeskey"
+		_, changesErr := rscsDB.Changes("", 0, 0)
+		if changesErr == nil {
+			t.Errorf("changes with zero limit")
+		}
+
+		since, indexErr := rscsDB.CurrentIndex()
+		if indexErr != nil {
+			t.Fatalf("current index fail:%s", indexErr.Error())
+		}
+		lastIndex, indexErr := rscsDB.LastIndex(changesKey)
+		if indexErr != nil || lastIndex != 0 {
+			t.Errorf("last index of unwritten key:%d", lastIndex)
+		}
+
+		_, insertErr := rscsDB.Insert(changesKey, "v1")
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		_, insertErr = rscsDB.Insert("otherkey", "v1")
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		_, deleteErr := rscsDB.Delete(changesKey)
+		if deleteErr != nil {
+			t.Fatalf("delete fail:%s", deleteErr.Error())
+		}
+
+		changes, changesErr := rscsDB.Changes("", since, 10)
+		if changesErr != nil {
+			t.Fatalf("changes fail:%s", changesErr.Error())
+		}
+		if len(changes) != 3 {
+			t.Fatalf("changes len:%d", len(changes))
+		}
+		changes, changesErr = rscsDB.Changes("changes", since, 10)
+		if changesErr != nil {
+			t.Fatalf("changes fail:%s", changesErr.Error())
+		}
+		if len(changes) != 2 || changes[0].Value != "v1" || !changes[1].Deleted {
+			t.Errorf("changes by prefix:%v", changes)
+		}
+		changes, changesErr = rscsDB.Changes("changes", changes[0].Index, 10)
+		if changesErr != nil || len(changes) != 1 {
+			t.Errorf("changes since index:%v", changes)
+		}
+
+		current, indexErr := rscsDB.CurrentIndex()
+		if indexErr != nil || current != changes[0].Index {
+			t.Errorf("current index:%d", current)
+		}
+		lastIndex, indexErr = rscsDB.LastIndex(changesKey)
+		if indexErr != nil || lastIndex != changes[0].Index {
+			t.Errorf("last index:%d", lastIndex)
+		}
+	})
+
+	t.Run("prune-history", func(t *testing.T) {
+		const pruneKey, prunedKey = "prunekey", "prunedkey"
+		_, pruneErr := rscsDB.PruneHistory(0, 0)
+		if pruneErr == nil {
+			t.Errorf("prune history keeping no revisions")
+		}
+
+		_, insertErr := rscsDB.Insert(pruneKey, "v1")
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		for _, value := range []string{"v2", "v3", "v4", "v5"} {
+			_, updateErr := rscsDB.Update(pruneKey, value)
+			if updateErr != nil {
+				t.Fatalf("update fail:%s", updateErr.Error())
+			}
+		}
+		_, insertErr = rscsDB.Insert(prunedKey, "v1")
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		_, updateErr := rscsDB.Update(prunedKey, "v2")
+		if updateErr != nil {
+			t.Fatalf("update fail:%s", updateErr.Error())
+		}
+		_, deleteErr := rscsDB.Delete(prunedKey)
+		if deleteErr != nil {
+			t.Fatalf("delete fail:%s", deleteErr.Error())
+		}
+		current, indexErr := rscsDB.CurrentIndex()
+		if indexErr != nil {
+			t.Fatalf("current index fail:%s", indexErr.Error())
+		}
+		lastIndex, indexErr := rscsDB.LastIndex(pruneKey)
+		if indexErr != nil {
+			t.Fatalf("last index fail:%s", indexErr.Error())
+		}
+
+		rowCount, pruneErr := rscsDB.PruneHistory(2, 0)
+		if pruneErr != nil || rowCount < 4 {
+			t.Fatalf("prune history:%d %v", rowCount, pruneErr)
+		}
+		for _, c := range []struct {
+			key       string
+			revisions []int
+			deleted   bool
+		}{
+			{pruneKey, []int{4, 5}, false},
+			{prunedKey, []int{2, 3}, true},
+		} {
+			revisions, historyErr := rscsDB.History(c.key)
+			if historyErr != nil || len(revisions) != len(c.revisions) {
+				t.Errorf("%s: pruned history:%v", c.key, revisions)
+				continue
+			}
+			for i, rev := range revisions {
+				if rev.Revision != c.revisions[i] {
+					t.Errorf("%s: pruned revision %d:%d", c.key, i, rev.Revision)
+				}
+			}
+			if revisions[len(revisions)-1].Deleted != c.deleted {
+				t.Errorf("%s: newest revision deleted:%v", c.key, !c.deleted)
+			}
+		}
+		_, found, getErr := rscsDB.GetRevision(pruneKey, 1)
+		if getErr != nil || found {
+			t.Errorf("get pruned revision")
+		}
+
+		index, indexErr := rscsDB.CurrentIndex()
+		if indexErr != nil || index != current {
+			t.Errorf("current index after prune:%d", index)
+		}
+		index, indexErr = rscsDB.LastIndex(pruneKey)
+		if indexErr != nil || index != lastIndex {
+			t.Errorf("last index after prune:%d", index)
+		}
+		_, updateErr = rscsDB.Update(pruneKey, "v6")
+		if updateErr != nil {
+			t.Fatalf("update fail:%s", updateErr.Error())
+		}
+		revisions, historyErr := rscsDB.History(pruneKey)
+		if historyErr != nil || len(revisions) != 3 || revisions[2].Revision != 6 {
+			t.Errorf("revision after prune:%v", revisions)
+		}
+
+		// Only keys written after since are looked at.
+		rowCount, pruneErr = rscsDB.PruneHistory(1, current)
+		if pruneErr != nil || rowCount != 2 {
+			t.Errorf("prune history since:%d %v", rowCount, pruneErr)
+		}
+		revisions, historyErr = rscsDB.History(prunedKey)
+		if historyErr != nil || len(revisions) != 2 {
+			t.Errorf("history of key not written since:%v", revisions)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		const ttlKey = "ttlkey"
+		const ttl = 50 * time.Millisecond
+		_, insertErr := rscsDB.InsertTTL(ttlKey, "v1", -ttl)
+		if insertErr == nil {
+			t.Errorf("insert with negative ttl")
+		}
+
+		_, insertErr = rscsDB.InsertTTL(ttlKey, "v1", ttl)
+		if insertErr != nil {
+			t.Fatalf("insert fail:%s", insertErr.Error())
+		}
+		entry, found, getErr := rscsDB.GetEntry(ttlKey)
+		if getErr != nil || !found {
+			t.Fatalf("get entry fail")
+		}
+		if entry.Expires.IsZero() || entry.Expires.After(time.Now().Add(ttl)) {
+			t.Errorf("entry expires:%v", entry.Expires)
+		}
+
+		time.Sleep(2 * ttl)
+		_, found, getErr = rscsDB.Get(ttlKey)
+		if getErr != nil || found {
+			t.Errorf("expired key found")
+		}
+		entries, _, listErr := rscsDB.List(ttlKey, "", 10)
+		if listErr != nil || len(entries) != 0 {
+			t.Errorf("expired key listed")
+		}
+		rowCount, updateErr := rscsDB.Update(ttlKey, "v2")
+		if updateErr != nil || rowCount != 0 {
+			t.Errorf("expired key updated")
+		}
+
+		// An expired key can be inserted again before it is purged.
+		rowCount, insertErr = rscsDB.Insert(ttlKey, "v3")
+		if insertErr != nil || rowCount != 1 {
+			t.Fatalf("insert over expired key")
+		}
+		entry, found, getErr = rscsDB.GetEntry(ttlKey)
+		if getErr != nil || !found || !entry.Expires.IsZero() {
+			t.Errorf("reinserted key:%v", entry)
+		}
+		rowCount, updateErr = rscsDB.UpdateTTL(ttlKey, "v4", ttl)
+		if updateErr != nil || rowCount != 1 {
+			t.Errorf("update ttl fail")
+		}
+
+		time.Sleep(2 * ttl)
+		rowCount, purgeErr := rscsDB.PurgeExpired()
+		if purgeErr != nil {
+			t.Fatalf("purge fail:%s", purgeErr.Error())
+		}
+		if rowCount != 1 {
+			t.Errorf("purge rowcount:%d", rowCount)
+		}
+		revisions, historyErr := rscsDB.History(ttlKey)
+		if historyErr != nil {
+			t.Fatalf("history fail:%s", historyErr.Error())
+		}
+		// insert, expiry, insert, update, expiry
+		if len(revisions) != 5 || !revisions[1].Deleted || !revisions[4].Deleted {
+			t.Errorf("ttl revisions:%v", revisions)
+		}
+	})
+
+	t.Run("txn", func(t *testing.T) {
+		_, txnErr := rscsDB.Txn([]Op{{Type: "frob", Key: "txn1"}})
+		if _, ok := txnErr.(*TxnError); !ok {
+			t.Errorf("txn with unknown op:%v", txnErr)
+		}
+
+		results, txnErr := rscsDB.Txn([]Op{
+			{Type: OpInsert, Key: "txn1", Value: "a"},
+			{Type: OpInsert, Key: "txn2", Value: "b"},
+			{Type: OpGet, Key: "txn1"},
+			{Type: OpGet, Key: "txn3"},
+		})
+		if txnErr != nil {
+			t.Fatalf("txn fail:%s", txnErr.Error())
+		}
+		if len(results) != 4 || results[0].Index == 0 || !results[2].Found || results[2].Value != "a" {
+			t.Errorf("txn results:%v", results)
+		}
+		if results[3].Found {
+			t.Errorf("txn get of missing key found")
+		}
+		txn1Index := results[2].Index
+
+		// The failing delete must roll back the update before it.
+		_, txnErr = rscsDB.Txn([]Op{
+			{Type: OpUpdate, Key: "txn1", Value: "changed"},
+			{Type: OpDelete, Key: "txn3"},
+		})
+		failed, ok := txnErr.(*TxnError)
+		if !ok || failed.Op != 1 {
+			t.Fatalf("txn with missing delete:%v", txnErr)
+		}
+		value, _, _ := rscsDB.Get("txn1")
+		if value != "a" {
+			t.Errorf("failed txn was not rolled back:%s", value)
+		}
+
+		_, txnErr = rscsDB.Txn([]Op{
+			{Type: OpCheck, Key: "txn1", Index: txn1Index + 100},
+			{Type: OpDelete, Key: "txn1"},
+		})
+		if failed, ok = txnErr.(*TxnError); !ok || failed.Op != 0 {
+			t.Errorf("txn with failed check:%v", txnErr)
+		}
+		_, txnErr = rscsDB.Txn([]Op{{Type: OpInsert, Key: "txn2", Value: "dup"}})
+		if _, ok = txnErr.(*TxnError); !ok {
+			t.Errorf("txn insert of existing key:%v", txnErr)
+		}
+
+		results, txnErr = rscsDB.Txn([]Op{
+			{Type: OpCheck, Key: "txn1", Index: txn1Index},
+			{Type: OpCheck, Key: "txn3", Index: 0},
+			{Type: OpUpdate, Key: "txn1", Value: "c", Index: txn1Index},
+			{Type: OpDelete, Key: "txn2"},
+		})
+		if txnErr != nil {
+			t.Fatalf("txn fail:%s", txnErr.Error())
+		}
+		if results[2].Index <= txn1Index || results[3].Found {
+			t.Errorf("txn write results:%v", results)
+		}
+		value, _, _ = rscsDB.Get("txn1")
+		_, found, _ := rscsDB.Get("txn2")
+		if value != "c" || found {
+			t.Errorf("txn not applied")
+		}
+	})
 }
 
 func TestWithReadonlyTempDB(t *testing.T) {
@@ -266,6 +756,123 @@ func TestWithReadonlyTempDB(t *testing.T) {
 	}
 }
 
+// oldSchemaDB returns the path of a new db file holding schema, as made by
+// an older rscs.
+func oldSchemaDB(t *testing.T, schema ...string) string {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("tempdir: %s", dirErr.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dbFile := filepath.Join(dir, "old.sqlite3")
+	oldDB, openErr := sql.Open("sqlite3", dbFile)
+	if openErr != nil {
+		t.Fatalf("open: %s", openErr.Error())
+	}
+	defer oldDB.Close()
+	for _, statement := range schema {
+		_, execErr := oldDB.Exec(statement)
+		if execErr != nil {
+			t.Fatalf("%s: %s", statement, execErr.Error())
+		}
+	}
+	return dbFile
+}
+
+func TestMigrateHistory(t *testing.T) {
+	dbFile := oldSchemaDB(t,
+		"CREATE TABLE kv (key VARCHAR(255) PRIMARY KEY, value TEXT NOT NULL, modindex INTEGER NOT NULL DEFAULT 0, expires INTEGER NOT NULL DEFAULT 0)",
+		"INSERT INTO kv (key, value) VALUES ('old', 'v')")
+	rscsDB, newErr := NewRscsDB(dbFile)
+	if newErr != nil {
+		t.Fatalf("open db without history: %s", newErr.Error())
+	}
+	if _, insertErr := rscsDB.Insert("new", "v"); insertErr != nil {
+		t.Errorf("insert: %s", insertErr.Error())
+	}
+	if _, updateErr := rscsDB.Update("old", "v2"); updateErr != nil {
+		t.Errorf("update: %s", updateErr.Error())
+	}
+	if _, deleteErr := rscsDB.Delete("new"); deleteErr != nil {
+		t.Errorf("delete: %s", deleteErr.Error())
+	}
+	revisions, historyErr := rscsDB.History("old")
+	if historyErr != nil || len(revisions) != 1 || revisions[0].Value != "v2" {
+		t.Errorf("history: %v %v", revisions, historyErr)
+	}
+}
+
+func TestMigrateExpires(t *testing.T) {
+	dbFile := oldSchemaDB(t,
+		"CREATE TABLE kv (key VARCHAR(255) PRIMARY KEY, value TEXT NOT NULL, modindex INTEGER NOT NULL DEFAULT 0)",
+		"INSERT INTO kv (key, value, modindex) VALUES ('old', 'v', 0)")
+	rscsDB, newErr := NewRscsDB(dbFile)
+	if newErr != nil {
+		t.Fatalf("open db without expires: %s", newErr.Error())
+	}
+	if _, insertErr := rscsDB.InsertTTL("new", "v", time.Millisecond); insertErr != nil {
+		t.Errorf("insert: %s", insertErr.Error())
+	}
+	if _, upsertErr := rscsDB.Upsert("old", "v2"); upsertErr != nil {
+		t.Errorf("upsert: %s", upsertErr.Error())
+	}
+	time.Sleep(5 * time.Millisecond)
+	purged, purgeErr := rscsDB.PurgeExpired()
+	if purgeErr != nil || purged != 1 {
+		t.Errorf("purge: %d %v", purged, purgeErr)
+	}
+	entry, found, getErr := rscsDB.GetEntry("old")
+	if getErr != nil || !found || entry.Value != "v2" || !entry.Expires.IsZero() {
+		t.Errorf("get: %+v %v %v", entry, found, getErr)
+	}
+
+	// PurgeExpired finds expiring rows by index rather than by scanning.
+	var detail string
+	planErr := rscsDB.db.QueryRow("EXPLAIN QUERY PLAN SELECT key FROM kv WHERE expires != 0 AND expires <= 1").
+		Scan(new(int), new(int), new(int), &detail)
+	if planErr != nil || !strings.Contains(detail, KVExpiresIndex) {
+		t.Errorf("purge query plan: %s %v", detail, planErr)
+	}
+}
+
+func TestMigrateFixture(t *testing.T) {
+	// The checked-in fixture predates modification indexes and expiry.
+	fixture, readErr := ioutil.ReadFile(filepath.Join("..", "test", "test-db.sqlite3"))
+	if readErr != nil {
+		t.Fatalf("read fixture: %s", readErr.Error())
+	}
+	dbFile := oldSchemaDB(t)
+	if writeErr := ioutil.WriteFile(dbFile, fixture, 0600); writeErr != nil {
+		t.Fatalf("copy fixture: %s", writeErr.Error())
+	}
+	rscsDB, newErr := NewRscsDB(dbFile)
+	if newErr != nil {
+		t.Fatalf("open fixture: %s", newErr.Error())
+	}
+
+	value, found, getErr := rscsDB.Get("test1")
+	if getErr != nil || !found || value != "val1" {
+		t.Errorf("get: %s %v %v", value, found, getErr)
+	}
+	entries, _, listErr := rscsDB.List("", "", 10)
+	if listErr != nil || len(entries) != 2 || entries[0].Key != "key2" {
+		t.Errorf("list: %+v %v", entries, listErr)
+	}
+
+	// Writes stamp rows with an index, so compare-and-swap works on them.
+	if _, updateErr := rscsDB.Update("key2", "val3"); updateErr != nil {
+		t.Fatalf("update: %s", updateErr.Error())
+	}
+	entry, _, _ := rscsDB.GetEntry("key2")
+	if entry.Index == 0 {
+		t.Errorf("update did not set an index")
+	}
+	rowCount, casErr := rscsDB.CompareAndSwap("key2", entry.Index, "val4")
+	if casErr != nil || rowCount != 1 {
+		t.Errorf("cas: %d %v", rowCount, casErr)
+	}
+}
+
 func Example() {
 	rscsDB, newErr := NewRscsDB("file::memory:?mode=memory&cache=shared")
 	if newErr != nil {
@@ -329,3 +936,51 @@ func Example() {
 		log.Fatalf("delete rowcount:%d", rowCount)
 	}
 }
+
+func TestListRange(t *testing.T) {
+	for _, c := range []struct{ prefix, end string }{
+		{"", ""},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"a\xfe\xff", "a\xff"},
+		{"\xff\xff", ""},
+		{nsKeyPrefix + "team" + nsKeyPrefix, nsKeyPrefix + "team\x20"},
+	} {
+		if end := prefixEnd(c.prefix); end != c.end {
+			t.Errorf("end of %q: %q, want %q", c.prefix, end, c.end)
+		}
+	}
+
+	rscsDB, newErr := NewRscsDB(filepath.Join(t.TempDir(), "list.db"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	rscsDB.CreateTable()
+	for _, key := range []string{"a", "a\xff", "a\xff\x01", "ab", "b", "\xff", "\xff\xff"} {
+		rscsDB.Insert(key, "v")
+	}
+	for _, c := range []struct {
+		prefix, after string
+		limit         int
+		want          []string
+		more          bool
+	}{
+		{prefix: "a", limit: 10, want: []string{"a", "ab", "a\xff", "a\xff\x01"}},
+		{prefix: "a\xff", limit: 10, want: []string{"a\xff", "a\xff\x01"}},
+		{prefix: "\xff", limit: 10, want: []string{"\xff", "\xff\xff"}},
+		{prefix: "", after: "ab", limit: 10, want: []string{"a\xff", "a\xff\x01", "b", "\xff", "\xff\xff"}},
+		{prefix: "a", after: "ab", limit: 10, want: []string{"a\xff", "a\xff\x01"}},
+		{prefix: "b", after: "a", limit: 10, want: []string{"b"}},
+		{prefix: "a", limit: 2, want: []string{"a", "ab"}, more: true},
+		{prefix: "c", limit: 10, want: []string{}},
+	} {
+		entries, more, listErr := rscsDB.List(c.prefix, c.after, c.limit)
+		keys := []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		if listErr != nil || more != c.more || strings.Join(keys, ",") != strings.Join(c.want, ",") {
+			t.Errorf("list %q after %q: %q %v %v", c.prefix, c.after, keys, more, listErr)
+		}
+	}
+}
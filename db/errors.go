@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxKeyLen is the length in bytes of the longest key.
+const MaxKeyLen = 255
+
+// The kinds of error a Store returns about a key, wrapped in a *KeyError.
+// Test for them with errors.Is.
+var (
+	// ErrNotFound is for a key that does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrExists is for inserting a key that exists.
+	ErrExists = errors.New("key exists")
+	// ErrKeyTooLong is for a key longer than MaxKeyLen.
+	ErrKeyTooLong = errors.New("key too long")
+	// ErrEmptyKey is for an empty key.
+	ErrEmptyKey = errors.New("empty key")
+	// ErrReservedKey is for a key in the range kept for namespaces.
+	ErrReservedKey = errors.New("key is reserved")
+	// ErrReservedValue is for a value that would be mistaken for an
+	// encrypted one, written to a store that does not encrypt.
+	ErrReservedValue = errors.New("value begins with the prefix of an encrypted value")
+)
+
+// KeyError is an error about the key an operation was passed. Err is one
+// of ErrNotFound, ErrExists, ErrKeyTooLong, ErrEmptyKey, ErrReservedKey or
+// ErrReservedValue.
+type KeyError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+// Error describes the operation, key and kind of error.
+func (e *KeyError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+	}
+	return fmt.Sprintf("%s '%s': %s", e.Op, e.Key, e.Err.Error())
+}
+
+// Unwrap returns Err, so errors.Is matches it.
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// emptyKeyError is the error of op when passed an empty key.
+func emptyKeyError(op string) error {
+	return &KeyError{Op: op, Err: ErrEmptyKey}
+}
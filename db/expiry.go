@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// unexpired is the SQL condition matching rows that have not expired as of
+// the unix nanosecond time bound to param.
+func unexpired(param string) string {
+	return fmt.Sprintf("(%s = 0 OR %s > %s)", KVExpiresColumn, KVExpiresColumn, param)
+}
+
+// expiresAt is the expires column value for a row written at now with ttl.
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+// expiresTime converts an expires column value to a time, zero for never.
+func expiresTime(expires int64) time.Time {
+	if expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expires).UTC()
+}
+
+// purgeExpiredKeyTx deletes key in tx if it expired before now, recording the
+// delete, so that the key can be written again.
+func purgeExpiredKeyTx(tx *sql.Tx, key string, now time.Time) error {
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND %s != 0 AND %s <= $2",
+		KVTableName, KVPrimaryKeyColumn, KVExpiresColumn, KVExpiresColumn)
+	rowCount, execErr := execRowCount(tx, queryStr, key, now.UnixNano())
+	if execErr != nil || rowCount == 0 {
+		return execErr
+	}
+	_, recordErr := recordRevision(tx, key, "", true)
+	return recordErr
+}
+
+// PurgeExpired deletes every expired row, recording each as a delete
+// revision so that watchers see the key go away. Expired rows are already
+// hidden from reads; purging only reclaims them. It returns the number of
+// rows deleted.
+func (r *RscsDB) PurgeExpired() (int, error) {
+	defer r.observe("purge_expired", time.Now())
+	now := time.Now()
+	var rowCount int
+	purgeErr := r.withTx(func(tx *sql.Tx) error {
+		queryStr := fmt.Sprintf("SELECT %s FROM %s WHERE %s != 0 AND %s <= $1",
+			KVPrimaryKeyColumn, KVTableName, KVExpiresColumn, KVExpiresColumn)
+		rows, selectErr := tx.Query(queryStr, now.UnixNano())
+		if selectErr != nil {
+			return selectErr
+		}
+		var keys []string
+		for rows.Next() {
+			var key string
+			scanErr := rows.Scan(&key)
+			if scanErr != nil {
+				rows.Close()
+				return scanErr
+			}
+			keys = append(keys, key)
+		}
+		rows.Close()
+		rowsErr := rows.Err()
+		if rowsErr != nil {
+			return rowsErr
+		}
+		for _, key := range keys {
+			keyErr := purgeExpiredKeyTx(tx, key, now)
+			if keyErr != nil {
+				return keyErr
+			}
+		}
+		rowCount = len(keys)
+		return nil
+	})
+	if purgeErr != nil {
+		return 0, purgeErr
+	}
+	return rowCount, nil
+}
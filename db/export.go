@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	// exportBatch is how many entries Export reads from a Store at a time.
+	exportBatch = 1000
+	// snapshotAttempts is how many times Snapshot reads a Store that keeps
+	// changing before giving up.
+	snapshotAttempts = 10
+)
+
+// errSnapshotBusy is returned when a Store changed during every read of a
+// Snapshot.
+var errSnapshotBusy = errors.New("store changed during every snapshot attempt")
+
+// ImportAction describes what an import does to one key.
+type ImportAction string
+
+const (
+	// ImportAdd creates a key that did not exist.
+	ImportAdd ImportAction = "add"
+	// ImportUpdate gives an existing key a new value.
+	ImportUpdate ImportAction = "update"
+	// ImportDelete removes a key missing from a replacing import.
+	ImportDelete ImportAction = "delete"
+)
+
+// ImportChange is one change an import makes, or would make in a dry run.
+// Old is empty for an add and New is empty for a delete.
+type ImportChange struct {
+	Key    string
+	Action ImportAction
+	Old    string `json:",omitempty"`
+	New    string `json:",omitempty"`
+}
+
+// Export returns the value of every unexpired key in store. Expiries are not
+// exported.
+func Export(store Store) (map[string]string, error) {
+	values := make(map[string]string)
+	listErr := listAll(store, func(entry Entry) {
+		values[entry.Key] = entry.Value
+	})
+	if listErr != nil {
+		return nil, listErr
+	}
+	return values, nil
+}
+
+// Snapshot returns every unexpired entry in store, in key order, together
+// with the modification index they are current as of. The index is read
+// before and after the entries, and the entries read again if a write came
+// between.
+func Snapshot(store Store) (int64, []Entry, error) {
+	for attempt := 0; attempt < snapshotAttempts; attempt++ {
+		before, beforeErr := store.CurrentIndex()
+		if beforeErr != nil {
+			return 0, nil, beforeErr
+		}
+		entries := []Entry{}
+		listErr := listAll(store, func(entry Entry) {
+			entries = append(entries, entry)
+		})
+		if listErr != nil {
+			return 0, nil, listErr
+		}
+		after, afterErr := store.CurrentIndex()
+		if afterErr != nil {
+			return 0, nil, afterErr
+		}
+		if after == before {
+			return after, entries, nil
+		}
+	}
+	return 0, nil, errSnapshotBusy
+}
+
+// listAll calls f with every unexpired entry in store, in key order.
+func listAll(store Store, f func(entry Entry)) error {
+	after := ""
+	for {
+		entries, more, listErr := store.List("", after, exportBatch)
+		if listErr != nil {
+			return listErr
+		}
+		for _, entry := range entries {
+			f(entry)
+		}
+		if !more {
+			return nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
+
+// CheckImport validates the keys of values before an Import.
+func CheckImport(values map[string]string) error {
+	for key := range values {
+		keyErr := checkKey("import", key)
+		if keyErr != nil {
+			return keyErr
+		}
+		if reservedKey(key) {
+			return &KeyError{Op: "import", Key: key, Err: ErrReservedKey}
+		}
+	}
+	return nil
+}
+
+// Import writes values into store in a single transaction and returns the
+// changes it made, in key order. Keys whose value is unchanged are left
+// alone. If replace is set, every other key is deleted, otherwise values are
+// merged into the store. If dryRun is set the changes are only computed, not
+// written. A *TxnError means the store changed while the import ran and
+// nothing was written.
+func Import(store Store, values map[string]string, replace, dryRun bool) ([]ImportChange, error) {
+	checkErr := CheckImport(values)
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	current := make(map[string]Entry)
+	listErr := listAll(store, func(entry Entry) {
+		current[entry.Key] = entry
+	})
+	if listErr != nil {
+		return nil, listErr
+	}
+
+	changes := []ImportChange{}
+	var ops []Op
+	for key, value := range values {
+		entry, found := current[key]
+		switch {
+		case !found:
+			changes = append(changes, ImportChange{Key: key, Action: ImportAdd, New: value})
+			ops = append(ops, Op{Type: OpInsert, Key: key, Value: value})
+		case entry.Value != value:
+			changes = append(changes, ImportChange{Key: key, Action: ImportUpdate, Old: entry.Value, New: value})
+			ops = append(ops, Op{Type: OpUpdate, Key: key, Value: value, Index: entry.Index})
+		}
+	}
+	if replace {
+		for key, entry := range current {
+			if _, kept := values[key]; !kept {
+				changes = append(changes, ImportChange{Key: key, Action: ImportDelete, Old: entry.Value})
+				ops = append(ops, Op{Type: OpDelete, Key: key, Index: entry.Index})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+
+	if dryRun || len(ops) == 0 {
+		return changes, nil
+	}
+	// Each op is conditional on the index read above, so a concurrent write
+	// fails the whole import rather than being overwritten.
+	_, txnErr := store.Txn(ops)
+	if txnErr != nil {
+		return nil, txnErr
+	}
+	return changes, nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportExport(t *testing.T) {
+	store := NewMemoryStore()
+	store.Insert("a", "1")
+	store.Insert("b", "2")
+
+	values := map[string]string{"a": "1", "b": "two", "c": "3"}
+	changes, importErr := Import(store, values, true, true)
+	if importErr != nil {
+		t.Fatalf("dry run:%s", importErr.Error())
+	}
+	want := []ImportChange{
+		{Key: "b", Action: ImportUpdate, Old: "2", New: "two"},
+		{Key: "c", Action: ImportAdd, New: "3"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("dry run changes: %+v", changes)
+	}
+	if index, _ := store.CurrentIndex(); index != 2 {
+		t.Errorf("dry run wrote")
+	}
+
+	store.Insert("d", "4")
+	changes, importErr = Import(store, values, true, false)
+	if importErr != nil {
+		t.Fatalf("replace:%s", importErr.Error())
+	}
+	if len(changes) != 3 || changes[2].Action != ImportDelete {
+		t.Errorf("replace changes: %+v", changes)
+	}
+	exported, exportErr := Export(store)
+	if exportErr != nil || !reflect.DeepEqual(exported, values) {
+		t.Errorf("export: %v %v", exported, exportErr)
+	}
+
+	changes, importErr = Import(store, map[string]string{"e": "5"}, false, false)
+	if importErr != nil || len(changes) != 1 {
+		t.Errorf("merge: %+v %v", changes, importErr)
+	}
+	if _, found, _ := store.Get("a"); !found {
+		t.Errorf("merge deleted a key")
+	}
+
+	_, importErr = Import(store, map[string]string{"": "x"}, false, false)
+	if importErr == nil {
+		t.Errorf("import of empty key")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	store.Insert("b", "2")
+	store.InsertTTL("a", "1", time.Hour)
+	store.Delete("b")
+	store.Insert("c", "3")
+
+	index, entries, snapshotErr := Snapshot(store)
+	if snapshotErr != nil || index != 4 || len(entries) != 2 {
+		t.Fatalf("snapshot: %d %+v %v", index, entries, snapshotErr)
+	}
+	if entries[0].Key != "a" || entries[0].Expires.IsZero() || entries[1].Key != "c" || entries[1].Value != "3" {
+		t.Errorf("snapshot entries: %+v", entries)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	values := map[string]string{
+		"plain":  "value",
+		"spaced": "two words",
+		"quoted": `say "hi" # not a comment`,
+		"lines":  "one\ntwo",
+		"empty":  "",
+	}
+	for _, format := range []string{FormatJSON, FormatYAML, FormatEnv} {
+		var buf bytes.Buffer
+		encodeErr := EncodeValues(&buf, format, values)
+		if encodeErr != nil {
+			t.Errorf("%s encode:%s", format, encodeErr.Error())
+			continue
+		}
+		decoded, decodeErr := DecodeValues(&buf, format)
+		if decodeErr != nil || !reflect.DeepEqual(decoded, values) {
+			t.Errorf("%s round trip: %v %v", format, decoded, decodeErr)
+		}
+	}
+
+	env := "# config\nexport A=1\nB = two # comment\nC='lit\\n'\n\nD=\"x\\ty\"\n"
+	decoded, decodeErr := DecodeValues(strings.NewReader(env), FormatEnv)
+	want := map[string]string{"A": "1", "B": "two", "C": `lit\n`, "D": "x\ty"}
+	if decodeErr != nil || !reflect.DeepEqual(decoded, want) {
+		t.Errorf("env decode: %v %v", decoded, decodeErr)
+	}
+
+	decoded, decodeErr = DecodeValues(strings.NewReader("port: 8080\n"), FormatYAML)
+	if decodeErr != nil || decoded["port"] != "8080" {
+		t.Errorf("yaml scalar: %v %v", decoded, decodeErr)
+	}
+
+	if EncodeValues(&bytes.Buffer{}, FormatEnv, map[string]string{"a=b": "1"}) == nil {
+		t.Errorf("env key with =")
+	}
+	if CheckFormat("xml") == nil {
+		t.Errorf("unknown format")
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FileStore is a MemoryStore that is also written to an append-only file, so
+// its contents survive a restart. Each line of the file holds the revisions
+// of one transaction as a JSON array, and is synced to disk before the
+// transaction is applied. The file is only ever appended to, so it grows
+// with the history of the store. Tokens are kept apart, in a JSON file
+// named after it with tokenFileSuffix, which is rewritten on each change,
+// and audit records in an AuditFile named after it with auditFileSuffix.
+type FileStore struct {
+	*MemoryStore
+	path  string
+	file  *os.File
+	size  int64
+	audit *AuditFile
+}
+
+// NewFileStore opens the file at path, creating it if needed, and loads the
+// store from it. A partially written last line, left by a crash during a
+// write, is discarded.
+func NewFileStore(path string) (*FileStore, error) {
+	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if openErr != nil {
+		return nil, openErr
+	}
+	f := &FileStore{MemoryStore: NewMemoryStore(), path: path, file: file}
+	loadErr := f.load()
+	if loadErr != nil {
+		file.Close()
+		return nil, loadErr
+	}
+	f.audit, openErr = OpenAuditFile(path + auditFileSuffix)
+	if openErr != nil {
+		file.Close()
+		return nil, openErr
+	}
+	f.persist = f.appendWrites
+	f.persistTokens = f.saveTokens
+	return f, nil
+}
+
+// tokenFileSuffix is added to the name of a FileStore file to name the file
+// its tokens are kept in.
+const tokenFileSuffix = ".tokens"
+
+// DBFileName returns the file the store is kept in.
+func (f *FileStore) DBFileName() string {
+	return f.path
+}
+
+// Close closes the files. The store must not be used afterwards.
+func (f *FileStore) Close() error {
+	f.audit.Close()
+	return f.file.Close()
+}
+
+// load replays the file into the store and positions it for appending.
+func (f *FileStore) load() error {
+	size, _, replayErr := f.replay(f.file)
+	if replayErr != nil {
+		return fmt.Errorf("%s: %s", f.path, replayErr.Error())
+	}
+	f.size = size
+	truncateErr := f.file.Truncate(f.size)
+	if truncateErr != nil {
+		return truncateErr
+	}
+	_, seekErr := f.file.Seek(f.size, io.SeekStart)
+	if seekErr != nil {
+		return seekErr
+	}
+	return f.loadTokens()
+}
+
+// loadTokens reads the token file, if there is one.
+func (f *FileStore) loadTokens() error {
+	tokenBytes, readErr := ioutil.ReadFile(f.path + tokenFileSuffix)
+	if os.IsNotExist(readErr) {
+		return nil
+	}
+	if readErr != nil {
+		return readErr
+	}
+	var tokens []Token
+	umErr := json.Unmarshal(tokenBytes, &tokens)
+	if umErr != nil {
+		return fmt.Errorf("%s: %s", f.path+tokenFileSuffix, umErr.Error())
+	}
+	for _, token := range tokens {
+		f.tokens[token.ID] = token
+	}
+	return nil
+}
+
+// saveTokens replaces the token file with one holding tokens. The new file
+// is synced before it is renamed over the old one.
+func (f *FileStore) saveTokens(tokens map[string]Token) error {
+	tokenBytes, jsonErr := json.Marshal(sortedTokens(tokens))
+	if jsonErr != nil {
+		return jsonErr
+	}
+	partial := f.path + tokenFileSuffix + ".partial"
+	file, createErr := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := file.Write(tokenBytes)
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	closeErr := file.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(partial, f.path+tokenFileSuffix)
+	}
+	if writeErr != nil {
+		os.Remove(partial)
+	}
+	return writeErr
+}
+
+// replay applies every complete line read from r to an empty store. It
+// returns how many bytes those lines took and whether a partial last line
+// followed them.
+func (m *MemoryStore) replay(r io.Reader) (int64, bool, error) {
+	reader := bufio.NewReader(r)
+	var size int64
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			return size, len(line) != 0, nil
+		}
+		if readErr != nil {
+			return 0, false, readErr
+		}
+		var writes []memWrite
+		umErr := json.Unmarshal(line, &writes)
+		if umErr != nil {
+			return 0, false, fmt.Errorf("offset %d: %s", size, umErr.Error())
+		}
+		for _, w := range writes {
+			if w.Index != int64(len(m.log))+1 {
+				return 0, false, fmt.Errorf("offset %d: index %d out of order", size, w.Index)
+			}
+			m.apply(w)
+		}
+		size += int64(len(line))
+	}
+}
+
+// appendWrites writes the revisions of a transaction to the end of the file
+// as one line and syncs it. On failure the file is cut back to where it was.
+func (f *FileStore) appendWrites(writes []memWrite) error {
+	line, jsonErr := json.Marshal(writes)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	line = append(line, '\n')
+	_, writeErr := f.file.Write(line)
+	if writeErr == nil {
+		writeErr = f.file.Sync()
+	}
+	if writeErr != nil {
+		f.file.Truncate(f.size)
+		f.file.Seek(f.size, io.SeekStart)
+		return writeErr
+	}
+	f.size += int64(len(line))
+	return nil
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// FormatJSON is a JSON object of keys to string values.
+	FormatJSON = "json"
+	// FormatYAML is a YAML mapping of keys to values.
+	FormatYAML = "yaml"
+	// FormatEnv is a .env file of key=value lines.
+	FormatEnv = "env"
+)
+
+// CheckFormat reports whether format is one EncodeValues and DecodeValues
+// understand.
+func CheckFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatYAML, FormatEnv:
+		return nil
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+// EncodeValues writes values to w in format, sorted by key.
+func EncodeValues(w io.Writer, format string, values map[string]string) error {
+	switch format {
+	case FormatJSON:
+		jsonBytes, jsonErr := json.MarshalIndent(values, "", "  ")
+		if jsonErr != nil {
+			return jsonErr
+		}
+		_, writeErr := fmt.Fprintf(w, "%s\n", jsonBytes)
+		return writeErr
+	case FormatYAML:
+		yamlBytes, yamlErr := yaml.Marshal(values)
+		if yamlErr != nil {
+			return yamlErr
+		}
+		_, writeErr := w.Write(yamlBytes)
+		return writeErr
+	case FormatEnv:
+		return encodeEnv(w, values)
+	default:
+		return CheckFormat(format)
+	}
+}
+
+// DecodeValues reads values written in format from r. Every value must be a
+// string, or for YAML a scalar.
+func DecodeValues(r io.Reader, format string) (map[string]string, error) {
+	formatErr := CheckFormat(format)
+	if formatErr != nil {
+		return nil, formatErr
+	}
+	if format == FormatEnv {
+		return decodeEnv(r)
+	}
+	body, readErr := ioutil.ReadAll(r)
+	if readErr != nil {
+		return nil, readErr
+	}
+	values := make(map[string]string)
+	var umErr error
+	if format == FormatJSON {
+		umErr = json.Unmarshal(body, &values)
+	} else {
+		umErr = yaml.Unmarshal(body, &values)
+	}
+	if umErr != nil {
+		return nil, umErr
+	}
+	return values, nil
+}
+
+// encodeEnv writes values as key=value lines. A value that is not made up of
+// plain characters is double quoted with Go escapes.
+func encodeEnv(w io.Writer, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if key == "" || strings.ContainsAny(key, "=#\"' \t\r\n") {
+			return fmt.Errorf("key '%s' cannot be written in env format", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bw := bufio.NewWriter(w)
+	for _, key := range keys {
+		value := values[key]
+		if !plainEnvValue(value) {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(bw, "%s=%s\n", key, value)
+	}
+	return bw.Flush()
+}
+
+// plainEnvValue reports whether value can be written unquoted.
+func plainEnvValue(value string) bool {
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("_-.,:/@+%", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeEnv reads key=value lines. Blank lines and lines starting with # are
+// skipped, and a leading "export " is ignored. A value may be unquoted, in
+// which case a trailing " #" comment is dropped, single quoted, taken
+// literally, or double quoted with Go escapes.
+func decodeEnv(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("env line %d: no key", lineNum)
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, unquoteErr := strconv.Unquote(value)
+			if unquoteErr != nil {
+				return nil, fmt.Errorf("env line %d: malformed quoted value", lineNum)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("env line %d: malformed quoted value", lineNum)
+			}
+			value = value[1 : len(value)-1]
+		default:
+			if comment := strings.Index(value, " #"); comment != -1 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		values[key] = value
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	return values, nil
+}
@@ -0,0 +1,295 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// HistoryTableName is the revision history table name.
+	HistoryTableName = "kv_history"
+	// HistoryIDColumn orders every revision across all keys.
+	HistoryIDColumn = "id"
+	// HistoryRevisionColumn numbers the revisions of a single key from 1.
+	HistoryRevisionColumn = "revision"
+	// HistoryDeletedColumn is nonzero for a revision that deleted the key.
+	HistoryDeletedColumn = "deleted"
+	// HistoryModifiedColumn is when the revision was written, in unix nanoseconds.
+	HistoryModifiedColumn = "modified"
+)
+
+// Revision is one recorded write to a key. A Deleted revision has an empty
+// Value. Index is the modification index the write was given.
+type Revision struct {
+	Key      string
+	Revision int
+	Index    int64
+	Value    string
+	Deleted  bool
+	Modified time.Time
+}
+
+// createHistoryTable creates the kv history table if it is missing, as it is
+// in dbs made before history was kept.
+func (r *RscsDB) createHistoryTable() error {
+	queryStr := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s INTEGER PRIMARY KEY AUTOINCREMENT, %s VARCHAR(255) NOT NULL, %s INTEGER NOT NULL, %s TEXT NOT NULL, %s INTEGER NOT NULL, %s INTEGER NOT NULL, UNIQUE (%s, %s))",
+		HistoryTableName, HistoryIDColumn, KVPrimaryKeyColumn, HistoryRevisionColumn,
+		KVValueColumn, HistoryDeletedColumn, HistoryModifiedColumn,
+		KVPrimaryKeyColumn, HistoryRevisionColumn)
+	_, createErr := r.db.Exec(queryStr)
+	return createErr
+}
+
+// dropHistoryTable drops the kv history table.
+func (r *RscsDB) dropHistoryTable() error {
+	queryStr := fmt.Sprintf("DROP TABLE %s", HistoryTableName)
+	_, dropErr := r.db.Exec(queryStr)
+	return dropErr
+}
+
+// recordRevision appends the next revision of key to the history table and,
+// unless the revision is a delete, stamps the live row with the new
+// modification index, which is returned.
+func recordRevision(tx *sql.Tx, key, value string, deleted bool) (int64, error) {
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s) SELECT $1, COALESCE(MAX(%s), 0) + 1, $2, $3, $4 FROM %s WHERE %s = $1",
+		HistoryTableName, KVPrimaryKeyColumn, HistoryRevisionColumn, KVValueColumn,
+		HistoryDeletedColumn, HistoryModifiedColumn,
+		HistoryRevisionColumn, HistoryTableName, KVPrimaryKeyColumn)
+	result, insertErr := tx.Exec(queryStr, key, value, deleted, time.Now().UnixNano())
+	if insertErr != nil {
+		return 0, insertErr
+	}
+	index, indexErr := result.LastInsertId()
+	if indexErr != nil || deleted {
+		return index, indexErr
+	}
+	queryStr = fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2",
+		KVTableName, KVIndexColumn, KVPrimaryKeyColumn)
+	_, stampErr := tx.Exec(queryStr, index, key)
+	return index, stampErr
+}
+
+// History returns every recorded revision of key, oldest first.
+func (r *RscsDB) History(key string) ([]Revision, error) {
+	defer r.observe("history", time.Now())
+	if key == "" {
+		return nil, emptyKeyError("history")
+	}
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM %s WHERE %s = $1 ORDER BY %s",
+		HistoryRevisionColumn, HistoryIDColumn, KVValueColumn, HistoryDeletedColumn, HistoryModifiedColumn,
+		HistoryTableName, KVPrimaryKeyColumn, HistoryRevisionColumn)
+	rows, selectErr := r.db.Query(queryStr, key)
+	if selectErr != nil {
+		return nil, selectErr
+	}
+	defer rows.Close()
+	revisions := []Revision{}
+	for rows.Next() {
+		rev := Revision{Key: key}
+		var modified int64
+		scanErr := rows.Scan(&rev.Revision, &rev.Index, &rev.Value, &rev.Deleted, &modified)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		rev.Modified = time.Unix(0, modified).UTC()
+		revisions = append(revisions, rev)
+	}
+	rowsErr := rows.Err()
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	openErr := r.openRevisions(revisions)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return revisions, nil
+}
+
+// GetRevision returns the value key had at revision. As with Get, the second
+// return value is a 'found' flag; it is false if there is no such revision or
+// if that revision deleted the key.
+func (r *RscsDB) GetRevision(key string, revision int) (string, bool, error) {
+	defer r.observe("get_revision", time.Now())
+	if key == "" {
+		return "", false, emptyKeyError("get revision")
+	}
+	value, deleted, found, selectErr := getRevisionTx(r.db, key, revision)
+	if selectErr != nil || !found || deleted {
+		return "", false, selectErr
+	}
+	value, openErr := r.open(key, value)
+	if openErr != nil {
+		return "", false, openErr
+	}
+	return value, true, nil
+}
+
+// getRevisionTx reads a single revision of key.
+func getRevisionTx(q queryRower, key string, revision int) (string, bool, bool, error) {
+	queryStr := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = $1 AND %s = $2",
+		KVValueColumn, HistoryDeletedColumn, HistoryTableName,
+		KVPrimaryKeyColumn, HistoryRevisionColumn)
+	var value string
+	var deleted bool
+	selectErr := q.QueryRow(queryStr, key, revision).Scan(&value, &deleted)
+	switch {
+	case selectErr == sql.ErrNoRows:
+		return "", false, false, nil
+	case selectErr != nil:
+		return "", false, false, selectErr
+	default:
+		return value, deleted, true, nil
+	}
+}
+
+// Rollback restores the value key had at revision, recording it as a new
+// revision that does not expire. The key is recreated if it has since been
+// deleted or has expired. A zero row
+// count means there is no such revision; rolling back to a revision that
+// deleted the key is an error.
+func (r *RscsDB) Rollback(key string, revision int) (int, error) {
+	defer r.observe("rollback", time.Now())
+	if key == "" {
+		return 0, emptyKeyError("rollback")
+	}
+	var rowCount int
+	rollbackErr := r.withTx(func(tx *sql.Tx) error {
+		value, deleted, found, selectErr := getRevisionTx(tx, key, revision)
+		if selectErr != nil || !found {
+			return selectErr
+		}
+		if deleted {
+			return fmt.Errorf("revision %d deleted key '%s'", revision, key)
+		}
+		// Seal the value afresh, as the revision may predate encryption or
+		// the current master key.
+		value, openErr := r.open(key, value)
+		if openErr != nil {
+			return openErr
+		}
+		value, sealErr := r.seal(key, value)
+		if sealErr != nil {
+			return sealErr
+		}
+		now := time.Now()
+		index, execErr := updateTx(tx, key, value, 0, 0, now)
+		if execErr != nil {
+			return execErr
+		}
+		if index == 0 {
+			index, execErr = insertTx(tx, key, value, 0, now)
+		}
+		rowCount = rowCountOf(index)
+		return execErr
+	})
+	if rollbackErr != nil {
+		return 0, rollbackErr
+	}
+	return rowCount, nil
+}
+
+// Changes returns up to limit revisions of keys beginning with prefix that
+// were written after the modification index since, in index order. It is
+// the change feed behind watches: pass the Index of the last revision seen as
+// since to continue from there.
+func (r *RscsDB) Changes(prefix string, since int64, limit int) ([]Revision, error) {
+	defer r.observe("changes", time.Now())
+	if limit < 1 {
+		return nil, errors.New("changes limit must be positive")
+	}
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s, %s FROM %s WHERE %s > $1 AND substr(%s, 1, length($2)) = $2 ORDER BY %s LIMIT $3",
+		KVPrimaryKeyColumn, HistoryRevisionColumn, HistoryIDColumn, KVValueColumn,
+		HistoryDeletedColumn, HistoryModifiedColumn, HistoryTableName,
+		HistoryIDColumn, KVPrimaryKeyColumn, HistoryIDColumn)
+	rows, selectErr := r.db.Query(queryStr, since, prefix, limit)
+	if selectErr != nil {
+		return nil, selectErr
+	}
+	defer rows.Close()
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		var modified int64
+		scanErr := rows.Scan(&rev.Key, &rev.Revision, &rev.Index, &rev.Value, &rev.Deleted, &modified)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		rev.Modified = time.Unix(0, modified).UTC()
+		revisions = append(revisions, rev)
+	}
+	rowsErr := rows.Err()
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	openErr := r.openRevisions(revisions)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return revisions, nil
+}
+
+// CurrentIndex returns the modification index of the most recent write to
+// any key, or zero if nothing has been written.
+func (r *RscsDB) CurrentIndex() (int64, error) {
+	defer r.observe("current_index", time.Now())
+	queryStr := fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s",
+		HistoryIDColumn, HistoryTableName)
+	var index int64
+	selectErr := r.db.QueryRow(queryStr).Scan(&index)
+	return index, selectErr
+}
+
+// LastIndex returns the modification index of the most recent write to key,
+// including a delete, or zero if key has never been written.
+func (r *RscsDB) LastIndex(key string) (int64, error) {
+	defer r.observe("last_index", time.Now())
+	if key == "" {
+		return 0, emptyKeyError("last index")
+	}
+	queryStr := fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s WHERE %s = $1",
+		HistoryIDColumn, HistoryTableName, KVPrimaryKeyColumn)
+	var index int64
+	selectErr := r.db.QueryRow(queryStr, key).Scan(&index)
+	return index, selectErr
+}
+
+// HistoryPruner is implemented by a Store that can drop old revisions. The
+// MemoryStore and FileStore number writes by their position in the log, so
+// they keep every revision.
+type HistoryPruner interface {
+	// PruneHistory deletes all but the newest keep revisions of each key
+	// written after the modification index since, and returns the number of
+	// revisions deleted.
+	PruneHistory(keep int, since int64) (int, error)
+}
+
+var _ HistoryPruner = (*RscsDB)(nil)
+
+// PruneHistory deletes all but the newest keep revisions of each key written
+// after the modification index since. The newest revision of a key, even a
+// delete, is always kept, so indexes and revision numbers carry on as before;
+// a watch that is further behind than keep revisions of a key skips to the
+// ones that remain. Pass the CurrentIndex of the last pass as since to only
+// look at keys written since then.
+func (r *RscsDB) PruneHistory(keep int, since int64) (int, error) {
+	defer r.observe("prune_history", time.Now())
+	if keep < 1 {
+		return 0, errors.New("history keep must be positive")
+	}
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s IN (SELECT %s FROM %s WHERE %s > $1) AND %s <= (SELECT MAX(latest.%s) FROM %s AS latest WHERE latest.%s = %s.%s) - $2",
+		HistoryTableName, KVPrimaryKeyColumn, KVPrimaryKeyColumn, HistoryTableName, HistoryIDColumn,
+		HistoryRevisionColumn, HistoryRevisionColumn, HistoryTableName,
+		KVPrimaryKeyColumn, HistoryTableName, KVPrimaryKeyColumn)
+	var rowCount int
+	pruneErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		rowCount, execErr = execRowCount(tx, queryStr, since, keep)
+		return execErr
+	})
+	if pruneErr != nil {
+		return 0, pruneErr
+	}
+	return rowCount, nil
+}
@@ -0,0 +1,612 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memWrite is one revision written to a MemoryStore, together with the
+// expiry it gave the key. Replaying every memWrite in index order rebuilds
+// the store, which is how a FileStore is loaded.
+type memWrite struct {
+	Revision
+	Expires int64
+}
+
+// MemoryStore is a Store kept in a Go map. It needs no cgo and nothing is
+// written to disk, so its contents are lost when the process exits.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	rows  map[string]memRow
+	log   []Revision       // every revision, in index order
+	byKey map[string][]int // positions in log of each key's revisions
+	// persist, if set, is called with the writes of each transaction before
+	// they are applied. If it fails the transaction is abandoned.
+	persist func(writes []memWrite) error
+	tokens  map[string]Token
+	// persistTokens, if set, is called with every token after each change
+	// to them. If it fails the change is undone.
+	persistTokens func(tokens map[string]Token) error
+	audit         []AuditRecord
+	// stats counts the rows of each namespace, by namespace prefix, and
+	// expiring holds the keys of rows with an expiry, so the stats of a
+	// namespace need not read every row.
+	stats    map[string]NamespaceStats
+	expiring map[string]struct{}
+}
+
+// memRow is the live value of a key in a MemoryStore.
+type memRow struct {
+	value   string
+	index   int64
+	expires int64
+}
+
+// live reports whether the row has not expired as of now.
+func (row memRow) live(now time.Time) bool {
+	return row.expires == 0 || row.expires > now.UnixNano()
+}
+
+// entry converts the row to an Entry for key.
+func (row memRow) entry(key string) Entry {
+	return Entry{Key: key, Value: row.value, Index: row.index, Expires: expiresTime(row.expires)}
+}
+
+// NewMemoryStore initializes a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rows:     make(map[string]memRow),
+		byKey:    make(map[string][]int),
+		tokens:   make(map[string]Token),
+		stats:    make(map[string]NamespaceStats),
+		expiring: make(map[string]struct{})}
+}
+
+// DBFileName returns the empty string, as a MemoryStore has no file.
+func (m *MemoryStore) DBFileName() string {
+	return ""
+}
+
+// apply adds a committed write to the store.
+func (m *MemoryStore) apply(w memWrite) {
+	m.byKey[w.Key] = append(m.byKey[w.Key], len(m.log))
+	m.log = append(m.log, w.Revision)
+	if old, found := m.rows[w.Key]; found {
+		m.count(w.Key, old, -1)
+	}
+	if w.Deleted {
+		delete(m.rows, w.Key)
+		return
+	}
+	row := memRow{value: w.Value, index: w.Index, expires: w.Expires}
+	m.rows[w.Key] = row
+	m.count(w.Key, row, 1)
+}
+
+// count adds the row of key to the stats of its namespace, or with a sign
+// of -1 takes it away.
+func (m *MemoryStore) count(key string, row memRow, sign int) {
+	prefix := namespacePrefix(key)
+	stats := m.stats[prefix]
+	stats.Keys += sign
+	stats.Bytes += int64(sign * len(row.value))
+	m.stats[prefix] = stats
+	if row.expires != 0 {
+		if sign > 0 {
+			m.expiring[key] = struct{}{}
+		} else {
+			delete(m.expiring, key)
+		}
+	}
+}
+
+// namespaceStats counts from the running stats, less the rows that have
+// expired but not been purged.
+func (m *MemoryStore) namespaceStats(prefix string) (NamespaceStats, error) {
+	now := time.Now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := m.stats[prefix]
+	for key := range m.expiring {
+		row := m.rows[key]
+		if !row.live(now) && namespacePrefix(key) == prefix {
+			stats.Keys--
+			stats.Bytes -= int64(len(row.value))
+		}
+	}
+	return stats, nil
+}
+
+// update runs f in a memTxn, applying its writes only if f returns no error.
+func (m *MemoryStore) update(now time.Time, f func(t *memTxn) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &memTxn{m: m, now: now, rows: make(map[string]*memRow), revisions: make(map[string]int)}
+	fErr := f(t)
+	if fErr != nil {
+		return fErr
+	}
+	if len(t.writes) == 0 {
+		return nil
+	}
+	if m.persist != nil {
+		persistErr := m.persist(t.writes)
+		if persistErr != nil {
+			return persistErr
+		}
+	}
+	for _, w := range t.writes {
+		m.apply(w)
+	}
+	return nil
+}
+
+// memTxn is a MemoryStore transaction. Its writes are kept aside until the
+// transaction commits, and its reads see them.
+type memTxn struct {
+	m         *MemoryStore
+	now       time.Time
+	rows      map[string]*memRow // rows written so far; nil if deleted
+	revisions map[string]int     // latest revision of each key written so far
+	writes    []memWrite
+}
+
+// row returns key's row as the transaction sees it, even if it has expired.
+func (t *memTxn) row(key string) (memRow, bool) {
+	if row, written := t.rows[key]; written {
+		if row == nil {
+			return memRow{}, false
+		}
+		return *row, true
+	}
+	row, found := t.m.rows[key]
+	return row, found
+}
+
+// record adds the next revision of key to the transaction and returns its
+// modification index.
+func (t *memTxn) record(key, value string, deleted bool, expires int64) int64 {
+	revision, written := t.revisions[key]
+	if !written {
+		revision = len(t.m.byKey[key])
+	}
+	revision++
+	t.revisions[key] = revision
+	index := int64(len(t.m.log) + len(t.writes) + 1)
+	t.writes = append(t.writes, memWrite{
+		Revision: Revision{Key: key, Revision: revision, Index: index, Value: value,
+			Deleted: deleted, Modified: time.Now().UTC().Round(0)},
+		Expires: expires})
+	if deleted {
+		t.rows[key] = nil
+	} else {
+		t.rows[key] = &memRow{value: value, index: index, expires: expires}
+	}
+	return index
+}
+
+// purgeExpired deletes key if it has expired, recording the delete.
+func (t *memTxn) purgeExpired(key string) {
+	row, found := t.row(key)
+	if found && !row.live(t.now) {
+		t.record(key, "", true, 0)
+	}
+}
+
+func (t *memTxn) get(key string) (Entry, bool, error) {
+	row, found := t.row(key)
+	if !found || !row.live(t.now) {
+		return Entry{}, false, nil
+	}
+	return row.entry(key), true, nil
+}
+
+// insert is like create but it is an error if the key exists.
+func (t *memTxn) insert(key, value string, expires int64) (int64, error) {
+	index, createErr := t.create(key, value, expires)
+	if createErr == nil && index == 0 {
+		return 0, &KeyError{Op: "insert", Key: key, Err: ErrExists}
+	}
+	return index, createErr
+}
+
+func (t *memTxn) create(key, value string, expires int64) (int64, error) {
+	t.purgeExpired(key)
+	if _, found := t.row(key); found {
+		return 0, nil
+	}
+	return t.record(key, value, false, expires), nil
+}
+
+func (t *memTxn) update(key, value string, expires, expectedIndex int64) (int64, error) {
+	row, found := t.row(key)
+	if !found || !row.live(t.now) || (expectedIndex != 0 && row.index != expectedIndex) {
+		return 0, nil
+	}
+	return t.record(key, value, false, expires), nil
+}
+
+func (t *memTxn) delete(key string, expectedIndex int64) (int64, error) {
+	row, found := t.row(key)
+	if !found || !row.live(t.now) || (expectedIndex != 0 && row.index != expectedIndex) {
+		return 0, nil
+	}
+	return t.record(key, "", true, 0), nil
+}
+
+// Insert will insert a new key/value pair.
+func (m *MemoryStore) Insert(key, value string) (int, error) {
+	return m.InsertTTL(key, value, 0)
+}
+
+// InsertTTL will insert a new key/value pair that expires after ttl. A zero
+// ttl never expires.
+func (m *MemoryStore) InsertTTL(key, value string, ttl time.Duration) (int, error) {
+	keyErr := checkKey("insert", key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
+	}
+	now := time.Now()
+	var index int64
+	insertErr := m.update(now, func(t *memTxn) error {
+		var execErr error
+		index, execErr = t.insert(key, value, expiresAt(now, ttl))
+		return execErr
+	})
+	if insertErr != nil {
+		return 0, insertErr
+	}
+	return rowCountOf(index), nil
+}
+
+// Delete will delete a row with ID key.
+func (m *MemoryStore) Delete(key string) (int, error) {
+	if key == "" {
+		return 0, emptyKeyError("delete")
+	}
+	var index int64
+	deleteErr := m.update(time.Now(), func(t *memTxn) error {
+		var execErr error
+		index, execErr = t.delete(key, 0)
+		return execErr
+	})
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	return rowCountOf(index), nil
+}
+
+// Update will give a row a new value. Any expiry the row had is cleared.
+func (m *MemoryStore) Update(key, value string) (int, error) {
+	return m.UpdateTTL(key, value, 0)
+}
+
+// UpdateTTL will give a row a new value that expires after ttl, replacing
+// any previous expiry. A zero ttl never expires.
+func (m *MemoryStore) UpdateTTL(key, value string, ttl time.Duration) (int, error) {
+	if key == "" {
+		return 0, emptyKeyError("update")
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
+	}
+	now := time.Now()
+	var index int64
+	updateErr := m.update(now, func(t *memTxn) error {
+		var execErr error
+		index, execErr = t.update(key, value, expiresAt(now, ttl), 0)
+		return execErr
+	})
+	if updateErr != nil {
+		return 0, updateErr
+	}
+	return rowCountOf(index), nil
+}
+
+// CompareAndSwap sets a new value for key only if the row's modification
+// index is still expectedIndex, where zero means the key must not exist.
+func (m *MemoryStore) CompareAndSwap(key string, expectedIndex int64, value string) (int, error) {
+	return m.CompareAndSwapTTL(key, expectedIndex, value, 0)
+}
+
+// CompareAndSwapTTL is like CompareAndSwap but the new value expires after
+// ttl. A zero ttl never expires.
+func (m *MemoryStore) CompareAndSwapTTL(key string, expectedIndex int64, value string, ttl time.Duration) (int, error) {
+	keyErr := checkKey("compare and swap", key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return 0, ttlErr
+	}
+	now := time.Now()
+	var index int64
+	casErr := m.update(now, func(t *memTxn) error {
+		var execErr error
+		if expectedIndex == 0 {
+			index, execErr = t.create(key, value, expiresAt(now, ttl))
+		} else {
+			index, execErr = t.update(key, value, expiresAt(now, ttl), expectedIndex)
+		}
+		return execErr
+	})
+	if casErr != nil {
+		return 0, casErr
+	}
+	return rowCountOf(index), nil
+}
+
+// CompareAndDelete deletes key only if the row's modification index is still
+// expectedIndex.
+func (m *MemoryStore) CompareAndDelete(key string, expectedIndex int64) (int, error) {
+	if key == "" {
+		return 0, emptyKeyError("compare and delete")
+	}
+	if expectedIndex == 0 {
+		return 0, nil
+	}
+	var index int64
+	deleteErr := m.update(time.Now(), func(t *memTxn) error {
+		var execErr error
+		index, execErr = t.delete(key, expectedIndex)
+		return execErr
+	})
+	if deleteErr != nil {
+		return 0, deleteErr
+	}
+	return rowCountOf(index), nil
+}
+
+// Upsert will set the value of key, whether or not it exists, and reports
+// whether it was created. Any expiry the row had is cleared.
+func (m *MemoryStore) Upsert(key, value string) (bool, error) {
+	return m.UpsertTTL(key, value, 0)
+}
+
+// UpsertTTL is like Upsert but the value expires after ttl. A zero ttl
+// never expires.
+func (m *MemoryStore) UpsertTTL(key, value string, ttl time.Duration) (bool, error) {
+	keyErr := checkKey("upsert", key)
+	if keyErr != nil {
+		return false, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return false, ttlErr
+	}
+	now := time.Now()
+	var created bool
+	upsertErr := m.update(now, func(t *memTxn) error {
+		var execErr error
+		created, execErr = upsertTx(t, key, value, expiresAt(now, ttl))
+		return execErr
+	})
+	if upsertErr != nil {
+		return false, upsertErr
+	}
+	return created, nil
+}
+
+// Modify reads key and replaces its value with what f returns, in a single
+// transaction. The key keeps its expiry.
+func (m *MemoryStore) Modify(key string, f func(entry Entry) (string, error)) (Entry, error) {
+	if key == "" {
+		return Entry{}, emptyKeyError("modify")
+	}
+	var entry Entry
+	modifyErr := m.update(time.Now(), func(t *memTxn) error {
+		var execErr error
+		entry, execErr = modifyTx(t, key, f)
+		return execErr
+	})
+	if modifyErr != nil {
+		return Entry{}, modifyErr
+	}
+	return entry, nil
+}
+
+// Txn runs ops in order, committing them together or not at all.
+func (m *MemoryStore) Txn(ops []Op) ([]OpResult, error) {
+	now := time.Now()
+	return runTxn(ops, now, func(apply func(txnBackend) error) error {
+		return m.update(now, func(t *memTxn) error {
+			return apply(t)
+		})
+	})
+}
+
+// Get returns the value string for the key string.
+func (m *MemoryStore) Get(key string) (string, bool, error) {
+	entry, found, getErr := m.GetEntry(key)
+	return entry.Value, found, getErr
+}
+
+// GetEntry is like Get but returns the whole row.
+func (m *MemoryStore) GetEntry(key string) (Entry, bool, error) {
+	if key == "" {
+		return Entry{}, false, emptyKeyError("get")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	row, found := m.rows[key]
+	if !found || !row.live(time.Now()) {
+		return Entry{}, false, nil
+	}
+	return row.entry(key), true, nil
+}
+
+// List returns up to limit entries whose keys begin with prefix and sort
+// after the key after, and whether more remain.
+func (m *MemoryStore) List(prefix, after string, limit int) ([]Entry, bool, error) {
+	if limit < 1 {
+		return nil, false, errors.New("list limit must be positive")
+	}
+	now := time.Now()
+	m.mu.RLock()
+	keys := []string{}
+	for key, row := range m.rows {
+		if strings.HasPrefix(key, prefix) && key > after && row.live(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	more := len(keys) > limit
+	if more {
+		keys = keys[:limit]
+	}
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = m.rows[key].entry(key)
+	}
+	m.mu.RUnlock()
+	return entries, more, nil
+}
+
+// History returns every recorded revision of key, oldest first.
+func (m *MemoryStore) History(key string) ([]Revision, error) {
+	if key == "" {
+		return nil, emptyKeyError("history")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revisions := make([]Revision, len(m.byKey[key]))
+	for i, pos := range m.byKey[key] {
+		revisions[i] = m.log[pos]
+	}
+	return revisions, nil
+}
+
+// GetRevision returns the value key had at revision, if that revision
+// exists and did not delete the key.
+func (m *MemoryStore) GetRevision(key string, revision int) (string, bool, error) {
+	if key == "" {
+		return "", false, emptyKeyError("get revision")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rev, found := m.revision(key, revision)
+	if !found || rev.Deleted {
+		return "", false, nil
+	}
+	return rev.Value, true, nil
+}
+
+// revision looks up a single revision of key. Revisions are numbered from
+// one without gaps, so it is the revision's position in byKey.
+func (m *MemoryStore) revision(key string, revision int) (Revision, bool) {
+	positions := m.byKey[key]
+	if revision < 1 || revision > len(positions) {
+		return Revision{}, false
+	}
+	return m.log[positions[revision-1]], true
+}
+
+// Rollback restores the value key had at revision, recording it as a new
+// revision that does not expire.
+func (m *MemoryStore) Rollback(key string, revision int) (int, error) {
+	if key == "" {
+		return 0, emptyKeyError("rollback")
+	}
+	var index int64
+	rollbackErr := m.update(time.Now(), func(t *memTxn) error {
+		rev, found := m.revision(key, revision)
+		if !found {
+			return nil
+		}
+		if rev.Deleted {
+			return fmt.Errorf("revision %d deleted key '%s'", revision, key)
+		}
+		var execErr error
+		index, execErr = t.update(key, rev.Value, 0, 0)
+		if execErr != nil {
+			return execErr
+		}
+		if index == 0 {
+			index, execErr = t.insert(key, rev.Value, 0)
+		}
+		return execErr
+	})
+	if rollbackErr != nil {
+		return 0, rollbackErr
+	}
+	return rowCountOf(index), nil
+}
+
+// Changes returns up to limit revisions of keys beginning with prefix that
+// were written after the modification index since, in index order.
+func (m *MemoryStore) Changes(prefix string, since int64, limit int) ([]Revision, error) {
+	if limit < 1 {
+		return nil, errors.New("changes limit must be positive")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revisions := []Revision{}
+	if since < 0 {
+		since = 0
+	}
+	// The revision with index i is at position i-1 of the log.
+	for pos := since; pos < int64(len(m.log)) && len(revisions) < limit; pos++ {
+		if strings.HasPrefix(m.log[pos].Key, prefix) {
+			revisions = append(revisions, m.log[pos])
+		}
+	}
+	return revisions, nil
+}
+
+// CurrentIndex returns the modification index of the most recent write to
+// any key, or zero if nothing has been written.
+func (m *MemoryStore) CurrentIndex() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.log)), nil
+}
+
+// LastIndex returns the modification index of the most recent write to key,
+// including a delete, or zero if key has never been written.
+func (m *MemoryStore) LastIndex(key string) (int64, error) {
+	if key == "" {
+		return 0, emptyKeyError("last index")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	positions := m.byKey[key]
+	if len(positions) == 0 {
+		return 0, nil
+	}
+	return m.log[positions[len(positions)-1]].Index, nil
+}
+
+// PurgeExpired deletes every expired row, recording each as a delete
+// revision, and returns the number of rows deleted.
+func (m *MemoryStore) PurgeExpired() (int, error) {
+	now := time.Now()
+	var rowCount int
+	purgeErr := m.update(now, func(t *memTxn) error {
+		var keys []string
+		for key, row := range m.rows {
+			if !row.live(now) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			t.purgeExpired(key)
+		}
+		rowCount = len(keys)
+		return nil
+	})
+	if purgeErr != nil {
+		return 0, purgeErr
+	}
+	return rowCount, nil
+}
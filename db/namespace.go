@@ -0,0 +1,505 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Namespaces share the kv table. A key in namespace ns is stored as
+// nsKeyPrefix + ns + nsKeyPrefix + key, and the namespace itself is recorded
+// by the key nsRegistryPrefix + ns. Keys beginning with either prefix are
+// reserved and cannot be written to the default namespace. Namespace names
+// only use characters below 0x7f, so every reserved key sorts between
+// nsRegistryPrefix and nsReservedEnd.
+const (
+	nsRegistryPrefix = "\x1e"
+	nsKeyPrefix      = "\x1f"
+	nsReservedEnd    = "\x1f\x7f"
+)
+
+// DefaultNamespace names the namespace of keys written without one.
+const DefaultNamespace = "default"
+
+// namespaceName is the form of a namespace name.
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// NamespaceStats describes the unexpired keys in a namespace.
+type NamespaceStats struct {
+	Keys  int
+	Bytes int64
+}
+
+// CheckNamespace validates the name of a namespace.
+func CheckNamespace(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("namespace '%s' must be 1-64 of a-z, 0-9, _ and -, starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// reservedKey reports whether key is used to implement namespaces.
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, nsRegistryPrefix) || strings.HasPrefix(key, nsKeyPrefix)
+}
+
+// Namespace returns a Store holding only the keys of namespace name in
+// store. The default namespace holds every key that is not in a named
+// namespace, which is every key written before namespaces were used. The
+// modification index is shared by all namespaces, and PurgeExpired purges
+// every namespace. The namespace need not exist; see CreateNamespace.
+func Namespace(store Store, name string) (Store, error) {
+	if name == DefaultNamespace {
+		return &namespaceStore{store: store}, nil
+	}
+	nameErr := CheckNamespace(name)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	return &namespaceStore{store: store, prefix: nsKeyPrefix + name + nsKeyPrefix}, nil
+}
+
+// CreateNamespace records a new namespace. It reports false if the
+// namespace already exists.
+func CreateNamespace(store Store, name string) (bool, error) {
+	nameErr := CheckNamespace(name)
+	if nameErr != nil {
+		return false, nameErr
+	}
+	if name == DefaultNamespace {
+		return false, nil
+	}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	rowCount, createErr := store.CompareAndSwap(nsRegistryPrefix+name, 0, created)
+	return rowCount == 1, createErr
+}
+
+// NamespaceExists reports whether the namespace has been created. The
+// default namespace always exists.
+func NamespaceExists(store Store, name string) (bool, error) {
+	if name == DefaultNamespace {
+		return true, nil
+	}
+	if CheckNamespace(name) != nil {
+		return false, nil
+	}
+	_, found, getErr := store.Get(nsRegistryPrefix + name)
+	return found, getErr
+}
+
+// ListNamespaces returns the names of every namespace in sorted order,
+// starting with the default namespace.
+func ListNamespaces(store Store) ([]string, error) {
+	names := []string{DefaultNamespace}
+	after := ""
+	for {
+		entries, more, listErr := store.List(nsRegistryPrefix, nsRegistryPrefix+after, exportBatch)
+		if listErr != nil {
+			return nil, listErr
+		}
+		for _, entry := range entries {
+			after = strings.TrimPrefix(entry.Key, nsRegistryPrefix)
+			names = append(names, after)
+		}
+		if !more {
+			return names, nil
+		}
+	}
+}
+
+// DeleteNamespace deletes a namespace and every key in it in a single
+// transaction, as DeletePrefix does. It reports false if the namespace does
+// not exist. The default namespace cannot be deleted. The history of the
+// keys is kept, but hidden from a namespace later created with the same
+// name.
+func DeleteNamespace(store Store, name string) (bool, error) {
+	if name == DefaultNamespace {
+		return false, errors.New("cannot delete the default namespace")
+	}
+	if CheckNamespace(name) != nil {
+		return false, nil
+	}
+	deleted, deleteErr := deletePrefix(store, nsKeyPrefix+name+nsKeyPrefix, func() ([]Op, bool, error) {
+		registry, exists, getErr := store.GetEntry(nsRegistryPrefix + name)
+		return []Op{{Type: OpDelete, Key: nsRegistryPrefix + name, Index: registry.Index}}, exists, getErr
+	})
+	return deleted != 0, deleteErr
+}
+
+// namespaceStatser is implemented by a Store that can count the keys of a
+// namespace without reading them.
+type namespaceStatser interface {
+	// namespaceStats counts the unexpired keys beginning with prefix, which
+	// is a namespace's prefix or empty for the default namespace, and the
+	// bytes of their values.
+	namespaceStats(prefix string) (NamespaceStats, error)
+}
+
+var (
+	_ namespaceStatser = (*RscsDB)(nil)
+	_ namespaceStatser = (*MemoryStore)(nil)
+	_ namespaceStatser = (*FileStore)(nil)
+)
+
+// namespacePrefix returns the prefix of the namespace key is in, which is
+// empty for the default namespace. A namespace's registry key is in
+// nsRegistryPrefix, which is no namespace.
+func namespacePrefix(key string) string {
+	if strings.HasPrefix(key, nsRegistryPrefix) {
+		return nsRegistryPrefix
+	}
+	if strings.HasPrefix(key, nsKeyPrefix) {
+		if i := strings.Index(key[len(nsKeyPrefix):], nsKeyPrefix); i >= 0 {
+			return key[:len(nsKeyPrefix)+i+len(nsKeyPrefix)]
+		}
+	}
+	return ""
+}
+
+// Stats counts the unexpired keys in a Store returned by Namespace, and the
+// bytes taken by their values. Stores in this package count them without
+// reading every key.
+func Stats(store Store) (NamespaceStats, error) {
+	if n, ok := store.(*namespaceStore); ok {
+		if statser, ok := n.store.(namespaceStatser); ok {
+			return statser.namespaceStats(n.prefix)
+		}
+	}
+	var stats NamespaceStats
+	listErr := listAll(store, func(entry Entry) {
+		stats.Keys++
+		stats.Bytes += int64(len(entry.Value))
+	})
+	return stats, listErr
+}
+
+// namespaceStore is the Store returned by Namespace. It adds prefix to every
+// key passed in and removes it from every key returned. The default
+// namespace has no prefix but hides the reserved keys.
+type namespaceStore struct {
+	store  Store
+	prefix string
+}
+
+// key converts a key in the namespace to a key in the store. An empty key is
+// passed through so the store reports it as usual.
+func (n *namespaceStore) key(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	if n.prefix == "" && reservedKey(key) {
+		return "", &KeyError{Op: "access", Key: key, Err: ErrReservedKey}
+	}
+	return n.prefix + key, nil
+}
+
+// entry converts an entry from the store to one in the namespace.
+func (n *namespaceStore) entry(entry Entry) Entry {
+	entry.Key = strings.TrimPrefix(entry.Key, n.prefix)
+	return entry
+}
+
+// keyError converts a *KeyError from the store to one about the key in the
+// namespace. Other errors are returned as is.
+func (n *namespaceStore) keyError(err error) error {
+	if keyErr, ok := err.(*KeyError); ok && keyErr.Key != "" {
+		return &KeyError{Op: keyErr.Op, Key: strings.TrimPrefix(keyErr.Key, n.prefix), Err: keyErr.Err}
+	}
+	return err
+}
+
+// created returns the modification index at which the namespace was
+// created, or zero for the default namespace or one that does not exist.
+// Revisions from before it belong to a deleted namespace of the same name.
+func (n *namespaceStore) created() (int64, error) {
+	if n.prefix == "" {
+		return 0, nil
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(n.prefix, nsKeyPrefix), nsKeyPrefix)
+	registry, _, getErr := n.store.GetEntry(nsRegistryPrefix + name)
+	return registry.Index, getErr
+}
+
+// staleRevision reports whether revision of storeKey was written before the
+// namespace was created.
+func (n *namespaceStore) staleRevision(storeKey string, revision int) (bool, error) {
+	created, createdErr := n.created()
+	if createdErr != nil || created == 0 {
+		return false, createdErr
+	}
+	revisions, historyErr := n.store.History(storeKey)
+	if historyErr != nil {
+		return false, n.keyError(historyErr)
+	}
+	for _, rev := range revisions {
+		if rev.Revision == revision {
+			return rev.Index < created, nil
+		}
+	}
+	return false, nil
+}
+
+// txnError converts an error from the store's Txn to one about the keys in
+// the namespace. The reason of a *TxnError names the failed op's key quoted.
+func (n *namespaceStore) txnError(err error, ops, storeOps []Op) error {
+	txnErr, ok := err.(*TxnError)
+	if !ok || txnErr.Op < 0 || txnErr.Op >= len(ops) || n.prefix == "" {
+		return n.keyError(err)
+	}
+	reason := strings.Replace(txnErr.Reason, "'"+storeOps[txnErr.Op].Key+"'", "'"+ops[txnErr.Op].Key+"'", -1)
+	return &TxnError{Op: txnErr.Op, Reason: reason}
+}
+
+// revision converts a revision from the store to one in the namespace.
+func (n *namespaceStore) revision(rev Revision) Revision {
+	rev.Key = strings.TrimPrefix(rev.Key, n.prefix)
+	return rev
+}
+
+func (n *namespaceStore) DBFileName() string {
+	return n.store.DBFileName()
+}
+
+func (n *namespaceStore) Get(key string) (string, bool, error) {
+	entry, found, getErr := n.GetEntry(key)
+	return entry.Value, found, getErr
+}
+
+func (n *namespaceStore) GetEntry(key string) (Entry, bool, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return Entry{}, false, keyErr
+	}
+	entry, found, getErr := n.store.GetEntry(storeKey)
+	return n.entry(entry), found, n.keyError(getErr)
+}
+
+func (n *namespaceStore) List(prefix, after string, limit int) ([]Entry, bool, error) {
+	if n.prefix == "" && reservedKey(prefix) {
+		return []Entry{}, false, nil
+	}
+	entries, more, listErr := n.store.List(n.prefix+prefix, n.prefix+after, limit)
+	if listErr != nil {
+		return nil, false, listErr
+	}
+	if n.prefix == "" {
+		// The reserved keys sort together, so skip over them in one step.
+		for i := range entries {
+			if reservedKey(entries[i].Key) {
+				rest, restMore, restErr := n.store.List(prefix, nsReservedEnd, limit-i)
+				if restErr != nil {
+					return nil, false, restErr
+				}
+				return append(entries[:i], rest...), restMore, nil
+			}
+		}
+	}
+	for i := range entries {
+		entries[i] = n.entry(entries[i])
+	}
+	return entries, more, nil
+}
+
+func (n *namespaceStore) Insert(key, value string) (int, error) {
+	return n.InsertTTL(key, value, 0)
+}
+
+func (n *namespaceStore) InsertTTL(key, value string, ttl time.Duration) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	rowCount, insertErr := n.store.InsertTTL(storeKey, value, ttl)
+	return rowCount, n.keyError(insertErr)
+}
+
+func (n *namespaceStore) Update(key, value string) (int, error) {
+	return n.UpdateTTL(key, value, 0)
+}
+
+func (n *namespaceStore) UpdateTTL(key, value string, ttl time.Duration) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	rowCount, updateErr := n.store.UpdateTTL(storeKey, value, ttl)
+	return rowCount, n.keyError(updateErr)
+}
+
+func (n *namespaceStore) Delete(key string) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	rowCount, deleteErr := n.store.Delete(storeKey)
+	return rowCount, n.keyError(deleteErr)
+}
+
+func (n *namespaceStore) CompareAndSwap(key string, expectedIndex int64, value string) (int, error) {
+	return n.CompareAndSwapTTL(key, expectedIndex, value, 0)
+}
+
+func (n *namespaceStore) CompareAndSwapTTL(key string, expectedIndex int64, value string, ttl time.Duration) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	rowCount, swapErr := n.store.CompareAndSwapTTL(storeKey, expectedIndex, value, ttl)
+	return rowCount, n.keyError(swapErr)
+}
+
+func (n *namespaceStore) CompareAndDelete(key string, expectedIndex int64) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	rowCount, deleteErr := n.store.CompareAndDelete(storeKey, expectedIndex)
+	return rowCount, n.keyError(deleteErr)
+}
+
+func (n *namespaceStore) Upsert(key, value string) (bool, error) {
+	return n.UpsertTTL(key, value, 0)
+}
+
+func (n *namespaceStore) UpsertTTL(key, value string, ttl time.Duration) (bool, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return false, keyErr
+	}
+	created, upsertErr := n.store.UpsertTTL(storeKey, value, ttl)
+	return created, n.keyError(upsertErr)
+}
+
+func (n *namespaceStore) Modify(key string, f func(entry Entry) (string, error)) (Entry, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return Entry{}, keyErr
+	}
+	entry, modifyErr := n.store.Modify(storeKey, func(entry Entry) (string, error) {
+		return f(n.entry(entry))
+	})
+	if modifyErr != nil {
+		return Entry{}, n.keyError(modifyErr)
+	}
+	return n.entry(entry), nil
+}
+
+func (n *namespaceStore) Txn(ops []Op) ([]OpResult, error) {
+	storeOps := make([]Op, len(ops))
+	for i, op := range ops {
+		storeKey, keyErr := n.key(op.Key)
+		if keyErr != nil {
+			return nil, &TxnError{Op: i, Reason: keyErr.Error()}
+		}
+		storeOps[i] = op
+		storeOps[i].Key = storeKey
+	}
+	results, txnErr := n.store.Txn(storeOps)
+	if txnErr != nil {
+		return nil, n.txnError(txnErr, ops, storeOps)
+	}
+	for i := range results {
+		results[i].Key = ops[i].Key
+	}
+	return results, nil
+}
+
+func (n *namespaceStore) History(key string) ([]Revision, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	created, createdErr := n.created()
+	if createdErr != nil {
+		return nil, createdErr
+	}
+	revisions, historyErr := n.store.History(storeKey)
+	if historyErr != nil {
+		return nil, n.keyError(historyErr)
+	}
+	current := []Revision{}
+	for _, rev := range revisions {
+		if rev.Index > created {
+			current = append(current, n.revision(rev))
+		}
+	}
+	return current, nil
+}
+
+func (n *namespaceStore) GetRevision(key string, revision int) (string, bool, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return "", false, keyErr
+	}
+	stale, staleErr := n.staleRevision(storeKey, revision)
+	if staleErr != nil || stale {
+		return "", false, staleErr
+	}
+	value, found, getErr := n.store.GetRevision(storeKey, revision)
+	return value, found, n.keyError(getErr)
+}
+
+func (n *namespaceStore) Rollback(key string, revision int) (int, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	stale, staleErr := n.staleRevision(storeKey, revision)
+	if staleErr != nil || stale {
+		return 0, staleErr
+	}
+	rowCount, rollbackErr := n.store.Rollback(storeKey, revision)
+	return rowCount, n.keyError(rollbackErr)
+}
+
+func (n *namespaceStore) Changes(prefix string, since int64, limit int) ([]Revision, error) {
+	if n.prefix == "" && reservedKey(prefix) {
+		return []Revision{}, nil
+	}
+	created, createdErr := n.created()
+	if createdErr != nil {
+		return nil, createdErr
+	}
+	if since < created {
+		since = created
+	}
+	revisions := []Revision{}
+	for {
+		changes, changesErr := n.store.Changes(n.prefix+prefix, since, limit)
+		if changesErr != nil {
+			return nil, changesErr
+		}
+		for _, rev := range changes {
+			if n.prefix == "" && reservedKey(rev.Key) {
+				continue
+			}
+			revisions = append(revisions, n.revision(rev))
+			if len(revisions) == limit {
+				return revisions, nil
+			}
+		}
+		if len(changes) < limit {
+			return revisions, nil
+		}
+		since = changes[len(changes)-1].Index
+	}
+}
+
+func (n *namespaceStore) CurrentIndex() (int64, error) {
+	return n.store.CurrentIndex()
+}
+
+func (n *namespaceStore) LastIndex(key string) (int64, error) {
+	storeKey, keyErr := n.key(key)
+	if keyErr != nil {
+		return 0, keyErr
+	}
+	index, indexErr := n.store.LastIndex(storeKey)
+	return index, n.keyError(indexErr)
+}
+
+func (n *namespaceStore) PurgeExpired() (int, error) {
+	return n.store.PurgeExpired()
+}
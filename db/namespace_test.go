@@ -0,0 +1,240 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamespaces(t *testing.T) {
+	store := NewMemoryStore()
+	store.Insert("a", "default-a")
+
+	created, createErr := CreateNamespace(store, "team-1")
+	if createErr != nil || !created {
+		t.Fatalf("create: %v %v", created, createErr)
+	}
+	created, createErr = CreateNamespace(store, "team-1")
+	if createErr != nil || created {
+		t.Errorf("create existing: %v %v", created, createErr)
+	}
+	for _, bad := range []string{"", "Team", "-team", "a/b"} {
+		if _, badErr := CreateNamespace(store, bad); badErr == nil {
+			t.Errorf("create bad namespace '%s'", bad)
+		}
+	}
+
+	team, nsErr := Namespace(store, "team-1")
+	if nsErr != nil {
+		t.Fatalf("namespace: %s", nsErr.Error())
+	}
+	team.Insert("a", "team-a")
+	team.Insert("b", "team-b")
+
+	def, _ := Namespace(store, DefaultNamespace)
+	if value, _, _ := def.Get("a"); value != "default-a" {
+		t.Errorf("default a: %s", value)
+	}
+	if value, _, _ := team.Get("a"); value != "team-a" {
+		t.Errorf("team a: %s", value)
+	}
+	if _, found, _ := def.Get("b"); found {
+		t.Errorf("team key visible in default namespace")
+	}
+	if _, insertErr := def.Insert(nsKeyPrefix+"x", "v"); insertErr == nil {
+		t.Errorf("insert of reserved key")
+	}
+
+	entries, more, listErr := def.List("", "", 10)
+	if listErr != nil || more || len(entries) != 1 || entries[0].Key != "a" {
+		t.Errorf("default list: %+v %v %v", entries, more, listErr)
+	}
+	entries, _, _ = team.List("", "", 1)
+	if len(entries) != 1 || entries[0].Key != "a" {
+		t.Errorf("team list: %+v", entries)
+	}
+	exported, _ := Export(team)
+	if !reflect.DeepEqual(exported, map[string]string{"a": "team-a", "b": "team-b"}) {
+		t.Errorf("team export: %v", exported)
+	}
+	changes, _ := def.Changes("", 0, 10)
+	if len(changes) != 1 || changes[0].Key != "a" {
+		t.Errorf("default changes: %+v", changes)
+	}
+
+	results, txnErr := team.Txn([]Op{{Type: OpGet, Key: "b"}})
+	if txnErr != nil || results[0].Key != "b" || results[0].Value != "team-b" {
+		t.Errorf("team txn: %+v %v", results, txnErr)
+	}
+	_, txnErr = team.Txn([]Op{{Type: OpGet, Key: "b"}, {Type: OpInsert, Key: "a", Value: "x"}})
+	var conflict *TxnError
+	if !errors.As(txnErr, &conflict) || conflict.Op != 1 || conflict.Reason != "key 'a' exists" {
+		t.Errorf("team txn conflict: %v", txnErr)
+	}
+	_, txnErr = team.Txn([]Op{{Type: OpCheck, Key: "b", Index: 1}})
+	if !errors.As(txnErr, &conflict) || strings.Contains(conflict.Reason, "team-1") {
+		t.Errorf("team txn check: %v", txnErr)
+	}
+
+	// Errors name the key in the namespace, not in the store.
+	rscsDB, newErr := NewRscsDB(filepath.Join(t.TempDir(), "ns.db"))
+	if newErr != nil {
+		t.Fatalf("fail on new:%s", newErr.Error())
+	}
+	rscsDB.CreateTable()
+	CreateNamespace(rscsDB, "team-2")
+	sqliteTeam, _ := Namespace(rscsDB, "team-2")
+	sqliteTeam.Insert("a", "v")
+	for op, write := range map[string]func() error{
+		"insert": func() error { _, err := sqliteTeam.InsertTTL("b", sealedPrefix, 0); return err },
+		"update": func() error { _, err := sqliteTeam.UpdateTTL("a", sealedPrefix, 0); return err },
+		"upsert": func() error { _, err := sqliteTeam.UpsertTTL("a", sealedPrefix, 0); return err },
+		"cas":    func() error { _, err := sqliteTeam.CompareAndSwapTTL("a", 1, sealedPrefix, 0); return err },
+		"txn": func() error {
+			_, err := sqliteTeam.Txn([]Op{{Type: OpInsert, Key: "b", Value: sealedPrefix}})
+			return err
+		},
+	} {
+		var keyErr *KeyError
+		if writeErr := write(); !errors.As(writeErr, &keyErr) || keyErr.Key == "" || strings.Contains(keyErr.Error(), "team-2") {
+			t.Errorf("%s of a sealed-looking value: %v", op, writeErr)
+		}
+	}
+
+	stats, statsErr := Stats(team)
+	if statsErr != nil || stats.Keys != 2 || stats.Bytes != 12 {
+		t.Errorf("team stats: %+v %v", stats, statsErr)
+	}
+
+	names, _ := ListNamespaces(store)
+	if !reflect.DeepEqual(names, []string{DefaultNamespace, "team-1"}) {
+		t.Errorf("list namespaces: %v", names)
+	}
+
+	deleted, deleteErr := DeleteNamespace(store, "team-1")
+	if deleteErr != nil || !deleted {
+		t.Fatalf("delete: %v %v", deleted, deleteErr)
+	}
+	if exists, _ := NamespaceExists(store, "team-1"); exists {
+		t.Errorf("namespace exists after delete")
+	}
+	if _, found, _ := team.Get("a"); found {
+		t.Errorf("key survived namespace delete")
+	}
+	if _, found, _ := def.Get("a"); !found {
+		t.Errorf("namespace delete removed default key")
+	}
+	if _, deleteErr = DeleteNamespace(store, DefaultNamespace); deleteErr == nil {
+		t.Errorf("deleted default namespace")
+	}
+
+	// A namespace created again with the same name does not see the history
+	// of the deleted one.
+	CreateNamespace(store, "team-1")
+	if revisions, _ := team.History("a"); len(revisions) != 0 {
+		t.Errorf("history of a recreated namespace: %+v", revisions)
+	}
+	if _, found, _ := team.GetRevision("a", 1); found {
+		t.Errorf("revision of a deleted namespace found")
+	}
+	if rowCount, _ := team.Rollback("a", 1); rowCount != 0 {
+		t.Errorf("rolled back to a revision of a deleted namespace")
+	}
+	team.Insert("a", "again")
+	revisions, _ := team.History("a")
+	if len(revisions) != 1 || revisions[0].Value != "again" {
+		t.Errorf("history after insert in a recreated namespace: %+v", revisions)
+	}
+	if value, found, _ := team.GetRevision("a", revisions[0].Revision); !found || value != "again" {
+		t.Errorf("revision of a recreated namespace: %s %v", value, found)
+	}
+	changes, _ = team.Changes("", 0, 10)
+	if len(changes) != 1 || changes[0].Value != "again" {
+		t.Errorf("changes of a recreated namespace: %+v", changes)
+	}
+}
+
+// listedStats counts the keys of a namespace by listing them, as Stats does
+// for a Store that cannot count them itself.
+func listedStats(t *testing.T, store Store) NamespaceStats {
+	var stats NamespaceStats
+	listErr := listAll(store, func(entry Entry) {
+		stats.Keys++
+		stats.Bytes += int64(len(entry.Value))
+	})
+	if listErr != nil {
+		t.Fatalf("list:%s", listErr.Error())
+	}
+	return stats
+}
+
+func TestNamespaceStats(t *testing.T) {
+	dir := t.TempDir()
+	encrypted, _ := NewRscsDB(filepath.Join(dir, "encrypted.db"))
+	encrypted.CreateTable()
+	masterKey, _ := NewMasterKey()
+	keyFile := filepath.Join(dir, "keys")
+	ioutil.WriteFile(keyFile, []byte(masterKey), 0600)
+	keyring, _ := LoadKeyring(keyFile)
+	encrypted.SetKeyring(keyring)
+	plain, _ := NewRscsDB(filepath.Join(dir, "plain.db"))
+	plain.CreateTable()
+	fileStore, _ := NewFileStore(filepath.Join(dir, "store.log"))
+	defer fileStore.Close()
+
+	for name, store := range map[string]Store{
+		"sqlite":    plain,
+		"encrypted": encrypted,
+		"memory":    NewMemoryStore(),
+		"file":      fileStore,
+	} {
+		CreateNamespace(store, "team")
+		CreateNamespace(store, "team-b")
+		def, _ := Namespace(store, DefaultNamespace)
+		team, _ := Namespace(store, "team")
+		teamB, _ := Namespace(store, "team-b")
+
+		def.Insert("a", "héllo")
+		def.Insert("b", strings.Repeat("x", 1000))
+		def.InsertTTL("expiring", "gone soon", time.Millisecond)
+		def.InsertTTL("lasting", "stays", time.Hour)
+		team.Insert("a", "1")
+		team.Insert("b", "22")
+		team.Update("b", "333")
+		team.Insert("c", "")
+		team.Delete("a")
+		teamB.Insert("a", "4444")
+		time.Sleep(10 * time.Millisecond)
+
+		for nsName, ns := range map[string]Store{DefaultNamespace: def, "team": team, "team-b": teamB} {
+			stats, statsErr := Stats(ns)
+			if statsErr != nil {
+				t.Errorf("%s %s stats:%s", name, nsName, statsErr.Error())
+				continue
+			}
+			if want := listedStats(t, ns); stats != want {
+				t.Errorf("%s %s stats: %+v, listing counts %+v", name, nsName, stats, want)
+			}
+		}
+		if stats, _ := Stats(team); stats.Keys != 2 || stats.Bytes != 3 {
+			t.Errorf("%s team stats: %+v", name, stats)
+		}
+	}
+
+	// The running counts of a memory store follow a restore.
+	from, to := NewMemoryStore(), NewMemoryStore()
+	from.Insert("a", "123")
+	to.Insert("b", "1")
+	to.Insert("c", "1")
+	var backup strings.Builder
+	from.Backup(&backup)
+	to.Restore(strings.NewReader(backup.String()))
+	def, _ := Namespace(to, DefaultNamespace)
+	if stats, _ := Stats(def); stats.Keys != 1 || stats.Bytes != 3 {
+		t.Errorf("stats after restore: %+v", stats)
+	}
+}
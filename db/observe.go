@@ -0,0 +1,29 @@
+package db
+
+import "time"
+
+// OpObserver is told the name and duration of each operation on a RscsDB,
+// such as "get" or "txn", for metrics.
+type OpObserver func(op string, d time.Duration)
+
+// Observable is implemented by stores that report their operations to an
+// OpObserver.
+type Observable interface {
+	SetOpObserver(observer OpObserver)
+}
+
+var _ Observable = (*RscsDB)(nil)
+
+// SetOpObserver reports every later operation to observer. Call it before
+// the RscsDB is shared.
+func (r *RscsDB) SetOpObserver(observer OpObserver) {
+	r.observer = observer
+}
+
+// observe reports an operation begun at start, if there is an observer.
+// Defer it at the top of an operation.
+func (r *RscsDB) observe(op string, start time.Time) {
+	if r.observer != nil {
+		r.observer(op, time.Since(start))
+	}
+}
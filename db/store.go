@@ -0,0 +1,45 @@
+package db
+
+import "time"
+
+// Store is the storage the rscs server is built on. RscsDB is the SQLite
+// implementation; MemoryStore and FileStore need no cgo. Every
+// implementation records a revision for each write, gives it a modification
+// index that increases across all keys, and hides expired keys from reads.
+// See RscsDB for the contract of each method.
+type Store interface {
+	// DBFileName returns the file the store is kept in, if any.
+	DBFileName() string
+
+	Get(key string) (string, bool, error)
+	GetEntry(key string) (Entry, bool, error)
+	List(prefix, after string, limit int) ([]Entry, bool, error)
+
+	Insert(key, value string) (int, error)
+	InsertTTL(key, value string, ttl time.Duration) (int, error)
+	Update(key, value string) (int, error)
+	UpdateTTL(key, value string, ttl time.Duration) (int, error)
+	Delete(key string) (int, error)
+	CompareAndSwap(key string, expectedIndex int64, value string) (int, error)
+	CompareAndSwapTTL(key string, expectedIndex int64, value string, ttl time.Duration) (int, error)
+	CompareAndDelete(key string, expectedIndex int64) (int, error)
+	Upsert(key, value string) (bool, error)
+	UpsertTTL(key, value string, ttl time.Duration) (bool, error)
+	Modify(key string, f func(entry Entry) (string, error)) (Entry, error)
+	Txn(ops []Op) ([]OpResult, error)
+
+	History(key string) ([]Revision, error)
+	GetRevision(key string, revision int) (string, bool, error)
+	Rollback(key string, revision int) (int, error)
+
+	Changes(prefix string, since int64, limit int) ([]Revision, error)
+	CurrentIndex() (int64, error)
+	LastIndex(key string) (int64, error)
+	PurgeExpired() (int, error)
+}
+
+var (
+	_ Store = (*RscsDB)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*FileStore)(nil)
+)
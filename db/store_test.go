@@ -0,0 +1,258 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore checks the behavior every Store must share. The store must be
+// empty.
+func testStore(t *testing.T, store Store) {
+	rowCount, insertErr := store.Insert("store-a", "1")
+	if insertErr != nil || rowCount != 1 {
+		t.Fatalf("insert: %d %v", rowCount, insertErr)
+	}
+	_, insertErr = store.Insert("store-a", "1")
+	if !errors.Is(insertErr, ErrExists) {
+		t.Errorf("duplicate insert: %v", insertErr)
+	}
+	_, insertErr = store.Insert("", "1")
+	if !errors.Is(insertErr, ErrEmptyKey) {
+		t.Errorf("insert on empty key: %v", insertErr)
+	}
+	_, insertErr = store.Insert(strings.Repeat("k", MaxKeyLen+1), "1")
+	var keyErr *KeyError
+	if !errors.As(insertErr, &keyErr) || keyErr.Err != ErrKeyTooLong || keyErr.Op != "insert" {
+		t.Errorf("insert on long key: %v", insertErr)
+	}
+
+	entry, found, getErr := store.GetEntry("store-a")
+	if getErr != nil || !found || entry.Value != "1" || entry.Index != 1 {
+		t.Errorf("get entry: %+v %v %v", entry, found, getErr)
+	}
+
+	rowCount, updateErr := store.Update("store-a", "2")
+	if updateErr != nil || rowCount != 1 {
+		t.Errorf("update: %d %v", rowCount, updateErr)
+	}
+	rowCount, updateErr = store.Update("store-missing", "2")
+	if updateErr != nil || rowCount != 0 {
+		t.Errorf("update missing: %d %v", rowCount, updateErr)
+	}
+
+	rowCount, casErr := store.CompareAndSwap("store-a", 1, "3")
+	if casErr != nil || rowCount != 0 {
+		t.Errorf("stale compare and swap: %d %v", rowCount, casErr)
+	}
+	rowCount, casErr = store.CompareAndSwap("store-a", 2, "3")
+	if casErr != nil || rowCount != 1 {
+		t.Errorf("compare and swap: %d %v", rowCount, casErr)
+	}
+	rowCount, casErr = store.CompareAndSwap("store-b", 0, "1")
+	if casErr != nil || rowCount != 1 {
+		t.Errorf("compare and swap create: %d %v", rowCount, casErr)
+	}
+
+	rowCount, deleteErr := store.CompareAndDelete("store-b", 1)
+	if deleteErr != nil || rowCount != 0 {
+		t.Errorf("stale compare and delete: %d %v", rowCount, deleteErr)
+	}
+	rowCount, deleteErr = store.Delete("store-b")
+	if deleteErr != nil || rowCount != 1 {
+		t.Errorf("delete: %d %v", rowCount, deleteErr)
+	}
+
+	entries, more, listErr := store.List("store-", "", 10)
+	if listErr != nil || more || len(entries) != 1 || entries[0].Value != "3" {
+		t.Errorf("list: %+v %v %v", entries, more, listErr)
+	}
+
+	index, indexErr := store.CurrentIndex()
+	if indexErr != nil || index != 5 {
+		t.Errorf("current index: %d %v", index, indexErr)
+	}
+	index, indexErr = store.LastIndex("store-b")
+	if indexErr != nil || index != 5 {
+		t.Errorf("last index: %d %v", index, indexErr)
+	}
+
+	revisions, historyErr := store.History("store-a")
+	if historyErr != nil || len(revisions) != 3 || revisions[2].Revision != 3 || revisions[2].Index != 3 {
+		t.Errorf("history: %+v %v", revisions, historyErr)
+	}
+	rowCount, rollbackErr := store.Rollback("store-a", 1)
+	if rollbackErr != nil || rowCount != 1 {
+		t.Errorf("rollback: %d %v", rowCount, rollbackErr)
+	}
+	value, found, getErr := store.Get("store-a")
+	if getErr != nil || !found || value != "1" {
+		t.Errorf("get after rollback: %s %v %v", value, found, getErr)
+	}
+	_, rollbackErr = store.Rollback("store-b", 2)
+	if rollbackErr == nil {
+		t.Errorf("rollback to a delete")
+	}
+
+	changes, changesErr := store.Changes("store-b", 0, 10)
+	if changesErr != nil || len(changes) != 2 || !changes[1].Deleted || changes[1].Index != 5 {
+		t.Errorf("changes: %+v %v", changes, changesErr)
+	}
+
+	_, txnErr := store.Txn([]Op{
+		{Type: OpInsert, Key: "store-c", Value: "1"},
+		{Type: OpCheck, Key: "store-a", Index: 1},
+	})
+	if _, ok := txnErr.(*TxnError); !ok {
+		t.Errorf("failed txn: %v", txnErr)
+	}
+	_, found, _ = store.Get("store-c")
+	if found {
+		t.Errorf("failed txn wrote")
+	}
+	results, txnErr := store.Txn([]Op{
+		{Type: OpInsert, Key: "store-c", Value: "1"},
+		{Type: OpGet, Key: "store-c"},
+	})
+	if txnErr != nil || !results[1].Found || results[1].Index != 7 {
+		t.Errorf("txn: %+v %v", results, txnErr)
+	}
+
+	rowCount, insertErr = store.InsertTTL("store-d", "1", time.Millisecond)
+	if insertErr != nil || rowCount != 1 {
+		t.Errorf("insert ttl: %d %v", rowCount, insertErr)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, found, _ = store.Get("store-d")
+	if found {
+		t.Errorf("expired key found")
+	}
+	rowCount, purgeErr := store.PurgeExpired()
+	if purgeErr != nil || rowCount != 1 {
+		t.Errorf("purge: %d %v", rowCount, purgeErr)
+	}
+	revisions, _ = store.History("store-d")
+	if len(revisions) != 2 || !revisions[1].Deleted {
+		t.Errorf("purge not recorded: %+v", revisions)
+	}
+
+	created, upsertErr := store.Upsert("store-f", "1")
+	if upsertErr != nil || !created {
+		t.Errorf("upsert create: %v %v", created, upsertErr)
+	}
+	created, upsertErr = store.UpsertTTL("store-f", "2", time.Hour)
+	if upsertErr != nil || created {
+		t.Errorf("upsert update: %v %v", created, upsertErr)
+	}
+	entry, _, _ = store.GetEntry("store-f")
+	if entry.Value != "2" || entry.Expires.IsZero() {
+		t.Errorf("get after upsert: %+v", entry)
+	}
+
+	modified, modifyErr := store.Modify("store-f", func(entry Entry) (string, error) {
+		return entry.Value + "3", nil
+	})
+	if modifyErr != nil || modified.Value != "23" || modified.Index <= entry.Index || !modified.Expires.Equal(entry.Expires) {
+		t.Errorf("modify: %+v %v", modified, modifyErr)
+	}
+	failErr := errors.New("fail")
+	_, modifyErr = store.Modify("store-f", func(entry Entry) (string, error) {
+		return "", failErr
+	})
+	if modifyErr != failErr {
+		t.Errorf("failed modify: %v", modifyErr)
+	}
+	value, _, _ = store.Get("store-f")
+	if value != "23" {
+		t.Errorf("failed modify wrote: %s", value)
+	}
+	_, modifyErr = store.Modify("store-missing", func(entry Entry) (string, error) {
+		return "", nil
+	})
+	if !errors.Is(modifyErr, ErrNotFound) {
+		t.Errorf("modify missing: %v", modifyErr)
+	}
+
+	for _, key := range []string{"store-g/1", "store-g/2", "store-g2"} {
+		store.Insert(key, "g")
+	}
+	deleted, deleteErr := DeletePrefix(store, "store-g/")
+	if deleteErr != nil || deleted != 2 {
+		t.Errorf("delete prefix: %d %v", deleted, deleteErr)
+	}
+	if _, found, _ = store.Get("store-g2"); !found {
+		t.Errorf("delete prefix removed a key outside it")
+	}
+	deleted, deleteErr = DeletePrefix(store, "store-g/")
+	if deleteErr != nil || deleted != 0 {
+		t.Errorf("delete of an empty prefix: %d %v", deleted, deleteErr)
+	}
+}
+
+func TestStores(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("sqlite", func(t *testing.T) {
+		rscsDB, newErr := NewRscsDB(filepath.Join(dir, "store.db"))
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		createErr := rscsDB.CreateTable()
+		if createErr != nil {
+			t.Fatalf("fail on create table:%s", createErr.Error())
+		}
+		testStore(t, rscsDB)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, NewMemoryStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(dir, "store.log")
+		fileStore, newErr := NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		testStore(t, fileStore)
+		fileStore.Close()
+
+		// Simulate a crash part way through writing a transaction.
+		file, openErr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if openErr != nil {
+			t.Fatalf("fail on open:%s", openErr.Error())
+		}
+		file.WriteString(`[{"Key":"store-e"`)
+		file.Close()
+
+		fileStore, newErr = NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on reopen:%s", newErr.Error())
+		}
+		defer fileStore.Close()
+		value, found, getErr := fileStore.Get("store-a")
+		if getErr != nil || !found || value != "1" {
+			t.Errorf("get after reopen: %s %v %v", value, found, getErr)
+		}
+		index, _ := fileStore.CurrentIndex()
+		if index != 17 {
+			t.Errorf("index after reopen: %d", index)
+		}
+		rowCount, insertErr := fileStore.Insert("store-e", "1")
+		if insertErr != nil || rowCount != 1 {
+			t.Errorf("insert after reopen: %d %v", rowCount, insertErr)
+		}
+		revisions, _ := fileStore.History("store-e")
+		if len(revisions) != 1 || revisions[0].Index != 18 {
+			t.Errorf("history after reopen: %+v", revisions)
+		}
+	})
+}
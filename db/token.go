@@ -0,0 +1,364 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenTableName is the table of bearer tokens, kept apart from the kv
+	// table so tokens are never visible as keys.
+	TokenTableName = "tokens"
+	// TokenIDColumn is the public part of a token, used to look it up.
+	TokenIDColumn = "id"
+	// TokenHashColumn is the SHA-256 hash of the secret part of a token.
+	TokenHashColumn = "hash"
+	// TokenAdminColumn is nonzero for a token that may do anything.
+	TokenAdminColumn = "admin"
+	// TokenPoliciesColumn holds the policies of a token as JSON.
+	TokenPoliciesColumn = "policies"
+	// TokenCreatedColumn is when the token was minted, in unix nanoseconds.
+	TokenCreatedColumn = "created"
+)
+
+// Permission is an action a Policy grants on keys.
+type Permission string
+
+const (
+	// PermRead allows getting, listing, watching and exporting keys.
+	PermRead Permission = "read"
+	// PermWrite allows inserting, updating, rolling back and importing keys.
+	PermWrite Permission = "write"
+	// PermDelete allows deleting keys.
+	PermDelete Permission = "delete"
+)
+
+// Policy grants Permissions on the keys beginning with Prefix in Namespace.
+// An empty Namespace is the default namespace, and an empty Prefix covers
+// every key in it.
+type Policy struct {
+	Namespace   string
+	Prefix      string
+	Permissions []Permission
+}
+
+// Token is a bearer token. Its holder presents ID and the secret joined by
+// a '.', and only the SHA-256 Hash of the secret is stored. An Admin token
+// may do anything, including minting other tokens; any other token may only
+// do what its Policies grant.
+type Token struct {
+	ID       string
+	Hash     string
+	Admin    bool
+	Policies []Policy
+	Created  time.Time
+}
+
+// TokenStore is implemented by a Store that can keep bearer tokens. Every
+// Store in this package is a TokenStore.
+type TokenStore interface {
+	// PutToken adds a new token. It fails if the ID is taken.
+	PutToken(token Token) error
+	GetToken(id string) (Token, bool, error)
+	// ListTokens returns every token, sorted by ID.
+	ListTokens() ([]Token, error)
+	// DeleteToken revokes a token. It reports false if there is no such token.
+	DeleteToken(id string) (bool, error)
+}
+
+var (
+	_ TokenStore = (*RscsDB)(nil)
+	_ TokenStore = (*MemoryStore)(nil)
+	_ TokenStore = (*FileStore)(nil)
+)
+
+// errTokenExists is returned when a token ID is reused.
+var errTokenExists = errors.New("token id exists")
+
+// CheckPolicy validates a policy.
+func CheckPolicy(policy Policy) error {
+	if policy.Namespace != "" {
+		nameErr := CheckNamespace(policy.Namespace)
+		if nameErr != nil {
+			return nameErr
+		}
+	}
+	if len(policy.Permissions) == 0 {
+		return errors.New("policy grants no permissions")
+	}
+	for _, perm := range policy.Permissions {
+		switch perm {
+		case PermRead, PermWrite, PermDelete:
+		default:
+			return fmt.Errorf("unknown permission '%s'", perm)
+		}
+	}
+	return nil
+}
+
+// NewToken mints a token with the given policies. It returns the token to
+// store and the bearer string to hand to its holder, which cannot be
+// recovered later.
+func NewToken(admin bool, policies []Policy) (Token, string, error) {
+	for _, policy := range policies {
+		policyErr := CheckPolicy(policy)
+		if policyErr != nil {
+			return Token{}, "", policyErr
+		}
+	}
+	id, idErr := randomHex(8)
+	if idErr != nil {
+		return Token{}, "", idErr
+	}
+	secret, secretErr := randomHex(32)
+	if secretErr != nil {
+		return Token{}, "", secretErr
+	}
+	if policies == nil {
+		policies = []Policy{}
+	}
+	token := Token{
+		ID:       id,
+		Hash:     hashSecret(secret),
+		Admin:    admin,
+		Policies: policies,
+		Created:  time.Now().UTC().Round(0)}
+	return token, id + "." + secret, nil
+}
+
+// Authenticate returns the token a bearer string was minted for. It reports
+// false if the bearer string is malformed, revoked or wrong.
+func Authenticate(tokens TokenStore, bearer string) (Token, bool, error) {
+	i := strings.IndexByte(bearer, '.')
+	if i < 1 {
+		return Token{}, false, nil
+	}
+	token, found, getErr := tokens.GetToken(bearer[:i])
+	if getErr != nil || !found {
+		return Token{}, false, getErr
+	}
+	hash := hashSecret(bearer[i+1:])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 {
+		return Token{}, false, nil
+	}
+	return token, true, nil
+}
+
+// Allows reports whether the token grants perm on key, or on every key
+// beginning with key when key is a list prefix, in namespace.
+func (t Token) Allows(namespace, key string, perm Permission) bool {
+	if t.Admin {
+		return true
+	}
+	for _, policy := range t.Policies {
+		policyNamespace := policy.Namespace
+		if policyNamespace == "" {
+			policyNamespace = DefaultNamespace
+		}
+		if policyNamespace != namespace || !strings.HasPrefix(key, policy.Prefix) {
+			continue
+		}
+		for _, granted := range policy.Permissions {
+			if granted == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AllowsNamespace reports whether the token grants any permission on any
+// key in namespace.
+func (t Token) AllowsNamespace(namespace string) bool {
+	if t.Admin {
+		return true
+	}
+	for _, policy := range t.Policies {
+		if policy.Namespace == namespace || (policy.Namespace == "" && namespace == DefaultNamespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, readErr := rand.Read(b)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret is how the secret part of a token is stored.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createTokenTable creates the token table if it is missing, as it is in
+// databases created before tokens were added. It runs when the db is opened
+// and after a restore, not on every token lookup.
+func (r *RscsDB) createTokenTable() error {
+	queryStr := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(255) PRIMARY KEY, %s TEXT NOT NULL, %s INTEGER NOT NULL, %s TEXT NOT NULL, %s INTEGER NOT NULL)",
+		TokenTableName, TokenIDColumn, TokenHashColumn, TokenAdminColumn,
+		TokenPoliciesColumn, TokenCreatedColumn)
+	_, createErr := r.db.Exec(queryStr)
+	return createErr
+}
+
+// PutToken adds a new token to the token table.
+func (r *RscsDB) PutToken(token Token) error {
+	policies, jsonErr := json.Marshal(token.Policies)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return r.withTx(func(tx *sql.Tx) error {
+		queryStr := fmt.Sprintf("INSERT OR IGNORE INTO %s (%s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5)",
+			TokenTableName, TokenIDColumn, TokenHashColumn, TokenAdminColumn,
+			TokenPoliciesColumn, TokenCreatedColumn)
+		rowCount, execErr := execRowCount(tx, queryStr, token.ID, token.Hash, token.Admin,
+			string(policies), token.Created.UnixNano())
+		if execErr != nil {
+			return execErr
+		}
+		if rowCount == 0 {
+			return errTokenExists
+		}
+		return nil
+	})
+}
+
+// GetToken returns the token with the given ID.
+func (r *RscsDB) GetToken(id string) (Token, bool, error) {
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM %s WHERE %s = $1",
+		TokenIDColumn, TokenHashColumn, TokenAdminColumn, TokenPoliciesColumn,
+		TokenCreatedColumn, TokenTableName, TokenIDColumn)
+	rows, queryErr := r.db.Query(queryStr, id)
+	if queryErr != nil {
+		return Token{}, false, queryErr
+	}
+	tokens, scanErr := scanTokens(rows)
+	if scanErr != nil || len(tokens) == 0 {
+		return Token{}, false, scanErr
+	}
+	return tokens[0], true, nil
+}
+
+// ListTokens returns every token in the token table, sorted by ID.
+func (r *RscsDB) ListTokens() ([]Token, error) {
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM %s ORDER BY %s",
+		TokenIDColumn, TokenHashColumn, TokenAdminColumn, TokenPoliciesColumn,
+		TokenCreatedColumn, TokenTableName, TokenIDColumn)
+	rows, queryErr := r.db.Query(queryStr)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	return scanTokens(rows)
+}
+
+// DeleteToken removes a token from the token table.
+func (r *RscsDB) DeleteToken(id string) (bool, error) {
+	var rowCount int
+	deleteErr := r.withTx(func(tx *sql.Tx) error {
+		queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", TokenTableName, TokenIDColumn)
+		var execErr error
+		rowCount, execErr = execRowCount(tx, queryStr, id)
+		return execErr
+	})
+	return rowCount == 1, deleteErr
+}
+
+// scanTokens reads and closes rows selected from the token table.
+func scanTokens(rows *sql.Rows) ([]Token, error) {
+	defer rows.Close()
+	tokens := []Token{}
+	for rows.Next() {
+		var token Token
+		var policies string
+		var created int64
+		scanErr := rows.Scan(&token.ID, &token.Hash, &token.Admin, &policies, &created)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		umErr := json.Unmarshal([]byte(policies), &token.Policies)
+		if umErr != nil {
+			return nil, umErr
+		}
+		token.Created = time.Unix(0, created).UTC()
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// PutToken adds a new token to the store.
+func (m *MemoryStore) PutToken(token Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.tokens[token.ID]; found {
+		return errTokenExists
+	}
+	m.tokens[token.ID] = token
+	if m.persistTokens != nil {
+		persistErr := m.persistTokens(m.tokens)
+		if persistErr != nil {
+			delete(m.tokens, token.ID)
+			return persistErr
+		}
+	}
+	return nil
+}
+
+// GetToken returns the token with the given ID.
+func (m *MemoryStore) GetToken(id string) (Token, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	token, found := m.tokens[id]
+	return token, found, nil
+}
+
+// ListTokens returns every token in the store, sorted by ID.
+func (m *MemoryStore) ListTokens() ([]Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return sortedTokens(m.tokens), nil
+}
+
+// DeleteToken removes a token from the store.
+func (m *MemoryStore) DeleteToken(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, found := m.tokens[id]
+	if !found {
+		return false, nil
+	}
+	delete(m.tokens, id)
+	if m.persistTokens != nil {
+		persistErr := m.persistTokens(m.tokens)
+		if persistErr != nil {
+			m.tokens[id] = token
+			return false, persistErr
+		}
+	}
+	return true, nil
+}
+
+// sortedTokens returns the tokens in a map, sorted by ID.
+func sortedTokens(tokenMap map[string]Token) []Token {
+	tokens := make([]Token, 0, len(tokenMap))
+	for _, token := range tokenMap {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTokens checks a TokenStore through minting, authenticating and
+// revoking a token.
+func testTokens(t *testing.T, tokens TokenStore) {
+	policies := []Policy{{Prefix: "app/", Permissions: []Permission{PermRead, PermWrite}}}
+	token, bearer, newErr := NewToken(false, policies)
+	if newErr != nil {
+		t.Fatalf("new token:%s", newErr.Error())
+	}
+	putErr := tokens.PutToken(token)
+	if putErr != nil {
+		t.Fatalf("put token:%s", putErr.Error())
+	}
+	if tokens.PutToken(token) == nil {
+		t.Errorf("put token with existing id")
+	}
+
+	found, ok, authErr := Authenticate(tokens, bearer)
+	if authErr != nil || !ok || found.ID != token.ID || len(found.Policies) != 1 {
+		t.Errorf("authenticate: %+v %v %v", found, ok, authErr)
+	}
+	for _, bad := range []string{"", token.ID, token.ID + ".wrong", "nosuchid.secret"} {
+		if _, ok, _ = Authenticate(tokens, bad); ok {
+			t.Errorf("authenticated '%s'", bad)
+		}
+	}
+
+	list, listErr := tokens.ListTokens()
+	if listErr != nil || len(list) != 1 || list[0].Hash != token.Hash {
+		t.Errorf("list tokens: %+v %v", list, listErr)
+	}
+
+	deleted, deleteErr := tokens.DeleteToken(token.ID)
+	if deleteErr != nil || !deleted {
+		t.Errorf("delete token: %v %v", deleted, deleteErr)
+	}
+	if _, ok, _ = Authenticate(tokens, bearer); ok {
+		t.Errorf("authenticated revoked token")
+	}
+	if deleted, _ = tokens.DeleteToken(token.ID); deleted {
+		t.Errorf("deleted missing token")
+	}
+}
+
+func TestTokenStores(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("sqlite", func(t *testing.T) {
+		rscsDB, newErr := NewRscsDB(filepath.Join(dir, "tokens.db"))
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		testTokens(t, rscsDB)
+
+		// A db from before tokens gets its token table when it is opened.
+		rscsDB.db.Exec("DROP TABLE " + TokenTableName)
+		rscsDB.db.Close()
+		rscsDB, newErr = NewRscsDB(filepath.Join(dir, "tokens.db"))
+		if newErr != nil {
+			t.Fatalf("fail on reopen:%s", newErr.Error())
+		}
+		defer rscsDB.db.Close()
+		if _, listErr := rscsDB.ListTokens(); listErr != nil {
+			t.Errorf("list tokens after reopen:%s", listErr.Error())
+		}
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		testTokens(t, NewMemoryStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(dir, "tokens.log")
+		fileStore, newErr := NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on new:%s", newErr.Error())
+		}
+		testTokens(t, fileStore)
+		token, bearer, _ := NewToken(true, nil)
+		fileStore.PutToken(token)
+		fileStore.Close()
+
+		fileStore, newErr = NewFileStore(path)
+		if newErr != nil {
+			t.Fatalf("fail on reopen:%s", newErr.Error())
+		}
+		defer fileStore.Close()
+		found, ok, _ := Authenticate(fileStore, bearer)
+		if !ok || !found.Admin {
+			t.Errorf("token lost on reopen: %+v", found)
+		}
+	})
+}
+
+func TestTokenAllows(t *testing.T) {
+	token := Token{Policies: []Policy{
+		{Prefix: "app/", Permissions: []Permission{PermRead}},
+		{Namespace: "payments", Prefix: "", Permissions: []Permission{PermWrite, PermDelete}},
+	}}
+	cases := []struct {
+		namespace, key string
+		perm           Permission
+		allowed        bool
+	}{
+		{DefaultNamespace, "app/a", PermRead, true},
+		{DefaultNamespace, "app/", PermRead, true},
+		{DefaultNamespace, "app/a", PermWrite, false},
+		{DefaultNamespace, "", PermRead, false},
+		{DefaultNamespace, "other", PermRead, false},
+		{"payments", "anything", PermDelete, true},
+		{"payments", "app/a", PermRead, false},
+	}
+	for _, c := range cases {
+		if token.Allows(c.namespace, c.key, c.perm) != c.allowed {
+			t.Errorf("allows %s %s %s: not %v", c.namespace, c.key, c.perm, c.allowed)
+		}
+	}
+	if !(Token{Admin: true}).Allows("payments", "", PermDelete) {
+		t.Errorf("admin token not allowed")
+	}
+
+	for _, bad := range []Policy{
+		{Prefix: "a"},
+		{Prefix: "a", Permissions: []Permission{"frob"}},
+		{Namespace: "Bad!", Prefix: "a", Permissions: []Permission{PermRead}},
+	} {
+		if _, _, newErr := NewToken(false, []Policy{bad}); newErr == nil {
+			t.Errorf("minted token with bad policy %+v", bad)
+		}
+	}
+}
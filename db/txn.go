@@ -0,0 +1,270 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// OpType names the operation an Op performs.
+type OpType string
+
+const (
+	// OpGet reads a key. A missing key is not a failure.
+	OpGet OpType = "get"
+	// OpInsert creates a key that must not exist.
+	OpInsert OpType = "insert"
+	// OpUpdate changes a key that must exist.
+	OpUpdate OpType = "update"
+	// OpDelete removes a key that must exist.
+	OpDelete OpType = "delete"
+	// OpCheck fails unless the key has the given modification index.
+	OpCheck OpType = "check"
+)
+
+// Op is one operation in a Txn. Value and TTL apply to inserts and updates.
+// A nonzero Index makes an update or delete conditional on the row still
+// having that modification index. For a check, Index is the modification
+// index the key must have, where zero means the key must not exist.
+type Op struct {
+	Type  OpType
+	Key   string
+	Value string
+	TTL   time.Duration
+	Index int64
+}
+
+// OpResult is the outcome of one Op. It describes the row as the op left it:
+// as read for a get or check, or as written for an insert or update, with
+// Index the new modification index. Found is false if there is no row, as
+// after a delete, whose Index is that of the delete.
+type OpResult struct {
+	Type    OpType
+	Key     string
+	Value   string
+	Index   int64
+	Expires time.Time
+	Found   bool
+}
+
+// TxnError reports the op that caused a Txn to fail. Nothing in the Txn was
+// written.
+type TxnError struct {
+	Op     int
+	Reason string
+}
+
+// Error describes the failed op.
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("txn op %d: %s", e.Op, e.Reason)
+}
+
+// txnBackend is what a Store's transaction offers Txn. Each write returns
+// the new modification index, or zero if nothing was written.
+type txnBackend interface {
+	get(key string) (Entry, bool, error)
+	create(key, value string, expires int64) (int64, error)
+	update(key, value string, expires, expectedIndex int64) (int64, error)
+	delete(key string, expectedIndex int64) (int64, error)
+}
+
+// sqlTxn is the txnBackend of an RscsDB transaction. Values are sealed and
+// opened with the RscsDB's keyring.
+type sqlTxn struct {
+	r   *RscsDB
+	tx  *sql.Tx
+	now time.Time
+}
+
+func (t sqlTxn) get(key string) (Entry, bool, error) {
+	entry, found, getErr := getTx(t.tx, key, t.now)
+	if getErr != nil || !found {
+		return entry, found, getErr
+	}
+	entry.Value, getErr = t.r.open(key, entry.Value)
+	return entry, getErr == nil, getErr
+}
+
+func (t sqlTxn) create(key, value string, expires int64) (int64, error) {
+	stored, sealErr := t.r.seal(key, value)
+	if sealErr != nil {
+		return 0, sealErr
+	}
+	return createTx(t.tx, key, stored, expires, t.now)
+}
+
+func (t sqlTxn) update(key, value string, expires, expectedIndex int64) (int64, error) {
+	stored, sealErr := t.r.seal(key, value)
+	if sealErr != nil {
+		return 0, sealErr
+	}
+	return updateTx(t.tx, key, stored, expires, expectedIndex, t.now)
+}
+
+func (t sqlTxn) delete(key string, expectedIndex int64) (int64, error) {
+	return deleteTx(t.tx, key, expectedIndex, t.now)
+}
+
+// Txn runs ops in order inside a single transaction, so either every op
+// succeeds or nothing is written. Later ops see the writes of earlier ones.
+// If an op cannot be applied, for example an insert of a key that exists or
+// a failed check, the error is a *TxnError naming it; any other error comes
+// from the database.
+func (r *RscsDB) Txn(ops []Op) ([]OpResult, error) {
+	defer r.observe("txn", time.Now())
+	now := time.Now()
+	return runTxn(ops, now, func(apply func(txnBackend) error) error {
+		return r.withTx(func(tx *sql.Tx) error {
+			return apply(sqlTxn{r: r, tx: tx, now: now})
+		})
+	})
+}
+
+// deletePrefixAttempts bounds how often DeletePrefix lists the keys again
+// after one of them changed before its transaction committed.
+const deletePrefixAttempts = 5
+
+// DeletePrefix deletes every key beginning with prefix in a single Txn, so
+// either all of them are deleted or none are. Each delete is conditional on
+// the modification index the key was listed with; if a key changes first,
+// the keys are listed and the Txn tried again. It returns the number of keys
+// deleted.
+func DeletePrefix(store Store, prefix string) (int, error) {
+	return deletePrefix(store, prefix, func() ([]Op, bool, error) {
+		return nil, true, nil
+	})
+}
+
+// deletePrefix is DeletePrefix with the ops returned by first run ahead of
+// the deletes, and counted with them. If first reports false nothing is
+// deleted.
+func deletePrefix(store Store, prefix string, first func() ([]Op, bool, error)) (int, error) {
+	for attempt := 1; ; attempt++ {
+		ops, ok, firstErr := first()
+		if firstErr != nil || !ok {
+			return 0, firstErr
+		}
+		after := ""
+		for {
+			entries, more, listErr := store.List(prefix, after, exportBatch)
+			if listErr != nil {
+				return 0, listErr
+			}
+			for _, entry := range entries {
+				ops = append(ops, Op{Type: OpDelete, Key: entry.Key, Index: entry.Index})
+				after = entry.Key
+			}
+			if !more {
+				break
+			}
+		}
+		if len(ops) == 0 {
+			return 0, nil
+		}
+		_, txnErr := store.Txn(ops)
+		if _, changed := txnErr.(*TxnError); changed && attempt < deletePrefixAttempts {
+			continue
+		}
+		if txnErr != nil {
+			return 0, txnErr
+		}
+		return len(ops), nil
+	}
+}
+
+// runTxn implements Txn for every Store. inTxn must call apply with a
+// transaction that is committed only if apply returns no error.
+func runTxn(ops []Op, now time.Time, inTxn func(apply func(txnBackend) error) error) ([]OpResult, error) {
+	for i, op := range ops {
+		opErr := checkOp(op)
+		if opErr != nil {
+			return nil, &TxnError{Op: i, Reason: opErr.Error()}
+		}
+	}
+	results := make([]OpResult, len(ops))
+	txnErr := inTxn(func(b txnBackend) error {
+		for i, op := range ops {
+			result, reason, opErr := applyOp(b, op, now)
+			if opErr != nil {
+				return opErr
+			}
+			if reason != "" {
+				return &TxnError{Op: i, Reason: reason}
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if txnErr != nil {
+		return nil, txnErr
+	}
+	return results, nil
+}
+
+// checkOp validates an op before the transaction starts.
+func checkOp(op Op) error {
+	switch op.Type {
+	case OpGet, OpInsert, OpUpdate, OpDelete, OpCheck:
+	default:
+		return fmt.Errorf("unknown op type '%s'", op.Type)
+	}
+	keyErr := checkKey(string(op.Type), op.Key)
+	if keyErr != nil {
+		return keyErr
+	}
+	return checkTTL(op.TTL)
+}
+
+// applyOp runs one op in a transaction. A non-empty reason means the op
+// could not be applied and the transaction must not commit.
+func applyOp(b txnBackend, op Op, now time.Time) (OpResult, string, error) {
+	result := OpResult{Type: op.Type, Key: op.Key}
+	expires := expiresAt(now, op.TTL)
+	switch op.Type {
+	case OpGet, OpCheck:
+		entry, found, getErr := b.get(op.Key)
+		if getErr != nil {
+			return result, "", getErr
+		}
+		result.Value, result.Index, result.Expires, result.Found = entry.Value, entry.Index, entry.Expires, found
+		if op.Type == OpCheck && entry.Index != op.Index {
+			return result, fmt.Sprintf("key '%s' has index %d, not %d", op.Key, entry.Index, op.Index), nil
+		}
+	case OpInsert:
+		index, execErr := b.create(op.Key, op.Value, expires)
+		if execErr != nil {
+			return result, "", execErr
+		}
+		if index == 0 {
+			return result, fmt.Sprintf("key '%s' exists", op.Key), nil
+		}
+		result.Value, result.Index, result.Expires, result.Found = op.Value, index, expiresTime(expires), true
+	case OpUpdate:
+		index, execErr := b.update(op.Key, op.Value, expires, op.Index)
+		if execErr != nil {
+			return result, "", execErr
+		}
+		if index == 0 {
+			return result, missingReason(op), nil
+		}
+		result.Value, result.Index, result.Expires, result.Found = op.Value, index, expiresTime(expires), true
+	case OpDelete:
+		index, execErr := b.delete(op.Key, op.Index)
+		if execErr != nil {
+			return result, "", execErr
+		}
+		if index == 0 {
+			return result, missingReason(op), nil
+		}
+		result.Index = index
+	}
+	return result, "", nil
+}
+
+// missingReason explains why an update or delete wrote nothing.
+func missingReason(op Op) string {
+	if op.Index != 0 {
+		return fmt.Sprintf("key '%s' not found at index %d", op.Key, op.Index)
+	}
+	return fmt.Sprintf("no key '%s' found", op.Key)
+}
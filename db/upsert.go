@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// upsertTx writes value to key in b, creating the key if it does not exist
+// and otherwise replacing its value and expiry. It reports whether the key
+// was created.
+func upsertTx(b txnBackend, key, value string, expires int64) (bool, error) {
+	entry, found, getErr := b.get(key)
+	if getErr != nil {
+		return false, getErr
+	}
+	if !found {
+		_, createErr := b.create(key, value, expires)
+		return createErr == nil, createErr
+	}
+	_, updateErr := b.update(key, value, expires, entry.Index)
+	return false, updateErr
+}
+
+// modifyTx replaces the value of key in b with what f makes of its current
+// entry. The key keeps its expiry. The entry as written is returned.
+func modifyTx(b txnBackend, key string, f func(entry Entry) (string, error)) (Entry, error) {
+	entry, found, getErr := b.get(key)
+	if getErr != nil {
+		return Entry{}, getErr
+	}
+	if !found {
+		return Entry{}, &KeyError{Op: "modify", Key: key, Err: ErrNotFound}
+	}
+	value, fErr := f(entry)
+	if fErr != nil {
+		return Entry{}, fErr
+	}
+	var expires int64
+	if !entry.Expires.IsZero() {
+		expires = entry.Expires.UnixNano()
+	}
+	index, updateErr := b.update(key, value, expires, entry.Index)
+	if updateErr != nil {
+		return Entry{}, updateErr
+	}
+	return Entry{Key: key, Value: value, Index: index, Expires: entry.Expires}, nil
+}
+
+// Upsert will set the value of key, whether or not it exists, and reports
+// whether it was created. Any expiry the row had is cleared.
+func (r *RscsDB) Upsert(key, value string) (bool, error) {
+	return r.UpsertTTL(key, value, 0)
+}
+
+// UpsertTTL is like Upsert but the value expires after ttl. A zero ttl
+// never expires. The existence check and the write are one transaction, so
+// there is no race between them.
+func (r *RscsDB) UpsertTTL(key, value string, ttl time.Duration) (bool, error) {
+	defer r.observe("upsert", time.Now())
+	keyErr := checkKey("upsert", key)
+	if keyErr != nil {
+		return false, keyErr
+	}
+	ttlErr := checkTTL(ttl)
+	if ttlErr != nil {
+		return false, ttlErr
+	}
+	now := time.Now()
+	var created bool
+	upsertErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		created, execErr = upsertTx(sqlTxn{r: r, tx: tx, now: now}, key, value, expiresAt(now, ttl))
+		return execErr
+	})
+	if upsertErr != nil {
+		return false, upsertErr
+	}
+	return created, nil
+}
+
+// Modify reads key and replaces its value with what f returns, in a single
+// transaction, so no other write can come between the read and the write.
+// The key keeps its expiry. A missing key is an ErrNotFound error, and an
+// error from f is returned as is, with nothing written. The entry as written
+// is returned.
+func (r *RscsDB) Modify(key string, f func(entry Entry) (string, error)) (Entry, error) {
+	defer r.observe("modify", time.Now())
+	if key == "" {
+		return Entry{}, emptyKeyError("modify")
+	}
+	now := time.Now()
+	var entry Entry
+	modifyErr := r.withTx(func(tx *sql.Tx) error {
+		var execErr error
+		entry, execErr = modifyTx(sqlTxn{r: r, tx: tx, now: now}, key, f)
+		return execErr
+	})
+	if modifyErr != nil {
+		return Entry{}, modifyErr
+	}
+	return entry, nil
+}
@@ -0,0 +1,18 @@
+module github.com/bradclawsie/rscs
+
+go 1.22.0
+
+require (
+	github.com/go-chi/chi v4.1.2+incompatible
+	github.com/mattn/go-sqlite3 v1.14.33
+	google.golang.org/grpc v1.71.1
+	google.golang.org/protobuf v1.36.6
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250115164207-1a7da9e5054f // indirect
+)
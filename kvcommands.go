@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradclawsie/rscs/client"
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// outputRaw prints values as they are, and keys one per line.
+	outputRaw = "raw"
+	// outputJSON prints JSON, one object per line when streaming.
+	outputJSON = "json"
+	// outputTable prints aligned columns with a header.
+	outputTable = "table"
+	// listBatch is how many entries are read from a store at a time.
+	listBatch = 1000
+	// watchPollInterval is how often watching a store directly checks it for
+	// changes, there being no daemon to be told of them.
+	watchPollInterval = time.Second
+)
+
+// keys reads and writes keys, either through a daemon or directly in a
+// store.
+type keys interface {
+	get(key string) (client.Entry, error)
+	create(key, value string, ttl time.Duration) error
+	put(key, value string, ttl time.Duration) error
+	delete(key string) error
+	list(prefix string) ([]client.Entry, error)
+	watch(prefix string, fn func(client.WatchEvent) error) error
+}
+
+// keyFlags holds the flags saying where keys are kept and how to print
+// them.
+type keyFlags struct {
+	dbFile, storeType, keyFile *string
+	url, token, namespace      *string
+	output                     *string // nil if the keys are not printed
+}
+
+// newKeyFlags adds the flags of the key subcommands to fs.
+func newKeyFlags(fs *flag.FlagSet) keyFlags {
+	k := newSourceFlags(fs)
+	k.output = fs.String("output", outputRaw, "output format: raw, json or table")
+	return k
+}
+
+// newSourceFlags adds only the flags saying where keys are kept to fs, for
+// subcommands that do not print them.
+func newSourceFlags(fs *flag.FlagSet) keyFlags {
+	var k keyFlags
+	k.dbFile, k.storeType, k.keyFile = storeFlags(fs)
+	k.url = fs.String("url", "", "talk to the daemon at this url instead, e.g. http://localhost:8081 or unix:///run/rscs.sock")
+	k.token = fs.String("token", "", "bearer token to present to a daemon run with --auth")
+	k.namespace = fs.String("namespace", "", "namespace of the keys, instead of the default one")
+	return k
+}
+
+// open returns the keys named by the flags. The returned function closes
+// them.
+func (k keyFlags) open() (keys, func(), error) {
+	if k.output != nil {
+		switch *k.output {
+		case outputRaw, outputJSON, outputTable:
+		default:
+			return nil, nil, fmt.Errorf("unknown output '%s'", *k.output)
+		}
+	}
+	if *k.url != "" {
+		c, newErr := client.New(client.Config{Address: *k.url, Token: *k.token, Namespace: *k.namespace})
+		if newErr != nil {
+			return nil, nil, newErr
+		}
+		return daemonKeys{c: c}, func() {}, nil
+	}
+	if *k.dbFile == "" {
+		return nil, nil, errors.New("--db or --url is required")
+	}
+	store, closeStore, openErr := openStore(*k.storeType, *k.dbFile, *k.keyFile)
+	if openErr != nil {
+		return nil, nil, openErr
+	}
+	namespace := *k.namespace
+	if namespace == "" {
+		namespace = db.DefaultNamespace
+	}
+	exists, existsErr := db.NamespaceExists(store, namespace)
+	if existsErr == nil && !exists {
+		existsErr = fmt.Errorf("no namespace '%s' found", namespace)
+	}
+	if existsErr != nil {
+		closeStore()
+		return nil, nil, existsErr
+	}
+	nsStore, nsErr := db.Namespace(store, namespace)
+	if nsErr != nil {
+		closeStore()
+		return nil, nil, nsErr
+	}
+	return storeKeys{store: nsStore}, closeStore, nil
+}
+
+// daemonKeys are keys kept by a running daemon.
+type daemonKeys struct {
+	c *client.Client
+}
+
+func (d daemonKeys) get(key string) (client.Entry, error) {
+	return d.c.Get(context.Background(), key)
+}
+
+func (d daemonKeys) create(key, value string, ttl time.Duration) error {
+	return d.c.Create(context.Background(), key, value, client.WriteOptions{TTL: ttl})
+}
+
+func (d daemonKeys) put(key, value string, ttl time.Duration) error {
+	return d.c.Put(context.Background(), key, value, client.WriteOptions{TTL: ttl})
+}
+
+func (d daemonKeys) delete(key string) error {
+	return d.c.Delete(context.Background(), key, client.WriteOptions{})
+}
+
+func (d daemonKeys) list(prefix string) ([]client.Entry, error) {
+	return d.c.List(context.Background(), prefix)
+}
+
+// watch streams changes until interrupted.
+func (d daemonKeys) watch(prefix string, fn func(client.WatchEvent) error) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	watchErr := d.c.Watch(ctx, prefix, client.FromNow, fn)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return watchErr
+}
+
+// storeKeys are keys in a store opened directly.
+type storeKeys struct {
+	store db.Store
+}
+
+func (s storeKeys) get(key string) (client.Entry, error) {
+	entry, found, getErr := s.store.GetEntry(key)
+	if getErr != nil {
+		return client.Entry{}, getErr
+	}
+	if !found {
+		return client.Entry{}, &db.KeyError{Op: "get", Key: key, Err: db.ErrNotFound}
+	}
+	return client.Entry{Key: key, Value: entry.Value, Index: entry.Index, Expires: entry.Expires}, nil
+}
+
+func (s storeKeys) create(key, value string, ttl time.Duration) error {
+	// Swapping with index 0 only succeeds if the key does not exist.
+	rowCount, createErr := s.store.CompareAndSwapTTL(key, 0, value, ttl)
+	if createErr != nil {
+		return createErr
+	}
+	if rowCount == 0 {
+		return &db.KeyError{Op: "create", Key: key, Err: db.ErrExists}
+	}
+	return nil
+}
+
+func (s storeKeys) put(key, value string, ttl time.Duration) error {
+	rowCount, updateErr := s.store.UpdateTTL(key, value, ttl)
+	if updateErr != nil {
+		return updateErr
+	}
+	if rowCount == 0 {
+		return &db.KeyError{Op: "put", Key: key, Err: db.ErrNotFound}
+	}
+	return nil
+}
+
+func (s storeKeys) delete(key string) error {
+	rowCount, deleteErr := s.store.Delete(key)
+	if deleteErr != nil {
+		return deleteErr
+	}
+	if rowCount == 0 {
+		return &db.KeyError{Op: "delete", Key: key, Err: db.ErrNotFound}
+	}
+	return nil
+}
+
+func (s storeKeys) list(prefix string) ([]client.Entry, error) {
+	var entries []client.Entry
+	after := ""
+	for {
+		page, more, listErr := s.store.List(prefix, after, listBatch)
+		if listErr != nil {
+			return nil, listErr
+		}
+		for _, entry := range page {
+			entries = append(entries, client.Entry{Key: entry.Key, Value: entry.Value, Expires: entry.Expires})
+		}
+		if !more {
+			return entries, nil
+		}
+		after = page[len(page)-1].Key
+	}
+}
+
+// watch polls the store's change feed until interrupted.
+func (s storeKeys) watch(prefix string, fn func(client.WatchEvent) error) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	since, indexErr := s.store.CurrentIndex()
+	if indexErr != nil {
+		return indexErr
+	}
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		changes, changesErr := s.store.Changes(prefix, since, listBatch)
+		if changesErr != nil {
+			return changesErr
+		}
+		for _, rev := range changes {
+			event := client.WatchEvent{Type: "put", Key: rev.Key, Value: rev.Value,
+				Index: rev.Index, Revision: rev.Revision}
+			if rev.Deleted {
+				event.Type = "delete"
+			}
+			fnErr := fn(event)
+			if fnErr != nil {
+				return fnErr
+			}
+			since = rev.Index
+		}
+		if len(changes) == listBatch {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// interruptContext returns a context that is done on os.Interrupt.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupt)
+		cancel()
+	}
+}
+
+// entryOutput is an entry printed as JSON.
+type entryOutput struct {
+	Key     string
+	Value   string
+	Index   int64      `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// newEntryOutput converts an entry for printing.
+func newEntryOutput(entry client.Entry) entryOutput {
+	out := entryOutput{Key: entry.Key, Value: entry.Value, Index: entry.Index}
+	if !entry.Expires.IsZero() {
+		out.Expires = &entry.Expires
+	}
+	return out
+}
+
+// formatExpires renders an expiry for a table, which is "-" for none.
+func formatExpires(expires time.Time) string {
+	if expires.IsZero() {
+		return "-"
+	}
+	return expires.Format(time.RFC3339)
+}
+
+// printEntries prints entries in the output format. Raw output is the keys.
+func printEntries(w io.Writer, output string, entries []client.Entry) error {
+	switch output {
+	case outputJSON:
+		outs := make([]entryOutput, len(entries))
+		for i, entry := range entries {
+			outs[i] = newEntryOutput(entry)
+		}
+		return json.NewEncoder(w).Encode(outs)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tVALUE\tEXPIRES")
+		for _, entry := range entries {
+			fmt.Fprintf(tw, "%s\t%q\t%s\n", entry.Key, entry.Value, formatExpires(entry.Expires))
+		}
+		return tw.Flush()
+	default:
+		for _, entry := range entries {
+			fmt.Fprintln(w, entry.Key)
+		}
+		return nil
+	}
+}
+
+// readValue returns the value to write: the argument after the key, or the
+// contents of file, or stdin if there is neither or the argument is "-".
+func readValue(args []string, file string) (string, error) {
+	if len(args) > 1 && file != "" {
+		return "", errors.New("give a value or --file, not both")
+	}
+	if len(args) > 1 && args[1] != "-" {
+		return args[1], nil
+	}
+	var valueBytes []byte
+	var readErr error
+	if file != "" {
+		valueBytes, readErr = ioutil.ReadFile(file)
+	} else {
+		valueBytes, readErr = ioutil.ReadAll(os.Stdin)
+	}
+	return string(valueBytes), readErr
+}
+
+// keyArg returns the key named by the arguments left after the flags,
+// which must be the only one unless a value may follow it.
+func keyArg(fs *flag.FlagSet, withValue bool) (string, error) {
+	max := 1
+	if withValue {
+		max = 2
+	}
+	if fs.NArg() < 1 || fs.NArg() > max || fs.Arg(0) == "" {
+		return "", fmt.Errorf("use: rscs %s [flags] key", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+// getCommand prints the value of a key.
+func getCommand(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	k := newKeyFlags(fs)
+	fs.Parse(args)
+
+	key, keyErr := keyArg(fs, false)
+	if keyErr != nil {
+		return keyErr
+	}
+	kv, closeKeys, openErr := k.open()
+	if openErr != nil {
+		return openErr
+	}
+	defer closeKeys()
+
+	entry, getErr := kv.get(key)
+	if getErr != nil {
+		return getErr
+	}
+	switch *k.output {
+	case outputJSON:
+		return json.NewEncoder(os.Stdout).Encode(newEntryOutput(entry))
+	case outputTable:
+		return printEntries(os.Stdout, outputTable, []client.Entry{entry})
+	default:
+		_, writeErr := io.WriteString(os.Stdout, entry.Value)
+		return writeErr
+	}
+}
+
+// writeCommand is put or create, which write a key read from the arguments.
+func writeCommand(name string, write func(kv keys, key, value string, ttl time.Duration) error) func([]string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		k := newKeyFlags(fs)
+		ttl := fs.Duration("ttl", 0, "make the key expire after this long")
+		file := fs.String("file", "", "file to read the value from, instead of the argument or stdin")
+		fs.Parse(args)
+
+		key, keyErr := keyArg(fs, true)
+		if keyErr != nil {
+			return keyErr
+		}
+		if *ttl < 0 {
+			return errors.New("--ttl must be positive")
+		}
+		value, valueErr := readValue(fs.Args(), *file)
+		if valueErr != nil {
+			return valueErr
+		}
+		kv, closeKeys, openErr := k.open()
+		if openErr != nil {
+			return openErr
+		}
+		defer closeKeys()
+		return write(kv, key, value, *ttl)
+	}
+}
+
+// putCommand changes the value of an existing key.
+var putCommand = writeCommand("put", func(kv keys, key, value string, ttl time.Duration) error {
+	return kv.put(key, value, ttl)
+})
+
+// createCommand adds a key that must not exist.
+var createCommand = writeCommand("create", func(kv keys, key, value string, ttl time.Duration) error {
+	return kv.create(key, value, ttl)
+})
+
+// deleteCommand removes a key.
+func deleteCommand(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	k := newKeyFlags(fs)
+	fs.Parse(args)
+
+	key, keyErr := keyArg(fs, false)
+	if keyErr != nil {
+		return keyErr
+	}
+	kv, closeKeys, openErr := k.open()
+	if openErr != nil {
+		return openErr
+	}
+	defer closeKeys()
+	return kv.delete(key)
+}
+
+// lsCommand prints the keys beginning with a prefix, or every key.
+func lsCommand(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	k := newKeyFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		return errors.New("use: rscs ls [flags] [prefix]")
+	}
+	kv, closeKeys, openErr := k.open()
+	if openErr != nil {
+		return openErr
+	}
+	defer closeKeys()
+
+	entries, listErr := kv.list(fs.Arg(0))
+	if listErr != nil {
+		return listErr
+	}
+	return printEntries(os.Stdout, *k.output, entries)
+}
+
+// watchCommand prints each change to keys beginning with a prefix, or to
+// any key, until interrupted.
+func watchCommand(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	k := newKeyFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		return errors.New("use: rscs watch [flags] [prefix]")
+	}
+	kv, closeKeys, openErr := k.open()
+	if openErr != nil {
+		return openErr
+	}
+	defer closeKeys()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if *k.output == outputTable {
+		fmt.Fprintln(tw, "TYPE\tINDEX\tKEY\tVALUE")
+		tw.Flush()
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	return kv.watch(fs.Arg(0), func(event client.WatchEvent) error {
+		switch *k.output {
+		case outputJSON:
+			return encoder.Encode(event)
+		case outputTable:
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%q\n", event.Type, event.Index, event.Key, event.Value)
+			return tw.Flush()
+		default:
+			if event.Type == "delete" {
+				_, printErr := fmt.Printf("delete %s\n", event.Key)
+				return printErr
+			}
+			_, printErr := fmt.Printf("put %s %q\n", event.Key, event.Value)
+			return printErr
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradclawsie/rscs/client"
+	"github.com/bradclawsie/rscs/db"
+)
+
+// withStdio runs fn with os.Stdin reading in and os.Stdout written to a
+// file, and returns what fn wrote.
+func withStdio(t *testing.T, in string, fn func() error) (string, error) {
+	dir := t.TempDir()
+	stdin, stdinErr := os.Create(filepath.Join(dir, "stdin"))
+	if stdinErr == nil {
+		_, stdinErr = stdin.WriteString(in)
+	}
+	if stdinErr == nil {
+		_, stdinErr = stdin.Seek(0, 0)
+	}
+	if stdinErr != nil {
+		t.Fatalf("stdin: %s", stdinErr.Error())
+	}
+	defer stdin.Close()
+	stdout, stdoutErr := os.Create(filepath.Join(dir, "stdout"))
+	if stdoutErr != nil {
+		t.Fatalf("stdout: %s", stdoutErr.Error())
+	}
+	defer stdout.Close()
+
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	fnErr := fn()
+	os.Stdin, os.Stdout = oldStdin, oldStdout
+	return readTestFile(t, stdout.Name()), fnErr
+}
+
+func TestPrintEntries(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []client.Entry{
+		{Key: "a", Value: "one", Index: 1},
+		{Key: "bb", Value: "two\nlines", Index: 2, Expires: expires},
+	}
+	for _, c := range []struct {
+		output, want string
+	}{
+		{output: outputRaw, want: "a\nbb\n"},
+		{output: outputJSON, want: `[{"Key":"a","Value":"one","Index":1},` +
+			`{"Key":"bb","Value":"two\nlines","Index":2,"Expires":"2030-01-02T03:04:05Z"}]` + "\n"},
+		{output: outputTable, want: "KEY  VALUE         EXPIRES\n" +
+			"a    \"one\"         -\n" +
+			"bb   \"two\\nlines\"  2030-01-02T03:04:05Z\n"},
+	} {
+		var out strings.Builder
+		printErr := printEntries(&out, c.output, entries)
+		if printErr != nil {
+			t.Errorf("%s: %s", c.output, printErr.Error())
+			continue
+		}
+		if out.String() != c.want {
+			t.Errorf("%s: printed\n%s\nwant\n%s", c.output, out.String(), c.want)
+		}
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	file := writeTestFile(t, t.TempDir(), "value", "from file")
+	for _, c := range []struct {
+		args       []string
+		file, want string
+		fails      bool
+	}{
+		{args: []string{"k", "from arg"}, want: "from arg"},
+		{args: []string{"k", ""}, want: ""},
+		{args: []string{"k"}, file: file, want: "from file"},
+		{args: []string{"k"}, want: "from stdin\n"},
+		{args: []string{"k", "-"}, want: "from stdin\n"},
+		{args: []string{"k", "from arg"}, file: file, fails: true},
+		{args: []string{"k"}, file: file + ".missing", fails: true},
+	} {
+		var value string
+		_, readErr := withStdio(t, "from stdin\n", func() error {
+			var err error
+			value, err = readValue(c.args, c.file)
+			return err
+		})
+		if c.fails {
+			if readErr == nil {
+				t.Errorf("%q %s: read '%s', want an error", c.args, c.file, value)
+			}
+			continue
+		}
+		if readErr != nil {
+			t.Errorf("%q %s: %s", c.args, c.file, readErr.Error())
+			continue
+		}
+		if value != c.want {
+			t.Errorf("%q %s: read '%s', want '%s'", c.args, c.file, value, c.want)
+		}
+	}
+}
+
+func TestKeyArg(t *testing.T) {
+	for _, c := range []struct {
+		args      []string
+		withValue bool
+		want      string
+	}{
+		{args: []string{"k"}, want: "k"},
+		{args: []string{"k"}, withValue: true, want: "k"},
+		{args: []string{"k", "v"}, withValue: true, want: "k"},
+		{args: nil},
+		{args: []string{""}},
+		{args: []string{"k", "v"}},
+		{args: []string{"k", "v", "w"}, withValue: true},
+	} {
+		fs := flag.NewFlagSet("get", flag.ContinueOnError)
+		fs.Parse(c.args)
+		key, keyErr := keyArg(fs, c.withValue)
+		if c.want == "" {
+			if keyErr == nil {
+				t.Errorf("%q: key '%s', want an error", c.args, key)
+			}
+			continue
+		}
+		if keyErr != nil || key != c.want {
+			t.Errorf("%q: key '%s' %v, want '%s'", c.args, key, keyErr, c.want)
+		}
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	kv := testKeys(t, "a/1", "one")
+
+	createErr := kv.create("a/1", "again", 0)
+	if !errors.Is(createErr, db.ErrExists) {
+		t.Errorf("create of an existing key returned %v", createErr)
+	}
+	putErr := kv.put("missing", "x", 0)
+	if !notFound(putErr) {
+		t.Errorf("put of a missing key returned %v", putErr)
+	}
+	deleteErr := kv.delete("missing")
+	if !notFound(deleteErr) {
+		t.Errorf("delete of a missing key returned %v", deleteErr)
+	}
+	_, getErr := kv.get("missing")
+	if !notFound(getErr) {
+		t.Errorf("get of a missing key returned %v", getErr)
+	}
+
+	createErr = kv.create("a/2", "two", time.Hour)
+	if createErr != nil {
+		t.Fatalf("create: %s", createErr.Error())
+	}
+	putErr = kv.put("a/1", "uno", 0)
+	if putErr != nil {
+		t.Fatalf("put: %s", putErr.Error())
+	}
+	entry, getErr := kv.get("a/1")
+	if getErr != nil || entry.Value != "uno" || !entry.Expires.IsZero() {
+		t.Errorf("get a/1 returned %+v %v", entry, getErr)
+	}
+	entry, getErr = kv.get("a/2")
+	if getErr != nil || entry.Value != "two" || entry.Expires.IsZero() {
+		t.Errorf("get a/2 returned %+v %v", entry, getErr)
+	}
+
+	entries, listErr := kv.list("a/")
+	if listErr != nil || len(entries) != 2 || entries[0].Key != "a/1" || entries[1].Key != "a/2" {
+		t.Errorf("list returned %+v %v", entries, listErr)
+	}
+	deleteErr = kv.delete("a/1")
+	if deleteErr != nil {
+		t.Fatalf("delete: %s", deleteErr.Error())
+	}
+	entries, listErr = kv.list("")
+	if listErr != nil || len(entries) != 1 || entries[0].Key != "a/2" {
+		t.Errorf("list after delete returned %+v %v", entries, listErr)
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	dir := t.TempDir()
+	store := []string{"--store=file", "--db=" + filepath.Join(dir, "store")}
+	run := func(command func([]string) error, in string, args ...string) (string, error) {
+		return withStdio(t, in, func() error {
+			return command(append(append([]string{}, store...), args...))
+		})
+	}
+
+	_, createErr := run(createCommand, "", "a/1", "one")
+	if createErr != nil {
+		t.Fatalf("create: %s", createErr.Error())
+	}
+	_, createErr = run(createCommand, "", "a/1", "one")
+	if !errors.Is(createErr, db.ErrExists) {
+		t.Errorf("second create returned %v", createErr)
+	}
+	_, createErr = run(createCommand, "two\n", "a/2")
+	if createErr != nil {
+		t.Fatalf("create from stdin: %s", createErr.Error())
+	}
+	file := writeTestFile(t, dir, "value", "uno")
+	_, putErr := run(putCommand, "", "--file="+file, "a/1")
+	if putErr != nil {
+		t.Fatalf("put from file: %s", putErr.Error())
+	}
+	_, putErr = run(putCommand, "", "missing", "x")
+	if !notFound(putErr) {
+		t.Errorf("put of a missing key returned %v", putErr)
+	}
+	_, putErr = run(putCommand, "", "--ttl=-1s", "a/1", "x")
+	if putErr == nil {
+		t.Errorf("put with a negative ttl returned no error")
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"a/1"}, want: "uno"},
+		{args: []string{"--output=json", "a/2"}, want: `{"Key":"a/2","Value":"two\n","Index":2}` + "\n"},
+		{args: []string{"--output=table", "a/2"}, want: "KEY  VALUE    EXPIRES\na/2  \"two\\n\"  -\n"},
+	} {
+		out, getErr := run(getCommand, "", c.args...)
+		if getErr != nil {
+			t.Errorf("get %q: %s", c.args, getErr.Error())
+			continue
+		}
+		if out != c.want {
+			t.Errorf("get %q printed '%s', want '%s'", c.args, out, c.want)
+		}
+	}
+	_, getErr := run(getCommand, "", "--output=xml", "a/1")
+	if getErr == nil {
+		t.Errorf("get with an unknown output returned no error")
+	}
+
+	out, lsErr := run(lsCommand, "", "a/")
+	if lsErr != nil || out != "a/1\na/2\n" {
+		t.Errorf("ls printed '%s' %v", out, lsErr)
+	}
+	out, lsErr = run(lsCommand, "", "--output=json")
+	var listed []entryOutput
+	if lsErr == nil {
+		lsErr = json.Unmarshal([]byte(out), &listed)
+	}
+	if lsErr != nil || len(listed) != 2 || listed[0].Value != "uno" || listed[1].Value != "two\n" {
+		t.Errorf("ls as json printed '%s' %v", out, lsErr)
+	}
+
+	_, deleteErr := run(deleteCommand, "", "a/1")
+	if deleteErr != nil {
+		t.Fatalf("delete: %s", deleteErr.Error())
+	}
+	_, deleteErr = run(deleteCommand, "", "a/1")
+	if !notFound(deleteErr) {
+		t.Errorf("second delete returned %v", deleteErr)
+	}
+	out, lsErr = run(lsCommand, "")
+	if lsErr != nil || out != "a/2\n" {
+		t.Errorf("ls after delete printed '%s' %v", out, lsErr)
+	}
+
+	_, openErr := run(lsCommand, "", "--namespace=missing")
+	if openErr == nil {
+		t.Errorf("ls in a missing namespace returned no error")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/bradclawsie/rscs/client"
+	"github.com/bradclawsie/rscs/db"
+)
+
+// renderPair is a key listed by the ls template function, with the prefix
+// trimmed from Key.
+type renderPair struct {
+	Key   string
+	Value string
+}
+
+// renderTemplate is a template file and the file it is rendered to.
+type renderTemplate struct {
+	source, dest string
+	tmpl         *template.Template
+}
+
+// renderFuncs are the functions templates may call to read keys.
+func renderFuncs(kv keys) template.FuncMap {
+	return template.FuncMap{
+		// key is the value of a key, which must exist.
+		"key": func(key string) (string, error) {
+			entry, getErr := kv.get(key)
+			if getErr != nil {
+				return "", getErr
+			}
+			return entry.Value, nil
+		},
+		// keyOrDefault is the value of a key, or def if it does not exist.
+		"keyOrDefault": func(key, def string) (string, error) {
+			entry, getErr := kv.get(key)
+			if notFound(getErr) {
+				return def, nil
+			}
+			if getErr != nil {
+				return "", getErr
+			}
+			return entry.Value, nil
+		},
+		// keyExists reports whether a key exists.
+		"keyExists": func(key string) (bool, error) {
+			_, getErr := kv.get(key)
+			if notFound(getErr) {
+				return false, nil
+			}
+			return getErr == nil, getErr
+		},
+		// ls lists the keys beginning with prefix, in sorted order.
+		"ls": func(prefix string) ([]renderPair, error) {
+			entries, listErr := kv.list(prefix)
+			if listErr != nil {
+				return nil, listErr
+			}
+			pairs := make([]renderPair, len(entries))
+			for i, entry := range entries {
+				pairs[i] = renderPair{Key: strings.TrimPrefix(entry.Key, prefix), Value: entry.Value}
+			}
+			return pairs, nil
+		},
+	}
+}
+
+// notFound reports whether err says a key does not exist, as returned by
+// either a daemon or a store.
+func notFound(err error) bool {
+	return client.IsNotFound(err) || errors.Is(err, db.ErrNotFound)
+}
+
+// parseRenderTemplates parses each source:dest pair and its template.
+func parseRenderTemplates(specs []string, funcs template.FuncMap) ([]renderTemplate, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("--template is required")
+	}
+	templates := make([]renderTemplate, len(specs))
+	for i, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("--template '%s' is not source:dest", spec)
+		}
+		source, sourceErr := ioutil.ReadFile(parts[0])
+		if sourceErr != nil {
+			return nil, sourceErr
+		}
+		tmpl, parseErr := template.New(filepath.Base(parts[0])).Funcs(funcs).Parse(string(source))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		templates[i] = renderTemplate{source: parts[0], dest: parts[1], tmpl: tmpl}
+	}
+	return templates, nil
+}
+
+// render executes the template and writes the result to its dest, unless
+// the dest already holds it. It reports whether the dest was written.
+func (r renderTemplate) render() (bool, error) {
+	var out bytes.Buffer
+	execErr := r.tmpl.Execute(&out, nil)
+	if execErr != nil {
+		return false, execErr
+	}
+	current, readErr := ioutil.ReadFile(r.dest)
+	if readErr == nil && bytes.Equal(current, out.Bytes()) {
+		return false, nil
+	}
+	return true, writeAtomic(r.dest, out.Bytes())
+}
+
+// writeAtomic replaces path with data by renaming a temporary file written
+// next to it, so readers see either the old contents or the new, never a
+// partial file. An existing file keeps its mode.
+func writeAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, statErr := os.Stat(path); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, tmpErr := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	defer os.Remove(tmp.Name())
+	_, writeErr := tmp.Write(data)
+	if writeErr == nil {
+		writeErr = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Chmod(tmp.Name(), mode)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// renderer renders a set of templates and runs a command after any of
+// them changes a file.
+type renderer struct {
+	templates []renderTemplate
+	command   string
+	pending   bool // a dest was written since command last succeeded
+}
+
+// renderAll renders every template, even after one fails, and then runs
+// command with sh if any dest was written since it last succeeded, so a
+// file written in a pass that failed elsewhere still gets its command.
+func (rd *renderer) renderAll() error {
+	var failures []string
+	for _, r := range rd.templates {
+		changed, renderErr := r.render()
+		if renderErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", r.source, renderErr.Error()))
+			continue
+		}
+		if changed {
+			log.Printf("rendered %s to %s", r.source, r.dest)
+			rd.pending = true
+		}
+	}
+	if rd.pending && rd.command != "" {
+		cmd := exec.Command("sh", "-c", rd.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		runErr := cmd.Run()
+		if runErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", rd.command, runErr.Error()))
+		} else {
+			rd.pending = false
+		}
+	}
+	if len(failures) != 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// renderCommand renders text/template files with the values of keys, and
+// with --watch renders them again whenever a key changes, until
+// interrupted.
+func renderCommand(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	k := newSourceFlags(fs)
+	var specs listFlags
+	fs.Var(&specs, "template", "template file and the file to render it to, as source:dest (repeatable)")
+	command := fs.String("exec", "", "command run with sh after a render changes any file, e.g. to reload a service")
+	watch := fs.Bool("watch", false, "render again whenever a key changes, until interrupted")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errors.New("use: rscs render [flags] --template=source:dest...")
+	}
+	kv, closeKeys, openErr := k.open()
+	if openErr != nil {
+		return openErr
+	}
+	defer closeKeys()
+	templates, parseErr := parseRenderTemplates(specs, renderFuncs(kv))
+	if parseErr != nil {
+		return parseErr
+	}
+	rd := &renderer{templates: templates, command: *command}
+	if !*watch {
+		return rd.renderAll()
+	}
+
+	// Changes arriving while rendering are folded into one more render.
+	changed := make(chan struct{}, 1)
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- kv.watch("", func(client.WatchEvent) error {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+	}()
+
+	renderErr := rd.renderAll()
+	if renderErr != nil {
+		return renderErr
+	}
+	for {
+		select {
+		case <-changed:
+			// A failed render leaves its file as it was; a later change
+			// may fix it.
+			renderErr := rd.renderAll()
+			if renderErr != nil {
+				log.Print(renderErr.Error())
+			}
+		case watchErr := <-watchDone:
+			return watchErr
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+// testKeys returns keys in a memory store holding the given pairs.
+func testKeys(t *testing.T, pairs ...string) keys {
+	kv := storeKeys{store: db.NewMemoryStore()}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		createErr := kv.create(pairs[i], pairs[i+1], 0)
+		if createErr != nil {
+			t.Fatalf("create %s: %s", pairs[i], createErr.Error())
+		}
+	}
+	return kv
+}
+
+// writeTestFile writes contents to name in dir and returns its path.
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	writeErr := ioutil.WriteFile(path, []byte(contents), 0644)
+	if writeErr != nil {
+		t.Fatalf("write %s: %s", name, writeErr.Error())
+	}
+	return path
+}
+
+// readTestFile returns the contents of path.
+func readTestFile(t *testing.T, path string) string {
+	contents, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		t.Fatalf("read %s: %s", path, readErr.Error())
+	}
+	return string(contents)
+}
+
+func TestRenderFuncs(t *testing.T) {
+	funcs := renderFuncs(testKeys(t, "app/host", "db1", "app/port", "5432", "other", "x"))
+	for _, c := range []struct {
+		text, want string
+		fails      bool
+	}{
+		{text: `{{key "app/host"}}`, want: "db1"},
+		{text: `{{key "missing"}}`, fails: true},
+		{text: `{{keyOrDefault "app/port" "1"}}`, want: "5432"},
+		{text: `{{keyOrDefault "missing" "1"}}`, want: "1"},
+		{text: `{{keyExists "app/host"}} {{keyExists "missing"}}`, want: "true false"},
+		{text: `{{range ls "app/"}}{{.Key}}={{.Value}};{{end}}`, want: "host=db1;port=5432;"},
+		{text: `{{range ls "none/"}}x{{end}}`, want: ""},
+	} {
+		tmpl := template.Must(template.New("t").Funcs(funcs).Parse(c.text))
+		var out strings.Builder
+		execErr := tmpl.Execute(&out, nil)
+		if c.fails {
+			if execErr == nil {
+				t.Errorf("%s: rendered '%s', want an error", c.text, out.String())
+			}
+			continue
+		}
+		if execErr != nil {
+			t.Errorf("%s: %s", c.text, execErr.Error())
+			continue
+		}
+		if out.String() != c.want {
+			t.Errorf("%s: rendered '%s', want '%s'", c.text, out.String(), c.want)
+		}
+	}
+}
+
+func TestParseRenderTemplates(t *testing.T) {
+	dir := t.TempDir()
+	good := writeTestFile(t, dir, "good.tmpl", `{{key "a"}}`)
+	bad := writeTestFile(t, dir, "bad.tmpl", `{{key "a"`)
+	funcs := renderFuncs(testKeys(t))
+
+	for _, specs := range [][]string{
+		nil,
+		{good},
+		{good + ":"},
+		{":" + filepath.Join(dir, "out")},
+		{filepath.Join(dir, "missing.tmpl") + ":" + filepath.Join(dir, "out")},
+		{bad + ":" + filepath.Join(dir, "out")},
+	} {
+		_, parseErr := parseRenderTemplates(specs, funcs)
+		if parseErr == nil {
+			t.Errorf("parsed %q, want an error", specs)
+		}
+	}
+
+	templates, parseErr := parseRenderTemplates([]string{good + ":" + filepath.Join(dir, "out")}, funcs)
+	if parseErr != nil {
+		t.Fatalf("parse: %s", parseErr.Error())
+	}
+	if len(templates) != 1 || templates[0].source != good || templates[0].dest != filepath.Join(dir, "out") {
+		t.Errorf("parsed %+v", templates)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+
+	fresh := filepath.Join(dir, "fresh")
+	writeErr := writeAtomic(fresh, []byte("one"))
+	if writeErr != nil {
+		t.Fatalf("write fresh: %s", writeErr.Error())
+	}
+	info, statErr := os.Stat(fresh)
+	if statErr != nil {
+		t.Fatalf("stat fresh: %s", statErr.Error())
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("fresh file has mode %v, want 0644", info.Mode().Perm())
+	}
+
+	existing := writeTestFile(t, dir, "existing", "old")
+	chmodErr := os.Chmod(existing, 0600)
+	if chmodErr != nil {
+		t.Fatalf("chmod: %s", chmodErr.Error())
+	}
+	writeErr = writeAtomic(existing, []byte("new"))
+	if writeErr != nil {
+		t.Fatalf("write existing: %s", writeErr.Error())
+	}
+	if contents := readTestFile(t, existing); contents != "new" {
+		t.Errorf("existing file holds '%s', want 'new'", contents)
+	}
+	info, statErr = os.Stat(existing)
+	if statErr != nil {
+		t.Fatalf("stat existing: %s", statErr.Error())
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("existing file has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Writes that fail leave no temporary file behind.
+	writeErr = writeAtomic(filepath.Join(dir, "missing", "file"), []byte("x"))
+	if writeErr == nil {
+		t.Errorf("wrote into a missing dir")
+	}
+	mkdirErr := os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if mkdirErr != nil {
+		t.Fatalf("mkdir: %s", mkdirErr.Error())
+	}
+	writeErr = writeAtomic(filepath.Join(dir, "sub"), []byte("x"))
+	if writeErr == nil {
+		t.Errorf("replaced a dir")
+	}
+
+	names, readErr := ioutil.ReadDir(dir)
+	if readErr != nil {
+		t.Fatalf("read dir: %s", readErr.Error())
+	}
+	var found []string
+	for _, name := range names {
+		found = append(found, name.Name())
+	}
+	if strings.Join(found, " ") != "existing fresh sub" {
+		t.Errorf("dir holds %q, want no temporary files", found)
+	}
+}
+
+func TestRenderAll(t *testing.T) {
+	dir := t.TempDir()
+	kv := testKeys(t, "a", "1", "b", "2")
+	funcs := renderFuncs(kv)
+	aDest := filepath.Join(dir, "a.out")
+	bDest := filepath.Join(dir, "b.out")
+	ran := filepath.Join(dir, "ran")
+	templates, parseErr := parseRenderTemplates([]string{
+		writeTestFile(t, dir, "a.tmpl", `{{key "a"}}`) + ":" + aDest,
+		writeTestFile(t, dir, "b.tmpl", `{{key "b"}}`) + ":" + bDest,
+	}, funcs)
+	if parseErr != nil {
+		t.Fatalf("parse: %s", parseErr.Error())
+	}
+	rd := &renderer{templates: templates, command: "echo run >> " + ran}
+
+	runs := func() int {
+		contents, readErr := ioutil.ReadFile(ran)
+		if os.IsNotExist(readErr) {
+			return 0
+		}
+		if readErr != nil {
+			t.Fatalf("read ran: %s", readErr.Error())
+		}
+		return strings.Count(string(contents), "run")
+	}
+
+	renderErr := rd.renderAll()
+	if renderErr != nil {
+		t.Fatalf("render: %s", renderErr.Error())
+	}
+	if readTestFile(t, aDest) != "1" || readTestFile(t, bDest) != "2" {
+		t.Errorf("first render wrote the wrong values")
+	}
+	if runs() != 1 {
+		t.Errorf("command ran %d times after the first render, want 1", runs())
+	}
+
+	// Nothing changed, so the command does not run again.
+	renderErr = rd.renderAll()
+	if renderErr != nil {
+		t.Fatalf("render unchanged: %s", renderErr.Error())
+	}
+	if runs() != 1 {
+		t.Errorf("command ran %d times after an unchanged render, want 1", runs())
+	}
+
+	// The first file changes and the second fails; the command still runs
+	// for the first.
+	putErr := kv.put("a", "10", 0)
+	if putErr != nil {
+		t.Fatalf("put: %s", putErr.Error())
+	}
+	deleteErr := kv.delete("b")
+	if deleteErr != nil {
+		t.Fatalf("delete: %s", deleteErr.Error())
+	}
+	renderErr = rd.renderAll()
+	if renderErr == nil || !strings.Contains(renderErr.Error(), "b.tmpl") {
+		t.Errorf("render with a missing key returned %v", renderErr)
+	}
+	if readTestFile(t, aDest) != "10" || readTestFile(t, bDest) != "2" {
+		t.Errorf("failed render wrote the wrong values")
+	}
+	if runs() != 2 {
+		t.Errorf("command ran %d times after a partly failed render, want 2", runs())
+	}
+
+	// A command that fails runs again on the next pass, even with nothing
+	// changed.
+	rd.command = "echo run >> " + ran + " && false"
+	createErr := kv.create("b", "20", 0)
+	if createErr != nil {
+		t.Fatalf("create: %s", createErr.Error())
+	}
+	renderErr = rd.renderAll()
+	if renderErr == nil {
+		t.Errorf("render with a failing command returned no error")
+	}
+	if runs() != 3 {
+		t.Errorf("command ran %d times after it failed, want 3", runs())
+	}
+	rd.command = "echo run >> " + ran
+	renderErr = rd.renderAll()
+	if renderErr != nil {
+		t.Fatalf("render after a failed command: %s", renderErr.Error())
+	}
+	if readTestFile(t, bDest) != "20" || runs() != 4 {
+		t.Errorf("command ran %d times after it was fixed, want 4", runs())
+	}
+}
@@ -0,0 +1,5 @@
+// Package rpc is the gRPC service of rscs, generated from rscs.proto. The
+// server side is in package server; clients use NewKVClient.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rscs.proto
@@ -2,30 +2,101 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/bradclawsie/rscs/db"
 	"github.com/bradclawsie/rscs/server"
+	"google.golang.org/grpc"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// listFlags collects a flag given more than once.
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds value to the list.
+func (l *listFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 
-	const use = `use: rscs --db={sqlite db file} [--create-only] [--memory] [--port={portnum}]`
+	const use = `use: rscs --db={sqlite db file} [--store={sqlite|memory|file}] [--create-only] [--memory] [--port={portnum} | --listen={tcp://host:port|unix://path}... [--socket-mode={octal mode}] [--socket-owner={user}[:{group}]] [--allow-user={user}...]] [--reap-interval={duration}] [--backup-dir={dir} [--backup-interval={duration}] [--backup-keep={count}]] [--auth] [--master-key-file={file}] [--tls-cert={file} --tls-key={file} [--tls-client-ca={file}]] [--audit-file={file}] [--replicate-from={primary url} [--replicate-token={token}] [--replica-writes={forward|reject}]] [--consul-kv] [--resp-listen={tcp://host:port|unix://path}...] [--grpc-listen={tcp://host:port|unix://path}...]
+     rscs export --db={db file} [--store={sqlite|file}] [--format={json|yaml|env}]
+     rscs import --db={db file} [--store={sqlite|file}] [--format={json|yaml|env}] [--file={file}] [--merge|--replace] [--dry-run]
+     rscs backup (--db={db file} [--store={sqlite|file}] | --url={daemon url} [--token={token}]) [--out={file}]
+     rscs restore (--db={db file} [--store={sqlite|file}] | --url={daemon url} [--token={token}]) --file={file}
+     rscs token --db={db file} [--store={sqlite|file}] [--admin] [--policy={perms}[@{namespace}]:{prefix}]...
+     rscs revoke --db={db file} [--store={sqlite|file}] --id={token id}
+     rscs keygen
+     rscs rekey --db={db file} [--master-key-file={file}]
+     rscs get (--db={db file} [--store={sqlite|file}] | --url={daemon url} [--token={token}]) [--namespace={name}] [--output={raw|json|table}] {key}
+     rscs put|create (--db=... | --url=...) [--namespace={name}] [--ttl={duration}] [--file={file}] {key} [{value}|-]
+     rscs delete (--db=... | --url=...) [--namespace={name}] {key}
+     rscs ls|watch (--db=... | --url=...) [--namespace={name}] [--output={raw|json|table}] [{prefix}]
+     rscs render (--db=... | --url=...) [--namespace={name}] --template={source}:{dest}... [--exec={command}] [--watch]
+
+Commands that open a sqlite db read its master keys from --master-key-file or $RSCS_MASTER_KEY.`
+
+	// Subcommands run instead of the daemon.
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			commandErr := command(os.Args[2:])
+			if commandErr != nil {
+				log.Fatal(commandErr.Error())
+			}
+			return
+		}
+	}
 
 	// Command line options.
-	var sqliteDBFile string
-	var createOnly, memory bool
-	var portNum int
+	var sqliteDBFile, storeType, backupDir, masterKeyFile, tlsCert, tlsKey, tlsClientCA string
+	var socketMode, socketOwner, auditFile, replicateFrom, replicateToken, replicaWrites string
+	var listenAddrs, allowUsers, respAddrs, grpcAddrs listFlags
+	var createOnly, memory, auth, consulKV bool
+	var portNum, backupKeep, historyKeep int
+	var reapInterval, backupInterval, historyInterval time.Duration
 
-	flag.StringVar(&sqliteDBFile, "db", "", "full path to sqlite db file")
+	flag.StringVar(&sqliteDBFile, "db", "", "full path to sqlite db file, or to the file store")
+	flag.StringVar(&storeType, "store", "sqlite", "storage backend: sqlite, memory or file")
 	flag.BoolVar(&createOnly, "create-only", false, "only create table in file and exit")
 	flag.BoolVar(&memory, "memory", false, "run rscs in-memory only")
 	flag.IntVar(&portNum, "port", 8081, "port to listen on")
+	flag.DurationVar(&reapInterval, "reap-interval", server.DefaultReapInterval, "how often to purge expired keys")
+	flag.StringVar(&backupDir, "backup-dir", "", "directory to write scheduled backups to")
+	flag.DurationVar(&backupInterval, "backup-interval", server.DefaultBackupInterval, "how often to write scheduled backups")
+	flag.IntVar(&backupKeep, "backup-keep", server.DefaultBackupKeep, "how many scheduled backups to keep")
+	flag.IntVar(&historyKeep, "history-keep", server.DefaultHistoryKeep, "how many revisions of each key to keep in the sqlite history, or 0 to keep all")
+	flag.DurationVar(&historyInterval, "history-interval", server.DefaultHistoryInterval, "how often to prune the sqlite history")
+	flag.BoolVar(&auth, "auth", false, "require a bearer token on every request")
+	flag.StringVar(&masterKeyFile, "master-key-file", "", "file of master keys to encrypt values with, instead of $"+db.MasterKeyEnv)
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file to serve https with")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file of --tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM file of CAs client certificates must be signed by")
+	flag.Var(&listenAddrs, "listen", "address to listen on, tcp://host:port or unix:///path/to.sock, instead of --port (repeatable)")
+	flag.StringVar(&socketMode, "socket-mode", "0600", "permissions of unix socket files")
+	flag.StringVar(&socketOwner, "socket-owner", "", "user[:group] to own unix socket files")
+	flag.Var(&allowUsers, "allow-user", "user allowed to connect over a unix socket, by name or uid; all are allowed if not given (repeatable)")
+	flag.StringVar(&auditFile, "audit-file", "", "JSON lines file to append audit records of writes to, instead of the store")
+	flag.StringVar(&replicateFrom, "replicate-from", "", "url of a primary rscs daemon to replicate")
+	flag.StringVar(&replicateToken, "replicate-token", "", "admin token to present to the primary if it was run with --auth")
+	flag.StringVar(&replicaWrites, "replica-writes", "forward", "what a replica does with writes: forward them to the primary, or reject them")
+	flag.BoolVar(&consulKV, "consul-kv", false, "serve the Consul KV API at /v1/kv/ in place of the native key routes")
+	flag.Var(&respAddrs, "resp-listen", "address to serve the Redis protocol on, tcp://host:port or unix:///path/to.sock (repeatable)")
+	flag.Var(&grpcAddrs, "grpc-listen", "address to serve gRPC on, tcp://host:port or unix:///path/to.sock (repeatable)")
 	flag.Parse()
 
 	const memoryDBName = "file::memory:?mode=memory&cache=shared"
@@ -34,34 +105,128 @@ func main() {
 		sqliteDBFile = memoryDBName
 	}
 
-	if sqliteDBFile == "" {
+	if reapInterval <= 0 || backupInterval <= 0 || backupKeep < 1 {
 		log.Fatal(use)
 	}
-
-	rscsDB, rscsDBErr := db.NewRscsDB(sqliteDBFile)
-	if rscsDBErr != nil {
-		log.Fatal(rscsDBErr)
+	if (masterKeyFile != "" || os.Getenv(db.MasterKeyEnv) != "") && storeType != "sqlite" {
+		// Only the sqlite store encrypts values; refuse to store them in
+		// plaintext when encryption was asked for.
+		log.Fatalf("only the sqlite store encrypts values; use --store=sqlite or unset $%s", db.MasterKeyEnv)
+	}
+	if (tlsCert == "") != (tlsKey == "") || (tlsClientCA != "" && tlsCert == "") {
+		// https needs both a certificate and its key.
+		log.Fatal(use)
+	}
+	mode, modeErr := strconv.ParseUint(socketMode, 8, 32)
+	if modeErr != nil || mode > 0777 {
+		log.Fatal(use)
+	}
+	if replicaWrites != "forward" && replicaWrites != "reject" {
+		log.Fatal(use)
+	}
+	if len(listenAddrs) == 0 {
+		listenAddrs = listFlags{fmt.Sprintf("%s:%d", server.TCPScheme, portNum)}
 	}
 
-	if createOnly || memory {
-		// In either case we require the table to be created.
-		createErr := rscsDB.CreateTable()
-		if createErr != nil {
-			log.Fatal(createErr.Error())
+	var store db.Store
+	switch storeType {
+	case "memory":
+		store = db.NewMemoryStore()
+	case "file":
+		if sqliteDBFile == "" || createOnly || memory {
+			log.Fatal(use)
+		}
+		fileStore, fileStoreErr := db.NewFileStore(sqliteDBFile)
+		if fileStoreErr != nil {
+			log.Fatal(fileStoreErr)
+		}
+		defer fileStore.Close()
+		store = fileStore
+	case "sqlite":
+		if sqliteDBFile == "" {
+			log.Fatal(use)
 		}
-		log.Printf("created")
-		if !memory {
-			// If we only want the db created and nothing else, exit.
-			os.Exit(0)
+		rscsDB, rscsDBErr := db.NewRscsDB(sqliteDBFile)
+		if rscsDBErr != nil {
+			log.Fatal(rscsDBErr)
 		}
+		keyring, keyringErr := db.LoadKeyring(masterKeyFile)
+		if keyringErr != nil {
+			log.Fatal(keyringErr)
+		}
+		rscsDB.SetKeyring(keyring)
+		if keyring != nil {
+			// SIGHUP reloads the master keys, as after a rotation.
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			go func() {
+				for range hup {
+					reloadErr := keyring.Reload()
+					if reloadErr != nil {
+						log.Printf("cannot reload master keys: %s", reloadErr.Error())
+						continue
+					}
+					log.Printf("reloaded master keys")
+				}
+			}()
+		}
+		store = rscsDB
+		if createOnly || memory {
+			// In either case we require the table to be created.
+			createErr := rscsDB.CreateTable()
+			if createErr != nil {
+				log.Fatal(createErr.Error())
+			}
+			log.Printf("created")
+			if !memory {
+				// If we only want the db created and nothing else, exit.
+				os.Exit(0)
+			}
+		}
+	default:
+		log.Fatal(use)
 	}
 
-	rscsServer, rscsSrvErr := server.NewRscsServer(rscsDB)
+	rscsServer, rscsSrvErr := server.NewRscsServer(store)
 	if rscsSrvErr != nil {
 		log.Fatal(rscsSrvErr)
 	}
+	if auditFile != "" {
+		auditLog, auditErr := db.OpenAuditFile(auditFile)
+		if auditErr != nil {
+			log.Fatal(auditErr)
+		}
+		defer auditLog.Close()
+		rscsServer.SetAuditLog(auditLog)
+	}
+	if replicateFrom != "" {
+		replicateErr := rscsServer.ReplicateFrom(replicateFrom, replicateToken, replicaWrites == "forward")
+		if replicateErr != nil {
+			log.Fatal(replicateErr)
+		}
+	}
+	if consulKV {
+		rscsServer.EnableConsulKV()
+	}
+	if auth {
+		authErr := rscsServer.RequireAuth()
+		if authErr != nil {
+			log.Fatal(authErr)
+		}
+	}
+	if len(allowUsers) > 0 {
+		var uids []int
+		for _, name := range allowUsers {
+			uid, uidErr := server.LookupUID(name)
+			if uidErr != nil {
+				log.Fatal(uidErr)
+			}
+			uids = append(uids, uid)
+		}
+		rscsServer.RestrictPeers(uids)
+	}
 
-	stopChan := make(chan os.Signal)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
 
 	rtr, rtrErr := rscsServer.NewRouter()
@@ -69,14 +234,94 @@ func main() {
 		log.Fatal(rtrErr.Error())
 	}
 
-	addrStr := fmt.Sprintf(":%d", portNum)
-	srv := &http.Server{Addr: addrStr, Handler: rtr}
+	srv := &http.Server{Handler: rtr, ConnContext: server.ConnContext}
+	srv.RegisterOnShutdown(rscsServer.Close)
+	if tlsCert != "" {
+		tlsConfig, tlsErr := server.NewTLSConfig(server.TLSFiles{
+			CertFile:     tlsCert,
+			KeyFile:      tlsKey,
+			ClientCAFile: tlsClientCA,
+		})
+		if tlsErr != nil {
+			log.Fatal(tlsErr.Error())
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	// A replica purges expired keys when the primary's deletes arrive;
+	// reaping them itself would add revisions the primary never made.
+	if replicateFrom != "" {
+		go rscsServer.Follow()
+	} else {
+		go rscsServer.Reap(reapInterval)
+	}
+	if backupDir != "" {
+		go rscsServer.BackupEvery(backupDir, backupInterval, backupKeep)
+	}
+	if historyKeep > 0 && storeType == "sqlite" {
+		go rscsServer.PruneHistory(historyKeep, historyInterval)
+	}
+
+	socketOpts := server.SocketOptions{Mode: os.FileMode(mode), Owner: socketOwner}
+	for _, addr := range listenAddrs {
+		l, listenErr := server.Listen(addr, socketOpts)
+		if listenErr != nil {
+			log.Fatal(listenErr.Error())
+		}
+		log.Printf("listening on %s", addr)
+		// Only tcp listeners serve https; unix sockets are local already.
+		useTLS := srv.TLSConfig != nil && strings.HasPrefix(addr, server.TCPScheme)
+		go func() {
+			var err error
+			if useTLS {
+				// The certificates come from srv.TLSConfig.
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+	}
+
+	var respListeners []net.Listener
+	for _, addr := range respAddrs {
+		l, listenErr := server.Listen(addr, socketOpts)
+		if listenErr != nil {
+			log.Fatal(listenErr.Error())
+		}
+		if srv.TLSConfig != nil && strings.HasPrefix(addr, server.TCPScheme) {
+			l = tls.NewListener(l, srv.TLSConfig)
+		}
+		log.Printf("serving RESP on %s", addr)
+		respListeners = append(respListeners, l)
+		go func() {
+			respErr := rscsServer.ServeRESP(l)
+			if respErr != nil {
+				log.Fatal(respErr.Error())
+			}
+		}()
+	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatal(err.Error())
+	var grpcServer *grpc.Server
+	if len(grpcAddrs) != 0 {
+		// tcp connections use TLS if it is configured, as for https.
+		grpcServer = rscsServer.NewGRPCServer(srv.TLSConfig)
+	}
+	for _, addr := range grpcAddrs {
+		l, listenErr := server.Listen(addr, socketOpts)
+		if listenErr != nil {
+			log.Fatal(listenErr.Error())
 		}
-	}()
+		log.Printf("serving gRPC on %s", addr)
+		go func() {
+			grpcErr := grpcServer.Serve(l)
+			if grpcErr != nil {
+				log.Fatal(grpcErr.Error())
+			}
+		}()
+	}
 
 	<-stopChan
 	log.Println("Shutting down server...")
@@ -84,6 +329,13 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv.Shutdown(ctx)
+	for _, l := range respListeners {
+		l.Close()
+	}
+	if grpcServer != nil {
+		// Shutdown closed the watches, so no stream holds this up.
+		grpcServer.GracefulStop()
+	}
 
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+const (
+	// AuditRoute is the route for querying the audit log.
+	AuditRoute = "/v1/admin/audit"
+	// DefaultAuditLimit is how many records Audit returns when not passed a
+	// limit.
+	DefaultAuditLimit = 100
+	// MaxAuditLimit is the most records Audit will return.
+	MaxAuditLimit = 1000
+)
+
+// AuditResult lists audit records, oldest first.
+type AuditResult struct {
+	Records []db.AuditRecord
+}
+
+// SetAuditLog sends audit records to auditLog instead of to the store. Call
+// it before the server is started.
+func (s *RscsServer) SetAuditLog(auditLog db.AuditLog) {
+	s.auditLog = auditLog
+}
+
+// caller identifies who made the request, by the first of its token, its
+// client certificate, the user at the other end of its unix socket and its
+// remote address.
+func caller(r *http.Request) string {
+	if token, ok := r.Context().Value(tokenContextKey).(db.Token); ok {
+		return "token:" + token.ID
+	}
+	if subject := ClientSubject(r); subject != "" {
+		return "cert:" + subject
+	}
+	if cred, ok := PeerCredentials(r); ok {
+		return fmt.Sprintf("uid:%d", cred.UID)
+	}
+	return "addr:" + r.RemoteAddr
+}
+
+// auditWrites records every request that may change the store in the audit
+// log, whatever its outcome. For a request about a key, the hashes of the
+// key's value are read before and after the request is served; a write by
+// another request in between is attributed to this one. A record that cannot
+// be written is logged, as the request has already been answered.
+func (s *RscsServer) auditWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auditLog == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		record := db.AuditRecord{Time: time.Now().UTC().Round(0), Caller: caller(r),
+			Method: r.Method, Path: r.URL.Path, Namespace: chi.URLParam(r, namespaceName)}
+		record.Key, _ = r.Context().Value(contextKey).(string)
+		if record.Key != "" {
+			record.OldHash = valueHash(s.store(r), record.Key)
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		record.Status = ww.Status()
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if record.Key != "" {
+			record.NewHash = valueHash(s.store(r), record.Key)
+		}
+
+		appendErr := s.auditLog.AppendAudit(record)
+		if appendErr != nil {
+			log.Printf("audit record of %s %s by %s not written: %s",
+				record.Method, record.Path, record.Caller, appendErr.Error())
+		}
+	})
+}
+
+// valueHash is the db.HashValue of key's value, or empty if it does not
+// exist or cannot be read.
+func valueHash(store db.Store, key string) string {
+	value, found, getErr := store.Get(key)
+	if getErr != nil || !found {
+		return ""
+	}
+	return db.HashValue(value)
+}
+
+// Audit returns records from the audit log, oldest first. The key query
+// parameter returns only those for a key, since only those made at or after
+// an RFC 3339 time, and limit sets how many are returned.
+func (s *RscsServer) Audit(w http.ResponseWriter, r *http.Request) {
+	if s.auditLog == nil {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", "no audit log")
+		return
+	}
+	query := r.URL.Query()
+
+	limit := DefaultAuditLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var limitErr error
+		limit, limitErr = strconv.Atoi(limitStr)
+		if limitErr != nil || limit < 1 {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "limit must be a positive integer")
+			return
+		}
+		if limit > MaxAuditLimit {
+			limit = MaxAuditLimit
+		}
+	}
+
+	var since time.Time
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		var sinceErr error
+		since, sinceErr = time.Parse(time.RFC3339Nano, sinceStr)
+		if sinceErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "since must be an RFC 3339 time")
+			return
+		}
+	}
+
+	records, auditErr := s.auditLog.Audit(query.Get("key"), since, limit)
+	if auditErr != nil {
+		writeError(w, auditErr)
+		return
+	}
+
+	jsonBytes, jsonErr := json.Marshal(AuditResult{Records: records})
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
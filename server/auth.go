@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/go-chi/chi"
+)
+
+const (
+	// TokensRoute is the route for minting and listing tokens.
+	TokensRoute = "/v1/admin/tokens"
+	// TokenRoute is the route for revoking a token.
+	TokenRoute = TokensRoute + "/{" + tokenIDName + "}"
+	// tokenIDName is the string for 'id'.
+	tokenIDName = "id"
+	// tokenContextKey references the db.Token the request was made with.
+	tokenContextKey ContextKeyType = 2
+)
+
+// errNoTokens is returned when the store cannot keep tokens.
+var errNoTokens = errors.New("store does not support tokens")
+
+// TokenRequest describes a token to mint.
+type TokenRequest struct {
+	Admin    bool
+	Policies []db.Policy
+}
+
+// TokenResult describes a token, leaving out the hash of its secret.
+// Bearer, the string to present in the Authorization header, is only set
+// when the token is minted.
+type TokenResult struct {
+	ID       string
+	Admin    bool
+	Policies []db.Policy
+	Created  time.Time
+	Bearer   string `json:",omitempty"`
+}
+
+// tokenResult converts a token to a TokenResult.
+func tokenResult(token db.Token) TokenResult {
+	return TokenResult{ID: token.ID, Admin: token.Admin, Policies: token.Policies, Created: token.Created}
+}
+
+// TokensResult lists every token.
+type TokensResult struct {
+	Tokens []TokenResult
+}
+
+// RequireAuth makes every request present a bearer token kept in the store,
+// and restricts it to what the token's policies allow. Call it before the
+// server is started.
+func (s *RscsServer) RequireAuth() error {
+	tokens, ok := s.rscsDB.(db.TokenStore)
+	if !ok {
+		return errNoTokens
+	}
+	s.tokens = tokens
+	return nil
+}
+
+// authenticate places the token presented by the request into the Context,
+// or answers 401 if there is none or it is not valid. It passes every
+// request when auth is not required.
+func (s *RscsServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		const scheme = "Bearer "
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, scheme) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rscs"`)
+			writeErrorCode(w, http.StatusUnauthorized, CodeUnauthorized, "", "bearer token required")
+			return
+		}
+		token, found, authErr := db.Authenticate(s.tokens, strings.TrimPrefix(header, scheme))
+		if authErr != nil {
+			writeError(w, authErr)
+			return
+		}
+		if !found {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rscs", error="invalid_token"`)
+			writeErrorCode(w, http.StatusUnauthorized, CodeUnauthorized, "", "invalid bearer token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdmin answers 403 unless the request was made with an admin token.
+func (s *RscsServer) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value(tokenContextKey).(db.Token)
+		if s.tokens != nil && (!ok || !token.Admin) {
+			writeErrorCode(w, http.StatusForbidden, CodeForbidden, "", "admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeKey answers 403 unless the request's token grants the
+// permission its method needs on the key in the Context.
+func (s *RscsServer) authorizeKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, keyErr := extractKeyContext(r)
+		if keyErr != nil {
+			writeError(w, keyErr)
+			return
+		}
+		perm := db.PermWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			perm = db.PermRead
+		case http.MethodDelete:
+			perm = db.PermDelete
+		}
+		if !s.authorize(w, r, perm, key) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize reports whether the request's token grants perm on key, or on
+// every key beginning with key, in the request's namespace. If not, it has
+// already written a 403 response.
+func (s *RscsServer) authorize(w http.ResponseWriter, r *http.Request, perm db.Permission, key string) bool {
+	if s.tokens == nil {
+		return true
+	}
+	namespace := chi.URLParam(r, namespaceName)
+	if namespace == "" {
+		namespace = db.DefaultNamespace
+	}
+	if !tokenAllows(r.Context(), namespace, perm, key) {
+		writeErrorCode(w, http.StatusForbidden, CodeForbidden, key, fmt.Sprintf("token may not %s '%s' in namespace '%s'", perm, key, namespace))
+		return false
+	}
+	return true
+}
+
+// tokenAllows reports whether the token in ctx grants perm on key, or on
+// every key beginning with key, in namespace.
+func tokenAllows(ctx context.Context, namespace string, perm db.Permission, key string) bool {
+	token, ok := ctx.Value(tokenContextKey).(db.Token)
+	return ok && token.Allows(namespace, key, perm)
+}
+
+// CreateToken mints a token as described by the posted TokenRequest. The
+// response holds the bearer string, which cannot be retrieved again.
+func (s *RscsServer) CreateToken(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := s.rscsDB.(db.TokenStore)
+	if !ok {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", errNoTokens.Error())
+		return
+	}
+
+	var req TokenRequest
+	decodeErr := json.NewDecoder(r.Body).Decode(&req)
+	if decodeErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "TokenRequest JSON malformed")
+		return
+	}
+	token, bearer, newErr := db.NewToken(req.Admin, req.Policies)
+	if newErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", newErr.Error())
+		return
+	}
+	putErr := tokens.PutToken(token)
+	if putErr != nil {
+		writeError(w, putErr)
+		return
+	}
+
+	result := tokenResult(token)
+	result.Bearer = bearer
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+	return
+}
+
+// ListTokens lists every token, without their secrets.
+func (s *RscsServer) ListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := s.rscsDB.(db.TokenStore)
+	if !ok {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", errNoTokens.Error())
+		return
+	}
+
+	list, listErr := tokens.ListTokens()
+	if listErr != nil {
+		writeError(w, listErr)
+		return
+	}
+	result := TokensResult{Tokens: make([]TokenResult, len(list))}
+	for i, token := range list {
+		result.Tokens[i] = tokenResult(token)
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// RevokeToken deletes the token named on the URL path.
+func (s *RscsServer) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	tokens, ok := s.rscsDB.(db.TokenStore)
+	if !ok {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", errNoTokens.Error())
+		return
+	}
+
+	id := chi.URLParam(r, tokenIDName)
+	deleted, deleteErr := tokens.DeleteToken(id)
+	if deleteErr != nil {
+		writeError(w, deleteErr)
+		return
+	}
+	if !deleted {
+		writeErrorCode(w, http.StatusNotFound, CodeTokenNotFound, "", fmt.Sprintf("no token '%s' found", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
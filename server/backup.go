@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// BackupRoute is the route for downloading a consistent snapshot.
+	BackupRoute = "/v1/admin/backup"
+	// RestoreRoute is the route for replacing the store with a snapshot.
+	RestoreRoute = "/v1/admin/restore"
+	// DefaultBackupInterval is how often the daemon writes scheduled backups.
+	DefaultBackupInterval = time.Hour
+	// DefaultBackupKeep is how many scheduled backups the daemon keeps.
+	DefaultBackupKeep = 24
+	// backupPrefix and backupSuffix surround the time in a backup file name.
+	backupPrefix = "rscs-"
+	backupSuffix = ".backup"
+	// backupTimeFormat sorts in time order, so the oldest backups sort first.
+	backupTimeFormat = "20060102T150405.000000000Z"
+)
+
+// errNoBackup is returned when the store cannot be backed up.
+var errNoBackup = errors.New("store does not support backups")
+
+// backupContentType is the content type of a snapshot of the store.
+func backupContentType(store db.Store) string {
+	if _, ok := store.(*db.RscsDB); ok {
+		return "application/vnd.sqlite3"
+	}
+	return "application/x-ndjson"
+}
+
+// writeCounter counts the bytes written through it.
+type writeCounter struct {
+	w http.ResponseWriter
+	n int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	n, writeErr := c.w.Write(p)
+	c.n += n
+	return n, writeErr
+}
+
+// Backup streams a consistent snapshot of the store, taken while it is in
+// use. For the sqlite store it is a SQLite database file.
+func (s *RscsServer) Backup(w http.ResponseWriter, r *http.Request) {
+	backuper, ok := s.rscsDB.(db.Backuper)
+	if !ok {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", errNoBackup.Error())
+		return
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	w.Header().Set("Content-type", backupContentType(s.rscsDB))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	counter := &writeCounter{w: w}
+	backupErr := backuper.Backup(counter)
+	if backupErr != nil {
+		if counter.n == 0 {
+			writeError(w, backupErr)
+			return
+		}
+		// Too late to change the status; the client sees a short body.
+		log.Printf("backup: %s", backupErr.Error())
+	}
+	return
+}
+
+// Restore replaces the contents of the store with the posted snapshot, as
+// written by Backup. Watchers are woken, but note that the modification
+// index goes back to that of the snapshot.
+func (s *RscsServer) Restore(w http.ResponseWriter, r *http.Request) {
+	backuper, ok := s.rscsDB.(db.Backuper)
+	if !ok {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, "", errNoBackup.Error())
+		return
+	}
+
+	restoreErr := backuper.Restore(r.Body)
+	if restoreErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", restoreErr.Error())
+		return
+	}
+
+	s.watch.notify()
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// BackupEvery writes a backup into dir every interval until Close is
+// called, keeping only the newest keep backups. The daemon runs it in its
+// own goroutine.
+func (s *RscsServer) BackupEvery(dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			name, backupErr := s.writeBackup(dir, keep)
+			if backupErr != nil {
+				log.Printf("backup: %s", backupErr.Error())
+				continue
+			}
+			log.Printf("backup: wrote %s", name)
+		case <-s.watch.closed:
+			return
+		}
+	}
+}
+
+// writeBackup writes a backup file into dir, then removes all but the
+// newest keep backups there. It returns the name of the new file.
+func (s *RscsServer) writeBackup(dir string, keep int) (string, error) {
+	backuper, ok := s.rscsDB.(db.Backuper)
+	if !ok {
+		return "", errNoBackup
+	}
+
+	name := filepath.Join(dir, backupPrefix+time.Now().UTC().Format(backupTimeFormat)+backupSuffix)
+	partial := name + ".partial"
+	file, createErr := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if createErr != nil {
+		return "", createErr
+	}
+	backupErr := backuper.Backup(file)
+	if backupErr == nil {
+		backupErr = file.Sync()
+	}
+	closeErr := file.Close()
+	if backupErr == nil {
+		backupErr = closeErr
+	}
+	if backupErr == nil {
+		backupErr = os.Rename(partial, name)
+	}
+	if backupErr != nil {
+		os.Remove(partial)
+		return "", backupErr
+	}
+
+	files, readErr := ioutil.ReadDir(dir)
+	if readErr != nil {
+		return name, readErr
+	}
+	var backups []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), backupPrefix) && strings.HasSuffix(file.Name(), backupSuffix) {
+			backups = append(backups, file.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		removeErr := os.Remove(filepath.Join(dir, backups[0]))
+		if removeErr != nil {
+			return name, removeErr
+		}
+		backups = backups[1:]
+	}
+	return name, nil
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/go-chi/chi"
+)
+
+const (
+	// ConsulIndexHeader is the header a Consul KV response reports the
+	// store's modification index in, to be passed back as the index query
+	// parameter of a blocking query.
+	ConsulIndexHeader = "X-Consul-Index"
+	// ConsulTokenHeader is the header Consul clients present their token in.
+	ConsulTokenHeader = "X-Consul-Token"
+)
+
+// ConsulEntry is a key as the Consul KV API reports it. Value is base64
+// encoded in JSON. rscs has no locks, flags or record of when a key was
+// created, so LockIndex and Flags are zero and CreateIndex is the same as
+// ModifyIndex.
+type ConsulEntry struct {
+	LockIndex   uint64
+	Key         string
+	Flags       uint64
+	Value       []byte
+	CreateIndex int64
+	ModifyIndex int64
+}
+
+// EnableConsulKV serves a subset of the Consul KV HTTP API at KVRoutePrefix,
+// for tools such as consul-template and envconsul, in place of the native
+// key routes of the default namespace. Those stay available below
+// NamespaceRoute, as /v1/ns/default/kv/{key}. Call it before NewRouter.
+func (s *RscsServer) EnableConsulKV() {
+	s.consulKV = true
+}
+
+// consulRoutes adds the Consul KV routes to rtr.
+func (s *RscsServer) consulRoutes(rtr chi.Router) {
+	rtr.Route(KVRoutePrefix, func(rtr chi.Router) {
+		rtr.Use(insertConsulKeyContext)
+		rtr.Use(s.auditWrites)
+		rtr.Get("/*", s.ConsulGet)
+		rtr.Put("/*", s.ConsulPut)
+		rtr.Delete("/*", s.ConsulDelete)
+	})
+}
+
+// insertConsulKeyContext places the rest of the path after KVRoutePrefix,
+// which may contain slashes, into the Context as the key.
+func insertConsulKeyContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "*")
+		if r.URL.RawPath != "" {
+			// chi routed on the escaped path.
+			unescaped, unescapeErr := url.PathUnescape(key)
+			if unescapeErr != nil {
+				writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "key is not escaped properly")
+				return
+			}
+			key = unescaped
+		}
+		ctx := context.WithValue(r.Context(), contextKey, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// consulToken lets Consul clients present their token in ConsulTokenHeader
+// or the token query parameter, by passing it on as a bearer token.
+func consulToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			token := r.Header.Get(ConsulTokenHeader)
+			if token == "" {
+				token = r.URL.Query().Get("token")
+			}
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// consulFlag reports whether the query parameter name is present; Consul
+// flags such as recurse and keys take no value.
+func consulFlag(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+// consulKey reads the key from the Context. Only recursive requests may
+// leave it empty, to mean every key.
+func consulKey(w http.ResponseWriter, r *http.Request, recurse bool) (string, bool) {
+	key, _ := r.Context().Value(contextKey).(string)
+	if key == "" && !recurse {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "missing key name")
+		return "", false
+	}
+	return key, true
+}
+
+// setConsulHeaders writes the headers Consul clients expect on every KV
+// response. There is no leader election, so there is always a known leader.
+func (s *RscsServer) setConsulHeaders(w http.ResponseWriter) error {
+	index, indexErr := s.rscsDB.CurrentIndex()
+	if indexErr != nil {
+		return indexErr
+	}
+	w.Header().Set(ConsulIndexHeader, strconv.FormatInt(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	return nil
+}
+
+// listPrefix returns every key beginning with prefix, in sorted order.
+func listPrefix(store db.Store, prefix string) ([]db.Entry, error) {
+	var all []db.Entry
+	after := ""
+	for {
+		entries, more, listErr := store.List(prefix, after, MaxListLimit)
+		if listErr != nil {
+			return nil, listErr
+		}
+		all = append(all, entries...)
+		if !more {
+			return all, nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
+
+// consulKeys reduces entries to their keys. With a separator, keys are cut
+// after the first separator following prefix and repeats dropped, as Consul
+// lists the "folders" below a prefix.
+func consulKeys(entries []db.Entry, prefix, separator string) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		key := entry.Key
+		if separator != "" {
+			if i := strings.Index(key[len(prefix):], separator); i >= 0 {
+				key = key[:len(prefix)+i+len(separator)]
+			}
+		}
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ConsulGet reads a key, or with recurse every key beginning with it, as a
+// JSON array of ConsulEntry. With keys only the key names are returned, cut
+// at the separator query parameter if given, and with raw the bare value of
+// a single key. A missing key, or a prefix no key begins with, is answered
+// with 404. As with Get, a positive index query parameter blocks until a
+// matching key changes after that index or the wait query parameter expires.
+func (s *RscsServer) ConsulGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	keysOnly := consulFlag(query, "keys")
+	recurse := consulFlag(query, "recurse") || keysOnly
+	key, ok := consulKey(w, r, recurse)
+	if !ok || !s.authorize(w, r, db.PermRead, key) {
+		return
+	}
+
+	index, wait, block, waitErr := parseWait(r)
+	if waitErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", waitErr.Error())
+		return
+	}
+	// Consul does not block on an index of zero.
+	if block && index > 0 {
+		blockErr := s.blockUntil(r, wait, func() (bool, error) {
+			if !recurse {
+				lastIndex, lastErr := s.store(r).LastIndex(key)
+				return lastIndex > index, lastErr
+			}
+			changes, changesErr := s.store(r).Changes(key, index, 1)
+			return len(changes) != 0, changesErr
+		})
+		if blockErr != nil {
+			writeError(w, blockErr)
+			return
+		}
+	}
+	headerErr := s.setConsulHeaders(w)
+	if headerErr != nil {
+		writeError(w, headerErr)
+		return
+	}
+
+	var entries []db.Entry
+	if recurse {
+		var listErr error
+		entries, listErr = listPrefix(s.store(r), key)
+		if listErr != nil {
+			writeError(w, listErr)
+			return
+		}
+	} else {
+		entry, found, getErr := s.store(r).GetEntry(key)
+		if getErr != nil {
+			writeError(w, getErr)
+			return
+		}
+		if found {
+			entries = []db.Entry{entry}
+		}
+	}
+	if len(entries) == 0 {
+		writeKeyNotFound(w, "get", key)
+		return
+	}
+
+	if consulFlag(query, "raw") && !recurse {
+		w.Header().Set("Content-type", "application/octet-stream")
+		w.Write([]byte(entries[0].Value))
+		return
+	}
+
+	var result interface{}
+	if keysOnly {
+		result = consulKeys(entries, key, query.Get("separator"))
+	} else {
+		consulEntries := make([]ConsulEntry, len(entries))
+		for i, entry := range entries {
+			consulEntries[i] = ConsulEntry{Key: entry.Key, CreateIndex: entry.Index, ModifyIndex: entry.Index}
+			if entry.Value != "" {
+				consulEntries[i].Value = []byte(entry.Value)
+			}
+		}
+		result = consulEntries
+	}
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// writeConsulBool answers a Consul write with true if it was applied.
+func writeConsulBool(w http.ResponseWriter, applied bool) {
+	w.Header().Set("Content-type", "application/json")
+	w.Write([]byte(strconv.FormatBool(applied)))
+}
+
+// consulCAS reads the cas query parameter, reporting whether it was given.
+func consulCAS(w http.ResponseWriter, query url.Values) (int64, bool, bool) {
+	casStr := query.Get("cas")
+	if casStr == "" {
+		return 0, false, true
+	}
+	cas, casErr := strconv.ParseInt(casStr, 10, 64)
+	if casErr != nil || cas < 0 {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "cas must be a non-negative integer")
+		return 0, false, false
+	}
+	return cas, true, true
+}
+
+// ConsulPut sets a key to the request body, as is, clearing any expiry. With
+// the cas query parameter the write only happens if the key's ModifyIndex
+// is still that index, where zero means the key must not exist. The
+// response is true if the key was written and false otherwise. Sessions and
+// flags are not supported.
+func (s *RscsServer) ConsulPut(w http.ResponseWriter, r *http.Request) {
+	key, ok := consulKey(w, r, false)
+	if !ok || !s.authorize(w, r, db.PermWrite, key) {
+		return
+	}
+	query := r.URL.Query()
+	if consulFlag(query, "acquire") || consulFlag(query, "release") {
+		writeErrorCode(w, http.StatusNotImplemented, CodeNotImplemented, key, "sessions are not supported")
+		return
+	}
+	if flags := query.Get("flags"); flags != "" && flags != "0" {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, key, "flags are not supported")
+		return
+	}
+	cas, conditional, ok := consulCAS(w, query)
+	if !ok {
+		return
+	}
+
+	body, bodyErr := ioutil.ReadAll(r.Body)
+	if bodyErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "cannot read body")
+		return
+	}
+
+	applied := true
+	if conditional {
+		rowCount, casErr := s.store(r).CompareAndSwap(key, cas, string(body))
+		if casErr != nil {
+			writeError(w, casErr)
+			return
+		}
+		applied = rowCount != 0
+	} else {
+		_, upsertErr := s.store(r).Upsert(key, string(body))
+		if upsertErr != nil {
+			writeError(w, upsertErr)
+			return
+		}
+	}
+	if applied {
+		s.watch.notify()
+	}
+	writeConsulBool(w, applied)
+	return
+}
+
+// ConsulDelete deletes a key, or with recurse every key beginning with it,
+// all in one transaction. Deleting every key of a namespace, with recurse
+// and no key, takes an admin token. With the cas query parameter a single
+// key is only deleted if its ModifyIndex is still that index. Deleting a
+// missing key succeeds. The response is true unless the cas did not match.
+func (s *RscsServer) ConsulDelete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	recurse := consulFlag(query, "recurse")
+	key, ok := consulKey(w, r, recurse)
+	if !ok || !s.authorize(w, r, db.PermDelete, key) {
+		return
+	}
+	if key == "" {
+		token, ok := r.Context().Value(tokenContextKey).(db.Token)
+		if s.tokens != nil && (!ok || !token.Admin) {
+			writeErrorCode(w, http.StatusForbidden, CodeForbidden, "", "admin token required to delete every key")
+			return
+		}
+	}
+	cas, conditional, ok := consulCAS(w, query)
+	if !ok {
+		return
+	}
+
+	var deleted int
+	switch {
+	case recurse:
+		var deleteErr error
+		deleted, deleteErr = db.DeletePrefix(s.store(r), key)
+		if deleteErr != nil {
+			writeError(w, deleteErr)
+			return
+		}
+	case conditional:
+		rowCount, deleteErr := s.store(r).CompareAndDelete(key, cas)
+		if deleteErr != nil {
+			writeError(w, deleteErr)
+			return
+		}
+		if rowCount == 0 {
+			writeConsulBool(w, false)
+			return
+		}
+		deleted = rowCount
+	default:
+		var deleteErr error
+		deleted, deleteErr = s.store(r).Delete(key)
+		if deleteErr != nil {
+			writeError(w, deleteErr)
+			return
+		}
+	}
+	if deleted != 0 {
+		s.watch.notify()
+	}
+	writeConsulBool(w, true)
+	return
+}
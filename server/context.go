@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/bradclawsie/rscs/db"
 	"github.com/go-chi/chi"
 )
 
@@ -14,6 +15,9 @@ type ContextKeyType int
 
 var contextKey ContextKeyType // == 0
 
+// namespaceContextKey references the db.Store of the request's namespace.
+const namespaceContextKey ContextKeyType = 1
+
 // insertKeyContext places the key into the Context.
 func insertKeyContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -39,3 +43,46 @@ func extractKeyContext(r *http.Request) (string, error) {
 	}
 	return keyStr, nil
 }
+
+// insertNamespaceContext places the store of the namespace named on the URL
+// path into the Context, or answers 404 if there is no such namespace. A
+// token granting nothing in the namespace gets 403 whether or not it exists,
+// so it cannot learn which namespaces do.
+func (s *RscsServer) insertNamespaceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, namespaceName)
+		if s.tokens != nil {
+			token, ok := r.Context().Value(tokenContextKey).(db.Token)
+			if !ok || !token.AllowsNamespace(name) {
+				writeErrorCode(w, http.StatusForbidden, CodeForbidden, "", fmt.Sprintf("token may not use namespace '%s'", name))
+				return
+			}
+		}
+		exists, existsErr := db.NamespaceExists(s.rscsDB, name)
+		if existsErr != nil {
+			writeError(w, existsErr)
+			return
+		}
+		if !exists {
+			writeErrorCode(w, http.StatusNotFound, CodeNamespaceNotFound, "", fmt.Sprintf("no namespace '%s' found", name))
+			return
+		}
+		store, nsErr := db.Namespace(s.rscsDB, name)
+		if nsErr != nil {
+			writeError(w, nsErr)
+			return
+		}
+		ctx := context.WithValue(r.Context(), namespaceContextKey, store)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// store returns the store of the request's namespace, which is the default
+// namespace unless the request was routed below NamespaceRoute.
+func (s *RscsServer) store(r *http.Request) db.Store {
+	store, ok := r.Context().Value(namespaceContextKey).(db.Store)
+	if !ok {
+		return s.defaultStore
+	}
+	return store
+}
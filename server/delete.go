@@ -1,34 +1,54 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 )
 
-// Delete removes a row identified by a key.
+// Delete removes a row identified by a key. If-Match and If-None-Match are
+// honoured against the row's modification index.
 func (s *RscsServer) Delete(w http.ResponseWriter, r *http.Request) {
 	key, keyErr := extractKeyContext(r)
 	if keyErr != nil {
-		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+		writeError(w, keyErr)
 		return
 	}
 
-	rowCount, deleteErr := s.rscsDB.Delete(key)
+	var rowCount int
+	var deleteErr error
+	if conditional(r) {
+		entry, found, ok := s.checkPreconditions(w, r, key)
+		if !ok {
+			return
+		}
+		if !found {
+			writeKeyNotFound(w, "delete", key)
+			return
+		}
+		rowCount, deleteErr = s.store(r).CompareAndDelete(key, entry.Index)
+		if deleteErr == nil && rowCount == 0 {
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, "key modified concurrently")
+			return
+		}
+	} else {
+		rowCount, deleteErr = s.store(r).Delete(key)
+	}
 	if deleteErr != nil {
-		http.Error(w, deleteErr.Error(), http.StatusInternalServerError)
+		writeError(w, deleteErr)
 		return
 	}
 
 	if rowCount == 0 {
-		e := fmt.Sprintf("no key '%s' found", key)
-		http.Error(w, e, http.StatusNotFound)
+		writeKeyNotFound(w, "delete", key)
 		return
 	}
 	if rowCount != 1 {
-		http.Error(w, "bad number of rows deleted", http.StatusInternalServerError)
+		writeError(w, errors.New("bad number of rows deleted"))
 		return
 	}
 
+	s.watch.notify()
+
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+// The Code of an ErrorResult. Codes are stable; match on them rather than
+// on Message.
+const (
+	// CodeInternal is for a failure inside the server. The details are
+	// logged, not returned.
+	CodeInternal = "internal"
+	// CodeMalformedRequest is for a body that cannot be read or decoded.
+	CodeMalformedRequest = "malformed_request"
+	// CodeInvalidParameter is for a query parameter, header or field with a
+	// bad value.
+	CodeInvalidParameter = "invalid_parameter"
+	// CodeKeyNotFound is for a key that does not exist.
+	CodeKeyNotFound = "key_not_found"
+	// CodeKeyExists is for inserting a key that exists.
+	CodeKeyExists = "key_exists"
+	// CodeKeyTooLong is for a key longer than db.MaxKeyLen.
+	CodeKeyTooLong = "key_too_long"
+	// CodeEmptyKey is for an empty key.
+	CodeEmptyKey = "empty_key"
+	// CodeReservedKey is for a key in the range kept for namespaces.
+	CodeReservedKey = "reserved_key"
+	// CodeReservedValue is for a value that would be read back as an
+	// encrypted one.
+	CodeReservedValue = "reserved_value"
+	// CodeRevisionNotFound is for a revision of a key that does not exist.
+	CodeRevisionNotFound = "revision_not_found"
+	// CodePreconditionFailed is for a failed If-Match or If-None-Match, or a
+	// key changed between checking and writing it.
+	CodePreconditionFailed = "precondition_failed"
+	// CodeValueNotJSON is for patching a value that is not a JSON document.
+	CodeValueNotJSON = "value_not_json"
+	// CodePatchFailed is for a JSON Patch that cannot be applied to the
+	// value, such as one whose test op fails.
+	CodePatchFailed = "patch_failed"
+	// CodeUnsupportedMediaType is for a body of a type the route does not
+	// take.
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	// CodeConflict is for a write that lost to another.
+	CodeConflict = "conflict"
+	// CodeTxnFailed is the Code of a TxnResult for a transaction that could
+	// not be applied.
+	CodeTxnFailed = "txn_failed"
+	// CodeNamespaceNotFound is for a namespace that does not exist.
+	CodeNamespaceNotFound = "namespace_not_found"
+	// CodeNamespaceExists is for creating a namespace that exists.
+	CodeNamespaceExists = "namespace_exists"
+	// CodeInvalidNamespace is for a namespace name that is not allowed.
+	CodeInvalidNamespace = "invalid_namespace"
+	// CodeUnauthorized is for a missing or invalid bearer token.
+	CodeUnauthorized = "unauthorized"
+	// CodeForbidden is for a request its token, or its caller, may not make.
+	CodeForbidden = "forbidden"
+	// CodeTokenNotFound is for a token that does not exist.
+	CodeTokenNotFound = "token_not_found"
+	// CodeNotImplemented is for a feature the store does not support.
+	CodeNotImplemented = "not_implemented"
+	// CodeRouteNotFound is for a path that is not a route.
+	CodeRouteNotFound = "route_not_found"
+	// CodeMethodNotAllowed is for a route that does not take the method.
+	CodeMethodNotAllowed = "method_not_allowed"
+	// CodeReadOnlyReplica is for a write to a replica that does not forward
+	// writes to its primary.
+	CodeReadOnlyReplica = "read_only_replica"
+)
+
+// ErrorResult is the body of every error response. Key is set when the
+// error is about a key.
+type ErrorResult struct {
+	Code    string
+	Message string
+	Key     string `json:",omitempty"`
+}
+
+// writeErrorCode writes an ErrorResult as the response with status.
+func writeErrorCode(w http.ResponseWriter, status int, code, key, message string) {
+	jsonBytes, jsonErr := json.Marshal(ErrorResult{Code: code, Message: message, Key: key})
+	if jsonErr != nil {
+		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// writeError writes the response to err. A *db.KeyError gets the status
+// and code of its kind; any other error is logged and answered with 500.
+func writeError(w http.ResponseWriter, err error) {
+	var keyErr *db.KeyError
+	if errors.As(err, &keyErr) {
+		switch keyErr.Err {
+		case db.ErrNotFound:
+			writeErrorCode(w, http.StatusNotFound, CodeKeyNotFound, keyErr.Key, err.Error())
+			return
+		case db.ErrExists:
+			writeErrorCode(w, http.StatusConflict, CodeKeyExists, keyErr.Key, err.Error())
+			return
+		case db.ErrKeyTooLong:
+			writeErrorCode(w, http.StatusBadRequest, CodeKeyTooLong, "", err.Error())
+			return
+		case db.ErrEmptyKey:
+			writeErrorCode(w, http.StatusBadRequest, CodeEmptyKey, "", err.Error())
+			return
+		case db.ErrReservedKey:
+			writeErrorCode(w, http.StatusBadRequest, CodeReservedKey, keyErr.Key, err.Error())
+			return
+		case db.ErrReservedValue:
+			writeErrorCode(w, http.StatusBadRequest, CodeReservedValue, keyErr.Key, err.Error())
+			return
+		}
+	}
+	log.Printf("internal error: %s", err.Error())
+	writeErrorCode(w, http.StatusInternalServerError, CodeInternal, "", "internal error")
+}
+
+// writeKeyNotFound answers 404 for key.
+func writeKeyNotFound(w http.ResponseWriter, op, key string) {
+	writeError(w, &db.KeyError{Op: op, Key: key, Err: db.ErrNotFound})
+}
+
+// notFound answers requests for paths that are not routes.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeErrorCode(w, http.StatusNotFound, CodeRouteNotFound, "", "no route "+r.URL.Path)
+}
+
+// methodNotAllowed answers requests with a method their route does not take.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeErrorCode(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "", r.Method+" not allowed on "+r.URL.Path)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+// formatETag renders a modification index as a strong ETag.
+func formatETag(index int64) string {
+	return strconv.Quote(strconv.FormatInt(index, 10))
+}
+
+// etagMatches reports whether the If-Match or If-None-Match header value
+// matches a row with the given modification index. A row that does not
+// exist matches nothing, and "*" matches any row that exists.
+func etagMatches(header string, index int64, found bool) (bool, error) {
+	if strings.TrimSpace(header) == "*" {
+		return found, nil
+	}
+	matched := false
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		unquoted, unquoteErr := strconv.Unquote(tag)
+		if unquoteErr != nil {
+			return false, errors.New("malformed ETag")
+		}
+		tagIndex, parseErr := strconv.ParseInt(unquoted, 10, 64)
+		if parseErr != nil {
+			return false, errors.New("malformed ETag")
+		}
+		if found && tagIndex == index {
+			matched = true
+		}
+	}
+	return matched, nil
+}
+
+// conditional reports whether the request carries If-Match or If-None-Match.
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against the current
+// row for key. On success it returns the row and whether it exists, so the
+// caller can make its write conditional on that same modification index.
+// Otherwise it has already written a 400 or 412 response.
+func (s *RscsServer) checkPreconditions(w http.ResponseWriter, r *http.Request, key string) (db.Entry, bool, bool) {
+	entry, found, getErr := s.store(r).GetEntry(key)
+	if getErr != nil {
+		writeError(w, getErr)
+		return db.Entry{}, false, false
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		matched, matchErr := etagMatches(ifMatch, entry.Index, found)
+		if matchErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, key, matchErr.Error())
+			return db.Entry{}, false, false
+		}
+		if !matched {
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, "If-Match precondition failed")
+			return db.Entry{}, false, false
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		matched, matchErr := etagMatches(ifNoneMatch, entry.Index, found)
+		if matchErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, key, matchErr.Error())
+			return db.Entry{}, false, false
+		}
+		if matched {
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, "If-None-Match precondition failed")
+			return db.Entry{}, false, false
+		}
+	}
+	return entry, found, true
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+// DefaultReapInterval is how often the daemon purges expired keys.
+const DefaultReapInterval = time.Second
+
+// Reap purges expired keys every interval until Close is called, waking
+// watchers so they see the delete events. Expired keys are hidden from reads
+// as soon as they expire, so the interval only bounds how late those events
+// arrive. The daemon runs it in its own goroutine.
+func (s *RscsServer) Reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rowCount, purgeErr := s.rscsDB.PurgeExpired()
+			if purgeErr != nil {
+				log.Printf("reap: %s", purgeErr.Error())
+				continue
+			}
+			if rowCount != 0 {
+				s.watch.notify()
+			}
+		case <-s.watch.closed:
+			return
+		}
+	}
+}
+
+const (
+	// DefaultHistoryKeep is how many revisions of each key the daemon keeps.
+	DefaultHistoryKeep = 100
+	// DefaultHistoryInterval is how often the daemon prunes the key history.
+	DefaultHistoryInterval = time.Minute
+)
+
+// PruneHistory drops all but the newest keep revisions of each key every
+// interval until Close is called, looking only at keys written since the
+// previous pass. It returns at once if the store keeps every revision. The
+// daemon runs it in its own goroutine.
+func (s *RscsServer) PruneHistory(keep int, interval time.Duration) {
+	pruner, ok := s.rscsDB.(db.HistoryPruner)
+	if !ok {
+		log.Printf("prune history: store does not support pruning")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var since int64
+	for {
+		select {
+		case <-ticker.C:
+			index, indexErr := s.rscsDB.CurrentIndex()
+			if indexErr != nil {
+				log.Printf("prune history: %s", indexErr.Error())
+				continue
+			}
+			_, pruneErr := pruner.PruneHistory(keep, since)
+			if pruneErr != nil {
+				log.Printf("prune history: %s", pruneErr.Error())
+				continue
+			}
+			since = index
+		case <-s.watch.closed:
+			return
+		}
+	}
+}
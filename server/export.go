@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// ExportRoute is the route for exporting every key.
+	ExportRoute = "/v1/export"
+	// ImportRoute is the route for importing keys.
+	ImportRoute = "/v1/import"
+)
+
+// ImportResult lists the changes an import made, or would make if DryRun is
+// set.
+type ImportResult struct {
+	DryRun  bool
+	Changes []db.ImportChange
+}
+
+// formatContentTypes maps each export format to its content type.
+var formatContentTypes = map[string]string{
+	db.FormatJSON: "application/json",
+	db.FormatYAML: "application/x-yaml",
+	db.FormatEnv:  "text/plain; charset=utf-8",
+}
+
+// queryFormat reads the format query parameter, which defaults to json.
+func queryFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		return db.FormatJSON, nil
+	}
+	return format, db.CheckFormat(format)
+}
+
+// Export writes the value of every unexpired key in the format query
+// parameter: json, yaml or env.
+func (s *RscsServer) Export(w http.ResponseWriter, r *http.Request) {
+	format, formatErr := queryFormat(r)
+	if formatErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", formatErr.Error())
+		return
+	}
+	if !s.authorize(w, r, db.PermRead, "") {
+		return
+	}
+
+	values, exportErr := db.Export(s.store(r))
+	if exportErr != nil {
+		writeError(w, exportErr)
+		return
+	}
+
+	var buf bytes.Buffer
+	encodeErr := db.EncodeValues(&buf, format, values)
+	if encodeErr != nil {
+		writeError(w, encodeErr)
+		return
+	}
+
+	w.Header().Set("Content-type", formatContentTypes[format])
+	w.Write(buf.Bytes())
+	return
+}
+
+// Import writes the keys in the posted body, in the format query parameter,
+// in a single transaction. The mode query parameter is merge, the default, to
+// leave other keys alone, or replace to delete them. With dryrun=true nothing
+// is written and the changes that would have been made are returned. If the
+// store changes while the import runs it is answered with 409 and no writes.
+func (s *RscsServer) Import(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format, formatErr := queryFormat(r)
+	if formatErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", formatErr.Error())
+		return
+	}
+
+	var replace bool
+	switch query.Get("mode") {
+	case "", "merge":
+	case "replace":
+		replace = true
+	default:
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "mode must be merge or replace")
+		return
+	}
+
+	var dryRun bool
+	if dryRunStr := query.Get("dryrun"); dryRunStr != "" {
+		var dryRunErr error
+		dryRun, dryRunErr = strconv.ParseBool(dryRunStr)
+		if dryRunErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "dryrun must be a boolean")
+			return
+		}
+	}
+
+	values, decodeErr := db.DecodeValues(r.Body, format)
+	if decodeErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", decodeErr.Error())
+		return
+	}
+	checkErr := db.CheckImport(values)
+	if checkErr != nil {
+		writeError(w, checkErr)
+		return
+	}
+	if replace && !s.authorize(w, r, db.PermDelete, "") {
+		return
+	}
+	for key := range values {
+		if !s.authorize(w, r, db.PermWrite, key) {
+			return
+		}
+	}
+
+	changes, importErr := db.Import(s.store(r), values, replace, dryRun)
+	if importErr != nil {
+		if _, ok := importErr.(*db.TxnError); ok {
+			writeErrorCode(w, http.StatusConflict, CodeConflict, "", "store changed during import")
+			return
+		}
+		writeError(w, importErr)
+		return
+	}
+	if !dryRun && len(changes) != 0 {
+		s.watch.notify()
+	}
+
+	jsonBytes, jsonErr := json.Marshal(ImportResult{DryRun: dryRun, Changes: changes})
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
@@ -2,33 +2,82 @@ package server
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
 )
 
-// Get retrieves the value for the key passed on the URL path.
+// Get retrieves the value for the key passed on the URL path, with its
+// modification index as the ETag. If the revision query parameter is set,
+// the value the key had at that revision is returned instead. If the index
+// query parameter is set, Get first blocks until the key is written after
+// that index or the wait query parameter expires.
 func (s *RscsServer) Get(w http.ResponseWriter, r *http.Request) {
 	key, keyErr := extractKeyContext(r)
 	if keyErr != nil {
-		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+		writeError(w, keyErr)
 		return
 	}
 
-	value, found, getErr := s.rscsDB.Get(key)
+	var value string
+	var expires time.Time
+	var found bool
+	var getErr error
+	if revisionStr := r.URL.Query().Get("revision"); revisionStr != "" {
+		revision, revisionErr := strconv.Atoi(revisionStr)
+		if revisionErr != nil || revision < 1 {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "revision must be a positive integer")
+			return
+		}
+		value, found, getErr = s.store(r).GetRevision(key, revision)
+	} else {
+		index, wait, block, waitErr := parseWait(r)
+		if waitErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", waitErr.Error())
+			return
+		}
+		if block {
+			blockErr := s.blockUntil(r, wait, func() (bool, error) {
+				lastIndex, lastErr := s.store(r).LastIndex(key)
+				return lastIndex > index, lastErr
+			})
+			if blockErr != nil {
+				writeError(w, blockErr)
+				return
+			}
+		}
+		indexErr := s.setIndexHeader(w)
+		if indexErr != nil {
+			writeError(w, indexErr)
+			return
+		}
+		var entry db.Entry
+		entry, found, getErr = s.store(r).GetEntry(key)
+		value = entry.Value
+		expires = entry.Expires
+		if found {
+			w.Header().Set("ETag", formatETag(entry.Index))
+		}
+	}
 	if getErr != nil {
-		http.Error(w, getErr.Error(), http.StatusInternalServerError)
+		writeError(w, getErr)
 		return
 	}
 
 	if !found {
-		e := fmt.Sprintf("no key '%s' found", key)
-		http.Error(w, e, http.StatusNotFound)
+		writeKeyNotFound(w, "get", key)
 		return
 	}
 
-	jsonBytes, jsonErr := json.Marshal(Value{Value: value})
+	result := Value{Value: value}
+	if !expires.IsZero() {
+		result.Expires = &expires
+	}
+	jsonBytes, jsonErr := json.Marshal(result)
 	if jsonErr != nil {
-		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		writeError(w, jsonErr)
 		return
 	}
 
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/bradclawsie/rscs/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcWrites are the methods that may change the store, and so are
+// refused by a replica and recorded in the audit log.
+var grpcWrites = map[string]bool{
+	rpc.KV_Put_FullMethodName:    true,
+	rpc.KV_Delete_FullMethodName: true,
+	rpc.KV_Txn_FullMethodName:    true,
+}
+
+// NewGRPCServer returns a gRPC server for the rpc.KV service, backed by the
+// same store, tokens, audit log and replication as the HTTP routes. Tokens
+// are presented as "authorization: Bearer <token>" metadata. Connections
+// over tcp use TLS if tlsConfig is not nil; connections over a unix socket
+// are subject to RestrictPeers instead. Serve it on listeners of its own,
+// and stop it when the HTTP server is shut down.
+func (s *RscsServer) NewGRPCServer(tlsConfig *tls.Config, opts ...grpc.ServerOption) *grpc.Server {
+	creds := grpcCreds{TransportCredentials: insecure.NewCredentials(), s: s}
+	if tlsConfig != nil {
+		creds.TransportCredentials = credentials.NewTLS(tlsConfig)
+	}
+	opts = append(opts, grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(s.grpcUnary),
+		grpc.ChainStreamInterceptor(s.grpcStream))
+	srv := grpc.NewServer(opts...)
+	rpc.RegisterKVServer(srv, &grpcService{s: s})
+	return srv
+}
+
+// grpcCreds hands tcp connections to the TransportCredentials it wraps, and
+// checks the peer of unix socket connections, which are local already and
+// so not encrypted.
+type grpcCreds struct {
+	credentials.TransportCredentials
+	s *RscsServer
+}
+
+// grpcPeerInfo is the AuthInfo of a unix socket connection.
+type grpcPeerInfo struct {
+	credentials.CommonAuthInfo
+	cred PeerCred
+	ok   bool
+}
+
+// AuthType names the kind of connection.
+func (grpcPeerInfo) AuthType() string {
+	return "unix"
+}
+
+// ServerHandshake refuses unix socket connections from users not allowed by
+// RestrictPeers.
+func (c grpcCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, isUnix := conn.(*net.UnixConn)
+	if !isUnix {
+		return c.TransportCredentials.ServerHandshake(conn)
+	}
+	cred, credErr := peerCred(unixConn)
+	if c.s.peerUIDs != nil && (credErr != nil || !c.s.peerUIDs[cred.UID]) {
+		conn.Close()
+		return nil, nil, errors.New("user may not connect")
+	}
+	info := grpcPeerInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		cred: cred, ok: credErr == nil}
+	return conn, info, nil
+}
+
+// Clone returns a copy of the credentials.
+func (c grpcCreds) Clone() credentials.TransportCredentials {
+	return grpcCreds{TransportCredentials: c.TransportCredentials.Clone(), s: c.s}
+}
+
+// grpcAuthenticate checks the bearer token in the authorization metadata,
+// as authenticate does for HTTP, and places it into the Context.
+func (s *RscsServer) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	if s.tokens == nil {
+		return ctx, nil
+	}
+	const scheme = "Bearer "
+	var header string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) != 0 {
+		header = values[0]
+	}
+	if !strings.HasPrefix(header, scheme) {
+		return nil, status.Error(codes.Unauthenticated, "bearer token required")
+	}
+	token, found, authErr := db.Authenticate(s.tokens, strings.TrimPrefix(header, scheme))
+	if authErr != nil {
+		return nil, grpcError(authErr)
+	}
+	if !found {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return context.WithValue(ctx, tokenContextKey, token), nil
+}
+
+// grpcUnary authenticates unary calls, refuses writes to a replica, and
+// records writes in the audit log as auditWrites does for HTTP.
+func (s *RscsServer) grpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, authErr := s.grpcAuthenticate(ctx)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if !grpcWrites[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	if s.replica != nil {
+		return nil, status.Error(codes.FailedPrecondition, "this is a read-only replica of "+s.replica.primary.String())
+	}
+	if s.auditLog == nil {
+		return handler(ctx, req)
+	}
+
+	record := db.AuditRecord{Time: time.Now().UTC().Round(0), Caller: grpcCaller(ctx),
+		Method: http.MethodPost, Path: info.FullMethod}
+	var store db.Store
+	if named, ok := req.(interface{ GetNamespace() string }); ok {
+		record.Namespace = named.GetNamespace()
+		store, _ = s.grpcStore(record.Namespace)
+	}
+	if keyed, ok := req.(interface{ GetKey() string }); ok && store != nil {
+		record.Key = keyed.GetKey()
+		record.OldHash = valueHash(store, record.Key)
+	}
+
+	resp, err := handler(ctx, req)
+	record.Status = grpcHTTPStatus(status.Code(err))
+	if record.Key != "" {
+		record.NewHash = valueHash(store, record.Key)
+	}
+	appendErr := s.auditLog.AppendAudit(record)
+	if appendErr != nil {
+		log.Printf("audit record of %s %s by %s not written: %s",
+			record.Method, record.Path, record.Caller, appendErr.Error())
+	}
+	return resp, err
+}
+
+// grpcAuthStream carries the authenticated Context of a stream.
+type grpcAuthStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the authenticated Context.
+func (g grpcAuthStream) Context() context.Context {
+	return g.ctx
+}
+
+// grpcStream authenticates streaming calls.
+func (s *RscsServer) grpcStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, authErr := s.grpcAuthenticate(stream.Context())
+	if authErr != nil {
+		return authErr
+	}
+	return handler(srv, grpcAuthStream{ServerStream: stream, ctx: ctx})
+}
+
+// grpcCaller identifies who made a call for the audit log, as caller does
+// for HTTP requests.
+func grpcCaller(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenContextKey).(db.Token); ok {
+		return "token:" + token.ID
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	switch info := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		chains := info.State.VerifiedChains
+		if len(chains) != 0 && len(chains[0]) != 0 {
+			return "cert:" + chains[0][0].Subject.String()
+		}
+	case grpcPeerInfo:
+		if info.ok {
+			return fmt.Sprintf("uid:%d", info.cred.UID)
+		}
+	}
+	return "addr:" + p.Addr.String()
+}
+
+// grpcHTTPStatus is the HTTP status an audit record gives a call that ended
+// with code.
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.FailedPrecondition, codes.Aborted:
+		return http.StatusPreconditionFailed
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// grpcError converts an error from the db to a gRPC status, as writeError
+// does for HTTP. Errors that are already a status are returned as they are.
+func grpcError(err error) error {
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	var keyErr *db.KeyError
+	if errors.As(err, &keyErr) {
+		switch keyErr.Err {
+		case db.ErrNotFound:
+			return status.Error(codes.NotFound, keyErr.Error())
+		case db.ErrExists:
+			return status.Error(codes.AlreadyExists, keyErr.Error())
+		case db.ErrKeyTooLong, db.ErrEmptyKey, db.ErrReservedKey, db.ErrReservedValue:
+			return status.Error(codes.InvalidArgument, keyErr.Error())
+		}
+	}
+	log.Printf("grpc: %s", err.Error())
+	return status.Error(codes.Internal, "internal error")
+}
+
+// grpcStore returns the store of namespace, or of the default namespace if
+// it is empty. Call it after grpcAuthorize, so a token cannot learn which
+// namespaces exist.
+func (s *RscsServer) grpcStore(namespace string) (db.Store, error) {
+	if namespace == "" {
+		return s.defaultStore, nil
+	}
+	exists, existsErr := db.NamespaceExists(s.rscsDB, namespace)
+	if existsErr != nil {
+		return nil, grpcError(existsErr)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "no namespace '%s' found", namespace)
+	}
+	store, nsErr := db.Namespace(s.rscsDB, namespace)
+	if nsErr != nil {
+		return nil, grpcError(nsErr)
+	}
+	return store, nil
+}
+
+// grpcAuthorize returns a PermissionDenied status unless the call's token
+// grants perm on key in namespace, as authorize does for HTTP.
+func (s *RscsServer) grpcAuthorize(ctx context.Context, namespace string, perm db.Permission, key string) error {
+	if s.tokens == nil {
+		return nil
+	}
+	if namespace == "" {
+		namespace = db.DefaultNamespace
+	}
+	if !tokenAllows(ctx, namespace, perm, key) {
+		return status.Errorf(codes.PermissionDenied, "token may not %s '%s' in namespace '%s'", perm, key, namespace)
+	}
+	return nil
+}
+
+// grpcTTL converts an optional TTL, which must be positive if set.
+func grpcTTL(ttl *durationpb.Duration) (time.Duration, error) {
+	if ttl == nil {
+		return 0, nil
+	}
+	if ttl.CheckValid() != nil || ttl.AsDuration() <= 0 {
+		return 0, status.Error(codes.InvalidArgument, "ttl must be a positive duration")
+	}
+	return ttl.AsDuration(), nil
+}
+
+// grpcExpires converts an expiry time, where the zero time means none.
+func grpcExpires(expires time.Time) *timestamppb.Timestamp {
+	if expires.IsZero() {
+		return nil
+	}
+	return timestamppb.New(expires)
+}
+
+// grpcService implements rpc.KVServer on an RscsServer.
+type grpcService struct {
+	rpc.UnimplementedKVServer
+	s *RscsServer
+}
+
+// Get reads a key, which must exist.
+func (g *grpcService) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	authErr := g.s.grpcAuthorize(ctx, req.Namespace, db.PermRead, req.Key)
+	if authErr != nil {
+		return nil, authErr
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	entry, found, getErr := store.GetEntry(req.Key)
+	if getErr != nil {
+		return nil, grpcError(getErr)
+	}
+	if !found {
+		return nil, grpcError(&db.KeyError{Op: "get", Key: req.Key, Err: db.ErrNotFound})
+	}
+	return &rpc.GetResponse{Entry: &rpc.Entry{Key: entry.Key, Value: entry.Value,
+		Index: entry.Index, Expires: grpcExpires(entry.Expires)}}, nil
+}
+
+// Put writes a key, creating it if need be. With expected_index the write
+// only happens if the key's modification index is still that index, where
+// zero means the key must not exist.
+func (g *grpcService) Put(ctx context.Context, req *rpc.PutRequest) (*rpc.PutResponse, error) {
+	authErr := g.s.grpcAuthorize(ctx, req.Namespace, db.PermWrite, req.Key)
+	if authErr != nil {
+		return nil, authErr
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	ttl, ttlErr := grpcTTL(req.Ttl)
+	if ttlErr != nil {
+		return nil, ttlErr
+	}
+
+	var created bool
+	if req.ExpectedIndex != nil {
+		rowCount, casErr := store.CompareAndSwapTTL(req.Key, *req.ExpectedIndex, req.Value, ttl)
+		if casErr != nil {
+			return nil, grpcError(casErr)
+		}
+		if rowCount == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "index of '%s' is not %d", req.Key, *req.ExpectedIndex)
+		}
+		created = *req.ExpectedIndex == 0
+	} else {
+		var upsertErr error
+		created, upsertErr = store.UpsertTTL(req.Key, req.Value, ttl)
+		if upsertErr != nil {
+			return nil, grpcError(upsertErr)
+		}
+	}
+	g.s.watch.notify()
+	return &rpc.PutResponse{Created: created}, nil
+}
+
+// Delete removes a key, which must exist. With expected_index it is only
+// removed if its modification index is still that index.
+func (g *grpcService) Delete(ctx context.Context, req *rpc.DeleteRequest) (*rpc.DeleteResponse, error) {
+	authErr := g.s.grpcAuthorize(ctx, req.Namespace, db.PermDelete, req.Key)
+	if authErr != nil {
+		return nil, authErr
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	if req.ExpectedIndex != nil {
+		if *req.ExpectedIndex <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "expected_index must be positive")
+		}
+		rowCount, deleteErr := store.CompareAndDelete(req.Key, *req.ExpectedIndex)
+		if deleteErr != nil {
+			return nil, grpcError(deleteErr)
+		}
+		if rowCount == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "index of '%s' is not %d", req.Key, *req.ExpectedIndex)
+		}
+	} else {
+		rowCount, deleteErr := store.Delete(req.Key)
+		if deleteErr != nil {
+			return nil, grpcError(deleteErr)
+		}
+		if rowCount == 0 {
+			return nil, grpcError(&db.KeyError{Op: "delete", Key: req.Key, Err: db.ErrNotFound})
+		}
+	}
+	g.s.watch.notify()
+	return &rpc.DeleteResponse{}, nil
+}
+
+// List returns a page of the keys beginning with prefix, in sorted order.
+func (g *grpcService) List(ctx context.Context, req *rpc.ListRequest) (*rpc.ListResponse, error) {
+	authErr := g.s.grpcAuthorize(ctx, req.Namespace, db.PermRead, req.Prefix)
+	if authErr != nil {
+		return nil, authErr
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	limit := int(req.Limit)
+	switch {
+	case limit < 0:
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	case limit == 0:
+		limit = DefaultListLimit
+	case limit > MaxListLimit:
+		limit = MaxListLimit
+	}
+
+	entries, more, listErr := store.List(req.Prefix, req.After, limit)
+	if listErr != nil {
+		return nil, grpcError(listErr)
+	}
+	resp := &rpc.ListResponse{Entries: make([]*rpc.Entry, len(entries))}
+	for i, entry := range entries {
+		resp.Entries[i] = &rpc.Entry{Key: entry.Key, Index: entry.Index, Expires: grpcExpires(entry.Expires)}
+		if req.Values {
+			resp.Entries[i].Value = entry.Value
+		}
+	}
+	if more {
+		resp.Next = entries[len(entries)-1].Key
+	}
+	return resp, nil
+}
+
+// grpcOpTypes maps the op types of the service to those of the db.
+var grpcOpTypes = map[rpc.Op_Type]db.OpType{
+	rpc.Op_GET:    db.OpGet,
+	rpc.Op_INSERT: db.OpInsert,
+	rpc.Op_UPDATE: db.OpUpdate,
+	rpc.Op_DELETE: db.OpDelete,
+	rpc.Op_CHECK:  db.OpCheck,
+}
+
+// Txn runs ops atomically, as the Txn route does. A transaction that cannot
+// be applied is not an error; the response says which op failed and why,
+// and nothing was written.
+func (g *grpcService) Txn(ctx context.Context, req *rpc.TxnRequest) (*rpc.TxnResponse, error) {
+	if len(req.Ops) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no ops")
+	}
+	if len(req.Ops) > MaxTxnOps {
+		return nil, status.Errorf(codes.InvalidArgument, "more than %d ops", MaxTxnOps)
+	}
+
+	ops := make([]db.Op, len(req.Ops))
+	writes := false
+	for i, rpcOp := range req.Ops {
+		opType, ok := grpcOpTypes[rpcOp.Type]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "op %d: unknown type %s", i, rpcOp.Type)
+		}
+		if rpcOp.Key == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "op %d: %s needs a key", i, opType)
+		}
+		ops[i] = db.Op{Type: opType, Key: rpcOp.Key, Index: rpcOp.Index}
+		if opType == db.OpInsert || opType == db.OpUpdate {
+			ttl, ttlErr := grpcTTL(rpcOp.Ttl)
+			if ttlErr != nil {
+				return nil, ttlErr
+			}
+			ops[i].Value = rpcOp.Value
+			ops[i].TTL = ttl
+		}
+		writes = writes || (opType != db.OpGet && opType != db.OpCheck)
+	}
+	for _, op := range ops {
+		authErr := g.s.grpcAuthorize(ctx, req.Namespace, opPermission(op.Type), op.Key)
+		if authErr != nil {
+			return nil, authErr
+		}
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	opResults, txnErr := store.Txn(ops)
+	if txnErr != nil {
+		failed, ok := txnErr.(*db.TxnError)
+		if !ok {
+			return nil, grpcError(txnErr)
+		}
+		return &rpc.TxnResponse{FailedOp: int32(failed.Op), Error: failed.Reason}, nil
+	}
+	if writes {
+		g.s.watch.notify()
+	}
+	resp := &rpc.TxnResponse{Committed: true, Results: make([]*rpc.OpResult, len(opResults))}
+	for i, opResult := range opResults {
+		resp.Results[i] = &rpc.OpResult{Type: req.Ops[i].Type, Key: opResult.Key, Found: opResult.Found,
+			Value: opResult.Value, Index: opResult.Index, Expires: grpcExpires(opResult.Expires)}
+	}
+	return resp, nil
+}
+
+// Watch streams every change to the keys beginning with prefix, as the
+// Watch route does, from after index if set and otherwise from now on,
+// until the client goes away or the server closes.
+func (g *grpcService) Watch(req *rpc.WatchRequest, stream rpc.KV_WatchServer) error {
+	ctx := stream.Context()
+	authErr := g.s.grpcAuthorize(ctx, req.Namespace, db.PermRead, req.Prefix)
+	if authErr != nil {
+		return authErr
+	}
+	store, storeErr := g.s.grpcStore(req.Namespace)
+	if storeErr != nil {
+		return storeErr
+	}
+	var since int64
+	if req.Index != nil {
+		if *req.Index < 0 {
+			return status.Error(codes.InvalidArgument, "index must not be negative")
+		}
+		since = *req.Index
+	} else {
+		var indexErr error
+		since, indexErr = g.s.rscsDB.CurrentIndex()
+		if indexErr != nil {
+			return grpcError(indexErr)
+		}
+	}
+
+	for {
+		notified := g.s.watch.wait()
+		changes, changesErr := store.Changes(req.Prefix, since, watchBatch)
+		if changesErr != nil {
+			return grpcError(changesErr)
+		}
+		for _, rev := range changes {
+			sendErr := stream.Send(&rpc.WatchEvent{Index: rev.Index, Key: rev.Key,
+				Value: rev.Value, Deleted: rev.Deleted})
+			if sendErr != nil {
+				return sendErr
+			}
+			since = rev.Index
+		}
+		if len(changes) == watchBatch {
+			continue
+		}
+		select {
+		case <-notified:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-g.s.watch.closed:
+			return status.Error(codes.Unavailable, "server closing")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+// HistoryResult lists the revisions of a key, oldest first.
+type HistoryResult struct {
+	Revisions []db.Revision
+}
+
+// History lists every recorded revision of the key passed on the URL path.
+func (s *RscsServer) History(w http.ResponseWriter, r *http.Request) {
+	key, keyErr := extractKeyContext(r)
+	if keyErr != nil {
+		writeError(w, keyErr)
+		return
+	}
+
+	revisions, historyErr := s.store(r).History(key)
+	if historyErr != nil {
+		writeError(w, historyErr)
+		return
+	}
+
+	if len(revisions) == 0 {
+		writeKeyNotFound(w, "history", key)
+		return
+	}
+
+	jsonBytes, jsonErr := json.Marshal(HistoryResult{Revisions: revisions})
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// Rollback restores the key passed on the URL path to the value it had at the
+// revision query parameter. The restored value is recorded as a new revision.
+func (s *RscsServer) Rollback(w http.ResponseWriter, r *http.Request) {
+	key, keyErr := extractKeyContext(r)
+	if keyErr != nil {
+		writeError(w, keyErr)
+		return
+	}
+
+	revision, revisionErr := strconv.Atoi(r.URL.Query().Get("revision"))
+	if revisionErr != nil || revision < 1 {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "revision must be a positive integer")
+		return
+	}
+
+	// Revisions never change, so checking first lets us report a deleted
+	// revision as missing rather than as a server error.
+	_, found, getErr := s.store(r).GetRevision(key, revision)
+	if getErr != nil {
+		writeError(w, getErr)
+		return
+	}
+	if !found {
+		writeErrorCode(w, http.StatusNotFound, CodeRevisionNotFound, key, fmt.Sprintf("no value at revision %d of key '%s'", revision, key))
+		return
+	}
+
+	rowCount, rollbackErr := s.store(r).Rollback(key, revision)
+	if rollbackErr != nil {
+		writeError(w, rollbackErr)
+		return
+	}
+
+	if rowCount == 0 {
+		writeErrorCode(w, http.StatusNotFound, CodeRevisionNotFound, key, fmt.Sprintf("no revision %d of key '%s' found", revision, key))
+		return
+	}
+	if rowCount != 1 {
+		writeError(w, errors.New("bad number of rows rolled back"))
+		return
+	}
+
+	s.watch.notify()
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
@@ -2,42 +2,73 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/bradclawsie/rscs/db"
 )
 
-// Insert adds a new key/value pair.
+// Insert adds a new key/value pair, which expires if a TTL is given.
+// If-None-Match is honoured against any existing row for the key.
 func (s *RscsServer) Insert(w http.ResponseWriter, r *http.Request) {
 	key, keyErr := extractKeyContext(r)
 	if keyErr != nil {
-		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+		writeError(w, keyErr)
 		return
 	}
 
 	body, bodyErr := ioutil.ReadAll(r.Body)
 	if bodyErr != nil {
-		http.Error(w, "cannot read body", http.StatusBadRequest)
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "cannot read body")
 		return
 	}
 
 	var v valueVerify
 	umErr := json.Unmarshal(body, &v)
 	if umErr != nil || v.Value == nil {
-		http.Error(w, "Value JSON malformed", http.StatusBadRequest)
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "Value JSON malformed")
+		return
+	}
+	ttl, ttlErr := v.ttl()
+	if ttlErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, key, ttlErr.Error())
 		return
 	}
 
-	rowCount, insertErr := s.rscsDB.Insert(key, *v.Value)
+	var rowCount int
+	var insertErr error
+	if conditional(r) {
+		_, found, ok := s.checkPreconditions(w, r, key)
+		if !ok {
+			return
+		}
+		if found {
+			// An If-Match can only match a key that exists, which POST
+			// cannot create.
+			writeError(w, &db.KeyError{Op: "insert", Key: key, Err: db.ErrExists})
+			return
+		}
+		rowCount, insertErr = s.store(r).CompareAndSwapTTL(key, 0, *v.Value, ttl)
+		if insertErr == nil && rowCount == 0 {
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, "key created concurrently")
+			return
+		}
+	} else {
+		rowCount, insertErr = s.store(r).InsertTTL(key, *v.Value, ttl)
+	}
 	if insertErr != nil {
-		http.Error(w, insertErr.Error(), http.StatusInternalServerError)
+		writeError(w, insertErr)
 		return
 	}
 
 	if rowCount != 1 {
-		http.Error(w, "bad number of rows inserted", http.StatusInternalServerError)
+		writeError(w, errors.New("bad number of rows inserted"))
 		return
 	}
 
+	s.watch.notify()
+
 	w.WriteHeader(http.StatusCreated)
 	return
 }
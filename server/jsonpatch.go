@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON decodes a single JSON document, keeping numbers as written.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	decodeErr := dec.Decode(&doc)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return nil, errors.New("data after JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes doc compactly, without escaping HTML characters.
+func encodeJSON(doc interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	encodeErr := enc.Encode(doc)
+	if encodeErr != nil {
+		return "", encodeErr
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// mergePatch applies an RFC 7386 JSON Merge Patch to target and returns the
+// result. Objects in patch are merged into target, a null member removes
+// the member, and anything else replaces the target outright.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = mergePatch(targetObj[name], value)
+	}
+	return targetObj
+}
+
+// patchOp is one operation of an RFC 6902 JSON Patch. Value is nil, rather
+// than JSON null, when it was not given.
+type patchOp struct {
+	Op    string
+	Path  *string
+	From  *string
+	Value json.RawMessage
+}
+
+// decodeJSONPatch decodes and validates an RFC 6902 JSON Patch.
+func decodeJSONPatch(data []byte) ([]patchOp, error) {
+	var ops []patchOp
+	umErr := json.Unmarshal(data, &ops)
+	if umErr != nil {
+		return nil, errors.New("JSON Patch must be an array of operations")
+	}
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, fmt.Errorf("op %d: no path", i)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("op %d: no value", i)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("op %d: no from", i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("op %d: unknown op '%s'", i, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// jsonPatch applies RFC 6902 JSON Patch ops to doc, in order, and returns
+// the result. If any op fails the error names it, and doc may have been
+// partly changed.
+func jsonPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		var opErr error
+		doc, opErr = applyPatchOp(doc, op)
+		if opErr != nil {
+			return nil, fmt.Errorf("op %d (%s %s): %s", i, op.Op, *op.Path, opErr.Error())
+		}
+	}
+	return doc, nil
+}
+
+// applyPatchOp applies one op to doc.
+func applyPatchOp(doc interface{}, op patchOp) (interface{}, error) {
+	path, pathErr := parsePointer(*op.Path)
+	if pathErr != nil {
+		return nil, pathErr
+	}
+	var value interface{}
+	if op.Value != nil {
+		var valueErr error
+		value, valueErr = decodeJSON(op.Value)
+		if valueErr != nil {
+			return nil, valueErr
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addAt(doc, path, value)
+	case "remove":
+		doc, _, removeErr := removeAt(doc, path)
+		return doc, removeErr
+	case "replace":
+		if _, getErr := getAt(doc, path); getErr != nil {
+			return nil, getErr
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		return walk(doc, path, func(container interface{}, token string) (interface{}, error) {
+			switch c := container.(type) {
+			case map[string]interface{}:
+				c[token] = value
+				return c, nil
+			case []interface{}:
+				i, _ := arrayIndex(token, len(c), false)
+				c[i] = value
+				return c, nil
+			}
+			return nil, errors.New("not a container")
+		})
+	case "move":
+		from, fromErr := parsePointer(*op.From)
+		if fromErr != nil {
+			return nil, fromErr
+		}
+		if len(path) > len(from) && pointerHasPrefix(path, from) {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		doc, moved, removeErr := removeAt(doc, from)
+		if removeErr != nil {
+			return nil, removeErr
+		}
+		return addAt(doc, path, moved)
+	case "copy":
+		from, fromErr := parsePointer(*op.From)
+		if fromErr != nil {
+			return nil, fromErr
+		}
+		copied, getErr := getAt(doc, from)
+		if getErr != nil {
+			return nil, getErr
+		}
+		return addAt(doc, path, deepCopy(copied))
+	case "test":
+		current, getErr := getAt(doc, path)
+		if getErr != nil {
+			return nil, getErr
+		}
+		if !jsonEqual(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op '%s'", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference
+// tokens. The empty pointer, for the whole document, has none.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON Pointer '%s' must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// pointerHasPrefix reports whether path starts with the tokens of prefix.
+func pointerHasPrefix(path, prefix []string) bool {
+	for i, token := range prefix {
+		if path[i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses token as an index into an array of length n. If end is
+// set, "-" and n itself, the position after the last element, are allowed.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.Trim(token, "0123456789") != "" {
+		return 0, fmt.Errorf("'%s' is not an array index", token)
+	}
+	i, atoiErr := strconv.Atoi(token)
+	if atoiErr != nil || i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index %s out of range", token)
+	}
+	return i, nil
+}
+
+// getAt returns the value at path in doc.
+func getAt(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("no member '%s'", token)
+			}
+			doc = value
+		case []interface{}:
+			i, indexErr := arrayIndex(token, len(c), false)
+			if indexErr != nil {
+				return nil, indexErr
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("cannot index a scalar with '%s'", token)
+		}
+	}
+	return doc, nil
+}
+
+// walk calls f with the container holding the last token of path, which
+// must not be empty, and that token. The container f returns replaces the
+// one it was passed, and the resulting doc is returned.
+func walk(doc interface{}, path []string, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("no member '%s'", path[0])
+		}
+		newChild, walkErr := walk(child, path[1:], f)
+		if walkErr != nil {
+			return nil, walkErr
+		}
+		c[path[0]] = newChild
+		return c, nil
+	case []interface{}:
+		i, indexErr := arrayIndex(path[0], len(c), false)
+		if indexErr != nil {
+			return nil, indexErr
+		}
+		newChild, walkErr := walk(c[i], path[1:], f)
+		if walkErr != nil {
+			return nil, walkErr
+		}
+		c[i] = newChild
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot index a scalar with '%s'", path[0])
+}
+
+// addAt adds value at path in doc: it sets an object member, or inserts
+// into an array.
+func addAt(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return walk(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, indexErr := arrayIndex(token, len(c), true)
+			if indexErr != nil {
+				return nil, indexErr
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add '%s' to a scalar", token)
+	})
+}
+
+// removeAt removes the value at path in doc and returns it.
+func removeAt(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	var removed interface{}
+	doc, walkErr := walk(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("no member '%s'", token)
+			}
+			removed = value
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, indexErr := arrayIndex(token, len(c), false)
+			if indexErr != nil {
+				return nil, indexErr
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove '%s' from a scalar", token)
+	})
+	if walkErr != nil {
+		return nil, nil, walkErr
+	}
+	return doc, removed, nil
+}
+
+// deepCopy copies a decoded JSON value, so a copied value is not shared.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for name, member := range v {
+			c[name] = deepCopy(member)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, element := range v {
+			c[i] = deepCopy(element)
+		}
+		return c
+	}
+	return value
+}
+
+// jsonEqual reports whether two decoded JSON values are equal, comparing
+// numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aErr := av.Float64()
+		bf, bErr := bv.Float64()
+		return aErr == nil && bErr == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for name, member := range av {
+			other, ok := bv[name]
+			if !ok || !jsonEqual(member, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
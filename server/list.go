@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// DefaultListLimit is the page size used when List is not passed a limit.
+	DefaultListLimit = 100
+	// MaxListLimit is the largest page size List will return.
+	MaxListLimit = 1000
+)
+
+// ListEntry is a single key in a ListResult. Value is only set when the
+// values were requested, and Expires only for a key that will expire.
+type ListEntry struct {
+	Key     string
+	Value   *string    `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// ListResult is one page of keys. If Next is not empty, pass it back as the
+// after parameter to fetch the following page.
+type ListResult struct {
+	Entries []ListEntry
+	Next    string `json:",omitempty"`
+}
+
+// List returns the keys matching the prefix query parameter in sorted order.
+// The after query parameter is the opaque Next cursor from a previous page,
+// limit sets the page size and values=true includes the values. As with Get,
+// the index and wait query parameters block until a matching key changes.
+func (s *RscsServer) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !s.authorize(w, r, db.PermRead, query.Get("prefix")) {
+		return
+	}
+
+	limit := DefaultListLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var limitErr error
+		limit, limitErr = strconv.Atoi(limitStr)
+		if limitErr != nil || limit < 1 {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "limit must be a positive integer")
+			return
+		}
+		if limit > MaxListLimit {
+			limit = MaxListLimit
+		}
+	}
+
+	var withValues bool
+	if valuesStr := query.Get("values"); valuesStr != "" {
+		var valuesErr error
+		withValues, valuesErr = strconv.ParseBool(valuesStr)
+		if valuesErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "values must be a boolean")
+			return
+		}
+	}
+
+	after, cursorErr := decodeCursor(query.Get("after"))
+	if cursorErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "after cursor malformed")
+		return
+	}
+
+	index, wait, block, waitErr := parseWait(r)
+	if waitErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", waitErr.Error())
+		return
+	}
+	if block {
+		blockErr := s.blockUntil(r, wait, func() (bool, error) {
+			changes, changesErr := s.store(r).Changes(query.Get("prefix"), index, 1)
+			return len(changes) != 0, changesErr
+		})
+		if blockErr != nil {
+			writeError(w, blockErr)
+			return
+		}
+	}
+	indexErr := s.setIndexHeader(w)
+	if indexErr != nil {
+		writeError(w, indexErr)
+		return
+	}
+
+	entries, more, listErr := s.store(r).List(query.Get("prefix"), after, limit)
+	if listErr != nil {
+		writeError(w, listErr)
+		return
+	}
+
+	result := ListResult{Entries: make([]ListEntry, len(entries))}
+	for i := range entries {
+		result.Entries[i].Key = entries[i].Key
+		if withValues {
+			result.Entries[i].Value = &entries[i].Value
+		}
+		if !entries[i].Expires.IsZero() {
+			result.Entries[i].Expires = &entries[i].Expires
+		}
+	}
+	if more {
+		result.Next = encodeCursor(entries[len(entries)-1].Key)
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// encodeCursor turns the last key of a page into an opaque cursor.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor reverses encodeCursor. An empty cursor is the empty key.
+func decodeCursor(cursor string) (string, error) {
+	key, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	if decodeErr != nil {
+		return "", decodeErr
+	}
+	return string(key), nil
+}
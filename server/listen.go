@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// UnixScheme begins a listen address naming a unix domain socket, as in
+	// unix:///run/rscs.sock.
+	UnixScheme = "unix://"
+	// TCPScheme begins a listen address naming a tcp host and port, as in
+	// tcp://localhost:8081.
+	TCPScheme = "tcp://"
+	// peerContextKey references the peerConn of a unix socket connection.
+	peerContextKey ContextKeyType = 3
+)
+
+// peerConn marks a request as made over a unix socket. ok is false if the
+// credentials of the peer could not be read.
+type peerConn struct {
+	cred PeerCred
+	ok   bool
+}
+
+// PeerCred holds the credentials of the process on the other end of a unix
+// socket connection, as reported by the kernel.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// SocketOptions describes the socket file made for a unix listen address.
+// Mode is left to the umask if zero. Owner is user[:group], by name or
+// number, and is left alone if empty.
+type SocketOptions struct {
+	Mode  os.FileMode
+	Owner string
+}
+
+// Listen listens on addr, which begins with UnixScheme or TCPScheme. A unix
+// socket left behind by a previous daemon is replaced, and the new socket
+// file is given the mode and owner in opts.
+func Listen(addr string, opts SocketOptions) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, TCPScheme):
+		return net.Listen("tcp", strings.TrimPrefix(addr, TCPScheme))
+	case strings.HasPrefix(addr, UnixScheme):
+		return listenUnix(strings.TrimPrefix(addr, UnixScheme), opts)
+	default:
+		return nil, fmt.Errorf("listen address '%s' must begin with %s or %s", addr, UnixScheme, TCPScheme)
+	}
+}
+
+// listenUnix listens on the unix socket at path.
+func listenUnix(path string, opts SocketOptions) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+	uid, gid, ownerErr := lookupOwner(opts.Owner)
+	if ownerErr != nil {
+		return nil, ownerErr
+	}
+	staleErr := removeStaleSocket(path)
+	if staleErr != nil {
+		return nil, staleErr
+	}
+	l, listenErr := net.Listen("unix", path)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	if opts.Mode != 0 {
+		chmodErr := os.Chmod(path, opts.Mode)
+		if chmodErr != nil {
+			l.Close()
+			return nil, chmodErr
+		}
+	}
+	if opts.Owner != "" {
+		chownErr := os.Chown(path, uid, gid)
+		if chownErr != nil {
+			l.Close()
+			return nil, chownErr
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing answers on
+// it. It is an error if path is some other kind of file, or is in use.
+func removeStaleSocket(path string) error {
+	info, statErr := os.Lstat(path)
+	if os.IsNotExist(statErr) {
+		return nil
+	}
+	if statErr != nil {
+		return statErr
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' exists and is not a socket", path)
+	}
+	conn, dialErr := net.DialTimeout("unix", path, time.Second)
+	if dialErr == nil {
+		conn.Close()
+		return fmt.Errorf("'%s' is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// lookupOwner resolves an owner written as user[:group] to a uid and gid.
+// The gid is -1, which leaves the group alone, if no group is named.
+func lookupOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+	userName, groupName := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	if userName != "" {
+		id, idErr := LookupUID(userName)
+		if idErr != nil {
+			return 0, 0, idErr
+		}
+		uid = id
+	}
+	if groupName != "" {
+		id, convErr := strconv.Atoi(groupName)
+		if convErr != nil {
+			group, groupErr := user.LookupGroup(groupName)
+			if groupErr != nil {
+				return 0, 0, groupErr
+			}
+			id, convErr = strconv.Atoi(group.Gid)
+			if convErr != nil {
+				return 0, 0, convErr
+			}
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
+
+// LookupUID resolves a user name, or a uid written as a number, to a uid.
+func LookupUID(name string) (int, error) {
+	uid, convErr := strconv.Atoi(name)
+	if convErr == nil {
+		return uid, nil
+	}
+	u, userErr := user.Lookup(name)
+	if userErr != nil {
+		return 0, userErr
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// ConnContext places the PeerCred of a unix socket connection into the
+// Context of every request made on it. Set it as the ConnContext of the
+// http.Server.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, credErr := peerCred(unixConn)
+	if credErr != nil {
+		log.Printf("peer credentials: %s", credErr.Error())
+	}
+	return context.WithValue(ctx, peerContextKey, peerConn{cred: cred, ok: credErr == nil})
+}
+
+// PeerCredentials returns the credentials of the process that made the
+// request over a unix socket. It is false for requests made over tcp.
+func PeerCredentials(r *http.Request) (PeerCred, bool) {
+	peer, _ := r.Context().Value(peerContextKey).(peerConn)
+	return peer.cred, peer.ok
+}
+
+// RestrictPeers answers 403 to requests made over a unix socket by a user
+// whose uid is not in uids. Requests made over tcp are not affected. Call it
+// before the server is started.
+func (s *RscsServer) RestrictPeers(uids []int) {
+	s.peerUIDs = make(map[int]bool)
+	for _, uid := range uids {
+		s.peerUIDs[uid] = true
+	}
+}
+
+// checkPeer applies the restrictions set by RestrictPeers.
+func (s *RscsServer) checkPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, isUnix := r.Context().Value(peerContextKey).(peerConn)
+		if s.peerUIDs == nil || !isUnix {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !peer.ok || !s.peerUIDs[peer.cred.UID] {
+			writeErrorCode(w, http.StatusForbidden, CodeForbidden, "", "user may not connect")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// MetricsRoute is the route for metrics in the Prometheus text format.
+const MetricsRoute = "/metrics"
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations into latencyBuckets.
+type histogram struct {
+	counts []uint64 // counts[i] is of observations <= latencyBuckets[i] only
+	sum    float64
+	count  uint64
+}
+
+// observe adds an observation.
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the histogram as name, with labels, which may be empty.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep,
+			strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// requestLabels identifies the requests a latency histogram is of.
+type requestLabels struct {
+	route  string
+	method string
+}
+
+// countLabels identifies the requests a counter is of.
+type countLabels struct {
+	requestLabels
+	code int
+}
+
+// metrics accumulates what is served at MetricsRoute.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[countLabels]uint64
+	latency  map[requestLabels]*histogram
+	dbOps    map[string]*histogram
+}
+
+// newMetrics initializes a new metrics.
+func newMetrics() *metrics {
+	return &metrics{requests: make(map[countLabels]uint64),
+		latency: make(map[requestLabels]*histogram),
+		dbOps:   make(map[string]*histogram)}
+}
+
+// observeRequest records a request served.
+func (m *metrics) observeRequest(route, method string, code int, d time.Duration) {
+	labels := requestLabels{route: route, method: method}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[countLabels{requestLabels: labels, code: code}]++
+	h, ok := m.latency[labels]
+	if !ok {
+		h = &histogram{}
+		m.latency[labels] = h
+	}
+	h.observe(d)
+}
+
+// observeDB records a db operation. It is the db.OpObserver of the store.
+func (m *metrics) observeDB(op string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.dbOps[op]
+	if !ok {
+		h = &histogram{}
+		m.dbOps[op] = h
+	}
+	h.observe(d)
+}
+
+// labelEscaper escapes a label value for the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label renders name="value".
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// write writes the request and db metrics.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make([]countLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		counts = append(counts, labels)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].requestLabels != counts[j].requestLabels {
+			return lessRequest(counts[i].requestLabels, counts[j].requestLabels)
+		}
+		return counts[i].code < counts[j].code
+	})
+	fmt.Fprintln(w, "# HELP rscs_http_requests_total Requests served, by route, method and status code.")
+	fmt.Fprintln(w, "# TYPE rscs_http_requests_total counter")
+	for _, labels := range counts {
+		fmt.Fprintf(w, "rscs_http_requests_total{%s,%s,%s} %d\n", label("route", labels.route),
+			label("method", labels.method), label("code", strconv.Itoa(labels.code)), m.requests[labels])
+	}
+
+	routes := make([]requestLabels, 0, len(m.latency))
+	for labels := range m.latency {
+		routes = append(routes, labels)
+	}
+	sort.Slice(routes, func(i, j int) bool { return lessRequest(routes[i], routes[j]) })
+	fmt.Fprintln(w, "# HELP rscs_http_request_duration_seconds Time taken to serve requests, by route and method.")
+	fmt.Fprintln(w, "# TYPE rscs_http_request_duration_seconds histogram")
+	for _, labels := range routes {
+		m.latency[labels].write(w, "rscs_http_request_duration_seconds",
+			label("route", labels.route)+","+label("method", labels.method))
+	}
+
+	ops := make([]string, 0, len(m.dbOps))
+	for op := range m.dbOps {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Fprintln(w, "# HELP rscs_db_operation_duration_seconds Time taken by database operations, by operation.")
+	fmt.Fprintln(w, "# TYPE rscs_db_operation_duration_seconds histogram")
+	for _, op := range ops {
+		m.dbOps[op].write(w, "rscs_db_operation_duration_seconds", label("op", op))
+	}
+}
+
+// lessRequest orders requestLabels by route, then method.
+func lessRequest(a, b requestLabels) bool {
+	if a.route != b.route {
+		return a.route < b.route
+	}
+	return a.method < b.method
+}
+
+// instrument records the route, method, status and latency of every
+// request.
+func (s *RscsServer) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+			if len(route) > 1 {
+				route = strings.TrimSuffix(route, "/")
+			}
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.metrics.observeRequest(route, r.Method, status, time.Since(start))
+	})
+}
+
+// Metrics writes the request and db metrics, the number of keys and bytes
+// of values in each namespace and the size of the db file, in the
+// Prometheus text format.
+func (s *RscsServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	names, listErr := db.ListNamespaces(s.rscsDB)
+	if listErr != nil {
+		writeError(w, listErr)
+		return
+	}
+	stats, statsErr := s.namespaceStats(names)
+	if statsErr != nil {
+		writeError(w, statsErr)
+		return
+	}
+
+	var buf bytes.Buffer
+	s.metrics.write(&buf)
+	fmt.Fprintln(&buf, "# HELP rscs_keys Unexpired keys, by namespace.")
+	fmt.Fprintln(&buf, "# TYPE rscs_keys gauge")
+	for i, name := range names {
+		fmt.Fprintf(&buf, "rscs_keys{%s} %d\n", label("namespace", name), stats[i].Keys)
+	}
+	fmt.Fprintln(&buf, "# HELP rscs_value_bytes Bytes of unexpired values, by namespace.")
+	fmt.Fprintln(&buf, "# TYPE rscs_value_bytes gauge")
+	for i, name := range names {
+		fmt.Fprintf(&buf, "rscs_value_bytes{%s} %d\n", label("namespace", name), stats[i].Bytes)
+	}
+	// A memory store, or an in-memory sqlite db, has no file to measure.
+	if info, statErr := os.Stat(s.rscsDB.DBFileName()); statErr == nil {
+		fmt.Fprintln(&buf, "# HELP rscs_db_file_size_bytes Size of the database file.")
+		fmt.Fprintln(&buf, "# TYPE rscs_db_file_size_bytes gauge")
+		fmt.Fprintf(&buf, "rscs_db_file_size_bytes %d\n", info.Size())
+	}
+	fmt.Fprintln(&buf, "# HELP rscs_uptime_seconds Time since the server started.")
+	fmt.Fprintln(&buf, "# TYPE rscs_uptime_seconds gauge")
+	fmt.Fprintf(&buf, "rscs_uptime_seconds %s\n", strconv.FormatFloat(time.Since(s.start).Seconds(), 'f', 3, 64))
+
+	w.Header().Set("Content-type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+	return
+}
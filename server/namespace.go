@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bradclawsie/rscs/db"
+	"github.com/go-chi/chi"
+)
+
+const (
+	// NamespacesRoute is the route for listing namespaces.
+	NamespacesRoute = APIPrefix + "/ns"
+	// NamespaceRoute is the route for creating, inspecting and deleting a
+	// namespace. The key, txn, watch, export and import routes are repeated
+	// below it, e.g. NamespaceRoute + "/kv/{key}".
+	NamespaceRoute = NamespacesRoute + "/{" + namespaceName + "}"
+	// namespaceName is the string for 'namespace'.
+	namespaceName = "namespace"
+)
+
+// NamespacesResult lists every namespace, starting with the default one.
+type NamespacesResult struct {
+	Namespaces []string
+}
+
+// NamespaceResult describes a single namespace.
+type NamespaceResult struct {
+	Namespace string
+	Stats     db.NamespaceStats
+}
+
+// ListNamespaces lists the names of every namespace. With auth required,
+// only the namespaces whose every key the token may read are listed, which
+// is all of them for an admin token.
+func (s *RscsServer) ListNamespaces(w http.ResponseWriter, r *http.Request) {
+	names, listErr := db.ListNamespaces(s.rscsDB)
+	if listErr != nil {
+		writeError(w, listErr)
+		return
+	}
+	names = s.readableNamespaces(r, names)
+
+	jsonBytes, jsonErr := json.Marshal(NamespacesResult{Namespaces: names})
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// readableNamespaces returns the names of the namespaces whose every key
+// the request's token may read, which is all of them without auth.
+func (s *RscsServer) readableNamespaces(r *http.Request, names []string) []string {
+	if s.tokens == nil {
+		return names
+	}
+	readable := []string{}
+	for _, name := range names {
+		if tokenAllows(r.Context(), name, db.PermRead, "") {
+			readable = append(readable, name)
+		}
+	}
+	return readable
+}
+
+// CreateNamespace creates the namespace named on the URL path. It is answered
+// with 409 if the namespace exists.
+func (s *RscsServer) CreateNamespace(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, namespaceName)
+	nameErr := db.CheckNamespace(name)
+	if nameErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidNamespace, "", nameErr.Error())
+		return
+	}
+
+	created, createErr := db.CreateNamespace(s.rscsDB, name)
+	if createErr != nil {
+		writeError(w, createErr)
+		return
+	}
+	if !created {
+		writeErrorCode(w, http.StatusConflict, CodeNamespaceExists, "", fmt.Sprintf("namespace '%s' exists", name))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return
+}
+
+// NamespaceStatus describes the namespace named on the URL path, for a
+// token that may read every key in it.
+func (s *RscsServer) NamespaceStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, db.PermRead, "") {
+		return
+	}
+	stats, statsErr := db.Stats(s.store(r))
+	if statsErr != nil {
+		writeError(w, statsErr)
+		return
+	}
+
+	jsonBytes, jsonErr := json.Marshal(NamespaceResult{
+		Namespace: chi.URLParam(r, namespaceName),
+		Stats:     stats})
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// DeleteNamespace deletes the namespace named on the URL path and every key
+// in it. The default namespace cannot be deleted.
+func (s *RscsServer) DeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, namespaceName)
+	if name == db.DefaultNamespace {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidNamespace, "", "cannot delete the default namespace")
+		return
+	}
+
+	deleted, deleteErr := db.DeleteNamespace(s.rscsDB, name)
+	if deleteErr != nil {
+		writeError(w, deleteErr)
+		return
+	}
+	if !deleted {
+		writeErrorCode(w, http.StatusNotFound, CodeNamespaceNotFound, "", fmt.Sprintf("no namespace '%s' found", name))
+		return
+	}
+
+	s.watch.notify()
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// MergePatchType is the Content-type of an RFC 7386 JSON Merge Patch.
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is the Content-type of an RFC 6902 JSON Patch.
+	JSONPatchType = "application/json-patch+json"
+)
+
+// patchError is why a patch could not be applied to a value.
+type patchError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// errPatchPrecondition aborts a patch of a key written since its
+// preconditions were checked.
+var errPatchPrecondition = errors.New("key modified concurrently")
+
+// Patch applies the posted JSON Merge Patch or JSON Patch, chosen by the
+// Content-type, to the value of an existing key, which must hold a JSON
+// document. The value is read, patched and written in one transaction, and
+// the key keeps its expiry. The patched value is returned with its ETag.
+// If-Match and If-None-Match are honoured against the row's modification
+// index.
+func (s *RscsServer) Patch(w http.ResponseWriter, r *http.Request) {
+	key, keyErr := extractKeyContext(r)
+	if keyErr != nil {
+		writeError(w, keyErr)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-type"))
+	if mediaType != MergePatchType && mediaType != JSONPatchType {
+		w.Header().Set("Accept-Patch", MergePatchType+", "+JSONPatchType)
+		writeErrorCode(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "",
+			"Content-type must be "+MergePatchType+" or "+JSONPatchType)
+		return
+	}
+
+	body, bodyErr := ioutil.ReadAll(r.Body)
+	if bodyErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "cannot read body")
+		return
+	}
+	var patch func(doc interface{}) (interface{}, error)
+	if mediaType == MergePatchType {
+		mergeDoc, decodeErr := decodeJSON(body)
+		if decodeErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "merge patch JSON malformed")
+			return
+		}
+		patch = func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, mergeDoc), nil
+		}
+	} else {
+		ops, decodeErr := decodeJSONPatch(body)
+		if decodeErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", decodeErr.Error())
+			return
+		}
+		patch = func(doc interface{}) (interface{}, error) {
+			return jsonPatch(doc, ops)
+		}
+	}
+
+	var checkedIndex int64
+	if conditional(r) {
+		entry, found, ok := s.checkPreconditions(w, r, key)
+		if !ok {
+			return
+		}
+		if !found {
+			writeKeyNotFound(w, "patch", key)
+			return
+		}
+		checkedIndex = entry.Index
+	}
+
+	entry, modifyErr := s.store(r).Modify(key, func(entry db.Entry) (string, error) {
+		if checkedIndex != 0 && entry.Index != checkedIndex {
+			return "", errPatchPrecondition
+		}
+		doc, decodeErr := decodeJSON([]byte(entry.Value))
+		if decodeErr != nil {
+			return "", &patchError{status: http.StatusConflict, code: CodeValueNotJSON,
+				message: "value is not a JSON document"}
+		}
+		patched, patchErr := patch(doc)
+		if patchErr != nil {
+			return "", &patchError{status: http.StatusUnprocessableEntity, code: CodePatchFailed,
+				message: patchErr.Error()}
+		}
+		return encodeJSON(patched)
+	})
+	if modifyErr != nil {
+		var pe *patchError
+		switch {
+		case modifyErr == errPatchPrecondition:
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, modifyErr.Error())
+		case errors.As(modifyErr, &pe):
+			writeErrorCode(w, pe.status, pe.code, key, pe.message)
+		default:
+			writeError(w, modifyErr)
+		}
+		return
+	}
+
+	s.watch.notify()
+
+	result := Value{Value: entry.Value}
+	if !entry.Expires.IsZero() {
+		result.Expires = &entry.Expires
+	}
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(entry.Index))
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the credentials of the peer of c with SO_PEERCRED.
+func peerCred(c *net.UnixConn) (PeerCred, error) {
+	raw, rawErr := c.SyscallConn()
+	if rawErr != nil {
+		return PeerCred{}, rawErr
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	controlErr := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if controlErr != nil {
+		return PeerCred{}, controlErr
+	}
+	if credErr != nil {
+		return PeerCred{}, credErr
+	}
+	return PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred needs SO_PEERCRED, which only linux has.
+func peerCred(c *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, errors.New("peer credentials need linux")
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// ReplicationSnapshotRoute is the route a replica bootstraps from.
+	ReplicationSnapshotRoute = "/v1/admin/replication/snapshot"
+	// ReplicationChangesRoute is the route of the change feed a replica
+	// tails.
+	ReplicationChangesRoute = "/v1/admin/replication/changes"
+	// replicationBatch is the most changes ReplicationChanges returns at once.
+	replicationBatch = 1000
+)
+
+var (
+	// replicationWait is how long a replica long-polls the primary for
+	// changes.
+	replicationWait = 30 * time.Second
+	// replicationRetry is how long a replica waits after a failed request to
+	// the primary.
+	replicationRetry = time.Second
+)
+
+// ReplicaEntry is one key of a SnapshotResult.
+type ReplicaEntry struct {
+	Key     string
+	Value   string
+	Expires *time.Time `json:",omitempty"`
+}
+
+// SnapshotResult is every unexpired key of the primary, across all
+// namespaces, as of its modification index Index.
+type SnapshotResult struct {
+	Index   int64
+	Entries []ReplicaEntry
+}
+
+// ReplicaChange is one write in a ChangesResult. Expires is set for a
+// write that is still the key's current value and will expire.
+type ReplicaChange struct {
+	Index   int64
+	Key     string
+	Value   string     `json:",omitempty"`
+	Deleted bool       `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// ChangesResult lists writes to the primary in index order. Index is the
+// primary's current modification index, so a replica can tell how far
+// behind it is.
+type ChangesResult struct {
+	Index   int64
+	Changes []ReplicaChange
+}
+
+// ReplicationStatus is reported in the StatusResult of a replica. Applied is
+// the primary's modification index the replica has caught up to, and Lag how
+// many indexes it is behind the primary as of LastContact.
+type ReplicationStatus struct {
+	Primary      string
+	Bootstrapped bool
+	Applied      int64
+	PrimaryIndex int64
+	Lag          int64
+	LastContact  *time.Time `json:",omitempty"`
+	Error        string     `json:",omitempty"`
+}
+
+// ReplicationSnapshot returns every unexpired key in the store, across all
+// namespaces, for a replica to bootstrap from.
+func (s *RscsServer) ReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	index, entries, snapshotErr := db.Snapshot(s.rscsDB)
+	if snapshotErr != nil {
+		writeError(w, snapshotErr)
+		return
+	}
+	result := SnapshotResult{Index: index, Entries: make([]ReplicaEntry, len(entries))}
+	for i, entry := range entries {
+		result.Entries[i] = ReplicaEntry{Key: entry.Key, Value: entry.Value}
+		if !entry.Expires.IsZero() {
+			expires := entry.Expires
+			result.Entries[i].Expires = &expires
+		}
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// ReplicationChanges returns the writes to the store after the index query
+// parameter, across all namespaces. As with Get, if there are none yet the
+// request blocks for up to the wait query parameter. An index after the
+// store's own, as a replica of a restored primary asks for, returns at once.
+func (s *RscsServer) ReplicationChanges(w http.ResponseWriter, r *http.Request) {
+	since, wait, block, waitErr := parseWait(r)
+	if waitErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", waitErr.Error())
+		return
+	}
+	if block {
+		blockErr := s.blockUntil(r, wait, func() (bool, error) {
+			index, indexErr := s.rscsDB.CurrentIndex()
+			return index != since, indexErr
+		})
+		if blockErr != nil {
+			writeError(w, blockErr)
+			return
+		}
+	}
+
+	index, indexErr := s.rscsDB.CurrentIndex()
+	if indexErr != nil {
+		writeError(w, indexErr)
+		return
+	}
+	revisions, changesErr := s.rscsDB.Changes("", since, replicationBatch)
+	if changesErr != nil {
+		writeError(w, changesErr)
+		return
+	}
+	result := ChangesResult{Index: index, Changes: make([]ReplicaChange, len(revisions))}
+	for i, rev := range revisions {
+		result.Changes[i] = ReplicaChange{Index: rev.Index, Key: rev.Key, Value: rev.Value, Deleted: rev.Deleted}
+		if rev.Deleted {
+			continue
+		}
+		// Revisions do not record expiries, but the row does while this
+		// revision is still its value.
+		entry, found, getErr := s.rscsDB.GetEntry(rev.Key)
+		if getErr != nil {
+			writeError(w, getErr)
+			return
+		}
+		if found && entry.Index == rev.Index && !entry.Expires.IsZero() {
+			expires := entry.Expires
+			result.Changes[i].Expires = &expires
+		}
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(jsonBytes)
+	return
+}
+
+// replica is the state of a server that follows a primary.
+type replica struct {
+	primary *url.URL
+	token   string
+	client  *http.Client
+	proxy   *httputil.ReverseProxy // nil if writes are rejected
+
+	mu           sync.Mutex
+	bootstrapped bool
+	applied      int64
+	primaryIndex int64
+	lastContact  time.Time
+	lastErr      error
+}
+
+// ReplicateFrom makes the server a replica of the rscs daemon at primary,
+// such as "http://primary:8081". Token, if set, must be an admin token of
+// the primary. Writes to the replica are forwarded to the primary if
+// forward is set, and otherwise answered with 403. Reads are served from
+// the local store, which Follow keeps up to date. Indexes and ETags are the
+// replica's own, and tokens are not replicated, so a replica run with auth
+// needs tokens of its own. Call it before the server is started.
+func (s *RscsServer) ReplicateFrom(primary, token string, forward bool) error {
+	primaryURL, parseErr := url.Parse(primary)
+	if parseErr != nil {
+		return parseErr
+	}
+	if (primaryURL.Scheme != "http" && primaryURL.Scheme != "https") || primaryURL.Host == "" {
+		return fmt.Errorf("primary '%s' must be an http or https URL", primary)
+	}
+	s.replica = &replica{primary: primaryURL, token: token,
+		client: &http.Client{Timeout: replicationWait + 10*time.Second}}
+	if forward {
+		s.replica.proxy = httputil.NewSingleHostReverseProxy(primaryURL)
+	}
+	return nil
+}
+
+// replicaWrites forwards or rejects requests that may write to a replica.
+func (s *RscsServer) replicaWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.replica == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.replica.proxy != nil {
+			s.replica.proxy.ServeHTTP(w, r)
+			return
+		}
+		writeErrorCode(w, http.StatusForbidden, CodeReadOnlyReplica, "",
+			"this is a read-only replica of "+s.replica.primary.String())
+	})
+}
+
+// Follow bootstraps the store from a snapshot of the primary and then tails
+// its change feed until Close is called, retrying after any failure. The
+// daemon runs it in its own goroutine when ReplicateFrom was called.
+func (s *RscsServer) Follow() {
+	for {
+		var followErr error
+		if !s.replica.isBootstrapped() {
+			followErr = s.bootstrap()
+		} else {
+			followErr = s.pullChanges()
+		}
+		s.replica.setErr(followErr)
+		if followErr != nil {
+			log.Printf("replication: %s", followErr.Error())
+			select {
+			case <-time.After(replicationRetry):
+			case <-s.watch.closed:
+				return
+			}
+		}
+		select {
+		case <-s.watch.closed:
+			return
+		default:
+		}
+	}
+}
+
+// fetch gets route from the primary and decodes the JSON response into v.
+func (rep *replica) fetch(route string, query url.Values, v interface{}) error {
+	u := *rep.primary
+	u.Path = route
+	u.RawQuery = query.Encode()
+	req, reqErr := http.NewRequest(http.MethodGet, u.String(), nil)
+	if reqErr != nil {
+		return reqErr
+	}
+	if rep.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rep.token)
+	}
+	resp, getErr := rep.client.Do(req)
+	if getErr != nil {
+		return getErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var result ErrorResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("%s: %s %s", route, resp.Status, result.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// bootstrap makes the store match a snapshot of the primary, writing only
+// the keys that differ.
+func (s *RscsServer) bootstrap() error {
+	var snapshot SnapshotResult
+	fetchErr := s.replica.fetch(ReplicationSnapshotRoute, url.Values{}, &snapshot)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	local, exportErr := db.Export(s.rscsDB)
+	if exportErr != nil {
+		return exportErr
+	}
+	for _, entry := range snapshot.Entries {
+		value, found := local[entry.Key]
+		delete(local, entry.Key)
+		if found && value == entry.Value && entry.Expires == nil {
+			continue
+		}
+		applyErr := s.applyChange(ReplicaChange{Key: entry.Key, Value: entry.Value, Expires: entry.Expires})
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+	for key := range local {
+		applyErr := s.applyChange(ReplicaChange{Key: key, Deleted: true})
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+	s.watch.notify()
+	s.replica.advance(snapshot.Index, snapshot.Index, true)
+	return nil
+}
+
+// pullChanges waits for writes to the primary after those applied and
+// applies them.
+func (s *RscsServer) pullChanges() error {
+	applied := s.replica.appliedIndex()
+	query := url.Values{"index": {strconv.FormatInt(applied, 10)}, "wait": {replicationWait.String()}}
+	var changes ChangesResult
+	fetchErr := s.replica.fetch(ReplicationChangesRoute, query, &changes)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if changes.Index < applied {
+		// The primary went back, as after a restore, so its feed no longer
+		// follows on from what was applied.
+		s.replica.advance(0, changes.Index, false)
+		return fmt.Errorf("primary index %d is behind the applied %d, bootstrapping again", changes.Index, applied)
+	}
+	for _, change := range changes.Changes {
+		applyErr := s.applyChange(change)
+		if applyErr != nil {
+			return applyErr
+		}
+		applied = change.Index
+		s.replica.advance(applied, changes.Index, true)
+	}
+	if len(changes.Changes) != 0 {
+		s.watch.notify()
+	}
+	s.replica.advance(applied, changes.Index, true)
+	return nil
+}
+
+// applyChange writes one change from the primary to the store. A value that
+// has already expired is deleted.
+func (s *RscsServer) applyChange(change ReplicaChange) error {
+	var ttl time.Duration
+	if change.Expires != nil {
+		ttl = time.Until(*change.Expires)
+	}
+	if change.Deleted || (change.Expires != nil && ttl <= 0) {
+		_, deleteErr := s.rscsDB.Delete(change.Key)
+		return deleteErr
+	}
+	_, upsertErr := s.rscsDB.UpsertTTL(change.Key, change.Value, ttl)
+	return upsertErr
+}
+
+func (rep *replica) isBootstrapped() bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.bootstrapped
+}
+
+func (rep *replica) appliedIndex() int64 {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.applied
+}
+
+// advance records that the store has caught up to applied, of primaryIndex.
+func (rep *replica) advance(applied, primaryIndex int64, bootstrapped bool) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.applied, rep.primaryIndex, rep.bootstrapped = applied, primaryIndex, bootstrapped
+	rep.lastContact = time.Now().UTC()
+}
+
+func (rep *replica) setErr(err error) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.lastErr = err
+}
+
+// status reports the progress of the replica.
+func (rep *replica) status() *ReplicationStatus {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	status := &ReplicationStatus{Primary: rep.primary.String(), Bootstrapped: rep.bootstrapped,
+		Applied: rep.applied, PrimaryIndex: rep.primaryIndex, Lag: rep.primaryIndex - rep.applied}
+	if !rep.lastContact.IsZero() {
+		lastContact := rep.lastContact
+		status.LastContact = &lastContact
+	}
+	if rep.lastErr != nil {
+		status.Error = rep.lastErr.Error()
+	}
+	return status
+}
@@ -0,0 +1,833 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// RESPAuditPath is the Path of audit records of writes made over RESP.
+	RESPAuditPath = "resp"
+	// respMaxArgs is the most arguments a RESP command may have.
+	respMaxArgs = 4096
+	// respMaxBulk is the largest argument a RESP command may have, in bytes.
+	respMaxBulk = 1024 * 1024
+	// respMaxLine is the longest line a client may send, in bytes.
+	respMaxLine = 64 * 1024
+	// respAnonArgs and respAnonBulk limit commands sent before AUTH, which
+	// need only hold a token.
+	respAnonArgs = 3
+	respAnonBulk = 1024
+	// respScanCount is how many keys SCAN looks at when not passed a COUNT.
+	respScanCount = 10
+	// respTxnAttempts is how many times MSET and DEL retry when keys they
+	// write are changed by others while they run.
+	respTxnAttempts = 10
+)
+
+// respError is an error reply to a RESP client, beginning with its Redis
+// error code, and the HTTP status audit records give it.
+type respError struct {
+	status int
+	reply  string
+}
+
+func (e *respError) Error() string {
+	return e.reply
+}
+
+var (
+	errRESPProtocol   = &respError{status: http.StatusBadRequest, reply: "ERR Protocol error"}
+	errRESPSyntax     = &respError{status: http.StatusBadRequest, reply: "ERR syntax error"}
+	errRESPNotInteger = &respError{status: http.StatusBadRequest, reply: "ERR value is not an integer or out of range"}
+)
+
+// respCommand is one Redis command ServeRESP understands. Arity counts the
+// command name, as Redis does, and a negative arity is a minimum. For a
+// command that writes, keys picks the keys it writes out of its arguments,
+// for the audit log.
+type respCommand struct {
+	arity int
+	write bool
+	keys  func(args []string) []string
+	run   func(s *RscsServer, c *respConn, args []string) error
+}
+
+// respCommands are the commands ServeRESP understands, by upper case name.
+var respCommands = map[string]respCommand{
+	"PING":   {arity: -1, run: (*RscsServer).respPing},
+	"ECHO":   {arity: 2, run: (*RscsServer).respEcho},
+	"QUIT":   {arity: 1, run: (*RscsServer).respQuit},
+	"AUTH":   {arity: -2, run: (*RscsServer).respAuth},
+	"SELECT": {arity: 2, run: (*RscsServer).respSelect},
+	"GET":    {arity: 2, run: (*RscsServer).respGet},
+	"MGET":   {arity: -2, run: (*RscsServer).respMGet},
+	"EXISTS": {arity: -2, run: (*RscsServer).respExists},
+	"KEYS":   {arity: 2, run: (*RscsServer).respKeys},
+	"SCAN":   {arity: -2, run: (*RscsServer).respScan},
+	"SET":    {arity: -3, write: true, keys: respFirstKey, run: (*RscsServer).respSet},
+	"MSET":   {arity: -3, write: true, keys: respPairKeys, run: (*RscsServer).respMSet},
+	"DEL":    {arity: -2, write: true, keys: respAllKeys, run: (*RscsServer).respDel},
+	"INCR":   {arity: 2, write: true, keys: respFirstKey, run: (*RscsServer).respIncr},
+}
+
+func respFirstKey(args []string) []string {
+	return args[1:2]
+}
+
+func respAllKeys(args []string) []string {
+	return args[1:]
+}
+
+func respPairKeys(args []string) []string {
+	var keys []string
+	for i := 1; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// respConn is a client connection to ServeRESP.
+type respConn struct {
+	r      *bufio.Reader
+	w      *bufio.Writer
+	caller string    // as in audit records, until AUTH succeeds
+	token  *db.Token // nil until AUTH succeeds
+	quit   bool      // set by QUIT
+}
+
+// ServeRESP serves the Redis protocol, RESP2, on l until l is closed. It
+// understands GET, SET (with NX, XX, EX and PX), DEL, EXISTS, KEYS, SCAN
+// (with MATCH and COUNT), MGET, MSET and INCR, plus PING, ECHO, AUTH, SELECT
+// 0 and QUIT, and acts on the default namespace of the store the HTTP routes
+// use. If RequireAuth was called clients must first send AUTH with a bearer
+// token. Writes are audited, wake blocked HTTP requests and are refused by
+// a replica. The daemon runs it in its own goroutine.
+func (s *RscsServer) ServeRESP(l net.Listener) error {
+	for {
+		conn, acceptErr := l.Accept()
+		if errors.Is(acceptErr, net.ErrClosed) {
+			return nil
+		}
+		if acceptErr != nil {
+			return acceptErr
+		}
+		go s.serveRESPConn(conn)
+	}
+}
+
+// serveRESPConn answers the commands sent over conn until it is closed or
+// the client sends QUIT or breaks the protocol. Replies to pipelined
+// commands are flushed together.
+func (s *RscsServer) serveRESPConn(conn net.Conn) {
+	defer conn.Close()
+	c := &respConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), caller: "addr:" + conn.RemoteAddr().String()}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		cred, credErr := peerCred(unixConn)
+		if credErr == nil {
+			c.caller = fmt.Sprintf("uid:%d", cred.UID)
+		}
+		if s.peerUIDs != nil && (credErr != nil || !s.peerUIDs[cred.UID]) {
+			c.errorReply("NOPERM user may not connect")
+			c.w.Flush()
+			return
+		}
+	}
+
+	for !c.quit {
+		maxArgs, maxBulk := respMaxArgs, respMaxBulk
+		if s.tokens != nil && c.token == nil {
+			maxArgs, maxBulk = respAnonArgs, respAnonBulk
+		}
+		args, readErr := c.readCommand(maxArgs, maxBulk)
+		if readErr == errRESPProtocol {
+			c.errorReply(readErr.Error())
+			c.w.Flush()
+			return
+		}
+		if readErr != nil {
+			return
+		}
+		if len(args) != 0 {
+			s.dispatchRESP(c, args)
+		}
+		if c.r.Buffered() == 0 || c.quit {
+			if c.w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads one line, without its CRLF. A line longer than
+// respMaxLine is a protocol error.
+func (c *respConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, readErr := c.r.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxLine {
+			return "", errRESPProtocol
+		}
+		line = append(line, chunk...)
+		if readErr == bufio.ErrBufferFull {
+			if len(line) >= respMaxLine {
+				// The rest of the line, at least its newline, is too much.
+				return "", errRESPProtocol
+			}
+			continue
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// readCommand reads one command, as an array of bulk strings, or as an
+// inline command typed into telnet. A command with more than maxArgs
+// arguments, or an argument longer than maxBulk, is a protocol error.
+// Arguments are buffered as their bytes arrive, not as their declared
+// length, so a client cannot make the server allocate memory it does not
+// send.
+func (c *respConn) readCommand(maxArgs, maxBulk int) ([]string, error) {
+	line, readErr := c.readLine()
+	if readErr != nil {
+		return nil, readErr
+	}
+	if !strings.HasPrefix(line, "*") {
+		args := strings.Fields(line)
+		if len(args) > maxArgs {
+			return nil, errRESPProtocol
+		}
+		return args, nil
+	}
+	count, countErr := strconv.Atoi(line[1:])
+	if countErr != nil || count > maxArgs {
+		return nil, errRESPProtocol
+	}
+	var args []string
+	for i := 0; i < count; i++ {
+		line, readErr = c.readLine()
+		if readErr != nil {
+			return nil, readErr
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errRESPProtocol
+		}
+		size, sizeErr := strconv.Atoi(line[1:])
+		if sizeErr != nil || size < 0 || size > maxBulk {
+			return nil, errRESPProtocol
+		}
+		var buf bytes.Buffer
+		_, readErr = io.CopyN(&buf, c.r, int64(size+2))
+		if readErr != nil {
+			return nil, readErr
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errRESPProtocol
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func (c *respConn) simpleReply(str string) {
+	c.w.WriteString("+" + str + "\r\n")
+}
+
+func (c *respConn) errorReply(str string) {
+	c.w.WriteString("-" + str + "\r\n")
+}
+
+func (c *respConn) integerReply(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) bulkReply(str string) {
+	c.w.WriteString("$" + strconv.Itoa(len(str)) + "\r\n" + str + "\r\n")
+}
+
+func (c *respConn) nullReply() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) arrayReply(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// dispatchRESP checks a command against its arity, authentication and
+// replication, then runs it. Writes are audited as they would be over HTTP.
+func (s *RscsServer) dispatchRESP(c *respConn, args []string) {
+	name := strings.ToUpper(args[0])
+	command, ok := respCommands[name]
+	switch {
+	case !ok:
+		c.errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	case (command.arity > 0 && len(args) != command.arity) || len(args) < -command.arity:
+		c.errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	case s.tokens != nil && c.token == nil && name != "AUTH" && name != "QUIT":
+		c.errorReply("NOAUTH Authentication required.")
+		return
+	case command.write && s.replica != nil:
+		c.errorReply("READONLY You can't write against a read only replica.")
+		return
+	}
+
+	var keys, oldHashes []string
+	if command.write && s.auditLog != nil {
+		keys = command.keys(args)
+		for _, key := range keys {
+			oldHashes = append(oldHashes, valueHash(s.defaultStore, key))
+		}
+	}
+
+	status := http.StatusOK
+	runErr := command.run(s, c, args)
+	if runErr != nil {
+		status = c.writeErr(runErr)
+	} else if command.write {
+		s.watch.notify()
+	}
+
+	caller := c.caller
+	if c.token != nil {
+		caller = "token:" + c.token.ID
+	}
+	for i, key := range keys {
+		record := db.AuditRecord{Time: time.Now().UTC().Round(0), Caller: caller, Method: name,
+			Path: RESPAuditPath, Key: key, OldHash: oldHashes[i],
+			NewHash: valueHash(s.defaultStore, key), Status: status}
+		appendErr := s.auditLog.AppendAudit(record)
+		if appendErr != nil {
+			log.Printf("audit record of %s %s by %s not written: %s",
+				record.Method, record.Key, record.Caller, appendErr.Error())
+		}
+	}
+}
+
+// writeErr writes err as an error reply and returns the HTTP status an
+// audit record gives it, as writeError would answer over HTTP.
+func (c *respConn) writeErr(err error) int {
+	var replyErr *respError
+	var keyErr *db.KeyError
+	switch {
+	case errors.As(err, &replyErr):
+		c.errorReply(replyErr.reply)
+		return replyErr.status
+	case errors.As(err, &keyErr) && keyErr.Err == db.ErrNotFound:
+		c.errorReply("ERR " + err.Error())
+		return http.StatusNotFound
+	case errors.As(err, &keyErr):
+		c.errorReply("ERR " + err.Error())
+		return http.StatusBadRequest
+	}
+	log.Printf("internal error: %s", err.Error())
+	c.errorReply("ERR internal error")
+	return http.StatusInternalServerError
+}
+
+// respAllowed reports whether the connection's token grants perm on key in
+// the default namespace.
+func (s *RscsServer) respAllowed(c *respConn, perm db.Permission, key string) bool {
+	return s.tokens == nil || c.token.Allows(db.DefaultNamespace, key, perm)
+}
+
+// respAuthorize fails unless the connection's token grants perm on every key.
+func (s *RscsServer) respAuthorize(c *respConn, perm db.Permission, keys ...string) error {
+	for _, key := range keys {
+		if !s.respAllowed(c, perm, key) {
+			return &respError{status: http.StatusForbidden,
+				reply: fmt.Sprintf("NOPERM token may not %s '%s' in namespace '%s'", perm, key, db.DefaultNamespace)}
+		}
+	}
+	return nil
+}
+
+func (s *RscsServer) respPing(c *respConn, args []string) error {
+	switch len(args) {
+	case 1:
+		c.simpleReply("PONG")
+	case 2:
+		c.bulkReply(args[1])
+	default:
+		return errRESPSyntax
+	}
+	return nil
+}
+
+func (s *RscsServer) respEcho(c *respConn, args []string) error {
+	c.bulkReply(args[1])
+	return nil
+}
+
+func (s *RscsServer) respQuit(c *respConn, args []string) error {
+	c.quit = true
+	c.simpleReply("OK")
+	return nil
+}
+
+// respAuth takes a bearer token, as "AUTH token" or "AUTH username token";
+// the username is ignored.
+func (s *RscsServer) respAuth(c *respConn, args []string) error {
+	if len(args) > 3 {
+		return errRESPSyntax
+	}
+	if s.tokens == nil {
+		return &respError{status: http.StatusBadRequest, reply: "ERR AUTH called without any tokens configured"}
+	}
+	token, found, authErr := db.Authenticate(s.tokens, args[len(args)-1])
+	if authErr != nil {
+		return authErr
+	}
+	if !found {
+		return &respError{status: http.StatusUnauthorized, reply: "WRONGPASS invalid bearer token"}
+	}
+	c.token = &token
+	c.simpleReply("OK")
+	return nil
+}
+
+// respSelect only accepts database 0, the default namespace.
+func (s *RscsServer) respSelect(c *respConn, args []string) error {
+	if args[1] != "0" {
+		return &respError{status: http.StatusBadRequest, reply: "ERR DB index is out of range"}
+	}
+	c.simpleReply("OK")
+	return nil
+}
+
+func (s *RscsServer) respGet(c *respConn, args []string) error {
+	authErr := s.respAuthorize(c, db.PermRead, args[1])
+	if authErr != nil {
+		return authErr
+	}
+	value, found, getErr := s.defaultStore.Get(args[1])
+	if getErr != nil {
+		return getErr
+	}
+	if !found {
+		c.nullReply()
+		return nil
+	}
+	c.bulkReply(value)
+	return nil
+}
+
+func (s *RscsServer) respMGet(c *respConn, args []string) error {
+	authErr := s.respAuthorize(c, db.PermRead, args[1:]...)
+	if authErr != nil {
+		return authErr
+	}
+	values := make([]*string, len(args)-1)
+	for i, key := range args[1:] {
+		value, found, getErr := s.defaultStore.Get(key)
+		if getErr != nil {
+			return getErr
+		}
+		if found {
+			values[i] = &value
+		}
+	}
+	c.arrayReply(len(values))
+	for _, value := range values {
+		if value == nil {
+			c.nullReply()
+			continue
+		}
+		c.bulkReply(*value)
+	}
+	return nil
+}
+
+func (s *RscsServer) respExists(c *respConn, args []string) error {
+	authErr := s.respAuthorize(c, db.PermRead, args[1:]...)
+	if authErr != nil {
+		return authErr
+	}
+	var count int64
+	for _, key := range args[1:] {
+		_, found, getErr := s.defaultStore.Get(key)
+		if getErr != nil {
+			return getErr
+		}
+		if found {
+			count++
+		}
+	}
+	c.integerReply(count)
+	return nil
+}
+
+// respKeys lists every key matching a glob pattern that the token may read.
+func (s *RscsServer) respKeys(c *respConn, args []string) error {
+	pattern := args[1]
+	entries, listErr := listPrefix(s.defaultStore, respGlobPrefix(pattern))
+	if listErr != nil {
+		return listErr
+	}
+	var keys []string
+	for _, entry := range entries {
+		if respGlob(pattern, entry.Key) && s.respAllowed(c, db.PermRead, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	c.arrayReply(len(keys))
+	for _, key := range keys {
+		c.bulkReply(key)
+	}
+	return nil
+}
+
+// respScan pages through the keys as SCAN cursor [MATCH pattern] [COUNT
+// count]. The cursor is the opaque cursor List pages with, or 0 to start
+// and when done. As in Redis, a page may hold fewer than COUNT keys, or none.
+func (s *RscsServer) respScan(c *respConn, args []string) error {
+	var after string
+	if args[1] != "0" {
+		var cursorErr error
+		after, cursorErr = decodeCursor(args[1])
+		if cursorErr != nil || after == "" {
+			return &respError{status: http.StatusBadRequest, reply: "ERR invalid cursor"}
+		}
+	}
+	pattern, count := "*", respScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRESPSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			var countErr error
+			count, countErr = strconv.Atoi(args[i+1])
+			if countErr != nil || count < 1 {
+				return errRESPSyntax
+			}
+			if count > MaxListLimit {
+				count = MaxListLimit
+			}
+		default:
+			return errRESPSyntax
+		}
+	}
+
+	entries, more, listErr := s.defaultStore.List(respGlobPrefix(pattern), after, count)
+	if listErr != nil {
+		return listErr
+	}
+	next := "0"
+	if more {
+		next = encodeCursor(entries[len(entries)-1].Key)
+	}
+	var keys []string
+	for _, entry := range entries {
+		if respGlob(pattern, entry.Key) && s.respAllowed(c, db.PermRead, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	c.arrayReply(2)
+	c.bulkReply(next)
+	c.arrayReply(len(keys))
+	for _, key := range keys {
+		c.bulkReply(key)
+	}
+	return nil
+}
+
+// respSet writes a key as SET key value [NX|XX] [EX seconds|PX
+// milliseconds]. Without EX or PX any expiry is cleared. If NX or XX
+// prevent the write the reply is null.
+func (s *RscsServer) respSet(c *respConn, args []string) error {
+	key, value := args[1], args[2]
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if ttl != 0 || i+1 == len(args) {
+				return errRESPSyntax
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			n, parseErr := strconv.ParseInt(args[i+1], 10, 64)
+			if parseErr != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+				return &respError{status: http.StatusBadRequest, reply: "ERR invalid expire time in 'set' command"}
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return errRESPSyntax
+		}
+	}
+	if nx && xx {
+		return errRESPSyntax
+	}
+	authErr := s.respAuthorize(c, db.PermWrite, key)
+	if authErr != nil {
+		return authErr
+	}
+
+	var rowCount int
+	var setErr error
+	switch {
+	case nx:
+		rowCount, setErr = s.defaultStore.CompareAndSwapTTL(key, 0, value, ttl)
+	case xx:
+		rowCount, setErr = s.defaultStore.UpdateTTL(key, value, ttl)
+	default:
+		_, setErr = s.defaultStore.UpsertTTL(key, value, ttl)
+		rowCount = 1
+	}
+	if setErr != nil {
+		return setErr
+	}
+	if rowCount == 0 {
+		c.nullReply()
+		return nil
+	}
+	c.simpleReply("OK")
+	return nil
+}
+
+// respMSet writes every key, clearing their expiries, in one transaction.
+// A later value for a key given twice wins.
+func (s *RscsServer) respMSet(c *respConn, args []string) error {
+	if len(args)%2 != 1 {
+		return &respError{status: http.StatusBadRequest, reply: "ERR wrong number of arguments for 'mset' command"}
+	}
+	values := make(map[string]string)
+	var keys []string
+	for i := 1; i < len(args); i += 2 {
+		if _, seen := values[args[i]]; !seen {
+			keys = append(keys, args[i])
+		}
+		values[args[i]] = args[i+1]
+	}
+	authErr := s.respAuthorize(c, db.PermWrite, keys...)
+	if authErr != nil {
+		return authErr
+	}
+
+	for attempt := 0; attempt < respTxnAttempts; attempt++ {
+		ops := make([]db.Op, len(keys))
+		for i, key := range keys {
+			_, found, getErr := s.defaultStore.Get(key)
+			if getErr != nil {
+				return getErr
+			}
+			ops[i] = db.Op{Type: db.OpInsert, Key: key, Value: values[key]}
+			if found {
+				ops[i].Type = db.OpUpdate
+			}
+		}
+		_, txnErr := s.defaultStore.Txn(ops)
+		var failed *db.TxnError
+		if errors.As(txnErr, &failed) {
+			// A key was created or deleted since it was read.
+			continue
+		}
+		if txnErr != nil {
+			return txnErr
+		}
+		c.simpleReply("OK")
+		return nil
+	}
+	return &respError{status: http.StatusConflict, reply: "ERR keys modified concurrently, try again"}
+}
+
+// respDel deletes every key that exists in one transaction, and replies
+// with how many there were. A key given twice is counted once.
+func (s *RscsServer) respDel(c *respConn, args []string) error {
+	authErr := s.respAuthorize(c, db.PermDelete, args[1:]...)
+	if authErr != nil {
+		return authErr
+	}
+
+	for attempt := 0; attempt < respTxnAttempts; attempt++ {
+		var ops []db.Op
+		seen := make(map[string]bool)
+		for _, key := range args[1:] {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			entry, found, getErr := s.defaultStore.GetEntry(key)
+			if getErr != nil {
+				return getErr
+			}
+			if found {
+				ops = append(ops, db.Op{Type: db.OpDelete, Key: key, Index: entry.Index})
+			}
+		}
+		if len(ops) == 0 {
+			c.integerReply(0)
+			return nil
+		}
+		_, txnErr := s.defaultStore.Txn(ops)
+		var failed *db.TxnError
+		if errors.As(txnErr, &failed) {
+			// A key was changed or deleted since it was read.
+			continue
+		}
+		if txnErr != nil {
+			return txnErr
+		}
+		c.integerReply(int64(len(ops)))
+		return nil
+	}
+	return &respError{status: http.StatusConflict, reply: "ERR keys modified concurrently, try again"}
+}
+
+// respIncr adds one to the integer value of a key, keeping its expiry. A
+// missing key counts as zero.
+func (s *RscsServer) respIncr(c *respConn, args []string) error {
+	key := args[1]
+	authErr := s.respAuthorize(c, db.PermWrite, key)
+	if authErr != nil {
+		return authErr
+	}
+	for {
+		var n int64
+		_, modifyErr := s.defaultStore.Modify(key, func(entry db.Entry) (string, error) {
+			var parseErr error
+			n, parseErr = strconv.ParseInt(entry.Value, 10, 64)
+			if parseErr != nil || n == math.MaxInt64 {
+				return "", errRESPNotInteger
+			}
+			n++
+			return strconv.FormatInt(n, 10), nil
+		})
+		if modifyErr == nil {
+			c.integerReply(n)
+			return nil
+		}
+		if !errors.Is(modifyErr, db.ErrNotFound) {
+			return modifyErr
+		}
+		rowCount, casErr := s.defaultStore.CompareAndSwap(key, 0, "1")
+		if casErr != nil {
+			return casErr
+		}
+		if rowCount != 0 {
+			c.integerReply(1)
+			return nil
+		}
+		// Created by another client in between; increment theirs.
+	}
+}
+
+// respGlobPrefix is the literal start of a glob pattern, which every key it
+// matches begins with.
+func respGlobPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// respGlob reports whether key matches a Redis glob pattern: * matches any
+// run of bytes, ? any one byte, [abc], [^abc] and [a-z] a set of bytes, and
+// \ escapes the byte after it. Unlike path.Match, * matches slashes. On a
+// mismatch only the last * is retried, one byte further on, so matching
+// takes at most len(pattern) * len(key) steps.
+func respGlob(pattern, key string) bool {
+	p, k := 0, 0
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starKey = p, k
+				p++
+				continue
+			}
+			if size, matched := respGlobByte(pattern[p:], key[k]); matched {
+				p, k = p+size, k+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starKey++
+		p, k = star+1, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// respGlobByte matches b against the element at the start of pattern that
+// is not a *: a ?, a set, an escaped byte or a literal one. It returns the
+// length of the element and whether b matches it.
+func respGlobByte(pattern string, b byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		matched, rest, ok := respGlobClass(pattern[1:], b)
+		if !ok {
+			// An unterminated set is a literal '['.
+			return 1, b == '['
+		}
+		return len(pattern) - len(rest), matched
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == b
+		}
+	}
+	return 1, pattern[0] == b
+}
+
+// respGlobClass matches b against the set at the start of pattern, just
+// after its '['. It returns the pattern after the set's ']', and false if
+// the set is not terminated.
+func respGlobClass(pattern string, b byte) (bool, string, bool) {
+	negate := strings.HasPrefix(pattern, "^")
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']':
+			return matched != negate, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			matched = matched || pattern[i] == b
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= b && b <= hi)
+			i += 2
+		default:
+			matched = matched || pattern[i] == b
+		}
+	}
+	return false, "", false
+}
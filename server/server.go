@@ -3,6 +3,7 @@ package server
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/bradclawsie/rscs/db"
@@ -11,55 +12,166 @@ import (
 )
 
 const (
-	// KVRoutePrefix is the prefix for the kv route.
-	KVRoutePrefix = "/v1/kv"
+	// APIPrefix is the prefix of every route. The routes for keys, txn, watch,
+	// export and import below it act on the default namespace, and are also
+	// found below NamespaceRoute acting on a named namespace.
+	APIPrefix = "/v1"
+	// KVRoutePrefix is the prefix for the kv route and the route for listing keys.
+	KVRoutePrefix = APIPrefix + "/kv"
 	// KVRoute is the route for all key/val operations.
 	KVRoute = KVRoutePrefix + "/{key}"
+	// HistoryRoute is the route, below KVRoute, for a key's revision history.
+	HistoryRoute = "/history"
+	// RollbackRoute is the route, below KVRoute, for restoring an old revision.
+	RollbackRoute = "/rollback"
 	// StatusRoute is the route for system status.
 	StatusRoute = "/v1/status"
 	// keyName is the string for 'key'.
 	keyName = "key"
 )
 
-// Value corresponds to a row value.
+// Value corresponds to a row value. TTL may be set when writing to make the
+// key expire, e.g. "10m". Expires is reported when reading a key that will
+// expire.
 type Value struct {
-	Value string
+	Value   string
+	TTL     string     `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
 }
 
 // valueVerify is like Value but nil-able for some internal validation purposes.
 type valueVerify struct {
 	Value *string
+	TTL   *string
 }
 
-// RscsServer contains the state values for the underlying database instance
-// and for https routing.
+// ttl parses the optional TTL of a written value. No TTL is zero.
+func (v valueVerify) ttl() (time.Duration, error) {
+	if v.TTL == nil {
+		return 0, nil
+	}
+	ttl, parseErr := time.ParseDuration(*v.TTL)
+	if parseErr != nil || ttl <= 0 {
+		return 0, errors.New("TTL must be a positive duration")
+	}
+	return ttl, nil
+}
+
+// RscsServer contains the state values for the underlying store and for
+// https routing.
 type RscsServer struct {
-	rscsDB *db.RscsDB
-	start  time.Time
+	rscsDB       db.Store
+	defaultStore db.Store
+	start        time.Time
+	watch        *watchHub
+	tokens       db.TokenStore // nil unless RequireAuth was called
+	peerUIDs     map[int]bool  // nil unless RestrictPeers was called
+	metrics      *metrics
+	auditLog     db.AuditLog // nil if writes are not audited
+	replica      *replica    // nil unless ReplicateFrom was called
+	consulKV     bool        // set by EnableConsulKV
 }
 
-// NewRscsServer initializes a new RscsServer instance.
-func NewRscsServer(rscsDB *db.RscsDB) (*RscsServer, error) {
+// NewRscsServer initializes a new RscsServer instance backed by any Store,
+// such as a *db.RscsDB. If the store is a db.Observable, its operations are
+// timed for the metrics, and if it is a db.AuditLog, writes are audited
+// there.
+func NewRscsServer(rscsDB db.Store) (*RscsServer, error) {
 	if rscsDB == nil {
 		return nil, errors.New("nil rscsDB")
 	}
-	return &RscsServer{rscsDB: rscsDB, start: time.Now()}, nil
+	defaultStore, nsErr := db.Namespace(rscsDB, db.DefaultNamespace)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	s := &RscsServer{rscsDB: rscsDB, defaultStore: defaultStore,
+		start: time.Now(), watch: newWatchHub(), metrics: newMetrics()}
+	if observable, ok := rscsDB.(db.Observable); ok {
+		observable.SetOpObserver(s.metrics.observeDB)
+	}
+	if auditLog, ok := rscsDB.(db.AuditLog); ok {
+		s.auditLog = auditLog
+	}
+	return s, nil
 }
 
 // NewRouter provides a new chi router to pass to a server.
 func (s *RscsServer) NewRouter() (*chi.Mux, error) {
 	rtr := chi.NewRouter()
+	rtr.Use(s.instrument)
 	rtr.Use(middleware.Recoverer)
+	rtr.Use(s.checkPeer)
+	rtr.Use(s.replicaWrites)
+	if s.consulKV {
+		rtr.Use(consulToken)
+	}
+	rtr.Use(s.authenticate)
+	rtr.NotFound(notFound)
+	rtr.MethodNotAllowed(methodNotAllowed)
+
+	s.scopedRoutes(rtr, APIPrefix)
+
+	rtr.Get(NamespacesRoute, s.ListNamespaces)
+	rtr.Route(NamespaceRoute, func(rtr chi.Router) {
+		rtr.With(s.requireAdmin, s.auditWrites).Put("/", s.CreateNamespace)
+		rtr.Group(func(rtr chi.Router) {
+			rtr.Use(s.insertNamespaceContext)
+			rtr.Get("/", s.NamespaceStatus)
+			rtr.With(s.requireAdmin, s.auditWrites).Delete("/", s.DeleteNamespace)
+			s.scopedRoutes(rtr, "")
+		})
+	})
+
+	rtr.Group(func(rtr chi.Router) {
+		rtr.Use(s.requireAdmin)
+		rtr.Get(BackupRoute, s.Backup)
+		rtr.With(s.auditWrites).Post(RestoreRoute, s.Restore)
+		rtr.With(s.auditWrites).Post(TokensRoute, s.CreateToken)
+		rtr.Get(TokensRoute, s.ListTokens)
+		rtr.With(s.auditWrites).Delete(TokenRoute, s.RevokeToken)
+		rtr.Get(AuditRoute, s.Audit)
+		rtr.Get(ReplicationSnapshotRoute, s.ReplicationSnapshot)
+		rtr.Get(ReplicationChangesRoute, s.ReplicationChanges)
+	})
+	rtr.Get(StatusRoute, s.Status)
+	rtr.Get(MetricsRoute, s.Metrics)
 
-	rtr.Route(KVRoute, func(rtr chi.Router) {
+	return rtr, nil
+}
+
+// scopedRoutes adds the routes that act on a namespace to rtr, below prefix.
+func (s *RscsServer) scopedRoutes(rtr chi.Router, prefix string) {
+	route := func(fullRoute string) string {
+		return prefix + strings.TrimPrefix(fullRoute, APIPrefix)
+	}
+
+	if s.consulKV && prefix == APIPrefix {
+		// The Consul KV API takes the place of the default namespace's keys.
+		s.consulRoutes(rtr)
+	} else {
+		s.kvRoutes(rtr, route)
+	}
+	rtr.With(s.auditWrites).Post(route(TxnRoute), s.Txn)
+	rtr.Get(route(ExportRoute), s.Export)
+	rtr.With(s.auditWrites).Post(route(ImportRoute), s.Import)
+	rtr.Get(route(WatchRoute), s.Watch)
+}
+
+// kvRoutes adds the routes for listing keys and acting on a single key to
+// rtr, at the paths route gives.
+func (s *RscsServer) kvRoutes(rtr chi.Router, route func(string) string) {
+	rtr.Get(route(KVRoutePrefix), s.List)
+
+	rtr.Route(route(KVRoute), func(rtr chi.Router) {
 		rtr.Use(insertKeyContext)
+		rtr.Use(s.auditWrites)
+		rtr.Use(s.authorizeKey)
 		rtr.Get("/", s.Get)
 		rtr.Post("/", s.Insert)
 		rtr.Put("/", s.Update)
+		rtr.Patch("/", s.Patch)
 		rtr.Delete("/", s.Delete)
+		rtr.Get(HistoryRoute, s.History)
+		rtr.Post(RollbackRoute, s.Rollback)
 	})
-
-	rtr.Get(StatusRoute, s.Status)
-
-	return rtr, nil
 }
@@ -1,22 +1,49 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bradclawsie/rscs/db"
+	"github.com/bradclawsie/rscs/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 const (
 	memoryDBName = "file::memory:?mode=memory&cache=shared"
+	// serverDBName is the db behind testServer, kept apart from memoryDBName
+	// so tests can create tables there.
+	serverDBName = "file:server?mode=memory&cache=shared"
 )
 
 var (
@@ -25,10 +52,14 @@ var (
 
 func TestMain(m *testing.M) {
 
-	rscsDB, rscsDBErr := db.NewRscsDB(memoryDBName)
+	rscsDB, rscsDBErr := db.NewRscsDB(serverDBName)
 	if rscsDBErr != nil {
 		log.Fatal(rscsDBErr)
 	}
+	createErr := rscsDB.CreateTable()
+	if createErr != nil {
+		log.Fatal(createErr)
+	}
 	rscsServer, rscsSrvErr := NewRscsServer(rscsDB)
 	if rscsSrvErr != nil {
 		log.Fatal(rscsSrvErr)
@@ -43,6 +74,8 @@ func TestMain(m *testing.M) {
 	testServer = httptest.NewServer(rtr)
 	defer testServer.Close()
 
+	go rscsServer.Reap(10 * time.Millisecond)
+
 	os.Exit(m.Run())
 }
 
@@ -99,7 +132,7 @@ func TestInsert(t *testing.T) {
 
 	emptyKeyRoute := KVRoutePrefix
 	emptyKeyResp, _ := testRequest(t, testServer, http.MethodPost, emptyKeyRoute, bytes.NewReader(vJSON))
-	if emptyKeyResp.StatusCode != http.StatusNotFound {
+	if emptyKeyResp.StatusCode != http.StatusMethodNotAllowed {
 		t.Errorf("inserted empty route")
 	}
 
@@ -170,7 +203,7 @@ func TestUpdate(t *testing.T) {
 
 	emptyKeyRoute := KVRoutePrefix
 	emptyKeyResp, _ := testRequest(t, testServer, http.MethodPut, emptyKeyRoute, bytes.NewReader(vJSON))
-	if emptyKeyResp.StatusCode != http.StatusNotFound {
+	if emptyKeyResp.StatusCode != http.StatusMethodNotAllowed {
 		t.Errorf("updated empty route")
 	}
 
@@ -254,7 +287,7 @@ func TestDelete(t *testing.T) {
 
 	emptyKeyRoute := KVRoutePrefix
 	emptyKeyResp, _ := testRequest(t, testServer, http.MethodDelete, emptyKeyRoute, nil)
-	if emptyKeyResp.StatusCode != http.StatusNotFound {
+	if emptyKeyResp.StatusCode != http.StatusMethodNotAllowed {
 		t.Errorf("deleted on empty route")
 	}
 
@@ -275,61 +308,2020 @@ func TestDelete(t *testing.T) {
 	}
 }
 
-func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
-	req, err := http.NewRequest(method, ts.URL+path, body)
-	if err != nil {
-		t.Fatal(err)
-		return nil, ""
+func TestList(t *testing.T) {
+	for _, key := range []string{"list-b", "list-a", "list-c", "lisu"} {
+		vJSON, jsonErr := json.Marshal(Value{Value: key + "-value"})
+		if jsonErr != nil {
+			t.Errorf(jsonErr.Error())
+		}
+		insertResp, _ := testRequest(t, testServer, http.MethodPost, KVRoutePrefix+"/"+key, bytes.NewReader(vJSON))
+		if insertResp.StatusCode != http.StatusCreated {
+			t.Errorf("insert:not 201")
+		}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatal(err)
-		return nil, ""
+	listResp, listBody := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"?prefix=list-&limit=2", nil)
+	if listResp.StatusCode != http.StatusOK {
+		t.Fatalf("list:not 200")
+	}
+	var page ListResult
+	umErr := json.Unmarshal([]byte(listBody), &page)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if len(page.Entries) != 2 || page.Entries[0].Key != "list-a" || page.Entries[1].Key != "list-b" {
+		t.Errorf("list first page:%v", page.Entries)
+	}
+	if page.Entries[0].Value != nil {
+		t.Errorf("list returned unrequested value")
+	}
+	if page.Next == "" {
+		t.Fatalf("list missing next cursor")
 	}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-		return nil, ""
+	route := KVRoutePrefix + "?prefix=list-&limit=2&values=true&after=" + page.Next
+	listResp, listBody = testRequest(t, testServer, http.MethodGet, route, nil)
+	if listResp.StatusCode != http.StatusOK {
+		t.Fatalf("list:not 200")
+	}
+	page = ListResult{}
+	umErr = json.Unmarshal([]byte(listBody), &page)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Key != "list-c" {
+		t.Fatalf("list second page:%v", page.Entries)
+	}
+	if page.Entries[0].Value == nil || *page.Entries[0].Value != "list-c-value" {
+		t.Errorf("list missing value")
+	}
+	if page.Next != "" {
+		t.Errorf("list unexpected next cursor")
 	}
-	defer resp.Body.Close()
 
-	return resp, string(respBody)
+	for _, query := range []string{"?limit=0", "?limit=x", "?values=x", "?after=!!"} {
+		badResp, _ := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+query, nil)
+		if badResp.StatusCode != http.StatusBadRequest {
+			t.Errorf("list %s:not 400", query)
+		}
+	}
 }
 
-func Example() {
+func TestHistory(t *testing.T) {
+	key := "key4"
+	route := KVRoutePrefix + "/" + key
+	for i, val := range []string{"val4a", "val4b"} {
+		vJSON, jsonErr := json.Marshal(Value{Value: val})
+		if jsonErr != nil {
+			t.Errorf(jsonErr.Error())
+		}
+		method := http.MethodPut
+		if i == 0 {
+			method = http.MethodPost
+		}
+		writeResp, _ := testRequest(t, testServer, method, route, bytes.NewReader(vJSON))
+		if writeResp.StatusCode != http.StatusOK && writeResp.StatusCode != http.StatusCreated {
+			t.Errorf("write:%d", writeResp.StatusCode)
+		}
+	}
 
-	// You need a sqlite file. We assume here that you have one with
-	// a pre-existing `kv` table, if not, look at rscs.go in this directory
-	// for an example of how to create an empty one.
-	var sqliteDBFile string
-	flag.StringVar(&sqliteDBFile, "db", "", "full path to sqlite db file")
-	flag.Parse()
+	historyResp, historyBody := testRequest(t, testServer, http.MethodGet, route+HistoryRoute, nil)
+	if historyResp.StatusCode != http.StatusOK {
+		t.Fatalf("history:not 200")
+	}
+	var history HistoryResult
+	umErr := json.Unmarshal([]byte(historyBody), &history)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if len(history.Revisions) != 2 || history.Revisions[0].Value != "val4a" {
+		t.Errorf("history:%v", history.Revisions)
+	}
 
-	if sqliteDBFile == "" {
-		log.Fatal(`use: example_daemon --db={sqlite db file}`)
+	getResp, getBody := testRequest(t, testServer, http.MethodGet, route+"?revision=1", nil)
+	if getResp.StatusCode != http.StatusOK {
+		t.Errorf("get revision:not 200")
+	}
+	var vOut Value
+	umErr = json.Unmarshal([]byte(getBody), &vOut)
+	if umErr != nil {
+		t.Errorf(umErr.Error())
+	}
+	if vOut.Value != "val4a" {
+		t.Errorf("get revision value:%s", vOut.Value)
 	}
 
-	// Create a DB instance for sqlite.
-	rscsDB, rscsDBErr := db.NewRscsDB(sqliteDBFile)
-	if rscsDBErr != nil {
-		log.Fatal(rscsDBErr)
+	getResp, _ = testRequest(t, testServer, http.MethodGet, route+"?revision=x", nil)
+	if getResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("get revision:not 400")
+	}
+	getResp, _ = testRequest(t, testServer, http.MethodGet, route+"?revision=99", nil)
+	if getResp.StatusCode != http.StatusNotFound {
+		t.Errorf("get revision:not 404")
 	}
 
-	// Create an http abstraction layer.
-	rscsServer, rscsSrvErr := NewRscsServer(rscsDB)
-	if rscsSrvErr != nil {
-		log.Fatal(rscsSrvErr)
+	rollbackResp, _ := testRequest(t, testServer, http.MethodPost, route+RollbackRoute+"?revision=99", nil)
+	if rollbackResp.StatusCode != http.StatusNotFound {
+		t.Errorf("rollback:not 404")
+	}
+	rollbackResp, _ = testRequest(t, testServer, http.MethodPost, route+RollbackRoute, nil)
+	if rollbackResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("rollback:not 400")
+	}
+	rollbackResp, _ = testRequest(t, testServer, http.MethodPost, route+RollbackRoute+"?revision=1", nil)
+	if rollbackResp.StatusCode != http.StatusOK {
+		t.Errorf("rollback:not 200")
+	}
+	getResp, getBody = testRequest(t, testServer, http.MethodGet, route, nil)
+	if getResp.StatusCode != http.StatusOK {
+		t.Errorf("get:not 200")
+	}
+	umErr = json.Unmarshal([]byte(getBody), &vOut)
+	if umErr != nil {
+		t.Errorf(umErr.Error())
+	}
+	if vOut.Value != "val4a" {
+		t.Errorf("rollback value:%s", vOut.Value)
 	}
 
-	// Instantiate a router.
-	rtr, rtrErr := rscsServer.NewRouter()
-	if rtrErr != nil {
-		log.Fatal(rtrErr.Error())
+	historyResp, _ = testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/not-there"+HistoryRoute, nil)
+	if historyResp.StatusCode != http.StatusNotFound {
+		t.Errorf("history:not 404")
 	}
+}
 
-	// Listen.
-	srv := &http.Server{Addr: ":8081", Handler: rtr}
-	log.Fatal(srv.ListenAndServe())
+func TestConditional(t *testing.T) {
+	key := "key5"
+	route := KVRoutePrefix + "/" + key
+	vJSON := func(val string) io.Reader {
+		b, jsonErr := json.Marshal(Value{Value: val})
+		if jsonErr != nil {
+			t.Errorf(jsonErr.Error())
+		}
+		return bytes.NewReader(b)
+	}
+
+	createOnly := http.Header{"If-None-Match": []string{"*"}}
+	insertResp, _ := testRequestHeader(t, testServer, http.MethodPost, route, vJSON("val5"), createOnly)
+	if insertResp.StatusCode != http.StatusCreated {
+		t.Errorf("conditional insert:not 201")
+	}
+	insertResp, _ = testRequestHeader(t, testServer, http.MethodPost, route, vJSON("val5"), createOnly)
+	if insertResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("conditional insert existing:not 412")
+	}
+
+	getResp, _ := testRequest(t, testServer, http.MethodGet, route, nil)
+	etag := getResp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("get:no ETag")
+	}
+
+	existsResp, existsBody := testRequestHeader(t, testServer, http.MethodPost, route, vJSON("val5"),
+		http.Header{"If-Match": []string{etag}})
+	if existsResp.StatusCode != http.StatusConflict || !strings.Contains(existsBody, CodeKeyExists) {
+		t.Errorf("conditional insert matching existing:not 409 %s", existsBody)
+	}
+
+	staleResp, _ := testRequestHeader(t, testServer, http.MethodPut, route, vJSON("stale"),
+		http.Header{"If-Match": []string{`"999999"`}})
+	if staleResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale update:not 412")
+	}
+	badResp, _ := testRequestHeader(t, testServer, http.MethodPut, route, vJSON("bad"),
+		http.Header{"If-Match": []string{"nope"}})
+	if badResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed ETag:not 400")
+	}
+	updateResp, _ := testRequestHeader(t, testServer, http.MethodPut, route, vJSON("val5new"),
+		http.Header{"If-Match": []string{etag}})
+	if updateResp.StatusCode != http.StatusOK {
+		t.Errorf("conditional update:not 200")
+	}
+	updateResp, _ = testRequestHeader(t, testServer, http.MethodPut, route, vJSON("val5lost"),
+		http.Header{"If-Match": []string{etag}})
+	if updateResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("lost update:not 412")
+	}
+
+	getResp, getBody := testRequest(t, testServer, http.MethodGet, route, nil)
+	var vOut Value
+	umErr := json.Unmarshal([]byte(getBody), &vOut)
+	if umErr != nil {
+		t.Errorf(umErr.Error())
+	}
+	if vOut.Value != "val5new" {
+		t.Errorf("conditional update value:%s", vOut.Value)
+	}
+	newETag := getResp.Header.Get("ETag")
+	if newETag == etag {
+		t.Errorf("ETag unchanged by update")
+	}
+
+	deleteResp, _ := testRequestHeader(t, testServer, http.MethodDelete, route, nil,
+		http.Header{"If-Match": []string{etag}})
+	if deleteResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale delete:not 412")
+	}
+	deleteResp, _ = testRequestHeader(t, testServer, http.MethodDelete, route, nil,
+		http.Header{"If-Match": []string{`"1", ` + newETag}})
+	if deleteResp.StatusCode != http.StatusOK {
+		t.Errorf("conditional delete:not 200")
+	}
+	deleteResp, _ = testRequestHeader(t, testServer, http.MethodDelete, route, nil,
+		http.Header{"If-Match": []string{"*"}})
+	if deleteResp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("delete missing key with If-Match *:not 412")
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	key := "key6"
+	route := KVRoutePrefix + "/" + key
+	getResp, _ := testRequest(t, testServer, http.MethodGet, route, nil)
+	if getResp.StatusCode != http.StatusNotFound {
+		t.Errorf("get:not 404")
+	}
+	index := getResp.Header.Get(IndexHeader)
+	if index == "" {
+		t.Fatalf("get:no index header")
+	}
+
+	start := time.Now()
+	timeoutResp, _ := testRequest(t, testServer, http.MethodGet, route+"?wait=50ms&index="+index, nil)
+	if timeoutResp.StatusCode != http.StatusNotFound {
+		t.Errorf("long-poll timeout:not 404")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("long-poll did not block")
+	}
+
+	badResp, _ := testRequest(t, testServer, http.MethodGet, route+"?wait=soon&index="+index, nil)
+	if badResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("long-poll bad wait:not 400")
+	}
+
+	type pollResult struct {
+		resp *http.Response
+		body string
+	}
+	getDone := make(chan pollResult)
+	go func() {
+		resp, body := testRequest(t, testServer, http.MethodGet, route+"?wait=10s&index="+index, nil)
+		getDone <- pollResult{resp, body}
+	}()
+	listDone := make(chan pollResult)
+	go func() {
+		resp, body := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"?prefix=key6&wait=10s&index="+index, nil)
+		listDone <- pollResult{resp, body}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	vJSON, jsonErr := json.Marshal(Value{Value: "val6"})
+	if jsonErr != nil {
+		t.Errorf(jsonErr.Error())
+	}
+	insertResp, _ := testRequest(t, testServer, http.MethodPost, route, bytes.NewReader(vJSON))
+	if insertResp.StatusCode != http.StatusCreated {
+		t.Errorf("insert:not 201")
+	}
+
+	got := <-getDone
+	if got.resp.StatusCode != http.StatusOK {
+		t.Errorf("long-poll get:not 200")
+	}
+	var vOut Value
+	umErr := json.Unmarshal([]byte(got.body), &vOut)
+	if umErr != nil || vOut.Value != "val6" {
+		t.Errorf("long-poll get value:%s", got.body)
+	}
+	if got.resp.Header.Get(IndexHeader) == index {
+		t.Errorf("long-poll index unchanged")
+	}
+
+	got = <-listDone
+	var page ListResult
+	umErr = json.Unmarshal([]byte(got.body), &page)
+	if umErr != nil || len(page.Entries) != 1 || page.Entries[0].Key != key {
+		t.Errorf("long-poll list:%s", got.body)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, reqErr := http.NewRequest(http.MethodGet, testServer.URL+WatchRoute+"?prefix=key7", nil)
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	watchResp, watchErr := http.DefaultClient.Do(req.WithContext(ctx))
+	if watchErr != nil {
+		t.Fatal(watchErr)
+	}
+	defer watchResp.Body.Close()
+	if watchResp.StatusCode != http.StatusOK {
+		t.Fatalf("watch:not 200")
+	}
+
+	route := KVRoutePrefix + "/key7"
+	vJSON, jsonErr := json.Marshal(Value{Value: "val7"})
+	if jsonErr != nil {
+		t.Errorf(jsonErr.Error())
+	}
+	testRequest(t, testServer, http.MethodPost, KVRoutePrefix+"/key8", bytes.NewReader(vJSON))
+	insertResp, _ := testRequest(t, testServer, http.MethodPost, route, bytes.NewReader(vJSON))
+	if insertResp.StatusCode != http.StatusCreated {
+		t.Errorf("insert:not 201")
+	}
+	deleteResp, _ := testRequest(t, testServer, http.MethodDelete, route, nil)
+	if deleteResp.StatusCode != http.StatusOK {
+		t.Errorf("delete:not 200")
+	}
+
+	var events []WatchEvent
+	scanner := bufio.NewScanner(watchResp.Body)
+	for len(events) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event WatchEvent
+		umErr := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+		if umErr != nil {
+			t.Fatalf(umErr.Error())
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("watch events:%v", events)
+	}
+	if events[0].Type != "put" || events[0].Key != "key7" || events[0].Value != "val7" {
+		t.Errorf("watch put event:%v", events[0])
+	}
+	if events[1].Type != "delete" || events[1].Index <= events[0].Index {
+		t.Errorf("watch delete event:%v", events[1])
+	}
+}
+
+func TestTTL(t *testing.T) {
+	route := KVRoutePrefix + "/key9"
+	badResp, _ := testRequest(t, testServer, http.MethodPost, route,
+		strings.NewReader(`{"Value":"val9","TTL":"soon"}`))
+	if badResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("insert bad TTL:not 400")
+	}
+
+	insertResp, _ := testRequest(t, testServer, http.MethodPost, route,
+		strings.NewReader(`{"Value":"val9","TTL":"100ms"}`))
+	if insertResp.StatusCode != http.StatusCreated {
+		t.Fatalf("insert:not 201")
+	}
+
+	getResp, getBody := testRequest(t, testServer, http.MethodGet, route, nil)
+	if getResp.StatusCode != http.StatusOK {
+		t.Fatalf("get:not 200")
+	}
+	var vOut Value
+	umErr := json.Unmarshal([]byte(getBody), &vOut)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if vOut.Expires == nil || vOut.Expires.Before(time.Now()) {
+		t.Errorf("get expires:%v", vOut.Expires)
+	}
+
+	listResp, listBody := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"?prefix=key9", nil)
+	if listResp.StatusCode != http.StatusOK {
+		t.Fatalf("list:not 200")
+	}
+	var page ListResult
+	umErr = json.Unmarshal([]byte(listBody), &page)
+	if umErr != nil || len(page.Entries) != 1 || page.Entries[0].Expires == nil {
+		t.Errorf("list expires:%s", listBody)
+	}
+
+	// The reaper deletes the key, which wakes the long-poll.
+	index := getResp.Header.Get(IndexHeader)
+	pollResp, _ := testRequest(t, testServer, http.MethodGet, route+"?wait=5s&index="+index, nil)
+	if pollResp.StatusCode != http.StatusNotFound {
+		t.Errorf("expired get:not 404")
+	}
+	historyResp, historyBody := testRequest(t, testServer, http.MethodGet, route+HistoryRoute, nil)
+	if historyResp.StatusCode != http.StatusOK {
+		t.Fatalf("history:not 200")
+	}
+	var history HistoryResult
+	umErr = json.Unmarshal([]byte(historyBody), &history)
+	if umErr != nil || len(history.Revisions) != 2 || !history.Revisions[1].Deleted {
+		t.Errorf("expired history:%s", historyBody)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	txnResp, txnBody := testRequest(t, testServer, http.MethodPost, TxnRoute, strings.NewReader(`{"Ops":[
+		{"Op":"insert","Key":"key10","Value":"val10"},
+		{"Op":"insert","Key":"key11","Value":"val11","TTL":"1h"},
+		{"Op":"get","Key":"key10"}]}`))
+	if txnResp.StatusCode != http.StatusOK {
+		t.Fatalf("txn:not 200:%s", txnBody)
+	}
+	var result TxnResult
+	umErr := json.Unmarshal([]byte(txnBody), &result)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if len(result.Results) != 3 || result.FailedOp != nil {
+		t.Fatalf("txn results:%s", txnBody)
+	}
+	if result.Results[1].Expires == nil {
+		t.Errorf("txn insert with TTL has no expiry")
+	}
+	get := result.Results[2]
+	if !get.Found || get.Value == nil || *get.Value != "val10" || get.Index == 0 {
+		t.Errorf("txn get:%s", txnBody)
+	}
+
+	// The failing insert rolls back the delete.
+	txnResp, txnBody = testRequest(t, testServer, http.MethodPost, TxnRoute, strings.NewReader(`{"Ops":[
+		{"Op":"delete","Key":"key10"},
+		{"Op":"insert","Key":"key11","Value":"again"}]}`))
+	if txnResp.StatusCode != http.StatusConflict {
+		t.Fatalf("failed txn:not 409")
+	}
+	result = TxnResult{}
+	umErr = json.Unmarshal([]byte(txnBody), &result)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if result.FailedOp == nil || *result.FailedOp != 1 || result.Error == "" || len(result.Results) != 0 {
+		t.Errorf("failed txn result:%s", txnBody)
+	}
+	getResp, _ := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/key10", nil)
+	if getResp.StatusCode != http.StatusOK {
+		t.Errorf("failed txn was not rolled back")
+	}
+
+	checkOps := fmt.Sprintf(`{"Ops":[{"Op":"check","Key":"key10","Index":%d},{"Op":"update","Key":"key10","Value":"new"}]}`, get.Index)
+	txnResp, _ = testRequest(t, testServer, http.MethodPost, TxnRoute, strings.NewReader(checkOps))
+	if txnResp.StatusCode != http.StatusOK {
+		t.Errorf("checked txn:not 200")
+	}
+	txnResp, _ = testRequest(t, testServer, http.MethodPost, TxnRoute, strings.NewReader(checkOps))
+	if txnResp.StatusCode != http.StatusConflict {
+		t.Errorf("stale checked txn:not 409")
+	}
+
+	for _, bad := range []string{``, `{"Ops":[]}`, `{"Ops":[{"Op":"frob","Key":"k"}]}`,
+		`{"Ops":[{"Op":"insert","Key":"k"}]}`, `{"Ops":[{"Op":"get"}]}`,
+		`{"Ops":[{"Op":"update","Key":"k","Value":"v","TTL":"-1s"}]}`} {
+		badResp, _ := testRequest(t, testServer, http.MethodPost, TxnRoute, strings.NewReader(bad))
+		if badResp.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad txn %s:not 400", bad)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	importPath := ImportRoute + "?format=env&dryrun=true&mode=replace"
+	importResp, importBody := testRequest(t, testServer, http.MethodPost, importPath,
+		strings.NewReader("import-a=1\nimport-b=\"two words\"\n"))
+	if importResp.StatusCode != http.StatusOK {
+		t.Fatalf("dry run import:not 200:%s", importBody)
+	}
+	var result ImportResult
+	umErr := json.Unmarshal([]byte(importBody), &result)
+	if umErr != nil {
+		t.Fatalf(umErr.Error())
+	}
+	if !result.DryRun || len(result.Changes) < 3 || result.Changes[0].Action != db.ImportAdd {
+		t.Errorf("dry run import: %s", importBody)
+	}
+	getResp, _ := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/import-a", nil)
+	if getResp.StatusCode != http.StatusNotFound {
+		t.Errorf("dry run import wrote")
+	}
+
+	importResp, importBody = testRequest(t, testServer, http.MethodPost, ImportRoute+"?format=yaml",
+		strings.NewReader("import-a: 1\nimport-b: two words\n"))
+	if importResp.StatusCode != http.StatusOK {
+		t.Fatalf("import:not 200:%s", importBody)
+	}
+	result = ImportResult{}
+	json.Unmarshal([]byte(importBody), &result)
+	if result.DryRun || len(result.Changes) != 2 {
+		t.Errorf("import: %s", importBody)
+	}
+
+	exportResp, exportBody := testRequest(t, testServer, http.MethodGet, ExportRoute+"?format=env", nil)
+	if exportResp.StatusCode != http.StatusOK {
+		t.Fatalf("export:not 200:%s", exportBody)
+	}
+	if !strings.Contains(exportBody, "import-a=1\n") || !strings.Contains(exportBody, `import-b="two words"`) {
+		t.Errorf("export: %s", exportBody)
+	}
+	exportResp, exportBody = testRequest(t, testServer, http.MethodGet, ExportRoute, nil)
+	var exported map[string]string
+	umErr = json.Unmarshal([]byte(exportBody), &exported)
+	if umErr != nil || exported["import-b"] != "two words" {
+		t.Errorf("json export: %s", exportBody)
+	}
+
+	for _, bad := range []string{"?format=xml", "?mode=frob", "?dryrun=frob"} {
+		badResp, _ := testRequest(t, testServer, http.MethodPost, ImportRoute+bad, strings.NewReader("{}"))
+		if badResp.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad import %s:not 400", bad)
+		}
+	}
+	badResp, _ := testRequest(t, testServer, http.MethodPost, ImportRoute, strings.NewReader(`{"a":`))
+	if badResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed import:not 400")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	testRequest(t, testServer, http.MethodPost, KVRoutePrefix+"/backup-a", strings.NewReader(`{"Value":"1"}`))
+	backupResp, backupBody := testRequest(t, testServer, http.MethodGet, BackupRoute, nil)
+	if backupResp.StatusCode != http.StatusOK {
+		t.Fatalf("backup:not 200:%s", backupBody)
+	}
+	if backupResp.Header.Get("Content-type") != "application/vnd.sqlite3" {
+		t.Errorf("backup content type: %s", backupResp.Header.Get("Content-type"))
+	}
+
+	testRequest(t, testServer, http.MethodPut, KVRoutePrefix+"/backup-a", strings.NewReader(`{"Value":"2"}`))
+	restoreResp, restoreBody := testRequest(t, testServer, http.MethodPost, RestoreRoute, strings.NewReader(backupBody))
+	if restoreResp.StatusCode != http.StatusOK {
+		t.Fatalf("restore:not 200:%s", restoreBody)
+	}
+	_, getBody := testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/backup-a", nil)
+	if getBody != `{"Value":"1"}` {
+		t.Errorf("restored value: %s", getBody)
+	}
+
+	restoreResp, _ = testRequest(t, testServer, http.MethodPost, RestoreRoute, strings.NewReader("not a backup"))
+	if restoreResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad restore:not 400")
+	}
+}
+
+func TestBackupEvery(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	rscsServer, _ := NewRscsServer(db.NewMemoryStore())
+	for i := 0; i < 3; i++ {
+		_, backupErr := rscsServer.writeBackup(dir, 2)
+		if backupErr != nil {
+			t.Fatalf("backup:%s", backupErr.Error())
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("kept %d backups", len(files))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	nsRoute := NamespacesRoute + "/ns-test"
+	getResp, _ := testRequest(t, testServer, http.MethodGet, nsRoute+"/kv/key1", nil)
+	if getResp.StatusCode != http.StatusNotFound {
+		t.Errorf("get in missing namespace:not 404")
+	}
+
+	createResp, createBody := testRequest(t, testServer, http.MethodPut, nsRoute, nil)
+	if createResp.StatusCode != http.StatusCreated {
+		t.Fatalf("create namespace:not 201:%s", createBody)
+	}
+	createResp, _ = testRequest(t, testServer, http.MethodPut, nsRoute, nil)
+	if createResp.StatusCode != http.StatusConflict {
+		t.Errorf("create existing namespace:not 409")
+	}
+	createResp, _ = testRequest(t, testServer, http.MethodPut, NamespacesRoute+"/Bad!", nil)
+	if createResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create bad namespace:not 400")
+	}
+
+	testRequest(t, testServer, http.MethodPost, KVRoutePrefix+"/ns-key", strings.NewReader(`{"Value":"default"}`))
+	insertResp, _ := testRequest(t, testServer, http.MethodPost, nsRoute+"/kv/ns-key", strings.NewReader(`{"Value":"team"}`))
+	if insertResp.StatusCode != http.StatusCreated {
+		t.Errorf("insert in namespace:not 201")
+	}
+	_, getBody := testRequest(t, testServer, http.MethodGet, nsRoute+"/kv/ns-key", nil)
+	if getBody != `{"Value":"team"}` {
+		t.Errorf("namespace value: %s", getBody)
+	}
+	_, getBody = testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/ns-key", nil)
+	if getBody != `{"Value":"default"}` {
+		t.Errorf("default value: %s", getBody)
+	}
+	_, listBody := testRequest(t, testServer, http.MethodGet, nsRoute+"/kv", nil)
+	var list ListResult
+	json.Unmarshal([]byte(listBody), &list)
+	if len(list.Entries) != 1 || list.Entries[0].Key != "ns-key" {
+		t.Errorf("namespace list: %s", listBody)
+	}
+
+	_, nsBody := testRequest(t, testServer, http.MethodGet, nsRoute, nil)
+	var ns NamespaceResult
+	json.Unmarshal([]byte(nsBody), &ns)
+	if ns.Namespace != "ns-test" || ns.Stats.Keys != 1 || ns.Stats.Bytes != 4 {
+		t.Errorf("namespace status: %s", nsBody)
+	}
+	_, listBody = testRequest(t, testServer, http.MethodGet, NamespacesRoute, nil)
+	var namespaces NamespacesResult
+	json.Unmarshal([]byte(listBody), &namespaces)
+	if len(namespaces.Namespaces) < 2 || namespaces.Namespaces[0] != db.DefaultNamespace {
+		t.Errorf("list namespaces: %s", listBody)
+	}
+	_, statusBody := testRequest(t, testServer, http.MethodGet, StatusRoute, nil)
+	var status StatusResult
+	json.Unmarshal([]byte(statusBody), &status)
+	if status.Namespaces["ns-test"].Keys != 1 {
+		t.Errorf("status namespaces: %s", statusBody)
+	}
+
+	deleteResp, _ := testRequest(t, testServer, http.MethodDelete, nsRoute, nil)
+	if deleteResp.StatusCode != http.StatusOK {
+		t.Errorf("delete namespace:not 200")
+	}
+	getResp, _ = testRequest(t, testServer, http.MethodGet, nsRoute+"/kv/ns-key", nil)
+	if getResp.StatusCode != http.StatusNotFound {
+		t.Errorf("get in deleted namespace:not 404")
+	}
+	deleteResp, _ = testRequest(t, testServer, http.MethodDelete, NamespacesRoute+"/"+db.DefaultNamespace, nil)
+	if deleteResp.StatusCode != http.StatusBadRequest {
+		t.Errorf("delete default namespace:not 400")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	authErr := rscsServer.RequireAuth()
+	if authErr != nil {
+		t.Fatalf("require auth:%s", authErr.Error())
+	}
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+	admin := http.Header{"Authorization": {"Bearer " + adminBearer}}
+
+	resp, _ := testRequest(t, ts, http.MethodGet, KVRoutePrefix+"/app-a", nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("no token:not 401")
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, StatusRoute, nil,
+		http.Header{"Authorization": {"Bearer " + adminToken.ID + ".wrong"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad token:not 401")
+	}
+
+	mintBody := `{"Policies":[{"Prefix":"app-","Permissions":["read","write"]}]}`
+	resp, mintJSON := testRequestHeader(t, ts, http.MethodPost, TokensRoute, strings.NewReader(mintBody), admin)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("mint:not 201:%s", mintJSON)
+	}
+	var minted TokenResult
+	json.Unmarshal([]byte(mintJSON), &minted)
+	if minted.Bearer == "" || strings.Contains(mintJSON, adminToken.Hash) {
+		t.Errorf("mint: %s", mintJSON)
+	}
+	user := http.Header{"Authorization": {"Bearer " + minted.Bearer}}
+
+	resp, _ = testRequestHeader(t, ts, http.MethodPost, KVRoutePrefix+"/app-a", strings.NewReader(`{"Value":"1"}`), user)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("permitted insert:not 201")
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app-a", nil, user)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("permitted get:not 200")
+	}
+	for _, forbidden := range []struct{ method, path, body string }{
+		{http.MethodDelete, KVRoutePrefix + "/app-a", ""},
+		{http.MethodPost, KVRoutePrefix + "/other", `{"Value":"1"}`},
+		{http.MethodGet, KVRoutePrefix, ""},
+		{http.MethodGet, ExportRoute, ""},
+		{http.MethodPost, TxnRoute, `{"Ops":[{"Op":"get","Key":"app-a"},{"Op":"delete","Key":"app-a"}]}`},
+		{http.MethodGet, NamespacesRoute + "/" + db.DefaultNamespace + "/kv/other", ""},
+		{http.MethodGet, TokensRoute, ""},
+		{http.MethodGet, BackupRoute, ""},
+	} {
+		resp, _ = testRequestHeader(t, ts, forbidden.method, forbidden.path, strings.NewReader(forbidden.body), user)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s:not 403", forbidden.method, forbidden.path)
+		}
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"?prefix=app-", nil, user)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("permitted list:not 200")
+	}
+
+	// Namespaces are listed and described only to tokens that may read all
+	// of them.
+	testRequestHeader(t, ts, http.MethodPut, NamespacesRoute+"/team", nil, admin)
+	resp, nsJSON := testRequestHeader(t, ts, http.MethodGet, NamespacesRoute, nil, user)
+	if resp.StatusCode != http.StatusOK || nsJSON != `{"Namespaces":[]}` {
+		t.Errorf("user namespaces: %s", nsJSON)
+	}
+	resp, nsJSON = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute, nil, admin)
+	if resp.StatusCode != http.StatusOK || nsJSON != `{"Namespaces":["default","team"]}` {
+		t.Errorf("admin namespaces: %s", nsJSON)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute+"/"+db.DefaultNamespace, nil, user)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("user namespace status:not 403")
+	}
+	resp, statusJSON := testRequestHeader(t, ts, http.MethodGet, StatusRoute, nil, user)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(statusJSON, `"Namespaces":{}`) {
+		t.Errorf("user status: %s", statusJSON)
+	}
+	readerBody := `{"Policies":[{"Namespace":"team","Prefix":"","Permissions":["read"]}]}`
+	_, readerJSON := testRequestHeader(t, ts, http.MethodPost, TokensRoute, strings.NewReader(readerBody), admin)
+	var reader TokenResult
+	json.Unmarshal([]byte(readerJSON), &reader)
+	teamReader := http.Header{"Authorization": {"Bearer " + reader.Bearer}}
+	resp, nsJSON = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute, nil, teamReader)
+	if resp.StatusCode != http.StatusOK || nsJSON != `{"Namespaces":["team"]}` {
+		t.Errorf("team reader namespaces: %s", nsJSON)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute+"/team", nil, teamReader)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("team reader namespace status:not 200")
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute+"/"+db.DefaultNamespace, nil, teamReader)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("team reader default namespace status:not 403")
+	}
+	// Tokens granting nothing in a namespace get 403 whether it exists or not.
+	for _, forbidden := range []struct {
+		header http.Header
+		path   string
+	}{
+		{user, NamespacesRoute + "/team/kv/k"},
+		{user, NamespacesRoute + "/nope/kv/k"},
+		{teamReader, NamespacesRoute + "/nope/kv/k"},
+		{teamReader, NamespacesRoute + "/nope"},
+	} {
+		resp, _ = testRequestHeader(t, ts, http.MethodGet, forbidden.path, nil, forbidden.header)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: %d, want 403", forbidden.path, resp.StatusCode)
+		}
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute+"/nope/kv/k", nil, admin)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("admin get in missing namespace: %d, want 404", resp.StatusCode)
+	}
+
+	resp, listJSON := testRequestHeader(t, ts, http.MethodGet, TokensRoute, nil, admin)
+	var list TokensResult
+	json.Unmarshal([]byte(listJSON), &list)
+	if resp.StatusCode != http.StatusOK || len(list.Tokens) != 3 || strings.Contains(listJSON, adminToken.Hash) {
+		t.Errorf("list tokens: %s", listJSON)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodDelete, TokensRoute+"/"+minted.ID, nil, admin)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("revoke:not 200")
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app-a", nil, user)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token:not 401")
+	}
+}
+
+func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) (*http.Response, string) {
+	return testRequestHeader(t, ts, method, path, body, nil)
+}
+
+func testRequestHeader(t *testing.T, ts *httptest.Server, method, path string, body io.Reader, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+		return nil, ""
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+		return nil, ""
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+		return nil, ""
+	}
+	defer resp.Body.Close()
+
+	return resp, string(respBody)
+}
+
+func Example() {
+
+	// You need a sqlite file. We assume here that you have one with
+	// a pre-existing `kv` table, if not, look at rscs.go in this directory
+	// for an example of how to create an empty one.
+	var sqliteDBFile string
+	flag.StringVar(&sqliteDBFile, "db", "", "full path to sqlite db file")
+	flag.Parse()
+
+	if sqliteDBFile == "" {
+		log.Fatal(`use: example_daemon --db={sqlite db file}`)
+	}
+
+	// Create a DB instance for sqlite.
+	rscsDB, rscsDBErr := db.NewRscsDB(sqliteDBFile)
+	if rscsDBErr != nil {
+		log.Fatal(rscsDBErr)
+	}
+
+	// Create an http abstraction layer.
+	rscsServer, rscsSrvErr := NewRscsServer(rscsDB)
+	if rscsSrvErr != nil {
+		log.Fatal(rscsSrvErr)
+	}
+
+	// Instantiate a router.
+	rtr, rtrErr := rscsServer.NewRouter()
+	if rtrErr != nil {
+		log.Fatal(rtrErr.Error())
+	}
+
+	// Listen.
+	srv := &http.Server{Addr: ":8081", Handler: rtr}
+	log.Fatal(srv.ListenAndServe())
+}
+
+// writeCert writes a PEM certificate for cn, and its key, into dir, signed by
+// parent if it is set and self-signed as a CA otherwise.
+func writeCert(t *testing.T, dir, name, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("generate key:%s", keyErr.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, certErr := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if certErr != nil {
+		t.Fatalf("create cert:%s", certErr.Error())
+	}
+	keyDER, marshalErr := x509.MarshalECPrivateKey(key)
+	if marshalErr != nil {
+		t.Fatalf("marshal key:%s", marshalErr.Error())
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600) != nil ||
+		ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600) != nil {
+		t.Fatalf("write cert %s", name)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) { tlsCheckInterval = interval }(tlsCheckInterval)
+	tlsCheckInterval = 0
+
+	ca, caKey := writeCert(t, dir, "ca", "rscs test ca", nil, nil)
+	writeCert(t, dir, "server", "server-one", ca, caKey)
+	writeCert(t, dir, "client", "client-one", ca, caKey)
+	files := TLSFiles{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	if _, badErr := NewTLSConfig(TLSFiles{CertFile: files.CertFile}); badErr == nil {
+		t.Errorf("tls config without a key")
+	}
+	tlsConfig, tlsErr := NewTLSConfig(files)
+	if tlsErr != nil {
+		t.Fatalf("tls config:%s", tlsErr.Error())
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, ClientSubject(r))
+	}))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, certErr := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if certErr != nil {
+		t.Fatalf("load client cert:%s", certErr.Error())
+	}
+	// get returns the subject the server saw and the common name of the
+	// server's certificate.
+	get := func(certs []tls.Certificate) (string, string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, getErr := client.Get(ts.URL)
+		if getErr != nil {
+			return "", "", getErr
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	if _, _, getErr := get(nil); getErr == nil {
+		t.Errorf("served a client without a certificate")
+	}
+	subject, serverName, getErr := get([]tls.Certificate{clientCert})
+	if getErr != nil || subject != "CN=client-one" || serverName != "server-one" {
+		t.Errorf("get: %q %q %v", subject, serverName, getErr)
+	}
+
+	// A renewed certificate is served without a restart.
+	writeCert(t, dir, "server", "server-two", ca, caKey)
+	if _, serverName, _ = get([]tls.Certificate{clientCert}); serverName != "server-two" {
+		t.Errorf("certificate not reloaded: %q", serverName)
+	}
+
+	// A broken certificate is ignored.
+	ioutil.WriteFile(files.CertFile, []byte("garbage"), 0600)
+	if _, serverName, _ = get([]tls.Certificate{clientCert}); serverName != "server-two" {
+		t.Errorf("broken certificate loaded: %q", serverName)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rscs.sock")
+
+	for _, bad := range []string{"localhost:8081", "unix://", "http://localhost"} {
+		if l, listenErr := Listen(bad, SocketOptions{}); listenErr == nil {
+			l.Close()
+			t.Errorf("listened on '%s'", bad)
+		}
+	}
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	l, listenErr := Listen(UnixScheme+path, SocketOptions{Mode: 0640, Owner: owner})
+	if listenErr != nil {
+		t.Fatalf("listen:%s", listenErr.Error())
+	}
+	info, statErr := os.Stat(path)
+	if statErr != nil || info.Mode()&os.ModePerm != 0640 {
+		t.Errorf("socket mode: %v %v", info, statErr)
+	}
+	if _, inUseErr := Listen(UnixScheme+path, SocketOptions{}); inUseErr == nil {
+		t.Errorf("listened on a socket in use")
+	}
+
+	rscsServer, _ := NewRscsServer(db.NewMemoryStore())
+	rtr, _ := rscsServer.NewRouter()
+	rtr.Get("/v1/peer", func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := PeerCredentials(r)
+		fmt.Fprintf(w, "%v %d", ok, cred.UID)
+	})
+	srv := &http.Server{Handler: rtr, ConnContext: ConnContext}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	get := func(route string) (int, string) {
+		resp, getErr := client.Get("http://rscs" + route)
+		if getErr != nil {
+			t.Fatalf("get %s:%s", route, getErr.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/v1/peer"); code != http.StatusOK || body != fmt.Sprintf("true %d", os.Getuid()) {
+		t.Errorf("peer credentials: %d %s", code, body)
+	}
+	rscsServer.RestrictPeers([]int{os.Getuid() + 1})
+	if code, _ := get(StatusRoute); code != http.StatusForbidden {
+		t.Errorf("restricted peer got %d", code)
+	}
+	rscsServer.RestrictPeers([]int{os.Getuid()})
+	if code, _ := get(StatusRoute); code != http.StatusOK {
+		t.Errorf("allowed peer got %d", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+	rscsDB, rscsDBErr := db.NewRscsDB(filepath.Join(dir, "metrics.db"))
+	if rscsDBErr != nil {
+		t.Fatalf("fail on new:%s", rscsDBErr.Error())
+	}
+	if createErr := rscsDB.CreateTable(); createErr != nil {
+		t.Fatalf("fail on create:%s", createErr.Error())
+	}
+	rscsServer, _ := NewRscsServer(rscsDB)
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+
+	testRequest(t, ts, http.MethodPost, KVRoutePrefix+"/key1", strings.NewReader(`{"Value":"value1"}`))
+	testRequest(t, ts, http.MethodGet, KVRoutePrefix+"/key1", nil)
+	testRequest(t, ts, http.MethodGet, KVRoutePrefix+"/key2", nil)
+	testRequest(t, ts, http.MethodGet, "/nowhere", nil)
+
+	resp, body := testRequest(t, ts, http.MethodGet, MetricsRoute, nil)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-type"), "text/plain") {
+		t.Fatalf("metrics: %d %s", resp.StatusCode, resp.Header.Get("Content-type"))
+	}
+	for _, want := range []string{
+		`rscs_http_requests_total{route="/v1/kv/{key}",method="POST",code="201"} 1`,
+		`rscs_http_requests_total{route="/v1/kv/{key}",method="GET",code="200"} 1`,
+		`rscs_http_requests_total{route="/v1/kv/{key}",method="GET",code="404"} 1`,
+		`rscs_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`rscs_http_request_duration_seconds_bucket{route="/v1/kv/{key}",method="GET",le="+Inf"} 2`,
+		`rscs_http_request_duration_seconds_count{route="/v1/kv/{key}",method="POST"} 1`,
+		`rscs_db_operation_duration_seconds_count{op="insert"} 1`,
+		`rscs_db_operation_duration_seconds_bucket{op="get",le="+Inf"} `,
+		`rscs_keys{namespace="default"} 1`,
+		`rscs_value_bytes{namespace="default"} 6`,
+		"rscs_db_file_size_bytes ",
+		"# TYPE rscs_http_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	errorResult := func(resp *http.Response, body string) ErrorResult {
+		t.Helper()
+		if resp.Header.Get("Content-type") != "application/json" {
+			t.Errorf("error content type %s", resp.Header.Get("Content-type"))
+		}
+		var result ErrorResult
+		if jsonErr := json.Unmarshal([]byte(body), &result); jsonErr != nil {
+			t.Fatalf("error body %s: %s", body, jsonErr.Error())
+		}
+		return result
+	}
+
+	route := KVRoutePrefix + "/errkey"
+	testRequest(t, testServer, http.MethodPost, route, strings.NewReader(`{"Value":"v"}`))
+	defer testRequest(t, testServer, http.MethodDelete, route, nil)
+
+	resp, body := testRequest(t, testServer, http.MethodPost, route, strings.NewReader(`{"Value":"v"}`))
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusConflict ||
+		result.Code != CodeKeyExists || result.Key != "errkey" {
+		t.Errorf("duplicate insert: %d %+v", resp.StatusCode, result)
+	}
+
+	resp, body = testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"/errmissing", nil)
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusNotFound ||
+		result.Code != CodeKeyNotFound || result.Key != "errmissing" {
+		t.Errorf("missing key: %d %+v", resp.StatusCode, result)
+	}
+
+	resp, body = testRequest(t, testServer, http.MethodPut, route, strings.NewReader(`{"Value":`))
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusBadRequest || result.Code != CodeMalformedRequest {
+		t.Errorf("malformed body: %d %+v", resp.StatusCode, result)
+	}
+
+	resp, body = testRequest(t, testServer, http.MethodGet, KVRoutePrefix+"?limit=x", nil)
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusBadRequest || result.Code != CodeInvalidParameter {
+		t.Errorf("bad limit: %d %+v", resp.StatusCode, result)
+	}
+
+	longKey := strings.Repeat("k", db.MaxKeyLen+1)
+	resp, body = testRequest(t, testServer, http.MethodPost, KVRoutePrefix+"/"+longKey, strings.NewReader(`{"Value":"v"}`))
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusBadRequest || result.Code != CodeKeyTooLong {
+		t.Errorf("long key: %d %+v", resp.StatusCode, result)
+	}
+
+	resp, body = testRequest(t, testServer, http.MethodGet, "/nowhere", nil)
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusNotFound || result.Code != CodeRouteNotFound {
+		t.Errorf("unknown route: %d %+v", resp.StatusCode, result)
+	}
+
+	resp, body = testRequest(t, testServer, http.MethodPatch, StatusRoute, nil)
+	if result := errorResult(resp, body); resp.StatusCode != http.StatusMethodNotAllowed || result.Code != CodeMethodNotAllowed {
+		t.Errorf("bad method: %d %+v", resp.StatusCode, result)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	route := KVRoutePrefix + "/upsertkey"
+	defer testRequest(t, testServer, http.MethodDelete, route, nil)
+
+	resp, _ := testRequest(t, testServer, http.MethodPut, route+"?upsert=true", strings.NewReader(`{"Value":"v1"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upsert create: %d", resp.StatusCode)
+	}
+	resp, _ = testRequest(t, testServer, http.MethodPut, route+"?upsert=true", strings.NewReader(`{"Value":"v2","TTL":"1h"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("upsert update: %d", resp.StatusCode)
+	}
+	resp, body := testRequest(t, testServer, http.MethodGet, route, nil)
+	var v Value
+	json.Unmarshal([]byte(body), &v)
+	if resp.StatusCode != http.StatusOK || v.Value != "v2" || v.Expires == nil {
+		t.Errorf("get after upsert: %d %s", resp.StatusCode, body)
+	}
+
+	resp, _ = testRequest(t, testServer, http.MethodPut, route+"?upsert=x", strings.NewReader(`{"Value":"v3"}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad upsert: %d", resp.StatusCode)
+	}
+
+	missing := KVRoutePrefix + "/upsertmissing"
+	defer testRequest(t, testServer, http.MethodDelete, missing, nil)
+	resp, _ = testRequestHeader(t, testServer, http.MethodPut, missing+"?upsert=true", strings.NewReader(`{"Value":"v1"}`),
+		http.Header{"If-Match": {`"1"`}})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("conditional upsert of missing key: %d", resp.StatusCode)
+	}
+	resp, _ = testRequestHeader(t, testServer, http.MethodPut, missing+"?upsert=true", strings.NewReader(`{"Value":"v1"}`),
+		http.Header{"If-None-Match": {"*"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("conditional upsert create: %d", resp.StatusCode)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	route := KVRoutePrefix + "/patchkey"
+	testRequest(t, testServer, http.MethodPost, route, strings.NewReader(`{"Value":"{\"a\":1,\"b\":{\"c\":[1,2]}}"}`))
+	defer testRequest(t, testServer, http.MethodDelete, route, nil)
+
+	patch := func(contentType, body string, header http.Header) (*http.Response, Value) {
+		t.Helper()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-type", contentType)
+		resp, respBody := testRequestHeader(t, testServer, http.MethodPatch, route, strings.NewReader(body), header)
+		var v Value
+		json.Unmarshal([]byte(respBody), &v)
+		return resp, v
+	}
+
+	resp, v := patch(MergePatchType, `{"a":null,"b":{"d":"x"},"e":true}`, nil)
+	if resp.StatusCode != http.StatusOK || v.Value != `{"b":{"c":[1,2],"d":"x"},"e":true}` || resp.Header.Get("ETag") == "" {
+		t.Errorf("merge patch: %d %s", resp.StatusCode, v.Value)
+	}
+	etag := resp.Header.Get("ETag")
+
+	resp, v = patch(JSONPatchType, `[{"op":"test","path":"/e","value":true},{"op":"add","path":"/b/c/-","value":3},`+
+		`{"op":"move","from":"/b/d","path":"/d"},{"op":"copy","from":"/b/c/0","path":"/b/c/0"},{"op":"remove","path":"/e"},`+
+		`{"op":"replace","path":"/b/c/3","value":"z"}]`, http.Header{"If-Match": {etag}})
+	if resp.StatusCode != http.StatusOK || v.Value != `{"b":{"c":[1,1,2,"z"]},"d":"x"}` {
+		t.Errorf("json patch: %d %s", resp.StatusCode, v.Value)
+	}
+
+	resp, _ = patch(JSONPatchType, `[{"op":"remove","path":"/d"},{"op":"test","path":"/b/c/0","value":2}]`, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("failed test op: %d", resp.StatusCode)
+	}
+	_, body := testRequest(t, testServer, http.MethodGet, route, nil)
+	if !strings.Contains(body, `\"d\":\"x\"`) {
+		t.Errorf("failed patch wrote: %s", body)
+	}
+
+	resp, _ = patch(MergePatchType, `{"a":1}`, http.Header{"If-Match": {etag}})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale patch: %d", resp.StatusCode)
+	}
+	resp, _ = patch("application/json", `{"a":1}`, nil)
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("wrong content type: %d", resp.StatusCode)
+	}
+	resp, _ = patch(JSONPatchType, `[{"op":"frob","path":"/a"}]`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown op: %d", resp.StatusCode)
+	}
+
+	textRoute := KVRoutePrefix + "/patchtext"
+	testRequest(t, testServer, http.MethodPost, textRoute, strings.NewReader(`{"Value":"not json"}`))
+	defer testRequest(t, testServer, http.MethodDelete, textRoute, nil)
+	resp, body = testRequestHeader(t, testServer, http.MethodPatch, textRoute, strings.NewReader(`{"a":1}`),
+		http.Header{"Content-type": {MergePatchType}})
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(body, CodeValueNotJSON) {
+		t.Errorf("patch of text: %d %s", resp.StatusCode, body)
+	}
+
+	resp, _ = testRequestHeader(t, testServer, http.MethodPatch, KVRoutePrefix+"/patchmissing", strings.NewReader(`{"a":1}`),
+		http.Header{"Content-type": {MergePatchType}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("patch of missing key: %d", resp.StatusCode)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	rscsServer.RequireAuth()
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+	admin := http.Header{"Authorization": {"Bearer " + adminBearer}}
+
+	route := KVRoutePrefix + "/audited"
+	testRequestHeader(t, ts, http.MethodPost, route, strings.NewReader(`{"Value":"v1"}`), admin)
+	testRequestHeader(t, ts, http.MethodPut, route, strings.NewReader(`{"Value":"v2"}`), admin)
+	testRequestHeader(t, ts, http.MethodGet, route, nil, admin)
+	testRequestHeader(t, ts, http.MethodPost, route, strings.NewReader(`{"Value":"v3"}`), admin)
+	testRequestHeader(t, ts, http.MethodDelete, route, nil, admin)
+	testRequestHeader(t, ts, http.MethodPost, TxnRoute, strings.NewReader(`{"Ops":[{"Op":"insert","Key":"other","Value":"1"}]}`), admin)
+
+	resp, body := testRequestHeader(t, ts, http.MethodGet, AuditRoute+"?key=audited", nil, admin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("audit: %d %s", resp.StatusCode, body)
+	}
+	var result AuditResult
+	json.Unmarshal([]byte(body), &result)
+	if len(result.Records) != 4 {
+		t.Fatalf("audit records: %s", body)
+	}
+	for i, want := range []struct {
+		method           string
+		status           int
+		oldHash, newHash string
+	}{
+		{http.MethodPost, http.StatusCreated, "", db.HashValue("v1")},
+		{http.MethodPut, http.StatusOK, db.HashValue("v1"), db.HashValue("v2")},
+		{http.MethodPost, http.StatusConflict, db.HashValue("v2"), db.HashValue("v2")},
+		{http.MethodDelete, http.StatusOK, db.HashValue("v2"), ""},
+	} {
+		record := result.Records[i]
+		if record.Method != want.method || record.Status != want.status || record.OldHash != want.oldHash ||
+			record.NewHash != want.newHash || record.Caller != "token:"+adminToken.ID || record.Key != "audited" {
+			t.Errorf("audit record %d: %+v", i, record)
+		}
+	}
+
+	resp, body = testRequestHeader(t, ts, http.MethodGet, AuditRoute, nil, admin)
+	json.Unmarshal([]byte(body), &result)
+	if len(result.Records) != 5 || result.Records[4].Path != TxnRoute || result.Records[4].Key != "" {
+		t.Errorf("audit of txn: %s", body)
+	}
+	since := result.Records[3].Time.Format(time.RFC3339Nano)
+	resp, body = testRequestHeader(t, ts, http.MethodGet, AuditRoute+"?limit=1&since="+since, nil, admin)
+	json.Unmarshal([]byte(body), &result)
+	if len(result.Records) != 1 || result.Records[0].Method != http.MethodDelete {
+		t.Errorf("audit since: %s", body)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, AuditRoute+"?since=yesterday", nil, admin)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad since: %d", resp.StatusCode)
+	}
+
+	dir, dirErr := ioutil.TempDir("", "rscs")
+	if dirErr != nil {
+		t.Fatalf("fail on tmpdir:%s", dirErr.Error())
+	}
+	defer os.RemoveAll(dir)
+	auditFile, openErr := db.OpenAuditFile(filepath.Join(dir, "audit.jsonl"))
+	if openErr != nil {
+		t.Fatalf("open audit file:%s", openErr.Error())
+	}
+	defer auditFile.Close()
+	rscsServer.SetAuditLog(auditFile)
+	readToken, readBearer, _ := db.NewToken(false, []db.Policy{{Permissions: []db.Permission{db.PermRead}}})
+	store.PutToken(readToken)
+	testRequestHeader(t, ts, http.MethodPost, route, strings.NewReader(`{"Value":"v4"}`),
+		http.Header{"Authorization": {"Bearer " + readBearer}})
+	records, _ := auditFile.Audit("", time.Time{}, 10)
+	if len(records) != 1 || records[0].Status != http.StatusForbidden || records[0].Caller != "token:"+readToken.ID {
+		t.Errorf("audit file: %+v", records)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer func(wait, retry time.Duration) {
+		replicationWait, replicationRetry = wait, retry
+	}(replicationWait, replicationRetry)
+	replicationWait, replicationRetry = 200*time.Millisecond, 50*time.Millisecond
+
+	primaryStore := db.NewMemoryStore()
+	primaryServer, _ := NewRscsServer(primaryStore)
+	primaryServer.RequireAuth()
+	primaryRtr, _ := primaryServer.NewRouter()
+	primary := httptest.NewServer(primaryRtr)
+	defer primary.Close()
+	defer primaryServer.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	primaryStore.PutToken(adminToken)
+	admin := http.Header{"Authorization": {"Bearer " + adminBearer}}
+
+	// Keys written before the replica starts come from the snapshot; stale
+	// keys of the replica are removed.
+	testRequestHeader(t, primary, http.MethodPost, KVRoutePrefix+"/before", strings.NewReader(`{"Value":"b"}`), admin)
+	testRequestHeader(t, primary, http.MethodPut, NamespacesRoute+"/team", nil, admin)
+	testRequestHeader(t, primary, http.MethodPost, NamespacesRoute+"/team/kv/key", strings.NewReader(`{"Value":"t"}`), admin)
+	replicaStore := db.NewMemoryStore()
+	replicaDefault, _ := db.Namespace(replicaStore, db.DefaultNamespace)
+	replicaDefault.Insert("stale", "s")
+
+	replicaServer, _ := NewRscsServer(replicaStore)
+	if replicateErr := replicaServer.ReplicateFrom("ftp://primary", "", true); replicateErr == nil {
+		t.Errorf("replicate from ftp url")
+	}
+	replicaServer.ReplicateFrom(primary.URL, adminBearer, true)
+	replicaRtr, _ := replicaServer.NewRouter()
+	replica := httptest.NewServer(replicaRtr)
+	defer replica.Close()
+	go replicaServer.Follow()
+	defer replicaServer.Close()
+
+	eventually := func(path, want string) {
+		t.Helper()
+		var body string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			var resp *http.Response
+			resp, body = testRequest(t, replica, http.MethodGet, path, nil)
+			if want == "" && resp.StatusCode == http.StatusNotFound {
+				return
+			}
+			var v Value
+			if resp.StatusCode == http.StatusOK && json.Unmarshal([]byte(body), &v) == nil && v.Value == want {
+				return
+			}
+		}
+		t.Errorf("replica %s: %s, want '%s'", path, body, want)
+	}
+	eventually(KVRoutePrefix+"/before", "b")
+	eventually(NamespacesRoute+"/team/kv/key", "t")
+	eventually(KVRoutePrefix+"/stale", "")
+	var backup bytes.Buffer
+	primaryStore.Backup(&backup)
+
+	// Later writes, including forwarded ones, come from the change feed.
+	testRequestHeader(t, primary, http.MethodPut, KVRoutePrefix+"/before", strings.NewReader(`{"Value":"b2"}`), admin)
+	eventually(KVRoutePrefix+"/before", "b2")
+	resp, body := testRequestHeader(t, replica, http.MethodPost, KVRoutePrefix+"/forwarded", strings.NewReader(`{"Value":"f"}`), admin)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("forwarded write: %d %s", resp.StatusCode, body)
+	}
+	eventually(KVRoutePrefix+"/forwarded", "f")
+	testRequestHeader(t, primary, http.MethodDelete, KVRoutePrefix+"/before", nil, admin)
+	eventually(KVRoutePrefix+"/before", "")
+	testRequestHeader(t, primary, http.MethodPost, KVRoutePrefix+"/ttl", strings.NewReader(`{"Value":"x","TTL":"1h"}`), admin)
+	eventually(KVRoutePrefix+"/ttl", "x")
+	entry, _, _ := replicaDefault.GetEntry("ttl")
+	if entry.Expires.IsZero() || time.Until(entry.Expires) > time.Hour {
+		t.Errorf("replicated expiry: %v", entry.Expires)
+	}
+
+	resp, body = testRequest(t, replica, http.MethodGet, StatusRoute, nil)
+	var status StatusResult
+	json.Unmarshal([]byte(body), &status)
+	if status.Replication == nil || !status.Replication.Bootstrapped || status.Replication.Primary != primary.URL ||
+		status.Replication.Lag != 0 || status.Replication.Applied == 0 || status.Replication.LastContact == nil {
+		t.Errorf("replica status: %s", body)
+	}
+	resp, body = testRequest(t, primary, http.MethodGet, StatusRoute, nil)
+	if strings.Contains(body, "Replication") {
+		t.Errorf("primary status: %s", body)
+	}
+
+	// Restoring the primary to an earlier index makes the replica bootstrap
+	// again from it.
+	restoreErr := primaryStore.Restore(&backup)
+	if restoreErr != nil {
+		t.Fatalf("restore primary: %s", restoreErr.Error())
+	}
+	eventually(KVRoutePrefix+"/before", "b")
+	eventually(KVRoutePrefix+"/forwarded", "")
+	eventually(KVRoutePrefix+"/ttl", "")
+	testRequestHeader(t, primary, http.MethodPost, KVRoutePrefix+"/restored", strings.NewReader(`{"Value":"r"}`), admin)
+	eventually(KVRoutePrefix+"/restored", "r")
+
+	// The feed needs an admin token.
+	resp, _ = testRequest(t, primary, http.MethodGet, ReplicationChangesRoute+"?index=0", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("changes without token: %d", resp.StatusCode)
+	}
+
+	rejecting, _ := NewRscsServer(db.NewMemoryStore())
+	rejecting.ReplicateFrom(primary.URL, adminBearer, false)
+	rejectingRtr, _ := rejecting.NewRouter()
+	rejectingTS := httptest.NewServer(rejectingRtr)
+	defer rejectingTS.Close()
+	resp, body = testRequest(t, rejectingTS, http.MethodPost, KVRoutePrefix+"/rejected", strings.NewReader(`{"Value":"r"}`))
+	var errResult ErrorResult
+	json.Unmarshal([]byte(body), &errResult)
+	if resp.StatusCode != http.StatusForbidden || errResult.Code != CodeReadOnlyReplica {
+		t.Errorf("rejected write: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestConsulKV(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	rscsServer.RequireAuth()
+	rscsServer.EnableConsulKV()
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+	defer rscsServer.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+	admin := http.Header{ConsulTokenHeader: {adminBearer}}
+
+	for key, value := range map[string]string{"app/db/host": "h", "app/db/port": "5432", "app/name": "rscs", "other": ""} {
+		resp, body := testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/"+key, strings.NewReader(value), admin)
+		if resp.StatusCode != http.StatusOK || body != "true" {
+			t.Fatalf("put %s: %d %s", key, resp.StatusCode, body)
+		}
+	}
+
+	resp, body := testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/db/port", nil, admin)
+	var entries []ConsulEntry
+	json.Unmarshal([]byte(body), &entries)
+	if resp.StatusCode != http.StatusOK || len(entries) != 1 || string(entries[0].Value) != "5432" ||
+		entries[0].ModifyIndex == 0 || resp.Header.Get(ConsulIndexHeader) == "" || !strings.Contains(body, `"Value":"NTQzMg=="`) {
+		t.Errorf("get: %d %s", resp.StatusCode, body)
+	}
+	modifyIndex := entries[0].ModifyIndex
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/db/port?raw", nil, admin)
+	if body != "5432" {
+		t.Errorf("raw: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/other", nil, admin)
+	if !strings.Contains(body, `"Value":null`) {
+		t.Errorf("empty value: %s", body)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/missing", nil, admin)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing: %d", resp.StatusCode)
+	}
+	resp, _ = testRequest(t, ts, http.MethodGet, KVRoutePrefix+"/app/name", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no token: %d", resp.StatusCode)
+	}
+	resp, _ = testRequest(t, ts, http.MethodGet, KVRoutePrefix+"/app/name?token="+adminBearer, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("token parameter: %d", resp.StatusCode)
+	}
+
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/?recurse", nil, admin)
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 3 || entries[0].Key != "app/db/host" || entries[2].Key != "app/name" {
+		t.Errorf("recurse: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/?keys", nil, admin)
+	if body != `["app/db/host","app/db/port","app/name","other"]` {
+		t.Errorf("keys: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/?keys&separator=/", nil, admin)
+	if body != `["app/db/","app/name"]` {
+		t.Errorf("keys with separator: %s", body)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/nothing/?recurse", nil, admin)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("recurse of nothing: %d", resp.StatusCode)
+	}
+
+	resp, body = testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/app/name?cas=0", strings.NewReader("x"), admin)
+	if body != "false" {
+		t.Errorf("cas=0 of existing key: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodPut, fmt.Sprintf("%s/app/db/port?cas=%d", KVRoutePrefix, modifyIndex+100), strings.NewReader("1"), admin)
+	if body != "false" {
+		t.Errorf("cas of wrong index: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodPut, fmt.Sprintf("%s/app/db/port?cas=%d", KVRoutePrefix, modifyIndex), strings.NewReader("6543"), admin)
+	if body != "true" {
+		t.Errorf("cas: %s", body)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/app/lock?acquire=session", strings.NewReader("x"), admin)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("acquire: %d", resp.StatusCode)
+	}
+
+	// A blocking query returns once a key below the prefix changes.
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/?recurse", nil, admin)
+	index := resp.Header.Get(ConsulIndexHeader)
+	done := make(chan string)
+	go func() {
+		_, body := testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/app/?recurse&wait=5s&index="+index, nil, admin)
+		done <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+	testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/unrelated", strings.NewReader("u"), admin)
+	testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/app/new", strings.NewReader("n"), admin)
+	select {
+	case body = <-done:
+		if !strings.Contains(body, `"Key":"app/new"`) {
+			t.Errorf("blocking query: %s", body)
+		}
+	case <-time.After(4 * time.Second):
+		t.Errorf("blocking query did not return")
+	}
+
+	resp, body = testRequestHeader(t, ts, http.MethodDelete, KVRoutePrefix+"/app/db?recurse", nil, admin)
+	if body != "true" {
+		t.Errorf("recursive delete: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/?keys", nil, admin)
+	if body != `["app/name","app/new","other","unrelated"]` {
+		t.Errorf("keys after delete: %s", body)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodDelete, fmt.Sprintf("%s/other?cas=%d", KVRoutePrefix, modifyIndex+100), nil, admin)
+	if body != "false" {
+		t.Errorf("delete with wrong cas: %s", body)
+	}
+
+	// The native routes of the default namespace are still there.
+	resp, body = testRequestHeader(t, ts, http.MethodGet, NamespacesRoute+"/"+db.DefaultNamespace+"/kv/other", nil,
+		http.Header{"Authorization": {"Bearer " + adminBearer}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"Value":""`) {
+		t.Errorf("native get: %d %s", resp.StatusCode, body)
+	}
+
+	// Deleting every key takes an admin token, even one that may delete
+	// them all.
+	deleterToken, deleterBearer, _ := db.NewToken(false, []db.Policy{{Permissions: []db.Permission{db.PermDelete}}})
+	store.PutToken(deleterToken)
+	resp, _ = testRequestHeader(t, ts, http.MethodDelete, KVRoutePrefix+"/?recurse", nil, http.Header{ConsulTokenHeader: {deleterBearer}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete of every key without admin: %d", resp.StatusCode)
+	}
+	resp, body = testRequestHeader(t, ts, http.MethodDelete, KVRoutePrefix+"/?recurse", nil, admin)
+	if body != "true" {
+		t.Errorf("delete of every key: %s", body)
+	}
+	resp, _ = testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/?keys", nil, admin)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("keys after deleting every key: %d", resp.StatusCode)
+	}
+}
+
+// readRESP reads one RESP reply and renders it as a string: simple strings
+// and bulk strings as themselves, errors with their '-', integers with their
+// ':', null as "(nil)" and arrays as "[a b]".
+func readRESP(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, readErr := r.ReadString('\n')
+	if readErr != nil {
+		t.Fatalf("read reply: %s", readErr.Error())
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-', ':':
+		return line
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, size+2)
+		io.ReadFull(r, buf)
+		return string(buf[:size])
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		elems := make([]string, count)
+		for i := range elems {
+			elems[i] = readRESP(t, r)
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	}
+	t.Fatalf("bad reply: %s", line)
+	return ""
+}
+
+func TestRESP(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	rscsServer.RequireAuth()
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+	readToken, readBearer, _ := db.NewToken(false, []db.Policy{{Namespace: db.DefaultNamespace, Prefix: "", Permissions: []db.Permission{db.PermRead}}})
+	store.PutToken(readToken)
+
+	l, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("listen: %s", listenErr.Error())
+	}
+	go rscsServer.ServeRESP(l)
+	defer l.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, dialErr := net.Dial("tcp", l.Addr().String())
+		if dialErr != nil {
+			t.Fatalf("dial: %s", dialErr.Error())
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	conn, reader := dial()
+	defer conn.Close()
+	do := func(args ...string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		conn.Write(buf.Bytes())
+		return readRESP(t, reader)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "k"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid bearer token"},
+		{[]string{"AUTH", "default", adminBearer}, "OK"},
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SELECT", "1"}, "-ERR DB index is out of range"},
+		{[]string{"NOPE"}, "-ERR unknown command 'NOPE'"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"SET", "user:1", "ann"}, "OK"},
+		{[]string{"SET", "user:1", "bob", "NX"}, "(nil)"},
+		{[]string{"SET", "user:2", "cat", "XX"}, "(nil)"},
+		{[]string{"SET", "user:2", "cat", "NX", "EX", "100"}, "OK"},
+		{[]string{"SET", "user:2", "cat", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "user:2", "cat", "NX", "XX"}, "-ERR syntax error"},
+		{[]string{"get", "user:1"}, "ann"},
+		{[]string{"GET", "user:3"}, "(nil)"},
+		{[]string{"MSET", "user:3", "dan", "count", "41", "user:3", "eve"}, "OK"},
+		{[]string{"MSET", "user:4"}, "-ERR wrong number of arguments for 'mset' command"},
+		{[]string{"MGET", "user:1", "nope", "user:3"}, "[ann (nil) eve]"},
+		{[]string{"EXISTS", "user:1", "nope", "user:1"}, ":2"},
+		{[]string{"INCR", "count"}, ":42"},
+		{[]string{"INCR", "fresh"}, ":1"},
+		{[]string{"INCR", "user:1"}, "-ERR value is not an integer or out of range"},
+		{[]string{"KEYS", "user:*"}, "[user:1 user:2 user:3]"},
+		{[]string{"KEYS", "user:[^2]"}, "[user:1 user:3]"},
+		{[]string{"KEYS", "*ou?t"}, "[count]"},
+		{[]string{"SCAN", "0", "MATCH", "user:*", "COUNT", "100"}, "[0 [user:1 user:2 user:3]]"},
+		{[]string{"DEL", "user:3", "nope", "fresh"}, ":2"},
+		{[]string{"SET", "dup", "x"}, "OK"},
+		{[]string{"DEL", "dup", "dup"}, ":1"},
+		{[]string{"DEL", "user:2", "\x1fx"}, "-ERR access '\x1fx': key is reserved"},
+		{[]string{"EXISTS", "user:2"}, ":1"},
+	} {
+		if got := do(c.args...); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.args, got, c.want)
+		}
+	}
+
+	// SCAN pages through every key.
+	var scanned []string
+	cursor := "0"
+	for i := 0; i < 10; i++ {
+		reply := do("SCAN", cursor, "COUNT", "2")
+		fields := strings.SplitN(strings.Trim(reply, "[]"), " ", 2)
+		cursor = fields[0]
+		if keys := strings.Trim(fields[1], "[]"); keys != "" {
+			scanned = append(scanned, strings.Fields(keys)...)
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(scanned, ",") != "count,user:1,user:2" {
+		t.Errorf("scan: %v", scanned)
+	}
+
+	// Pipelined commands are all answered.
+	conn.Write([]byte("PING\r\n*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n"))
+	if first, second := readRESP(t, reader), readRESP(t, reader); first != "PONG" || second != "ann" {
+		t.Errorf("pipelined: %s %s", first, second)
+	}
+
+	// The HTTP routes see writes made over RESP, and the reverse.
+	header := http.Header{"Authorization": {"Bearer " + adminBearer}}
+	_, body := testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/user:2", nil, header)
+	if !strings.Contains(body, `"Value":"cat"`) || !strings.Contains(body, `"Expires"`) {
+		t.Errorf("http get of resp write: %s", body)
+	}
+	testRequestHeader(t, ts, http.MethodPut, KVRoutePrefix+"/user:1", strings.NewReader(`{"Value":"ann2"}`), header)
+	if got := do("GET", "user:1"); got != "ann2" {
+		t.Errorf("resp get of http write: %s", got)
+	}
+
+	readConn, readReader := dial()
+	defer readConn.Close()
+	readConn.Write([]byte(fmt.Sprintf("AUTH %s\r\nGET user:1\r\nSET user:1 x\r\n", readBearer)))
+	for _, want := range []string{"OK", "ann2", "-NOPERM token may not write 'user:1' in namespace 'default'"} {
+		if got := readRESP(t, readReader); got != want {
+			t.Errorf("read token: got %s, want %s", got, want)
+		}
+	}
+
+	records, _ := store.Audit("user:1", time.Time{}, 100)
+	if len(records) != 5 || records[0].Method != "SET" || records[0].Path != RESPAuditPath ||
+		records[0].Caller != "token:"+adminToken.ID || records[2].Status != http.StatusBadRequest ||
+		records[4].Caller != "token:"+readToken.ID || records[4].Status != http.StatusForbidden {
+		t.Errorf("audit of resp writes: %+v", records)
+	}
+
+	if got := do("QUIT"); got != "OK" {
+		t.Errorf("quit: %s", got)
+	}
+}
+
+func TestRESPLimits(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	rscsServer.RequireAuth()
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+
+	l, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("listen: %s", listenErr.Error())
+	}
+	go rscsServer.ServeRESP(l)
+	defer l.Close()
+
+	for _, c := range []struct {
+		name, auth, send string
+	}{
+		{"arguments before auth", "", "*4\r\n"},
+		{"argument size before auth", "", "*2\r\n$4\r\nAUTH\r\n$2000\r\n"},
+		{"arguments", adminBearer, fmt.Sprintf("*%d\r\n", respMaxArgs+1)},
+		{"argument size", adminBearer, fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n", respMaxBulk+1)},
+		{"line length", adminBearer, strings.Repeat("a", respMaxLine+1)},
+	} {
+		conn, dialErr := net.Dial("tcp", l.Addr().String())
+		if dialErr != nil {
+			t.Fatalf("dial: %s", dialErr.Error())
+		}
+		reader := bufio.NewReader(conn)
+		if c.auth != "" {
+			fmt.Fprintf(conn, "AUTH %s\r\n", c.auth)
+			if got := readRESP(t, reader); got != "OK" {
+				t.Fatalf("%s: auth: %s", c.name, got)
+			}
+		}
+		conn.Write([]byte(c.send))
+		if got := readRESP(t, reader); got != "-ERR Protocol error" {
+			t.Errorf("%s: got %s", c.name, got)
+		}
+		conn.Close()
+	}
+
+	// Arguments up to the limit are read, however they arrive.
+	conn, dialErr := net.Dial("tcp", l.Addr().String())
+	if dialErr != nil {
+		t.Fatalf("dial: %s", dialErr.Error())
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "AUTH %s\r\n", adminBearer)
+	readRESP(t, reader)
+	value := strings.Repeat("v", respMaxBulk)
+	fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$3\r\nbig\r\n$%d\r\n", len(value))
+	for i := 0; i < len(value); i += 100000 {
+		end := i + 100000
+		if end > len(value) {
+			end = len(value)
+		}
+		conn.Write([]byte(value[i:end]))
+	}
+	conn.Write([]byte("\r\n"))
+	if got := readRESP(t, reader); got != "OK" {
+		t.Errorf("set of largest value: %s", got)
+	}
+}
+
+func TestRESPGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "a/b", true},
+		{"a*", "abc", true},
+		{"a*c", "abbc", true},
+		{"a*c", "abcd", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+		{"", "", true},
+		{"", "a", false},
+		{"*a*b", "xaxxb", true},
+		{"a*", "", false},
+		{"**", "", true},
+		{"*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 200), false},
+	} {
+		if got := respGlob(c.pattern, c.key); got != c.want {
+			t.Errorf("respGlob(%q, %q) = %v", c.pattern, c.key, got)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	store := db.NewMemoryStore()
+	rscsServer, _ := NewRscsServer(store)
+	rscsServer.RequireAuth()
+	rtr, _ := rscsServer.NewRouter()
+	ts := httptest.NewServer(rtr)
+	defer ts.Close()
+	defer rscsServer.Close()
+
+	adminToken, adminBearer, _ := db.NewToken(true, nil)
+	store.PutToken(adminToken)
+	readToken, readBearer, _ := db.NewToken(false, []db.Policy{{Namespace: db.DefaultNamespace, Prefix: "", Permissions: []db.Permission{db.PermRead}}})
+	store.PutToken(readToken)
+
+	l := bufconn.Listen(1 << 20)
+	grpcServer := rscsServer.NewGRPCServer(nil)
+	go grpcServer.Serve(l)
+	defer grpcServer.Stop()
+
+	conn, dialErr := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if dialErr != nil {
+		t.Fatalf("dial: %s", dialErr.Error())
+	}
+	defer conn.Close()
+	client := rpc.NewKVClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+adminBearer)
+	readCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+readBearer)
+	wantCode := func(what string, err error, code codes.Code) {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Errorf("%s: got %v, want %s", what, err, code)
+		}
+	}
+
+	_, getErr := client.Get(context.Background(), &rpc.GetRequest{Key: "k"})
+	wantCode("get without token", getErr, codes.Unauthenticated)
+	_, getErr = client.Get(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong"), &rpc.GetRequest{Key: "k"})
+	wantCode("get with bad token", getErr, codes.Unauthenticated)
+	_, getErr = client.Get(ctx, &rpc.GetRequest{Key: "k"})
+	wantCode("get of missing key", getErr, codes.NotFound)
+	_, getErr = client.Get(ctx, &rpc.GetRequest{Namespace: "nope", Key: "k"})
+	wantCode("get in missing namespace", getErr, codes.NotFound)
+
+	// A token without rights in a namespace cannot tell whether it exists.
+	db.CreateNamespace(store, "team")
+	for _, namespace := range []string{"team", "nope"} {
+		_, getErr = client.Get(readCtx, &rpc.GetRequest{Namespace: namespace, Key: "k"})
+		wantCode("get in namespace "+namespace+" with read token", getErr, codes.PermissionDenied)
+		_, listErr := client.List(readCtx, &rpc.ListRequest{Namespace: namespace})
+		wantCode("list in namespace "+namespace+" with read token", listErr, codes.PermissionDenied)
+		_, txnErr := client.Txn(readCtx, &rpc.TxnRequest{Namespace: namespace, Ops: []*rpc.Op{{Type: rpc.Op_GET, Key: "k"}}})
+		wantCode("txn in namespace "+namespace+" with read token", txnErr, codes.PermissionDenied)
+	}
+
+	// Watch from the start, as the stream may begin after the writes below.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+	var start int64
+	watch, watchErr := client.Watch(watchCtx, &rpc.WatchRequest{Prefix: "user:", Index: &start})
+	if watchErr != nil {
+		t.Fatalf("watch: %s", watchErr.Error())
+	}
+
+	putResp, putErr := client.Put(ctx, &rpc.PutRequest{Key: "user:1", Value: "ann"})
+	if putErr != nil || !putResp.Created {
+		t.Fatalf("put: %v %v", putResp, putErr)
+	}
+	putResp, putErr = client.Put(ctx, &rpc.PutRequest{Key: "user:2", Value: "bob", Ttl: durationpb.New(time.Hour)})
+	if putErr != nil || !putResp.Created {
+		t.Fatalf("put with ttl: %v %v", putResp, putErr)
+	}
+	_, putErr = client.Put(ctx, &rpc.PutRequest{Key: "user:2", Value: "bob", Ttl: durationpb.New(-time.Hour)})
+	wantCode("put with negative ttl", putErr, codes.InvalidArgument)
+	_, putErr = client.Put(ctx, &rpc.PutRequest{Key: "", Value: "x"})
+	wantCode("put of empty key", putErr, codes.InvalidArgument)
+
+	getResp, getErr := client.Get(ctx, &rpc.GetRequest{Key: "user:2"})
+	if getErr != nil || getResp.Entry.Value != "bob" || getResp.Entry.Expires == nil {
+		t.Fatalf("get: %v %v", getResp, getErr)
+	}
+	index := getResp.Entry.Index
+	stale := index - 1
+	_, putErr = client.Put(ctx, &rpc.PutRequest{Key: "user:2", Value: "cat", ExpectedIndex: &stale})
+	wantCode("put with stale index", putErr, codes.FailedPrecondition)
+	putResp, putErr = client.Put(ctx, &rpc.PutRequest{Key: "user:2", Value: "cat", ExpectedIndex: &index})
+	if putErr != nil || putResp.Created {
+		t.Errorf("put with index: %v %v", putResp, putErr)
+	}
+
+	_, putErr = client.Put(readCtx, &rpc.PutRequest{Key: "user:1", Value: "x"})
+	wantCode("put with read token", putErr, codes.PermissionDenied)
+	if getResp, getErr = client.Get(readCtx, &rpc.GetRequest{Key: "user:1"}); getErr != nil || getResp.Entry.Value != "ann" {
+		t.Errorf("get with read token: %v %v", getResp, getErr)
+	}
+
+	client.Put(ctx, &rpc.PutRequest{Key: "user:3", Value: "dan"})
+	listResp, listErr := client.List(ctx, &rpc.ListRequest{Prefix: "user:", Limit: 2, Values: true})
+	if listErr != nil || len(listResp.Entries) != 2 || listResp.Entries[1].Value != "cat" || listResp.Next != "user:2" {
+		t.Fatalf("list: %v %v", listResp, listErr)
+	}
+	listResp, listErr = client.List(ctx, &rpc.ListRequest{Prefix: "user:", After: listResp.Next})
+	if listErr != nil || len(listResp.Entries) != 1 || listResp.Entries[0].Key != "user:3" ||
+		listResp.Entries[0].Value != "" || listResp.Next != "" {
+		t.Errorf("list after: %v %v", listResp, listErr)
+	}
+
+	txnResp, txnErr := client.Txn(ctx, &rpc.TxnRequest{Ops: []*rpc.Op{
+		{Type: rpc.Op_CHECK, Key: "user:4"},
+		{Type: rpc.Op_INSERT, Key: "user:4", Value: "eve"},
+		{Type: rpc.Op_DELETE, Key: "user:3"},
+		{Type: rpc.Op_GET, Key: "user:1"},
+	}})
+	if txnErr != nil || !txnResp.Committed || len(txnResp.Results) != 4 || !txnResp.Results[1].Found ||
+		txnResp.Results[2].Found || txnResp.Results[3].Value != "ann" {
+		t.Fatalf("txn: %v %v", txnResp, txnErr)
+	}
+	txnResp, txnErr = client.Txn(ctx, &rpc.TxnRequest{Ops: []*rpc.Op{
+		{Type: rpc.Op_UPDATE, Key: "user:1", Value: "ann2"},
+		{Type: rpc.Op_INSERT, Key: "user:4", Value: "fay"},
+	}})
+	if txnErr != nil || txnResp.Committed || txnResp.FailedOp != 1 || txnResp.Error == "" {
+		t.Errorf("failed txn: %v %v", txnResp, txnErr)
+	}
+	_, txnErr = client.Txn(ctx, &rpc.TxnRequest{Ops: []*rpc.Op{{Key: "user:1"}}})
+	wantCode("txn with no op type", txnErr, codes.InvalidArgument)
+	_, txnErr = client.Txn(readCtx, &rpc.TxnRequest{Ops: []*rpc.Op{{Type: rpc.Op_DELETE, Key: "user:1"}}})
+	wantCode("txn with read token", txnErr, codes.PermissionDenied)
+
+	_, deleteErr := client.Delete(ctx, &rpc.DeleteRequest{Key: "user:3"})
+	wantCode("delete of missing key", deleteErr, codes.NotFound)
+	_, deleteErr = client.Delete(ctx, &rpc.DeleteRequest{Key: "user:4", ExpectedIndex: &stale})
+	wantCode("delete with stale index", deleteErr, codes.FailedPrecondition)
+	if _, deleteErr = client.Delete(ctx, &rpc.DeleteRequest{Key: "user:4"}); deleteErr != nil {
+		t.Errorf("delete: %s", deleteErr.Error())
+	}
+
+	// The watch saw every change, in order.
+	var events []string
+	for _, want := range []string{"user:1", "user:2", "user:2", "user:3", "user:4", "user:3", "user:4"} {
+		event, recvErr := watch.Recv()
+		if recvErr != nil {
+			t.Fatalf("watch recv: %s", recvErr.Error())
+		}
+		if event.Key != want {
+			t.Errorf("watch: got %s, want %s", event.Key, want)
+		}
+		events = append(events, fmt.Sprintf("%s:%v", event.Value, event.Deleted))
+	}
+	if strings.Join(events, ",") != "ann:false,bob:false,cat:false,dan:false,eve:false,:true,:true" {
+		t.Errorf("watch events: %v", events)
+	}
+
+	// The HTTP routes see writes made over gRPC.
+	header := http.Header{"Authorization": {"Bearer " + adminBearer}}
+	_, body := testRequestHeader(t, ts, http.MethodGet, KVRoutePrefix+"/user:2", nil, header)
+	if !strings.Contains(body, `"Value":"cat"`) {
+		t.Errorf("http get of grpc write: %s", body)
+	}
 }
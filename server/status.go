@@ -5,27 +5,75 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/bradclawsie/rscs/db"
 )
 
-// StatusResult describes the system status.
+// StatusResult describes the system status, including the size of each
+// namespace and, on a replica, how far behind its primary it is.
 type StatusResult struct {
-	Alive  bool
-	DBFile string
-	Uptime string
+	Alive       bool
+	DBFile      string
+	Uptime      string
+	Namespaces  map[string]db.NamespaceStats
+	Replication *ReplicationStatus `json:",omitempty"`
 }
 
-// Status returns the system status as JSON.
+// Status returns the system status as JSON. With auth required, only the
+// namespaces whose every key the token may read are described.
 func (s *RscsServer) Status(w http.ResponseWriter, r *http.Request) {
 	uptime := fmt.Sprintf("%v", time.Since(s.start))
-	jsonBytes, jsonErr := json.Marshal(StatusResult{
-		Alive:  true,
-		DBFile: s.rscsDB.DBFileName(),
-		Uptime: uptime})
+
+	names, listErr := db.ListNamespaces(s.rscsDB)
+	if listErr != nil {
+		writeError(w, listErr)
+		return
+	}
+	names = s.readableNamespaces(r, names)
+	stats, statsErr := s.namespaceStats(names)
+	if statsErr != nil {
+		writeError(w, statsErr)
+		return
+	}
+	namespaces := make(map[string]db.NamespaceStats, len(names))
+	for i, name := range names {
+		namespaces[name] = stats[i]
+	}
+
+	result := StatusResult{
+		Alive:      true,
+		DBFile:     s.rscsDB.DBFileName(),
+		Uptime:     uptime,
+		Namespaces: namespaces}
+	if s.replica != nil {
+		result.Replication = s.replica.status()
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
 	if jsonErr != nil {
-		http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		writeError(w, jsonErr)
 		return
 	}
 	w.Header().Set("Content-type", "application/json")
 	w.Write(jsonBytes)
 	return
 }
+
+// namespaceStats returns the stats of each of the named namespaces, as
+// reported by both Status and Metrics. The stores count them without
+// reading every key.
+func (s *RscsServer) namespaceStats(names []string) ([]db.NamespaceStats, error) {
+	stats := make([]db.NamespaceStats, len(names))
+	for i, name := range names {
+		store, nsErr := db.Namespace(s.rscsDB, name)
+		if nsErr != nil {
+			return nil, nsErr
+		}
+		var statsErr error
+		stats[i], statsErr = db.Stats(store)
+		if statsErr != nil {
+			return nil, statsErr
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsCheckInterval is how often the files named by TLSFiles are checked
+// for changes, at most.
+var tlsCheckInterval = time.Second
+
+// TLSFiles names the PEM files the daemon serves HTTPS with. If ClientCAFile
+// is set, every client must present a certificate signed by one of the CAs
+// in it.
+type TLSFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// tlsReloader hands out a tls.Config built from a TLSFiles, rebuilding it
+// when any of the files change so certificates can be renewed without a
+// restart.
+type tlsReloader struct {
+	files   TLSFiles
+	mu      sync.Mutex
+	checked time.Time
+	stamps  []string
+	config  *tls.Config
+}
+
+// NewTLSConfig returns the tls.Config of an HTTPS server using files. The
+// files are read again whenever they change. A change that cannot be loaded
+// is logged and the previous certificates are kept.
+func NewTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("a certificate and a key are required")
+	}
+	l := &tlsReloader{files: files}
+	stamps, statErr := l.stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+	loadErr := l.load(stamps)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	l.checked = time.Now()
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetConfigForClient: l.getConfig}, nil
+}
+
+// stat describes the current version of each file, so changes are noticed.
+func (l *tlsReloader) stat() ([]string, error) {
+	var stamps []string
+	for _, name := range []string{l.files.CertFile, l.files.KeyFile, l.files.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, statErr := os.Stat(name)
+		if statErr != nil {
+			return nil, statErr
+		}
+		stamps = append(stamps, fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return stamps, nil
+}
+
+// load builds the config from the files, recording stamps as their version.
+func (l *tlsReloader) load(stamps []string) error {
+	cert, certErr := tls.LoadX509KeyPair(l.files.CertFile, l.files.KeyFile)
+	if certErr != nil {
+		return certErr
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if l.files.ClientCAFile != "" {
+		caBytes, readErr := ioutil.ReadFile(l.files.ClientCAFile)
+		if readErr != nil {
+			return readErr
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in '%s'", l.files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	l.config, l.stamps = config, stamps
+	return nil
+}
+
+// getConfig returns the config for a new connection, first reloading the
+// files if they have changed since last checked.
+func (l *tlsReloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) < tlsCheckInterval {
+		return l.config, nil
+	}
+	l.checked = time.Now()
+	stamps, statErr := l.stat()
+	if statErr != nil {
+		log.Printf("tls: %s", statErr.Error())
+		return l.config, nil
+	}
+	if fmt.Sprint(stamps) == fmt.Sprint(l.stamps) {
+		return l.config, nil
+	}
+	loadErr := l.load(stamps)
+	if loadErr != nil {
+		// Wait for the files to change again before retrying.
+		l.stamps = stamps
+		log.Printf("tls: keeping previous certificates: %s", loadErr.Error())
+		return l.config, nil
+	}
+	log.Printf("tls: reloaded certificates")
+	return l.config, nil
+}
+
+// ClientSubject returns the subject of the verified client certificate the
+// request was made with, or the empty string if there is none. Handlers use
+// it to identify the caller.
+func ClientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
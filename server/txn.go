@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// TxnRoute is the route for atomic multi-key transactions.
+	TxnRoute = "/v1/txn"
+	// MaxTxnOps is the most operations a single transaction may contain.
+	MaxTxnOps = 64
+)
+
+// TxnOp is one operation in a TxnRequest. Op is one of get, insert, update,
+// delete or check. Value is required for insert and update, and TTL may make
+// the written key expire. A nonzero Index makes an update or delete
+// conditional on the key's modification index; for a check it is the index
+// the key must have, where zero means the key must not exist.
+type TxnOp struct {
+	Op    string
+	Key   string
+	Value *string `json:",omitempty"`
+	TTL   string  `json:",omitempty"`
+	Index int64   `json:",omitempty"`
+}
+
+// TxnRequest is the body of a transaction.
+type TxnRequest struct {
+	Ops []TxnOp
+}
+
+// TxnOpResult describes the key as one op left it. Value is set when the key
+// exists after the op, and Index is its modification index, or that of the
+// delete for a delete.
+type TxnOpResult struct {
+	Op      string
+	Key     string
+	Found   bool
+	Value   *string    `json:",omitempty"`
+	Index   int64      `json:",omitempty"`
+	Expires *time.Time `json:",omitempty"`
+}
+
+// TxnResult is the response to a transaction. If it committed, Results has
+// one entry per op. Otherwise nothing was written, Code is CodeTxnFailed and
+// FailedOp and Error say which op could not be applied and why.
+type TxnResult struct {
+	Results  []TxnOpResult `json:",omitempty"`
+	Code     string        `json:",omitempty"`
+	FailedOp *int          `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+// Txn runs the posted operations inside a single database transaction. A
+// transaction that cannot be applied is answered with 409 and no writes.
+func (s *RscsServer) Txn(w http.ResponseWriter, r *http.Request) {
+	body, bodyErr := ioutil.ReadAll(r.Body)
+	if bodyErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "cannot read body")
+		return
+	}
+
+	var txnReq TxnRequest
+	umErr := json.Unmarshal(body, &txnReq)
+	if umErr != nil || len(txnReq.Ops) == 0 {
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "Txn JSON malformed")
+		return
+	}
+	if len(txnReq.Ops) > MaxTxnOps {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", fmt.Sprintf("more than %d ops", MaxTxnOps))
+		return
+	}
+
+	ops := make([]db.Op, len(txnReq.Ops))
+	writes := false
+	for i, txnOp := range txnReq.Ops {
+		op, opErr := txnOp.toOp()
+		if opErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, txnReq.Ops[i].Key, fmt.Sprintf("op %d: %s", i, opErr.Error()))
+			return
+		}
+		ops[i] = op
+		writes = writes || (op.Type != db.OpGet && op.Type != db.OpCheck)
+	}
+	for _, op := range ops {
+		if !s.authorize(w, r, opPermission(op.Type), op.Key) {
+			return
+		}
+	}
+
+	var result TxnResult
+	status := http.StatusOK
+	opResults, txnErr := s.store(r).Txn(ops)
+	if txnErr != nil {
+		failed, ok := txnErr.(*db.TxnError)
+		if !ok {
+			writeError(w, txnErr)
+			return
+		}
+		result.Code = CodeTxnFailed
+		result.FailedOp = &failed.Op
+		result.Error = failed.Reason
+		status = http.StatusConflict
+	} else {
+		result.Results = make([]TxnOpResult, len(opResults))
+		for i, opResult := range opResults {
+			result.Results[i] = newTxnOpResult(opResult)
+		}
+		if writes {
+			s.watch.notify()
+		}
+	}
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		writeError(w, jsonErr)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+	return
+}
+
+// toOp validates a TxnOp and converts it for the db.
+func (t TxnOp) toOp() (db.Op, error) {
+	op := db.Op{Type: db.OpType(t.Op), Key: t.Key, Index: t.Index}
+	switch op.Type {
+	case db.OpGet, db.OpDelete, db.OpCheck:
+	case db.OpInsert, db.OpUpdate:
+		if t.Value == nil {
+			return op, fmt.Errorf("%s needs a Value", t.Op)
+		}
+		op.Value = *t.Value
+		ttl, ttlErr := valueVerify{TTL: nilIfEmpty(t.TTL)}.ttl()
+		if ttlErr != nil {
+			return op, ttlErr
+		}
+		op.TTL = ttl
+	default:
+		return op, fmt.Errorf("unknown op '%s'", t.Op)
+	}
+	if t.Key == "" {
+		return op, fmt.Errorf("%s needs a Key", t.Op)
+	}
+	return op, nil
+}
+
+// opPermission is the permission a token needs to run an op of type opType.
+func opPermission(opType db.OpType) db.Permission {
+	switch opType {
+	case db.OpInsert, db.OpUpdate:
+		return db.PermWrite
+	case db.OpDelete:
+		return db.PermDelete
+	}
+	return db.PermRead
+}
+
+// nilIfEmpty returns nil for an empty string, or a pointer to it.
+func nilIfEmpty(str string) *string {
+	if str == "" {
+		return nil
+	}
+	return &str
+}
+
+// newTxnOpResult converts an op result from the db.
+func newTxnOpResult(opResult db.OpResult) TxnOpResult {
+	result := TxnOpResult{Op: string(opResult.Type), Key: opResult.Key,
+		Found: opResult.Found, Index: opResult.Index}
+	if opResult.Found {
+		value := opResult.Value
+		result.Value = &value
+	}
+	if !opResult.Expires.IsZero() {
+		expires := opResult.Expires
+		result.Expires = &expires
+	}
+	return result
+}
@@ -2,48 +2,97 @@ package server
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
-// Update changes the value of an existing key/value pair.
+// Update changes the value of an existing key/value pair. The key expires
+// if a TTL is given and otherwise no longer expires. With upsert=true a
+// missing key is created instead, and answered with 201. If-Match and
+// If-None-Match are honoured against the row's modification index.
 func (s *RscsServer) Update(w http.ResponseWriter, r *http.Request) {
 	key, keyErr := extractKeyContext(r)
 	if keyErr != nil {
-		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+		writeError(w, keyErr)
 		return
 	}
 
+	var upsert bool
+	if upsertStr := r.URL.Query().Get("upsert"); upsertStr != "" {
+		var upsertErr error
+		upsert, upsertErr = strconv.ParseBool(upsertStr)
+		if upsertErr != nil {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "upsert must be a boolean")
+			return
+		}
+	}
+
 	body, bodyErr := ioutil.ReadAll(r.Body)
 	if bodyErr != nil {
-		http.Error(w, "cannot read body", http.StatusBadRequest)
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "cannot read body")
 		return
 	}
 
 	var v valueVerify
 	umErr := json.Unmarshal(body, &v)
 	if umErr != nil || v.Value == nil {
-		http.Error(w, "Value JSON malformed", http.StatusBadRequest)
+		writeErrorCode(w, http.StatusBadRequest, CodeMalformedRequest, "", "Value JSON malformed")
+		return
+	}
+	ttl, ttlErr := v.ttl()
+	if ttlErr != nil {
+		writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, key, ttlErr.Error())
 		return
 	}
 
-	rowCount, updateErr := s.rscsDB.Update(key, *v.Value)
+	var rowCount int
+	var created bool
+	var updateErr error
+	switch {
+	case conditional(r):
+		entry, found, ok := s.checkPreconditions(w, r, key)
+		if !ok {
+			return
+		}
+		if !found && !upsert {
+			writeKeyNotFound(w, "update", key)
+			return
+		}
+		// A zero index, for a key that was not found, creates it.
+		rowCount, updateErr = s.store(r).CompareAndSwapTTL(key, entry.Index, *v.Value, ttl)
+		if updateErr == nil && rowCount == 0 {
+			writeErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, key, "key modified concurrently")
+			return
+		}
+		created = !found
+	case upsert:
+		created, updateErr = s.store(r).UpsertTTL(key, *v.Value, ttl)
+		rowCount = 1
+	default:
+		rowCount, updateErr = s.store(r).UpdateTTL(key, *v.Value, ttl)
+	}
 	if updateErr != nil {
-		http.Error(w, updateErr.Error(), http.StatusInternalServerError)
+		writeError(w, updateErr)
 		return
 	}
 
 	if rowCount == 0 {
-		e := fmt.Sprintf("no key '%s' found", key)
-		http.Error(w, e, http.StatusNotFound)
+		writeKeyNotFound(w, "update", key)
 		return
 	}
 	if rowCount != 1 {
-		http.Error(w, "bad number of rows updated", http.StatusInternalServerError)
+		writeError(w, errors.New("bad number of rows updated"))
 		return
 	}
 
+	s.watch.notify()
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	return
 }
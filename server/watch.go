@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradclawsie/rscs/db"
+)
+
+const (
+	// WatchRoute is the route for streaming changes as Server-Sent Events.
+	WatchRoute = "/v1/watch"
+	// IndexHeader carries the current modification index on responses that
+	// can be long-polled; pass it back as the index query parameter.
+	IndexHeader = "X-Rscs-Index"
+	// DefaultWait is how long a long-poll with an index but no wait blocks.
+	DefaultWait = 5 * time.Minute
+	// MaxWait is the longest a long-poll will block.
+	MaxWait = 10 * time.Minute
+	// watchBatch is how many changes are read from the db at a time.
+	watchBatch = 100
+	// keepaliveInterval is how often an idle event stream sends a comment.
+	keepaliveInterval = 30 * time.Second
+)
+
+// WatchEvent describes one change to a key. Type is "put" or "delete", and
+// Value is empty for a delete.
+type WatchEvent struct {
+	Type     string
+	Key      string
+	Value    string `json:",omitempty"`
+	Index    int64
+	Revision int
+}
+
+// newWatchEvent converts a revision from the db change feed into an event.
+func newWatchEvent(rev db.Revision) WatchEvent {
+	e := WatchEvent{Type: "put", Key: rev.Key, Value: rev.Value,
+		Index: rev.Index, Revision: rev.Revision}
+	if rev.Deleted {
+		e.Type = "delete"
+	}
+	return e
+}
+
+// watchHub wakes watchers when the db changes. It carries no data itself;
+// watchers read the change feed from the db, so none can miss a change.
+type watchHub struct {
+	mu      sync.Mutex
+	changed chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// newWatchHub initializes a new watchHub.
+func newWatchHub() *watchHub {
+	return &watchHub{changed: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// notify wakes every watcher. Handlers call it after each successful write.
+func (h *watchHub) notify() {
+	h.mu.Lock()
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// wait returns a channel that is closed by the next notify. Take it before
+// reading the change feed so a write between the two is not missed.
+func (h *watchHub) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.changed
+}
+
+// close releases every watcher for good.
+func (h *watchHub) close() {
+	h.once.Do(func() { close(h.closed) })
+}
+
+// Close releases any open watches and long-polls so that a graceful
+// shutdown does not wait on them. Pass it to http.Server.RegisterOnShutdown.
+func (s *RscsServer) Close() {
+	s.watch.close()
+}
+
+// parseWait reads the index and wait query parameters of a long-poll. The
+// returned flag is false if the request should not block at all.
+func parseWait(r *http.Request) (int64, time.Duration, bool, error) {
+	query := r.URL.Query()
+	indexStr := query.Get("index")
+	if indexStr == "" {
+		return 0, 0, false, nil
+	}
+	index, indexErr := strconv.ParseInt(indexStr, 10, 64)
+	if indexErr != nil || index < 0 {
+		return 0, 0, false, errors.New("index must be a non-negative integer")
+	}
+	wait := DefaultWait
+	if waitStr := query.Get("wait"); waitStr != "" {
+		var waitErr error
+		wait, waitErr = time.ParseDuration(waitStr)
+		if waitErr != nil || wait <= 0 {
+			return 0, 0, false, errors.New("wait must be a positive duration")
+		}
+		if wait > MaxWait {
+			wait = MaxWait
+		}
+	}
+	return index, wait, true, nil
+}
+
+// blockUntil waits until changed reports true, the wait expires, the client
+// goes away or the server closes. changed is rechecked on every write.
+func (s *RscsServer) blockUntil(r *http.Request, wait time.Duration, changed func() (bool, error)) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		notified := s.watch.wait()
+		done, changedErr := changed()
+		if changedErr != nil || done {
+			return changedErr
+		}
+		select {
+		case <-notified:
+		case <-timer.C:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		case <-s.watch.closed:
+			return nil
+		}
+	}
+}
+
+// setIndexHeader writes the current modification index for long-polling clients.
+func (s *RscsServer) setIndexHeader(w http.ResponseWriter) error {
+	index, indexErr := s.rscsDB.CurrentIndex()
+	if indexErr != nil {
+		return indexErr
+	}
+	w.Header().Set(IndexHeader, strconv.FormatInt(index, 10))
+	return nil
+}
+
+// Watch streams changes to keys beginning with the prefix query parameter as
+// Server-Sent Events. Streaming starts after the index query parameter, or
+// the Last-Event-ID header of a reconnecting client, and otherwise after the
+// current index. Each event's id is its modification index.
+func (s *RscsServer) Watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming unsupported"))
+		return
+	}
+
+	store := s.store(r)
+	prefix := r.URL.Query().Get("prefix")
+	if !s.authorize(w, r, db.PermRead, prefix) {
+		return
+	}
+	sinceStr := r.Header.Get("Last-Event-ID")
+	if sinceStr == "" {
+		sinceStr = r.URL.Query().Get("index")
+	}
+	var since int64
+	if sinceStr != "" {
+		var sinceErr error
+		since, sinceErr = strconv.ParseInt(sinceStr, 10, 64)
+		if sinceErr != nil || since < 0 {
+			writeErrorCode(w, http.StatusBadRequest, CodeInvalidParameter, "", "index must be a non-negative integer")
+			return
+		}
+	} else {
+		var indexErr error
+		since, indexErr = s.rscsDB.CurrentIndex()
+		if indexErr != nil {
+			writeError(w, indexErr)
+			return
+		}
+	}
+
+	w.Header().Set("Content-type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		notified := s.watch.wait()
+		changes, changesErr := store.Changes(prefix, since, watchBatch)
+		if changesErr != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", changesErr.Error())
+			flusher.Flush()
+			return
+		}
+		for _, rev := range changes {
+			event := newWatchEvent(rev)
+			jsonBytes, jsonErr := json.Marshal(event)
+			if jsonErr != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Index, event.Type, jsonBytes)
+			since = event.Index
+		}
+		if len(changes) != 0 {
+			flusher.Flush()
+		}
+		if len(changes) == watchBatch {
+			continue
+		}
+		select {
+		case <-notified:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.watch.closed:
+			return
+		}
+	}
+}